@@ -0,0 +1,153 @@
+// Lightbox for gallery pages. Thumbnails link to the page of each image,
+// which keeps working without JavaScript. With it, the images open in an
+// overlay navigated with the arrow keys or by swiping, and the address
+// changes to the page of the image shown, so it can be shared directly.
+(function () {
+    "use strict";
+
+    const gallery = document.querySelector("[data-lightbox-gallery]");
+    if (!gallery) {
+        return;
+    }
+    const galleryURL = gallery.dataset.lightboxGallery;
+
+    // The thumbnails are laid out in columns, image i being in column
+    // i % columns. Reading the columns row by row restores the order.
+    const columns = Array.from(gallery.children).map(function (column) {
+        return Array.from(column.querySelectorAll("[data-lightbox]"));
+    });
+    const items = [];
+    for (let row = 0; columns.some(function (c) { return row < c.length; }); row++) {
+        columns.forEach(function (column) {
+            if (row < column.length) {
+                items.push(column[row]);
+            }
+        });
+    }
+    if (items.length === 0) {
+        return;
+    }
+
+    const overlay = document.createElement("div");
+    overlay.className = "position-fixed top-0 start-0 w-100 h-100 d-none flex-column align-items-center justify-content-center";
+    overlay.style.background = "rgba(0, 0, 0, 0.92)";
+    overlay.style.zIndex = "2000";
+    overlay.setAttribute("role", "dialog");
+    overlay.setAttribute("aria-modal", "true");
+    overlay.innerHTML =
+        '<img class="img-fluid" style="max-height: 85vh; max-width: 95vw;" alt="">' +
+        '<p class="text-light mt-2 mb-0" data-caption></p>' +
+        '<div class="mt-2">' +
+        '<button type="button" class="btn btn-sm btn-outline-light me-1" data-prev aria-label="Previous image">&larr;</button>' +
+        '<a class="btn btn-sm btn-outline-light me-1" data-details>Details</a>' +
+        '<a class="btn btn-sm btn-outline-light me-1" data-download download>Download</a>' +
+        '<button type="button" class="btn btn-sm btn-outline-light me-1" data-next aria-label="Next image">&rarr;</button>' +
+        '<button type="button" class="btn btn-sm btn-light" data-close aria-label="Close">&times;</button>' +
+        "</div>";
+    document.body.appendChild(overlay);
+
+    const img = overlay.querySelector("img");
+    const caption = overlay.querySelector("[data-caption]");
+    const details = overlay.querySelector("[data-details]");
+    const download = overlay.querySelector("[data-download]");
+    let current = -1;
+
+    function show(index, push) {
+        current = (index + items.length) % items.length;
+        const item = items[current];
+        img.src = item.dataset.src;
+        img.alt = item.dataset.caption || "";
+        caption.textContent = item.dataset.caption || "";
+        details.href = item.href;
+        download.href = item.dataset.download;
+        overlay.classList.remove("d-none");
+        overlay.classList.add("d-flex");
+        document.body.style.overflow = "hidden";
+        if (push) {
+            history.pushState({lightbox: current}, "", item.href);
+        }
+    }
+
+    function close(push) {
+        if (current < 0) {
+            return;
+        }
+        current = -1;
+        overlay.classList.add("d-none");
+        overlay.classList.remove("d-flex");
+        img.removeAttribute("src");
+        document.body.style.overflow = "";
+        if (push) {
+            history.pushState(null, "", galleryURL);
+        }
+    }
+
+    items.forEach(function (item, index) {
+        item.addEventListener("click", function (e) {
+            if (e.metaKey || e.ctrlKey || e.shiftKey || e.button !== 0) {
+                return; // Let the browser open the page in a new tab.
+            }
+            e.preventDefault();
+            show(index, true);
+        });
+    });
+
+    overlay.querySelector("[data-prev]").addEventListener("click", function () {
+        show(current - 1, true);
+    });
+    overlay.querySelector("[data-next]").addEventListener("click", function () {
+        show(current + 1, true);
+    });
+    overlay.querySelector("[data-close]").addEventListener("click", function () {
+        close(true);
+    });
+    overlay.addEventListener("click", function (e) {
+        if (e.target === overlay) {
+            close(true);
+        }
+    });
+
+    document.addEventListener("keydown", function (e) {
+        if (current < 0) {
+            return;
+        }
+        switch (e.key) {
+            case "ArrowLeft":
+                show(current - 1, true);
+                break;
+            case "ArrowRight":
+                show(current + 1, true);
+                break;
+            case "Escape":
+                close(true);
+                break;
+            default:
+                return;
+        }
+        e.preventDefault();
+    });
+
+    let touchX = null;
+    overlay.addEventListener("touchstart", function (e) {
+        touchX = e.changedTouches[0].clientX;
+    }, {passive: true});
+    overlay.addEventListener("touchend", function (e) {
+        if (touchX === null) {
+            return;
+        }
+        const dx = e.changedTouches[0].clientX - touchX;
+        touchX = null;
+        if (Math.abs(dx) > 50) {
+            show(dx > 0 ? current - 1 : current + 1, true);
+        }
+    });
+
+    // Going back and forward moves between the images which were shown.
+    window.addEventListener("popstate", function (e) {
+        if (e.state && typeof e.state.lightbox === "number") {
+            show(e.state.lightbox, false);
+        } else {
+            close(false);
+        }
+    });
+})();
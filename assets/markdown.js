@@ -0,0 +1,47 @@
+// Previews of Markdown fields. A button marked with data-markdown-preview
+// renders the textarea it names on the server, which sanitises the HTML,
+// into the element marked with the matching data-markdown-output.
+(function () {
+    "use strict";
+
+    function csrfToken(form) {
+        const input = form.querySelector('input[name="gorilla.csrf.Token"]');
+        return input ? input.value : "";
+    }
+
+    document.querySelectorAll("[data-markdown-preview]").forEach(function (button) {
+        const name = button.dataset.markdownPreview;
+        const textarea = document.getElementById(name);
+        const output = document.querySelector('[data-markdown-output="' + name + '"]');
+        if (!textarea || !output) {
+            return;
+        }
+        button.addEventListener("click", async function () {
+            if (!output.classList.contains("d-none")) {
+                output.classList.add("d-none");
+                button.textContent = "Preview";
+                return;
+            }
+            const body = new URLSearchParams();
+            body.set(textarea.name, textarea.value);
+            try {
+                const res = await fetch(button.dataset.previewUrl, {
+                    method: "POST",
+                    credentials: "same-origin",
+                    headers: {"X-CSRF-Token": csrfToken(textarea.form)},
+                    body: body,
+                });
+                const data = await res.json();
+                if (!res.ok) {
+                    throw new Error(data.error);
+                }
+                // The server only returns sanitised HTML.
+                output.innerHTML = data.html || '<p class="text-muted">Nothing to preview.</p>';
+            } catch (err) {
+                output.textContent = "The preview is not available: " + err.message;
+            }
+            output.classList.remove("d-none");
+            button.textContent = "Hide preview";
+        });
+    });
+})();
@@ -0,0 +1,62 @@
+// Tag suggestions for inputs marked with data-tag-autocomplete.
+// The inputs hold a comma separated list of tags, the last
+// one is completed from the tags the user already has.
+(function () {
+    "use strict";
+
+    let counter = 0;
+
+    function lastTag(value) {
+        const i = value.lastIndexOf(",");
+        return {
+            head: i < 0 ? "" : value.slice(0, i + 1) + " ",
+            tail: value.slice(i + 1).trim(),
+        };
+    }
+
+    function setup(input) {
+        const list = document.createElement("datalist");
+        list.id = "tag-suggestions-" + counter++;
+        input.setAttribute("list", list.id);
+        input.setAttribute("autocomplete", "off");
+        input.after(list);
+
+        let timer;
+        let controller;
+        input.addEventListener("input", function () {
+            clearTimeout(timer);
+            timer = setTimeout(async function () {
+                const {head, tail} = lastTag(input.value);
+                if (tail === "") {
+                    list.replaceChildren();
+                    return;
+                }
+                if (controller) {
+                    controller.abort();
+                }
+                controller = new AbortController();
+                try {
+                    const res = await fetch("/api/tags?q=" + encodeURIComponent(tail), {
+                        credentials: "same-origin",
+                        signal: controller.signal,
+                    });
+                    if (!res.ok) {
+                        return;
+                    }
+                    const tags = await res.json();
+                    list.replaceChildren(...tags.map(function (tag) {
+                        const option = document.createElement("option");
+                        option.value = head + tag.name;
+                        return option;
+                    }));
+                } catch (err) {
+                    if (err.name !== "AbortError") {
+                        console.error(err);
+                    }
+                }
+            }, 150);
+        });
+    }
+
+    document.querySelectorAll("[data-tag-autocomplete]").forEach(setup);
+})();
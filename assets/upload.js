@@ -0,0 +1,160 @@
+// Resumable uploads for forms marked with data-uploads.
+// Files are sent in chunks using the tus protocol, so an interrupted upload
+// continues from the last received chunk, even after reloading the page.
+// Without JavaScript the form falls back to a regular multipart upload.
+(function () {
+    "use strict";
+
+    const chunkSize = 4 << 20; // 4 megabytes, must not exceed the server limit.
+    const maxRetries = 5;
+
+    function csrfToken(form) {
+        const input = form.querySelector('input[name="gorilla.csrf.Token"]');
+        return input ? input.value : "";
+    }
+
+    function storageKey(endpoint, file) {
+        return ["upload", endpoint, file.name, file.size, file.lastModified].join(":");
+    }
+
+    function bytesToBase64(buffer) {
+        let binary = "";
+        const bytes = new Uint8Array(buffer);
+        for (let i = 0; i < bytes.length; i++) {
+            binary += String.fromCharCode(bytes[i]);
+        }
+        return btoa(binary);
+    }
+
+    // checksum returns "sha256 <base64>", or an empty string when the
+    // browser cannot hash (crypto.subtle needs a secure context).
+    async function checksum(blob) {
+        if (!window.crypto || !window.crypto.subtle) {
+            return "";
+        }
+        const digest = await window.crypto.subtle.digest("SHA-256", await blob.arrayBuffer());
+        return "sha256 " + bytesToBase64(digest);
+    }
+
+    function metadata(values) {
+        return Object.keys(values)
+            .filter((key) => values[key] !== "")
+            .map((key) => key + " " + btoa(unescape(encodeURIComponent(values[key]))))
+            .join(",");
+    }
+
+    async function request(method, url, token, headers, body) {
+        const response = await fetch(url, {
+            method: method,
+            credentials: "same-origin",
+            headers: Object.assign({"Tus-Resumable": "1.0.0", "X-CSRF-Token": token}, headers),
+            body: body,
+        });
+        if (!response.ok) {
+            const error = new Error(method + " " + url + " failed with " + response.status);
+            error.status = response.status;
+            throw error;
+        }
+        return response;
+    }
+
+    async function create(endpoint, token, file) {
+        const response = await request("POST", endpoint, token, {
+            "Upload-Length": String(file.size),
+            "Upload-Metadata": metadata({filename: file.name, checksum: await checksum(file)}),
+        });
+        return response.headers.get("Location");
+    }
+
+    async function currentOffset(url, token) {
+        const response = await request("HEAD", url, token, {});
+        return parseInt(response.headers.get("Upload-Offset"), 10);
+    }
+
+    async function upload(endpoint, token, file, progress) {
+        const key = storageKey(endpoint, file);
+        let url = localStorage.getItem(key);
+        let offset = 0;
+        if (url) {
+            try {
+                offset = await currentOffset(url, token);
+            } catch (e) {
+                url = null; // Expired or unknown, start over.
+            }
+        }
+        if (!url) {
+            url = await create(endpoint, token, file);
+            localStorage.setItem(key, url);
+        }
+
+        let retries = 0;
+        while (offset < file.size) {
+            const chunk = file.slice(offset, offset + chunkSize);
+            try {
+                const response = await request("PATCH", url, token, {
+                    "Content-Type": "application/offset+octet-stream",
+                    "Upload-Offset": String(offset),
+                    "Upload-Checksum": await checksum(chunk),
+                }, chunk);
+                offset = parseInt(response.headers.get("Upload-Offset"), 10);
+                retries = 0;
+                progress(offset / file.size);
+            } catch (e) {
+                if (e.status === 404 || e.status === 410 || e.status === 413 || retries >= maxRetries) {
+                    localStorage.removeItem(key);
+                    throw e;
+                }
+                retries++;
+                await new Promise((resolve) => setTimeout(resolve, 1000 * 2 ** retries));
+                offset = await currentOffset(url, token);
+            }
+        }
+        localStorage.removeItem(key);
+    }
+
+    function progressBar(container, file) {
+        const wrapper = document.createElement("div");
+        wrapper.className = "mt-2";
+        wrapper.innerHTML = '<div class="small"></div><div class="progress"><div class="progress-bar" role="progressbar"></div></div>';
+        wrapper.querySelector(".small").textContent = file.name;
+        container.appendChild(wrapper);
+        const bar = wrapper.querySelector(".progress-bar");
+        return {
+            update: (fraction) => {
+                bar.style.width = Math.round(fraction * 100) + "%";
+            },
+            fail: () => {
+                bar.classList.add("bg-danger");
+            },
+        };
+    }
+
+    document.querySelectorAll("form[data-uploads]").forEach((form) => {
+        form.addEventListener("submit", async (event) => {
+            event.preventDefault();
+            const endpoint = form.dataset.uploads;
+            const input = form.querySelector('input[type="file"]');
+            const container = form.querySelector("[data-upload-progress]");
+            const button = form.querySelector('button[type="submit"]');
+            const token = csrfToken(form);
+            button.disabled = true;
+
+            let failed = false;
+            for (const file of input.files) {
+                const bar = progressBar(container, file);
+                try {
+                    await upload(endpoint, token, file, bar.update);
+                } catch (e) {
+                    console.error(e);
+                    bar.fail();
+                    failed = true;
+                }
+            }
+            if (!failed) {
+                window.location.reload();
+                return;
+            }
+            button.disabled = false;
+        });
+    });
+})();
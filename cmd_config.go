@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"myphoto/models"
+	"os"
+)
+
+// storageDirs are the directories the application writes files to.
+var storageDirs = []string{"images", "uploads"}
+
+// configCheck checks the loaded config, that the database can be reached
+// and is migrated, and that files can be stored. It prints the result of
+// every check and fails if any of them failed.
+func configCheck(cfg Config, fs *flag.FlagSet, args []string) error {
+	parseArgs(fs, args, 0)
+
+	failed := false
+	report := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("ok    %s\n", name)
+	}
+
+	report("settings", cfg.Validate())
+	if cfg.Server.TLS() {
+		_, err := tls.LoadX509KeyPair(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		report("tls certificate", err)
+	}
+	if cfg.Mail.Host == "" {
+		fmt.Println("note  mail: no SMTP host, emails are only logged")
+	}
+
+	svc, err := newServices(cfg)
+	report("database", err)
+	if err == nil {
+		defer svc.Close()
+		report("migrations", checkMigrations(svc))
+	}
+	for _, dir := range storageDirs {
+		report("storage "+dir, checkWritable(dir))
+	}
+
+	if failed {
+		return errors.New("config check failed")
+	}
+	return nil
+}
+
+// checkMigrations fails if the database has pending migrations.
+func checkMigrations(svc *models.Services) error {
+	migrator, err := newMigrator(svc)
+	if err != nil {
+		return err
+	}
+	statuses, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d pending, run the migrate up command", pending)
+	}
+	return nil
+}
+
+// checkWritable creates the directory if needed, and
+// checks that files can be written to it.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// configPrint prints the effective config as JSON, with the secrets redacted.
+func configPrint(cfg Config, fs *flag.FlagSet, args []string) error {
+	parseArgs(fs, args, 0)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(cfg.Redacted())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"myphoto/models"
+	"myphoto/views"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// galleryList prints a table of the galleries of all users, or of one user.
+func galleryList(cfg Config, fs *flag.FlagSet, args []string) error {
+	email := fs.String("user", "", "Only list the galleries of the user with this email address.")
+	parseArgs(fs, args, 0)
+
+	svc, err := newServices(cfg)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	users, err := svc.User.All()
+	if err != nil {
+		return err
+	}
+	owners := make(map[uint]string, len(users))
+	for _, u := range users {
+		owners[u.ID] = u.Email
+	}
+	var galleries []models.Gallery
+	if *email != "" {
+		user, err := svc.User.ByEmail(*email)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", *email, err)
+		}
+		galleries, err = svc.Gallery.ByUserID(user.ID)
+		if err != nil {
+			return err
+		}
+	} else {
+		galleries, err = svc.Gallery.All()
+		if err != nil {
+			return err
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tOWNER\tTITLE\tPUBLIC\tSIZE\tCREATED")
+	for _, g := range galleries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%s\t%s\n", g.ID, owners[g.UserID], g.Title, g.Public,
+			views.FormatBytes(g.StorageBytes), g.CreatedAt.Format(dateLayout))
+	}
+	return w.Flush()
+}
+
+// galleryDelete moves a gallery to the trash like its owner would, or
+// removes it with its images and files for good.
+func galleryDelete(cfg Config, fs *flag.FlagSet, args []string) error {
+	purge := fs.Bool("purge", false, "Remove the gallery, its images and files for good instead of moving it to the trash.")
+	parseArgs(fs, args, 1)
+	id, err := strconv.ParseUint(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid gallery ID %q", fs.Arg(0))
+	}
+
+	svc, err := newServices(cfg)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	gallery, err := svc.Gallery.ByID(uint(id))
+	if *purge && errors.Is(err, models.ErrResourceNotFound) {
+		// Galleries in the trash can be purged too.
+		gallery, err = svc.Gallery.TrashedByID(uint(id))
+	}
+	if err != nil {
+		return fmt.Errorf("gallery %d: %w", id, err)
+	}
+	trashed := gallery.DeletedAt.Valid
+	if *purge {
+		err = svc.Trash.PurgeGallery(gallery.ID)
+	} else {
+		err = svc.Gallery.Delete(gallery.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if !trashed {
+		auditCLI(svc.Audit, models.AuditEntry{
+			Action:     models.AuditGalleryDelete,
+			TargetType: models.AuditTargetGallery,
+			TargetID:   gallery.ID,
+			Changes:    models.Diff(gallery, nil),
+		})
+		if err = svc.Webhook.GalleryEvent(models.EventGalleryDeleted, gallery); err != nil {
+			slog.Error("publishing the webhook event failed", "err", err)
+		}
+	}
+	if *purge {
+		auditCLI(svc.Audit, models.AuditEntry{
+			Action:     models.AuditGalleryPurge,
+			TargetType: models.AuditTargetGallery,
+			TargetID:   gallery.ID,
+			Changes:    models.Diff(gallery, nil),
+		})
+		fmt.Printf("Successfully purged gallery %d\n", gallery.ID)
+	} else {
+		fmt.Printf("Successfully moved gallery %d to the trash\n", gallery.ID)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"myphoto/migrate"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const migrateUsage = `usage: myphoto migrate <command>
+
+commands:
+  up            apply all pending migrations
+  down [n]      roll back the last n migrations, one by default
+  status        list the migrations and whether they are applied
+  to <version>  apply or roll back migrations up to the version`
+
+// runMigrate runs the migrate command with its arguments.
+func runMigrate(cfg Config, fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	svc, err := newServices(cfg)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	m, err := newMigrator(svc)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "up":
+		if err = m.Up(); err != nil {
+			return err
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+			steps = n
+		}
+		if err = m.Down(steps); err != nil {
+			return err
+		}
+	case "to":
+		if len(args) < 2 {
+			return errors.New(migrateUsage)
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if err = m.To(version); err != nil {
+			return err
+		}
+	case "status":
+		return printMigrateStatus(m)
+	default:
+		return errors.New(migrateUsage)
+	}
+	fmt.Println("Successfully migrated the database")
+	return nil
+}
+
+// printMigrateStatus prints a table of the migrations and when they were applied.
+func printMigrateStatus(m *migrate.Migrator) error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, s := range statuses {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = s.AppliedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"myphoto/controllers"
+	"myphoto/jobs"
+	"myphoto/metrics"
+	"myphoto/migrate"
+	"myphoto/models"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serve applies pending migrations and runs the web server
+// together with the background jobs until it is interrupted.
+func serve(cfg Config, fs *flag.FlagSet, args []string) error {
+	parseArgs(fs, args, 0)
+
+	svc, err := newServices(cfg)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	migrator, err := newMigrator(svc)
+	if err != nil {
+		return err
+	}
+	if err = migrator.Up(); err != nil {
+		return err
+	}
+	shutdownTracing, err := cfg.Tracing.Setup()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The spans still buffered are sent before exiting.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("flushing the traces failed", "err", err)
+		}
+	}()
+
+	healthC := controllers.NewHealth(
+		controllers.HealthCheck{Name: "database", Check: svc.Ping},
+		controllers.HealthCheck{Name: "migrations", Check: func(ctx context.Context) error {
+			return checkMigrated(ctx, migrator)
+		}},
+		controllers.HealthCheck{Name: "storage", Check: func(context.Context) error {
+			return checkWritable("images")
+		}},
+	)
+
+	router := newRouter(svc)
+	handler, err := newHandler(cfg, svc, router, healthC)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Background work is only stopped once the server has drained,
+	// as requests which are still in flight may enqueue jobs.
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	var wg sync.WaitGroup
+	every(bgCtx, &wg, time.Hour, func() { removeExpiredUploads(svc.Upload) })
+	every(bgCtx, &wg, time.Hour, func() { purgeTrash(svc.Trash, svc.Audit, time.Now()) })
+	every(bgCtx, &wg, time.Hour, func() { pruneAuditLog(svc.Audit) })
+
+	runner := jobs.NewRunner(svc.Job, cfg.Jobs.Concurrency)
+	runner.Handle(models.JobProcessImage, func(job *models.Job) error {
+		var p models.ImageJob
+		if err := job.Decode(&p); err != nil {
+			return err
+		}
+		start := time.Now()
+		err := svc.Image.Process(p.ImageID)
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		metrics.ImageProcessing.WithLabelValues(result).Observe(time.Since(start).Seconds())
+		return err
+	})
+	runner.Handle(models.JobNotifySubmission, func(job *models.Job) error {
+		var p models.ProofingJob
+		if err := job.Decode(&p); err != nil {
+			return err
+		}
+		return svc.Proofing.NotifySubmission(p.ProoferID)
+	})
+	runner.Handle(models.JobDeliverWebhook, func(job *models.Job) error {
+		var p models.DeliveryJob
+		if err := job.Decode(&p); err != nil {
+			return err
+		}
+		return svc.Webhook.Deliver(p.DeliveryID)
+	})
+	runner.Start(bgCtx)
+
+	srv := newServer(cfg, handler)
+	srvErr := make(chan error, 3)
+	go func() {
+		slog.Info("starting the server", "addr", srv.Addr, "tls", cfg.Server.TLS())
+		var err error
+		if cfg.Server.TLS() {
+			err = srv.ListenAndServeTLS(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			srvErr <- err
+		}
+	}()
+	var redirectSrv *http.Server
+	if cfg.Server.TLS() && cfg.Server.RedirectPort > 0 {
+		redirectSrv = newServer(cfg, redirectHTTPS(cfg.Port))
+		redirectSrv.Addr = fmt.Sprintf(":%d", cfg.Server.RedirectPort)
+		go func() {
+			slog.Info("redirecting HTTP to HTTPS", "addr", redirectSrv.Addr)
+			if err := redirectSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				srvErr <- err
+			}
+		}()
+	}
+
+	var metricsSrv *http.Server
+	if cfg.Metrics.Address != "" {
+		sqlDB, err := svc.DB()
+		if err != nil {
+			return err
+		}
+		if err = metrics.RegisterDB(sqlDB); err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsSrv = newServer(cfg, mux)
+		metricsSrv.Addr = cfg.Metrics.Address
+		go func() {
+			slog.Info("serving metrics", "addr", metricsSrv.Addr)
+			if err := metricsSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				srvErr <- err
+			}
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+	case err = <-srvErr:
+	}
+	stop()
+	if err == nil {
+		// Readiness fails first so load balancers stop sending requests,
+		// a second signal stops right away as stop restored its default.
+		healthC.Drain()
+		slog.Info("draining", "duration", cfg.Server.Drain())
+		time.Sleep(cfg.Server.Drain())
+	}
+
+	// Requests are drained first, then the background work is stopped,
+	// and the database is closed last by the deferred svc.Close.
+	slog.Info("shutting down, waiting for requests to finish")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout())
+	defer cancel()
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("shutting down the redirect server failed", "err", err)
+		}
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutting down the server failed", "err", err)
+	}
+	if metricsSrv != nil {
+		// Metrics are served until the end, to see the shutdown.
+		defer metricsSrv.Close()
+	}
+	slog.Info("waiting for background jobs to finish")
+	stopBackground()
+	runner.Wait()
+	wg.Wait()
+	return err
+}
+
+// checkMigrated fails unless the database has the
+// migrations of this binary applied, and no others.
+func checkMigrated(ctx context.Context, m *migrate.Migrator) error {
+	current, err := m.Current(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current < m.Latest():
+		return fmt.Errorf("at version %d of %d, migrations are pending", current, m.Latest())
+	case current > m.Latest():
+		return migrate.ErrDirty
+	}
+	return nil
+}
+
+// newServer creates a server on the configured port with its timeouts, so
+// slow clients cannot hold on to connections for as long as they like.
+func newServer(cfg Config, handler http.Handler) *http.Server {
+	sc := cfg.Server
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           handler,
+		ReadTimeout:       seconds(sc.ReadTimeoutSeconds),
+		ReadHeaderTimeout: seconds(sc.ReadHeaderTimeoutSeconds),
+		WriteTimeout:      seconds(sc.WriteTimeoutSeconds),
+		IdleTimeout:       seconds(sc.IdleTimeoutSeconds),
+		MaxHeaderBytes:    sc.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// redirectHTTPS redirects every request to the same URL on HTTPS.
+func redirectHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+// every runs fn every interval until ctx is done.
+func every(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, fn func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// removeExpiredUploads deletes abandoned resumable
+// uploads together with their chunks.
+func removeExpiredUploads(us models.UploadService) {
+	n, err := us.DeleteExpired(time.Now())
+	if err != nil {
+		slog.Error("removing expired uploads failed", "err", err)
+		return
+	}
+	if n > 0 {
+		slog.Info("removed expired uploads", "count", n)
+	}
+}
+
+// purgeTrash removes galleries and images which were deleted longer
+// than the retention window before now, and records them in the audit log.
+func purgeTrash(ts models.TrashService, as models.AuditService, now time.Time) {
+	purged, err := ts.Purge(now)
+	for _, gallery := range purged.Galleries {
+		auditJob(as, models.AuditEntry{
+			Action:     models.AuditGalleryPurge,
+			TargetType: models.AuditTargetGallery,
+			TargetID:   gallery.ID,
+			Changes:    models.Diff(&gallery, nil),
+		})
+	}
+	for _, img := range purged.Images {
+		auditJob(as, models.AuditEntry{
+			Action:     models.AuditImagePurge,
+			TargetType: models.AuditTargetImage,
+			TargetID:   img.ID,
+			Changes:    models.Diff(&img, nil),
+		})
+	}
+	if err != nil {
+		slog.Error("purging the trash failed", "err", err)
+		return
+	}
+	if n := len(purged.Galleries) + len(purged.Images); n > 0 {
+		slog.Info("purged galleries and images from the trash", "count", n)
+	}
+}
+
+// pruneAuditLog removes entries of the
+// audit log which are older than the retention window.
+func pruneAuditLog(as models.AuditService) {
+	n, err := as.Prune(time.Now())
+	if err != nil {
+		slog.Error("pruning the audit log failed", "err", err)
+		return
+	}
+	if n > 0 {
+		slog.Info("pruned the audit log", "count", n)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"myphoto/views"
+	"os"
+	"text/tabwriter"
+)
+
+// imagesReconcile reports the files in storage without an image in the
+// database, and the images without a file. Orphaned files are only
+// imported when asked to, which creates the images of the files uploaded
+// before images were kept in the database. Neither orphaned files nor
+// missing ones are ever removed, they have to be looked into by hand.
+func imagesReconcile(cfg Config, fs *flag.FlagSet, args []string) error {
+	importOrphans := fs.Bool("import-orphans", false, "Create images for the files which have none in the database.")
+	parseArgs(fs, args, 0)
+
+	svc, err := newServices(cfg)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	rec, err := svc.Image.Reconcile()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Orphaned files: %d\n", len(rec.Orphans))
+	for _, path := range rec.Orphans {
+		if *importOrphans {
+			img, err := svc.Image.Import(path)
+			if err != nil {
+				fmt.Printf("  not imported %s: %v\n", path, err)
+				continue
+			}
+			fmt.Printf("  imported %s as image %d\n", path, img.ID)
+			continue
+		}
+		fmt.Printf("  %s\n", path)
+	}
+	fmt.Printf("Images with missing files: %d\n", len(rec.Missing))
+	for _, img := range rec.Missing {
+		fmt.Printf("  image %d in gallery %d: %s\n", img.ID, img.GalleryID, img.RelativePath())
+	}
+	return nil
+}
+
+// storageUsage prints the storage used by every user against their quota.
+func storageUsage(cfg Config, fs *flag.FlagSet, args []string) error {
+	recompute := fs.Bool("recompute", false, "Recompute the storage usage of all galleries and users from the stored files first.")
+	parseArgs(fs, args, 0)
+
+	svc, err := newServices(cfg)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	if *recompute {
+		if err = svc.Image.RecomputeUsage(); err != nil {
+			return err
+		}
+		fmt.Println("Successfully recomputed storage usage")
+	}
+	users, err := svc.User.All()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tPLAN\tUSED\tQUOTA\tPERCENT")
+	var total int64
+	for _, u := range users {
+		usage, err := svc.Image.Usage(u.ID)
+		if err != nil {
+			return err
+		}
+		quota, percent := "unlimited", "-"
+		if !usage.Unlimited() {
+			quota = views.FormatBytes(usage.Quota)
+			percent = fmt.Sprintf("%d%%", usage.Percent())
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.Email, usage.Plan,
+			views.FormatBytes(usage.Used), quota, percent)
+		total += usage.Used
+	}
+	fmt.Fprintf(w, "\tTOTAL\t\t%s\t\t\n", views.FormatBytes(total))
+	return w.Flush()
+}
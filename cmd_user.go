@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"myphoto/models"
+	"myphoto/rand"
+	"os"
+	"text/tabwriter"
+)
+
+// userCreate creates a user with the password read from stdin.
+func userCreate(cfg Config, fs *flag.FlagSet, args []string) error {
+	name := fs.String("name", "", "Name of the user.")
+	admin := fs.Bool("admin", false, "Make the user an admin.")
+	parseArgs(fs, args, 1)
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	svc, err := newServices(cfg)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	user := models.User{
+		Name:     *name,
+		Email:    fs.Arg(0),
+		Password: password,
+		Admin:    *admin,
+	}
+	if err = svc.User.Create(&user); err != nil {
+		return err
+	}
+	auditCLI(svc.Audit, models.AuditEntry{
+		Action:     models.AuditUserCreate,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID,
+		Changes:    models.Diff(nil, &user),
+	})
+	fmt.Printf("Successfully created user %d %s\n", user.ID, user.Email)
+	return nil
+}
+
+// userList prints a table of all users.
+func userList(cfg Config, fs *flag.FlagSet, args []string) error {
+	parseArgs(fs, args, 0)
+
+	svc, err := newServices(cfg)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	users, err := svc.User.All()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tNAME\tPLAN\tADMIN\tDISABLED\tCREATED")
+	for _, u := range users {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\t%t\t%s\n",
+			u.ID, u.Email, u.Name, u.Plan, u.Admin, u.Disabled, u.CreatedAt.Format(dateLayout))
+	}
+	return w.Flush()
+}
+
+// userDisable prevents a user from logging in. Their remember token is
+// replaced, which signs them out of every browser.
+func userDisable(cfg Config, fs *flag.FlagSet, args []string) error {
+	parseArgs(fs, args, 1)
+	return updateUser(cfg, fs.Arg(0), func(user *models.User) error {
+		token, err := rand.RememberToken()
+		if err != nil {
+			return err
+		}
+		user.Disabled = true
+		user.Remember = token
+		return nil
+	})
+}
+
+// userEnable allows a disabled user to log in again.
+func userEnable(cfg Config, fs *flag.FlagSet, args []string) error {
+	parseArgs(fs, args, 1)
+	return updateUser(cfg, fs.Arg(0), func(user *models.User) error {
+		user.Disabled = false
+		return nil
+	})
+}
+
+// userSetPassword changes the password of a user to the one read from stdin.
+func userSetPassword(cfg Config, fs *flag.FlagSet, args []string) error {
+	parseArgs(fs, args, 1)
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	return updateUser(cfg, fs.Arg(0), func(user *models.User) error {
+		user.Password = password
+		return nil
+	})
+}
+
+// userSetAdmin grants or revokes the admin role of a user.
+func userSetAdmin(cfg Config, fs *flag.FlagSet, args []string) error {
+	revoke := fs.Bool("revoke", false, "Revoke the admin role instead of granting it.")
+	parseArgs(fs, args, 1)
+	return updateUser(cfg, fs.Arg(0), func(user *models.User) error {
+		user.Admin = !*revoke
+		return nil
+	})
+}
+
+// updateUser looks up the user with the email address, changes
+// them with fn and records the change in the audit log.
+func updateUser(cfg Config, email string, fn func(*models.User) error) error {
+	svc, err := newServices(cfg)
+	if err != nil {
+		return err
+	}
+	defer svc.Close()
+	user, err := svc.User.ByEmail(email)
+	if err != nil {
+		return fmt.Errorf("user %s: %w", email, err)
+	}
+	before := *user
+	if err = fn(user); err != nil {
+		return err
+	}
+	if err = svc.User.Update(user); err != nil {
+		return err
+	}
+	auditCLI(svc.Audit, models.AuditEntry{
+		Action:     models.AuditUserUpdate,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID,
+		Changes:    models.Diff(&before, user),
+	})
+	fmt.Printf("Successfully updated user %d %s\n", user.ID, user.Email)
+	return nil
+}
@@ -1,22 +1,46 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"myphoto/email"
+	"myphoto/models"
+	"myphoto/tracing"
+	"net"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type PostgresConfig struct {
+type DatabaseConfig struct {
+	// Driver is either postgres or sqlite. SQLite stores everything in the
+	// file at Path and needs no database server, for self-hosting by a
+	// single user, the other settings are for Postgres.
+	Driver   string `json:"driver"`
+	Path     string `json:"path"`
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
 	User     string `json:"user"`
-	Password string `json:"password"`
+	Password string `json:"password" secret:"true"`
 	DBName   string `json:"db_name"`
 	SSLMode  string `json:"ssl_mode"`
 	TimeZone string `json:"time_zone"`
 }
 
-func (c *PostgresConfig) ConnectionInfo() string {
+// ConnectionInfo returns the data source name of the database for its driver.
+func (c *DatabaseConfig) ConnectionInfo() string {
+	if c.Driver == models.DriverSQLite {
+		// Foreign keys are off in SQLite unless enabled, and writers wait
+		// for each other instead of failing while the database is locked.
+		return "file:" + c.Path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)" +
+			"&_pragma=journal_mode(WAL)&_txlock=immediate"
+	}
 	if c.Password == "" {
 		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=%s TimeZone=%s",
 			c.Host, c.Port, c.User, c.DBName, c.SSLMode, c.TimeZone)
@@ -25,8 +49,10 @@ func (c *PostgresConfig) ConnectionInfo() string {
 		c.Host, c.Port, c.User, c.Password, c.DBName, c.SSLMode, c.TimeZone)
 }
 
-func DefaultPostgresConfig() PostgresConfig {
-	return PostgresConfig{
+func DefaultDatabaseConfig() DatabaseConfig {
+	return DatabaseConfig{
+		Driver:   models.DriverPostgres,
+		Path:     "myphoto.db",
 		Host:     "localhost",
 		Port:     5432,
 		User:     "postgres",
@@ -37,11 +63,201 @@ func DefaultPostgresConfig() PostgresConfig {
 	}
 }
 
+type ServerConfig struct {
+	// The timeouts are in seconds, zero means there is none. Reading
+	// and writing is allowed to take long for uploads and downloads of
+	// large originals, only the headers have to arrive quickly.
+	ReadTimeoutSeconds       int `json:"read_timeout_seconds"`
+	ReadHeaderTimeoutSeconds int `json:"read_header_timeout_seconds"`
+	WriteTimeoutSeconds      int `json:"write_timeout_seconds"`
+	IdleTimeoutSeconds       int `json:"idle_timeout_seconds"`
+	// ShutdownTimeoutSeconds is how long requests in flight
+	// may take to finish when the server is stopped.
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+	// DrainSeconds is how long /readyz fails before the server stops
+	// accepting requests, so load balancers notice and drain it first.
+	DrainSeconds   int `json:"drain_seconds"`
+	MaxHeaderBytes int `json:"max_header_bytes"`
+	// TLSCertFile and TLSKeyFile serve HTTPS on the port if both are set.
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// RedirectPort serves redirects from HTTP to HTTPS when TLS
+	// is enabled, zero means there is no such listener.
+	RedirectPort int `json:"redirect_port"`
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadTimeoutSeconds:       300,
+		ReadHeaderTimeoutSeconds: 10,
+		WriteTimeoutSeconds:      300,
+		IdleTimeoutSeconds:       120,
+		ShutdownTimeoutSeconds:   30,
+		DrainSeconds:             5,
+		MaxHeaderBytes:           1 << 20,
+	}
+}
+
+// TLS reports whether the server serves HTTPS.
+func (c *ServerConfig) TLS() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// ShutdownTimeout returns the shutdown timeout as a duration.
+func (c *ServerConfig) ShutdownTimeout() time.Duration {
+	return seconds(c.ShutdownTimeoutSeconds)
+}
+
+// Drain returns the drain period as a duration.
+func (c *ServerConfig) Drain() time.Duration {
+	return seconds(c.DrainSeconds)
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+type LogConfig struct {
+	// Level is the least severe level logged, one of debug, info, warn and error.
+	Level string `json:"level"`
+	// Format is either text or json.
+	Format string `json:"format"`
+}
+
+func DefaultLogConfig() LogConfig {
+	return LogConfig{
+		Level:  "info",
+		Format: "text",
+	}
+}
+
+// Logger returns the logger writing to stderr in the configured format.
+func (c *LogConfig) Logger() *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if c.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+type MetricsConfig struct {
+	// Address is where /metrics is served to Prometheus, apart from the
+	// application so it need not be public. Empty disables metrics.
+	Address string `json:"address"`
+}
+
+func DefaultMetricsConfig() MetricsConfig {
+	return MetricsConfig{
+		Address: "localhost:9090",
+	}
+}
+
+type TracingConfig struct {
+	// Exporter sends the traces to a collector with "otlp", prints
+	// them with "stdout" for development, or is empty to disable tracing.
+	Exporter string `json:"exporter"`
+	// Endpoint is the OTLP/HTTP URL of the collector.
+	Endpoint string `json:"endpoint"`
+	// SampleRatio is the ratio of the traces which are recorded, from 0 to 1.
+	// Requests from callers who already sampled their trace follow the caller.
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+func DefaultTracingConfig() TracingConfig {
+	return TracingConfig{
+		Endpoint:    "http://localhost:4318",
+		SampleRatio: 1,
+	}
+}
+
+// Setup installs the tracer provider, see tracing.Setup.
+func (c *TracingConfig) Setup() (func(context.Context) error, error) {
+	return tracing.Setup(c.Exporter, c.Endpoint, c.SampleRatio)
+}
+
+type JobsConfig struct {
+	// Concurrency is the number of workers processing background jobs.
+	Concurrency int `json:"concurrency"`
+}
+
+func DefaultJobsConfig() JobsConfig {
+	return JobsConfig{
+		Concurrency: 2,
+	}
+}
+
+type MailConfig struct {
+	// Host of the SMTP server, emails are only logged if it is empty.
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password" secret:"true"`
+	From     string `json:"from"`
+}
+
+func DefaultMailConfig() MailConfig {
+	return MailConfig{
+		Port: 587,
+		From: "MyPhoto <noreply@localhost>",
+	}
+}
+
+// Mailer returns the mailer sending emails through the configured
+// SMTP server, or logging them if there is none.
+func (c *MailConfig) Mailer() email.Mailer {
+	if c.Host == "" {
+		return email.NewLogMailer()
+	}
+	return email.NewSMTPMailer(email.SMTPConfig{
+		Host:     c.Host,
+		Port:     c.Port,
+		Username: c.Username,
+		Password: c.Password,
+		From:     c.From,
+	})
+}
+
+// DefaultQuotas allows users on the free plan to store one gigabyte.
+func DefaultQuotas() map[string]int64 {
+	return map[string]int64{
+		"free": 1 << 30,
+	}
+}
+
 type Config struct {
-	Port     int            `json:"port"`
-	Env      string         `json:"env"`
-	HMACKey  string         `json:"hmac_key"`
-	Database PostgresConfig `json:"database"`
+	Port int    `json:"port"`
+	Env  string `json:"env"`
+	// BaseURL is where the application is reached, used for links in emails.
+	BaseURL  string         `json:"base_url"`
+	HMACKey  string         `json:"hmac_key" secret:"true"`
+	Server   ServerConfig   `json:"server"`
+	Log      LogConfig      `json:"log"`
+	Metrics  MetricsConfig  `json:"metrics"`
+	Tracing  TracingConfig  `json:"tracing"`
+	Database DatabaseConfig `json:"database"`
+	Jobs     JobsConfig     `json:"jobs"`
+	Mail     MailConfig     `json:"mail"`
+	// Quotas maps plans to the number of bytes their users may store,
+	// zero means unlimited.
+	Quotas map[string]int64 `json:"quotas"`
+	// TrashRetentionDays is how long deleted galleries and
+	// images can be restored before they are purged.
+	TrashRetentionDays int `json:"trash_retention_days"`
+	// AuditRetentionDays is how long entries of the audit log are kept,
+	// at least one day.
+	AuditRetentionDays int `json:"audit_retention_days"`
+}
+
+// TrashRetention returns the trash retention window as a duration.
+func (c *Config) TrashRetention() time.Duration {
+	return time.Duration(c.TrashRetentionDays) * 24 * time.Hour
+}
+
+// AuditRetention returns the audit log retention window as a duration.
+func (c *Config) AuditRetention() time.Duration {
+	return time.Duration(c.AuditRetentionDays) * 24 * time.Hour
 }
 
 func (c *Config) IsProd() bool {
@@ -52,26 +268,267 @@ func DefaultConfig() Config {
 	return Config{
 		Port:     3000,
 		Env:      "dev",
+		BaseURL:  "http://localhost:3000",
 		HMACKey:  "secret-hmac-key",
-		Database: DefaultPostgresConfig(),
+		Server:   DefaultServerConfig(),
+		Log:      DefaultLogConfig(),
+		Metrics:  DefaultMetricsConfig(),
+		Tracing:  DefaultTracingConfig(),
+		Database: DefaultDatabaseConfig(),
+		Jobs:     DefaultJobsConfig(),
+		Mail:     DefaultMailConfig(),
+		Quotas:   DefaultQuotas(),
+
+		TrashRetentionDays: 30,
+		AuditRetentionDays: 365,
 	}
 }
 
-func LoadConfig(configReq bool) Config {
-	f, err := os.Open("config.json")
-	if err != nil {
-		if configReq {
-			panic(err)
+// LoadConfig layers the config from, in increasing order of precedence:
+// the defaults, the JSON file at path, the environment and the overrides.
+// A missing file is only an error if required is set.
+//
+// Every field can be set from the environment with its JSON path in
+// upper case, prefixed with MYPHOTO_, like MYPHOTO_DATABASE_HOST. The
+// value is read from a file instead if the name ends with _FILE, like
+// MYPHOTO_HMAC_KEY_FILE, which is how secrets are usually mounted.
+// Overrides are of the form database.host=localhost.
+func LoadConfig(path string, required bool, overrides []string) (Config, error) {
+	c := DefaultConfig()
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&c); err != nil {
+			return c, fmt.Errorf("config: %s: %w", path, err)
 		}
-		fmt.Println("Using the default config...")
-		return DefaultConfig()
+		slog.Info("loaded the config", "path", path)
+	case errors.Is(err, os.ErrNotExist) && !required:
+		slog.Info("there is no config file, using the defaults and the environment", "path", path)
+	default:
+		return c, fmt.Errorf("config: %w", err)
+	}
+	if err = c.applyEnv(os.LookupEnv); err != nil {
+		return c, err
 	}
-	var c Config
-	dec := json.NewDecoder(f)
-	err = dec.Decode(&c)
-	if err != nil {
-		panic(err)
+	for _, o := range overrides {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return c, fmt.Errorf("config: override %q is not of the form key=value", o)
+		}
+		if err = c.set(kv[0], kv[1]); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// configField is a setting of the config, addressed by its JSON path.
+type configField struct {
+	// Path is the dot separated JSON path, like database.host.
+	Path   string
+	Secret bool
+	value  reflect.Value
+}
+
+// EnvName returns the name of the environment variable of the field.
+func (f configField) EnvName() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(f.Path, ".", "_"))
+}
+
+// envPrefix starts the names of the environment variables of the config.
+const envPrefix = "MYPHOTO_"
+
+// fields returns every setting of the config, descending into nested structs.
+func (c *Config) fields() []configField {
+	var fields []configField
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Struct {
+				walk(fv, prefix+name+".")
+				continue
+			}
+			fields = append(fields, configField{
+				Path:   prefix + name,
+				Secret: t.Field(i).Tag.Get("secret") == "true",
+				value:  fv,
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return fields
+}
+
+// applyEnv sets the fields which have an environment variable.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	for _, f := range c.fields() {
+		name := f.EnvName()
+		value, ok := lookup(name)
+		if file, fromFile := lookup(name + "_FILE"); fromFile {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("config: %s_FILE: %w", name, err)
+			}
+			value, ok = strings.TrimRight(string(b), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+		if err := setConfigValue(f.value, value); err != nil {
+			return fmt.Errorf("config: %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// set changes the field with the JSON path key.
+func (c *Config) set(key, value string) error {
+	for _, f := range c.fields() {
+		if f.Path != key {
+			continue
+		}
+		if err := setConfigValue(f.value, value); err != nil {
+			return fmt.Errorf("config: %s: %w", key, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("config: unknown setting %s", key)
+}
+
+// setConfigValue parses value into v. Strings, numbers and
+// booleans are written as is, everything else as JSON.
+func setConfigValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		ptr := reflect.New(v.Type())
+		if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+			return err
+		}
+		v.Set(ptr.Elem())
+	}
+	return nil
+}
+
+// Validate checks that the config can be run with. In production
+// it also refuses the default secrets, which are public.
+func (c *Config) Validate() error {
+	var problems []string
+	if c.Env != "dev" && c.Env != "prod" {
+		problems = append(problems, "env must be dev or prod")
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		problems = append(problems, "port must be between 1 and 65535")
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		problems = append(problems, "base_url must be an absolute URL")
+	}
+	sc := c.Server
+	if sc.ReadTimeoutSeconds < 0 || sc.ReadHeaderTimeoutSeconds < 0 || sc.WriteTimeoutSeconds < 0 ||
+		sc.IdleTimeoutSeconds < 0 || sc.ShutdownTimeoutSeconds < 0 || sc.DrainSeconds < 0 || sc.MaxHeaderBytes < 0 {
+		problems = append(problems, "server timeouts and max_header_bytes cannot be negative")
+	}
+	if (sc.TLSCertFile == "") != (sc.TLSKeyFile == "") {
+		problems = append(problems, "server.tls_cert_file and server.tls_key_file must be set together")
+	}
+	if sc.TLS() && sc.RedirectPort == c.Port {
+		problems = append(problems, "server.redirect_port must differ from port")
+	}
+	var level slog.Level
+	if level.UnmarshalText([]byte(c.Log.Level)) != nil {
+		problems = append(problems, "log.level must be debug, info, warn or error")
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		problems = append(problems, "log.format must be text or json")
+	}
+	if c.Metrics.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Address); err != nil {
+			problems = append(problems, "metrics.address must be host:port")
+		}
+	}
+	switch c.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout:
+	case tracing.ExporterOTLP:
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, "tracing.endpoint must be an absolute URL")
+		}
+	default:
+		problems = append(problems, "tracing.exporter must be empty, otlp or stdout")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problems = append(problems, "tracing.sample_ratio must be between 0 and 1")
+	}
+	if c.HMACKey == "" {
+		problems = append(problems, "hmac_key is required")
+	}
+	switch c.Database.Driver {
+	case models.DriverPostgres:
+		if c.Database.Host == "" || c.Database.DBName == "" {
+			problems = append(problems, "database.host and database.db_name are required")
+		}
+	case models.DriverSQLite:
+		if c.Database.Path == "" {
+			problems = append(problems, "database.path is required for sqlite")
+		}
+	default:
+		problems = append(problems, "database.driver must be postgres or sqlite")
+	}
+	if c.Jobs.Concurrency < 1 {
+		problems = append(problems, "jobs.concurrency must be at least 1")
+	}
+	if c.TrashRetentionDays < 0 {
+		problems = append(problems, "trash_retention_days cannot be negative")
+	}
+	// Pruning with no retention at all would empty the audit log every hour.
+	if c.AuditRetentionDays < 1 {
+		problems = append(problems, "audit_retention_days must be at least 1")
+	}
+	if c.IsProd() {
+		defaults := DefaultConfig()
+		if c.HMACKey == defaults.HMACKey {
+			problems = append(problems, "hmac_key must not be the default in prod")
+		}
+		if c.Database.Driver == models.DriverPostgres && c.Database.Password == defaults.Database.Password {
+			problems = append(problems, "database.password must not be the default in prod")
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// redacted replaces the values of secrets when the config is printed.
+const redacted = "[redacted]"
+
+// Redacted returns a copy of the config with the secrets which are set replaced.
+func (c Config) Redacted() Config {
+	for _, f := range c.fields() {
+		if f.Secret && f.value.String() != "" {
+			f.value.SetString(redacted)
+		}
 	}
-	fmt.Println("Successfully loaded config.json")
 	return c
 }
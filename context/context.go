@@ -2,12 +2,18 @@ package context
 
 import (
 	"context"
+	"log/slog"
 	"myphoto/models"
 )
 
 type contextKey string
 
-const userKey contextKey = "user"
+const (
+	userKey      contextKey = "user"
+	requestIDKey contextKey = "request_id"
+	loggerKey    contextKey = "logger"
+	infoKey      contextKey = "info"
+)
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
 	return context.WithValue(ctx, userKey, user)
@@ -21,3 +27,43 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithRequestID stores the ID of the request, together with
+// a logger which adds the ID to everything it logs.
+func WithRequestID(ctx context.Context, id string, logger *slog.Logger) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, id)
+	return context.WithValue(ctx, loggerKey, logger.With("request_id", id))
+}
+
+// RequestID returns the ID of the request, or an empty string if it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Logger returns the logger of the request, which
+// is the default logger outside of requests.
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// RequestInfo collects what is learnt about a request while it
+// is routed and served, so it can be logged once it is done.
+type RequestInfo struct {
+	// Route is the path template of the matched route.
+	Route  string
+	UserID uint
+}
+
+func WithInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, infoKey, info)
+}
+
+// Info returns the info of the request, or nil if it is not collected.
+func Info(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(infoKey).(*RequestInfo)
+	return info
+}
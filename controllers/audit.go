@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"myphoto/models"
+	"myphoto/views"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// auditPageSize is the number of entries per page of the audit log.
+	auditPageSize = 50
+)
+
+// NewAudit creates a new Audit controller.
+// This function will panic if templates are not correct,
+// and should be used only during initial mux setup.
+func NewAudit(as models.AuditService) *Audit {
+	return &Audit{
+		IndexView: views.NewView("index", "audit/index"),
+		as:        as,
+	}
+}
+
+type Audit struct {
+	IndexView *views.View
+	as        models.AuditService
+}
+
+// AuditFilterForm holds the filters and page of the audit log page.
+type AuditFilterForm struct {
+	ActorID    uint   `schema:"actor"`
+	Action     string `schema:"action"`
+	TargetType string `schema:"target"`
+	TargetID   uint   `schema:"target_id"`
+	// From and To are dates formatted as YYYY-MM-DD, To is inclusive.
+	From string `schema:"from"`
+	To   string `schema:"to"`
+	Page int    `schema:"page"`
+}
+
+// values returns the filters as URL parameters, leaving out the page.
+func (f *AuditFilterForm) values() url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"action": f.Action,
+		"target": f.TargetType,
+		"from":   f.From,
+		"to":     f.To,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if f.ActorID > 0 {
+		values.Set("actor", strconv.FormatUint(uint64(f.ActorID), 10))
+	}
+	if f.TargetID > 0 {
+		values.Set("target_id", strconv.FormatUint(uint64(f.TargetID), 10))
+	}
+	return values
+}
+
+// query converts the form to a query of one page of the audit log,
+// with one more entry than shown to tell whether there is a next page.
+func (f *AuditFilterForm) query() (models.AuditQuery, error) {
+	q := models.AuditQuery{
+		ActorID:    f.ActorID,
+		TargetType: f.TargetType,
+		TargetID:   f.TargetID,
+		Limit:      auditPageSize + 1,
+		Offset:     (f.Page - 1) * auditPageSize,
+	}
+	if f.Action != "" {
+		q.Actions = []string{f.Action}
+	}
+	var err error
+	if f.From != "" {
+		if q.From, err = time.Parse(dateLayout, f.From); err != nil {
+			return q, models.ErrInvalidDate
+		}
+	}
+	if f.To != "" {
+		if q.Until, err = time.Parse(dateLayout, f.To); err != nil {
+			return q, models.ErrInvalidDate
+		}
+		q.Until = q.Until.AddDate(0, 0, 1)
+	}
+	return q, nil
+}
+
+// AuditIndex is the data of the audit log page.
+type AuditIndex struct {
+	Entries []models.AuditEntry
+	Filter  AuditFilterForm
+	Actions []string
+	Targets []string
+	// NextURL and PrevURL link to the following and preceding pages, if there are any.
+	NextURL string
+	PrevURL string
+}
+
+// Index is used to show the audit log of all users to admins.
+// GET /admin/audit?actor=:actor&action=:action&target=:target&target_id=:target_id&from=:from&to=:to&page=:page
+func (a *Audit) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	index := AuditIndex{
+		Actions: models.AuditActions,
+		Targets: models.AuditTargets,
+	}
+	if err := parseURLParams(r, &index.Filter); err != nil {
+		vd.Yield = index
+		vd.SetAlert(err)
+		a.IndexView.Render(w, r, vd)
+		return
+	}
+	if index.Filter.Page < 1 {
+		index.Filter.Page = 1
+	}
+	q, err := index.Filter.query()
+	if err != nil {
+		vd.Yield = index
+		vd.SetAlert(err)
+		a.IndexView.Render(w, r, vd)
+		return
+	}
+	entries, err := a.as.Search(q)
+	if err != nil {
+		vd.Yield = index
+		vd.SetAlert(err)
+		a.IndexView.Render(w, r, vd)
+		return
+	}
+	if len(entries) > auditPageSize {
+		entries = entries[:auditPageSize]
+		values := index.Filter.values()
+		values.Set("page", strconv.Itoa(index.Filter.Page+1))
+		index.NextURL = "/admin/audit?" + values.Encode()
+	}
+	if index.Filter.Page > 1 {
+		values := index.Filter.values()
+		values.Set("page", strconv.Itoa(index.Filter.Page-1))
+		index.PrevURL = "/admin/audit?" + values.Encode()
+	}
+	index.Entries = entries
+	vd.Yield = index
+	a.IndexView.Render(w, r, vd)
+}
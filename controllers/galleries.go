@@ -2,13 +2,19 @@ package controllers
 
 import (
 	"fmt"
-	"log"
+	"mime"
 	"mime/multipart"
 	"myphoto/context"
+	"myphoto/markdown"
+	"myphoto/metrics"
 	"myphoto/models"
+	"myphoto/tracing"
 	"myphoto/views"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -20,46 +26,202 @@ const (
 	EditGallery = "edit_gallery"
 
 	maxMultipartMemory = 1 << 20 // 1 megabyte
+
+	// dateLayout is the format of dates in forms.
+	dateLayout = "2006-01-02"
 )
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService, ts models.TagService,
+	ms models.MemberService, as models.AuditService, ws models.WebhookService, r *mux.Router) *Galleries {
 	return &Galleries{
-		New:       views.NewView("index", "galleries/new"),
-		ShowView:  views.NewView("index", "galleries/show"),
-		EditView:  views.NewView("index", "galleries/edit"),
-		IndexView: views.NewView("index", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:            views.NewView("index", "galleries/new"),
+		ShowView:       views.NewView("index", "galleries/show"),
+		EditView:       views.NewView("index", "galleries/edit"),
+		IndexView:      views.NewView("index", "galleries/index"),
+		DuplicatesView: views.NewView("index", "galleries/duplicates"),
+		ImageView:      views.NewView("index", "galleries/image"),
+		InvitationView: views.NewView("index", "galleries/invitation"),
+		gs:             gs,
+		is:             is,
+		ts:             ts,
+		ms:             ms,
+		as:             as,
+		ws:             ws,
+		r:              r,
 	}
 }
 
 type Galleries struct {
-	New       *views.View
-	IndexView *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New            *views.View
+	IndexView      *views.View
+	ShowView       *views.View
+	EditView       *views.View
+	DuplicatesView *views.View
+	ImageView      *views.View
+	InvitationView *views.View
+	gs             models.GalleryService
+	is             models.ImageService
+	ts             models.TagService
+	ms             models.MemberService
+	as             models.AuditService
+	ws             models.WebhookService
+	r              *mux.Router
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title       string `schema:"title"`
+	Description string `schema:"description"`
+	Public      bool   `schema:"public"`
+	Proofing    bool   `schema:"proofing"`
+	// SelectionLimit is the number of images each proofer may select, zero means unlimited.
+	SelectionLimit int `schema:"selection_limit"`
+	// Tags is a comma separated list of tag names.
+	Tags string `schema:"tags"`
+}
+
+// ImageTagsForm is used to add or remove tags of the selected images.
+type ImageTagsForm struct {
+	Images []uint `schema:"images"`
+	Tags   string `schema:"tags"`
+	// Action is either "tag" or "untag".
+	Action string `schema:"action"`
+}
+
+type DuplicatesForm struct {
+	Keep   uint   `schema:"keep"`
+	Remove []uint `schema:"remove"`
+}
+
+// DuplicateImage is an image listed on the duplicates page, together
+// with its gallery and the IDs of the other images in its group.
+type DuplicateImage struct {
+	models.Image
+	Gallery *models.Gallery
+	Others  []uint
+}
+
+// GalleryFilterForm holds the sorting, filters and
+// position of the gallery list page.
+type GalleryFilterForm struct {
+	Sort string `schema:"sort"`
+	// Order is either "asc" or "desc".
+	Order      string `schema:"order"`
+	Visibility string `schema:"visibility"`
+	Tag        string `schema:"tag"`
+	// From and To are dates formatted as YYYY-MM-DD, To is inclusive.
+	From   string `schema:"from"`
+	To     string `schema:"to"`
+	After  string `schema:"after"`
+	Before string `schema:"before"`
+}
+
+// values returns the sorting and filters as URL query parameters, without the position.
+func (f *GalleryFilterForm) values() url.Values {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"sort":       f.Sort,
+		"order":      f.Order,
+		"visibility": f.Visibility,
+		"tag":        f.Tag,
+		"from":       f.From,
+		"to":         f.To,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values
+}
+
+// query turns the form into a query for the galleries of the user.
+func (f *GalleryFilterForm) query(userID uint) (models.GalleryQuery, error) {
+	q := models.GalleryQuery{
+		UserID:     userID,
+		Sort:       f.Sort,
+		Order:      f.Order,
+		Visibility: f.Visibility,
+		Tag:        f.Tag,
+		After:      f.After,
+		Before:     f.Before,
+	}
+	var err error
+	if f.From != "" {
+		if q.CreatedFrom, err = time.Parse(dateLayout, f.From); err != nil {
+			return q, models.ErrInvalidDate
+		}
+	}
+	if f.To != "" {
+		if q.CreatedUntil, err = time.Parse(dateLayout, f.To); err != nil {
+			return q, models.ErrInvalidDate
+		}
+		q.CreatedUntil = q.CreatedUntil.AddDate(0, 0, 1)
+	}
+	return q, nil
+}
+
+// GalleriesIndex is the data of the gallery list page.
+type GalleriesIndex struct {
+	Galleries []models.Gallery
+	// Shared are the galleries of other users the user is a member of.
+	Shared []models.Gallery
+	Usage  *models.Usage
+	Filter GalleryFilterForm
+	// NextURL and PrevURL link to the following and preceding pages, if there are any.
+	NextURL string
+	PrevURL string
 }
 
 // Index is used to show gallery list.
-// GET /galleries
+// GET /galleries?sort=:sort&order=:order&visibility=:visibility&tag=:tag&from=:from&to=:to
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
-	galleries, err := g.gs.ByUserID(user.ID)
+	usage, err := g.is.WithContext(r.Context()).Usage(user.ID)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		serverError(w, r, err)
+		return
+	}
+	shared, err := g.gs.WithContext(r.Context()).SharedWith(user.ID)
+	if err != nil {
+		serverError(w, r, err)
 		return
 	}
 	var vd views.Data
-	vd.Yield = galleries
+	index := GalleriesIndex{
+		Usage:  usage,
+		Shared: shared,
+	}
+	if err = parseURLParams(r, &index.Filter); err != nil {
+		vd.Yield = index
+		vd.SetAlert(err)
+		g.IndexView.Render(w, r, vd)
+		return
+	}
+	q, err := index.Filter.query(user.ID)
+	if err != nil {
+		vd.Yield = index
+		vd.SetAlert(err)
+		g.IndexView.Render(w, r, vd)
+		return
+	}
+	page, err := g.gs.WithContext(r.Context()).List(q)
+	if err != nil {
+		vd.Yield = index
+		vd.SetAlert(err)
+		g.IndexView.Render(w, r, vd)
+		return
+	}
+	index.Galleries = page.Galleries
+	if page.Next != "" {
+		values := index.Filter.values()
+		values.Set("after", page.Next)
+		index.NextURL = "/galleries?" + values.Encode()
+	}
+	if page.Prev != "" {
+		values := index.Filter.values()
+		values.Set("before", page.Prev)
+		index.PrevURL = "/galleries?" + values.Encode()
+	}
+	vd.Yield = index
 	g.IndexView.Render(w, r, vd)
 }
 
@@ -70,11 +232,112 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	if _, ok := g.authorize(w, r, gallery, models.RoleViewer); !ok {
+		return
+	}
 	var vd views.Data
 	vd.Yield = gallery
 	g.ShowView.Render(w, r, vd)
 }
 
+// ImagePage is the data of the page of a single image of a gallery.
+type ImagePage struct {
+	Gallery *models.Gallery
+	Image   *models.Image
+	// Prev and Next are the neighbouring images, if there are any.
+	Prev     *models.Image
+	Next     *models.Image
+	Position int
+}
+
+// ImageShow is used to show a single image of a gallery.
+// GET /galleries/:id/images/:imageID
+func (g *Galleries) ImageShow(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if _, ok := g.authorize(w, r, gallery, models.RoleViewer); !ok {
+		return
+	}
+	i, ok := g.imageIndex(w, r, gallery)
+	if !ok {
+		return
+	}
+	page := ImagePage{
+		Gallery:  gallery,
+		Image:    &gallery.Images[i],
+		Position: i + 1,
+	}
+	if i > 0 {
+		page.Prev = &gallery.Images[i-1]
+	}
+	if i < len(gallery.Images)-1 {
+		page.Next = &gallery.Images[i+1]
+	}
+	var vd views.Data
+	vd.Yield = page
+	g.ImageView.Render(w, r, vd)
+}
+
+// ImageDownload is used to download the original file of an image.
+// GET /galleries/:id/images/:imageID/download
+func (g *Galleries) ImageDownload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if _, ok := g.authorize(w, r, gallery, models.RoleViewer); !ok {
+		return
+	}
+	i, ok := g.imageIndex(w, r, gallery)
+	if !ok {
+		return
+	}
+	img := gallery.Images[i]
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": img.Filename}))
+	http.ServeFile(w, r, img.RelativePath())
+}
+
+// ImageFile is used to serve the file of an image to the users who may view its gallery.
+// Only the files of images which are not in the trash are served, by their exact name.
+// GET /images/galleries/:id/:filename
+func (g *Galleries) ImageFile(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if _, ok := g.authorize(w, r, gallery, models.RoleViewer); !ok {
+		return
+	}
+	filename := mux.Vars(r)["filename"]
+	for _, img := range gallery.Images {
+		if img.Filename == filename {
+			http.ServeFile(w, r, img.RelativePath())
+			return
+		}
+	}
+	http.Error(w, "Image not found", http.StatusNotFound)
+}
+
+// imageIndex returns the index of the image of the request among the
+// images of the gallery, or responds with an error if it is not there.
+func (g *Galleries) imageIndex(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["imageID"])
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return 0, false
+	}
+	for i, img := range gallery.Images {
+		if img.ID == uint(id) {
+			return i, true
+		}
+	}
+	http.Error(w, "Image not found", http.StatusNotFound)
+	return 0, false
+}
+
 // Edit is used to show the gallery edit form.
 // GET /galleries/:id/edit
 func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
@@ -82,14 +345,11 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if _, ok := g.authorize(w, r, gallery, models.RoleContributor); !ok {
 		return
 	}
 	var vd views.Data
-	vd.Yield = gallery
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, vd, gallery)
 }
 
 // Update is used to for processing the gallery edit form.
@@ -99,31 +359,75 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if _, ok := g.authorize(w, r, gallery, models.RoleEditor); !ok {
 		return
 	}
 	var vd views.Data
-	vd.Yield = gallery
 	var form GalleryForm
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
+	before := *gallery
 	gallery.Title = form.Title
-	err = g.gs.Update(gallery)
+	gallery.Description = form.Description
+	gallery.Public = form.Public
+	gallery.Proofing = form.Proofing
+	gallery.SelectionLimit = form.SelectionLimit
+	err = g.gs.WithContext(r.Context()).Update(gallery)
 	if err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
+	if changes := models.Diff(&before, gallery); len(changes) > 0 {
+		audit(g.as, r, models.AuditEntry{
+			Action:     models.AuditGalleryUpdate,
+			TargetType: models.AuditTargetGallery,
+			TargetID:   gallery.ID,
+			Changes:    changes,
+		})
+		if err = g.ws.GalleryEvent(models.EventGalleryUpdated, gallery); err != nil {
+			logError(r, err)
+		}
+	}
+	// Tags belong to the owner of the gallery, also when an editor sets them.
+	err = g.ts.SetGalleryTags(gallery.UserID, gallery.ID, models.ParseTags(form.Tags))
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	if err = g.ts.LoadTags(gallery); err != nil {
+		logError(r, err)
+	}
 	vd.Alert = &views.Alert{
 		Level:   views.AlertLevelSuccess,
 		Message: "Gallery successfully updated!",
 	}
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, vd, gallery)
+}
+
+// PreviewJSON is the response of the description preview.
+type PreviewJSON struct {
+	HTML string `json:"html"`
+}
+
+// Preview is used to render a gallery description while it is edited.
+// POST /galleries/preview
+func (g *Galleries) Preview(w http.ResponseWriter, r *http.Request) {
+	var form GalleryForm
+	if err := parseForm(r, &form); err != nil {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "Invalid form."})
+		return
+	}
+	html, err := markdown.Render(form.Description)
+	if err != nil {
+		serverErrorJSON(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, PreviewJSON{HTML: string(html)})
 }
 
 // Create is used to for processing the gallery create form.
@@ -145,14 +449,23 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 		Title:  form.Title,
 		UserID: user.ID,
 	}
-	if err := g.gs.Create(&gallery); err != nil {
+	if err := g.gs.WithContext(r.Context()).Create(&gallery); err != nil {
 		vd.SetAlert(err)
 		g.New.Render(w, r, vd)
 		return
 	}
+	audit(g.as, r, models.AuditEntry{
+		Action:     models.AuditGalleryCreate,
+		TargetType: models.AuditTargetGallery,
+		TargetID:   gallery.ID,
+		Changes:    models.Diff(nil, &gallery),
+	})
+	if err := g.ws.GalleryEvent(models.EventGalleryCreated, &gallery); err != nil {
+		logError(r, err)
+	}
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
-		log.Println(err)
+		logError(r, err)
 		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
@@ -167,58 +480,158 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if _, ok := g.authorize(w, r, gallery, models.RoleContributor); !ok {
 		return
 	}
 
 	var vd views.Data
-	vd.Yield = gallery
+	_, span := tracing.Start(r.Context(), "parse multipart form")
 	err = r.ParseMultipartForm(maxMultipartMemory)
+	tracing.End(span, err)
 	if err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
 
+	var warnings []string
 	files := r.MultipartForm.File["images"]
 	for _, f := range files {
-		func(f *multipart.FileHeader) {
+		err = func(f *multipart.FileHeader) error {
 			file, err := f.Open()
 			if err != nil {
-				vd.SetAlert(err)
-				g.EditView.Render(w, r, vd)
-				return
+				return err
 			}
 			defer file.Close()
-			err = g.is.Create(gallery.ID, file, f.Filename)
+			img, err := g.is.WithContext(r.Context()).Create(gallery.ID, user.ID, file, f.Filename)
 			if err != nil {
-				vd.SetAlert(err)
-				g.EditView.Render(w, r, vd)
-				return
+				return err
+			}
+			metrics.Upload(metrics.UploadForm, img.Size)
+			auditImage(g.as, r, models.AuditImageUpload, nil, img)
+			if err = g.ws.ImageEvent(models.EventImageUploaded, gallery, img); err != nil {
+				logError(r, err)
 			}
+			if warning := duplicateWarning(r, g.gs, g.is, gallery.UserID, img); warning != "" {
+				warnings = append(warnings, warning)
+			}
+			return nil
 		}(f)
+		// The files after the first one failing, like one over the quota, are not uploaded.
+		if err != nil {
+			vd.SetAlert(err)
+			g.renderEdit(w, r, vd, gallery)
+			return
+		}
 	}
 
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
-		log.Println(err)
+		logError(r, err)
 		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
+	if len(warnings) > 0 {
+		alert := views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: strings.Join(warnings, " "),
+		}
+		views.RedirectAlert(w, r, url.Path, http.StatusFound, alert)
+		return
+	}
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
-// ImageDelete is used to delete an image.
+// Duplicates is used to show groups of identical or nearly identical
+// images across all galleries of the user.
+// GET /galleries/duplicates
+func (g *Galleries) Duplicates(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	groups, err := g.is.WithContext(r.Context()).DuplicateGroups(user.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	galleries := make(map[uint]*models.Gallery)
+	yield := make([][]DuplicateImage, len(groups))
+	for i, group := range groups {
+		for _, img := range group {
+			gallery, ok := galleries[img.GalleryID]
+			if !ok {
+				gallery, err = g.gs.WithContext(r.Context()).ByID(img.GalleryID)
+				if err != nil {
+					serverError(w, r, err)
+					return
+				}
+				galleries[img.GalleryID] = gallery
+			}
+			yield[i] = append(yield[i], DuplicateImage{Image: img, Gallery: gallery})
+		}
+		for j := range yield[i] {
+			for _, other := range group {
+				if other.ID != yield[i][j].ID {
+					yield[i][j].Others = append(yield[i][j].Others, other.ID)
+				}
+			}
+		}
+	}
+	var vd views.Data
+	vd.Yield = yield
+	g.DuplicatesView.Render(w, r, vd)
+}
+
+// ResolveDuplicates is used to keep one image of a group of duplicates and delete the others.
+// POST /galleries/duplicates
+func (g *Galleries) ResolveDuplicates(w http.ResponseWriter, r *http.Request) {
+	var form DuplicatesForm
+	if err := parseForm(r, &form); err != nil {
+		logError(r, err)
+		http.Redirect(w, r, "/galleries/duplicates", http.StatusFound)
+		return
+	}
+	user := context.User(r.Context())
+	removed := 0
+	for _, id := range form.Remove {
+		if id == form.Keep {
+			continue
+		}
+		img, err := g.is.WithContext(r.Context()).ByID(id)
+		if err != nil {
+			continue
+		}
+		gallery, err := g.gs.WithContext(r.Context()).ByID(img.GalleryID)
+		if err != nil {
+			continue
+		}
+		if role, err := g.ms.Role(gallery, user.ID); err != nil || !models.RoleAtLeast(role, models.RoleEditor) {
+			continue
+		}
+		if err = g.is.WithContext(r.Context()).Delete(img); err != nil {
+			logError(r, err)
+			continue
+		}
+		auditImage(g.as, r, models.AuditImageDelete, img, nil)
+		if err = g.ws.ImageEvent(models.EventImageDeleted, gallery, img); err != nil {
+			logError(r, err)
+		}
+		removed++
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Moved %d duplicate images to the trash.", removed),
+	}
+	views.RedirectAlert(w, r, "/galleries/duplicates", http.StatusFound, alert)
+}
+
+// ImageDelete is used to move an image to the trash.
 // POST /galleries/:id/images/:filename/delete
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	role, ok := g.authorize(w, r, gallery, models.RoleContributor)
+	if !ok {
 		return
 	}
 	filename := mux.Vars(r)["filename"]
@@ -226,48 +639,173 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 		Filename:  filename,
 		GalleryID: gallery.ID,
 	}
-	err = g.is.Delete(&i)
+	for _, img := range gallery.Images {
+		if img.Filename == filename {
+			i = img
+		}
+	}
+	user := context.User(r.Context())
+	if !canDeleteImage(role, user.ID, &i) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	err = g.is.WithContext(r.Context()).Delete(&i)
 	if err != nil {
 		var vd views.Data
-		vd.Yield = gallery
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
+	auditImage(g.as, r, models.AuditImageDelete, &i, nil)
+	if err = g.ws.ImageEvent(models.EventImageDeleted, gallery, &i); err != nil {
+		logError(r, err)
+	}
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
-		log.Println(err)
+		logError(r, err)
 		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
-// Delete is used to delete a gallery.
+// ImageTags is used to tag or untag the selected images of a gallery.
+// POST /galleries/:id/images/tags
+func (g *Galleries) ImageTags(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if _, ok := g.authorize(w, r, gallery, models.RoleEditor); !ok {
+		return
+	}
+	var vd views.Data
+	var form ImageTagsForm
+	if err = parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	// Only images of this gallery can be selected on its edit page.
+	imageIDs := make([]uint, 0, len(form.Images))
+	for _, img := range gallery.Images {
+		for _, id := range form.Images {
+			if img.ID == id {
+				imageIDs = append(imageIDs, id)
+			}
+		}
+	}
+	if len(imageIDs) == 0 {
+		vd.AlertError("Select at least one image.")
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	names := models.ParseTags(form.Tags)
+	change := models.Change{New: strings.Join(names, ", ")}
+	if form.Action == "untag" {
+		err = g.ts.UntagImages(gallery.UserID, imageIDs, names)
+		change = models.Change{Old: change.New}
+	} else {
+		err = g.ts.TagImages(gallery.UserID, imageIDs, names)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	for _, id := range imageIDs {
+		audit(g.as, r, models.AuditEntry{
+			Action:     models.AuditImageUpdate,
+			TargetType: models.AuditTargetImage,
+			TargetID:   id,
+			Changes:    models.Changes{"tags": change},
+		})
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		logError(r, err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+type CaptionForm struct {
+	Caption string `schema:"caption"`
+}
+
+// ImageCaption is used to update the caption of an image.
+// POST /galleries/:id/images/:filename/caption
+func (g *Galleries) ImageCaption(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if _, ok := g.authorize(w, r, gallery, models.RoleEditor); !ok {
+		return
+	}
+	var vd views.Data
+	var form CaptionForm
+	if err = parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	filename := mux.Vars(r)["filename"]
+	err = g.is.WithContext(r.Context()).SetCaption(gallery.ID, filename, form.Caption)
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	for _, img := range gallery.Images {
+		if img.Filename == filename && img.Caption != strings.TrimSpace(form.Caption) {
+			after := img
+			after.Caption = strings.TrimSpace(form.Caption)
+			auditImage(g.as, r, models.AuditImageUpdate, &img, &after)
+		}
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		logError(r, err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// Delete is used to move a gallery to the trash.
 // POST /galleries/:id/delete
 func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if _, ok := g.authorize(w, r, gallery, models.RoleOwner); !ok {
 		return
 	}
 	var vd views.Data
-	err = g.gs.Delete(gallery.ID)
+	err = g.gs.WithContext(r.Context()).Delete(gallery.ID)
 	if err != nil {
 		vd.SetAlert(err)
-		vd.Yield = gallery
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd, gallery)
 		return
 	}
-	err = g.is.DeleteGallery(gallery.ID)
-	if err != nil {
-		log.Println(err)
+	audit(g.as, r, models.AuditEntry{
+		Action:     models.AuditGalleryDelete,
+		TargetType: models.AuditTargetGallery,
+		TargetID:   gallery.ID,
+		Changes:    models.Diff(gallery, nil),
+	})
+	if err = g.ws.GalleryEvent(models.EventGalleryDeleted, gallery); err != nil {
+		logError(r, err)
+	}
+	// Images are kept, so the gallery can be restored from the trash.
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Gallery moved to the trash.",
 	}
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
 }
 
 func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
@@ -277,18 +815,109 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
 		return nil, err
 	}
-	gallery, err := g.gs.ByID(uint(id))
+	gallery, err := g.gs.WithContext(r.Context()).ByID(uint(id))
 	if err != nil {
 		switch err {
 		case models.ErrResourceNotFound:
 			http.Error(w, "Gallery not found", http.StatusNotFound)
 		default:
-			log.Println(err)
-			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+			serverError(w, r, err)
 		}
 		return nil, err
 	}
-	images, _ := g.is.ByGalleryID(gallery.ID)
+	images, _ := g.is.WithContext(r.Context()).ByGalleryID(gallery.ID)
 	gallery.Images = images
+	if err = g.ts.LoadTags(gallery); err != nil {
+		logError(r, err)
+	}
 	return gallery, nil
 }
+
+// GalleryEdit is the data of the gallery edit page, which depends
+// on the role of the user in the gallery.
+type GalleryEdit struct {
+	*models.Gallery
+	Role   string
+	UserID uint
+	// Members and Invitations are only set for owners, who manage them.
+	Members     []models.Member
+	Invitations []models.Invitation
+}
+
+// CanEdit reports whether the user may change the gallery and all of its images.
+func (ge *GalleryEdit) CanEdit() bool {
+	return models.RoleAtLeast(ge.Role, models.RoleEditor)
+}
+
+// CanManage reports whether the user may manage the members and delete the gallery.
+func (ge *GalleryEdit) CanManage() bool {
+	return models.RoleAtLeast(ge.Role, models.RoleOwner)
+}
+
+// CanDelete reports whether the user may move the image to the trash.
+func (ge *GalleryEdit) CanDelete(img models.Image) bool {
+	return canDeleteImage(ge.Role, ge.UserID, &img)
+}
+
+// Roles returns the roles members can be given.
+func (ge *GalleryEdit) Roles() []string {
+	return models.Roles
+}
+
+// renderEdit shows the edit page of the gallery with the data of vd.
+func (g *Galleries) renderEdit(w http.ResponseWriter, r *http.Request, vd views.Data, gallery *models.Gallery) {
+	user := context.User(r.Context())
+	edit := GalleryEdit{
+		Gallery: gallery,
+		UserID:  user.ID,
+	}
+	var err error
+	if edit.Role, err = g.ms.Role(gallery, user.ID); err == nil && edit.CanManage() {
+		if edit.Members, err = g.ms.ByGalleryID(gallery.ID); err == nil {
+			edit.Invitations, err = g.ms.InvitationsByGalleryID(gallery.ID)
+		}
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	vd.Yield = &edit
+	g.EditView.Render(w, r, vd)
+}
+
+// authorize checks that the signed-in user has at least the role min in the gallery.
+func (g *Galleries) authorize(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, min string) (string, bool) {
+	return authorize(w, r, g.ms, gallery, min)
+}
+
+// canDeleteImage reports whether a user with the role may delete the image.
+// Contributors may only delete the images they uploaded themselves.
+func canDeleteImage(role string, userID uint, img *models.Image) bool {
+	if models.RoleAtLeast(role, models.RoleEditor) {
+		return true
+	}
+	return models.RoleAtLeast(role, models.RoleContributor) && img.UploaderID == userID
+}
+
+// duplicateWarning describes where images with exactly the same content
+// as img were uploaded before, or returns an empty string if nowhere.
+func duplicateWarning(r *http.Request, gs models.GalleryService, is models.ImageService, userID uint, img *models.Image) string {
+	gs, is = gs.WithContext(r.Context()), is.WithContext(r.Context())
+	duplicates, err := is.ExactDuplicates(userID, img)
+	if err != nil {
+		logError(r, err)
+		return ""
+	}
+	if len(duplicates) == 0 {
+		return ""
+	}
+	places := make([]string, 0, len(duplicates))
+	for _, d := range duplicates {
+		gallery, err := gs.ByID(d.GalleryID)
+		if err != nil {
+			continue
+		}
+		places = append(places, fmt.Sprintf("%s in %s", d.Filename, gallery.Title))
+	}
+	return fmt.Sprintf("%s was already uploaded as %s.", img.Filename, strings.Join(places, " and "))
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// healthCheckTimeout is how long a single readiness check may take.
+	healthCheckTimeout = 2 * time.Second
+
+	healthOK       = "ok"
+	healthFailing  = "failing"
+	healthDraining = "draining"
+)
+
+// HealthCheck is a dependency the application needs to serve requests.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// NewHealth creates a new Health controller running the checks for readiness.
+func NewHealth(checks ...HealthCheck) *Health {
+	return &Health{checks: checks}
+}
+
+type Health struct {
+	checks   []HealthCheck
+	draining atomic.Bool
+}
+
+// Drain makes the readiness checks fail from now on, so load
+// balancers stop sending requests before the server shuts down.
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+// healthResponse is the body of the readiness response.
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Live reports that the process is up and serving requests.
+//
+// GET /healthz
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": healthOK})
+}
+
+// Ready runs every check at the same time and reports their status and
+// latency. It responds with 503 Service Unavailable if any of them failed,
+// or while the server is draining.
+//
+// GET /readyz
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	res := healthResponse{Status: healthOK, Checks: make(map[string]checkResult, len(h.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, hc := range h.checks {
+		wg.Add(1)
+		go func(hc HealthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := hc.Check(ctx)
+			result := checkResult{
+				Status:    healthOK,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = healthFailing
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			res.Checks[hc.Name] = result
+			if err != nil {
+				res.Status = healthFailing
+			}
+		}(hc)
+	}
+	wg.Wait()
+
+	if h.draining.Load() {
+		res.Status = healthDraining
+	}
+	code := http.StatusOK
+	if res.Status != healthOK {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, res)
+}
@@ -1,6 +1,12 @@
 package controllers
 
 import (
+	"encoding/json"
+	"log/slog"
+	"myphoto/context"
+	"myphoto/models"
+	"myphoto/views"
+	"net"
 	"net/http"
 	"net/url"
 
@@ -26,3 +32,90 @@ func parseValues(values url.Values, dst interface{}) error {
 	dec.IgnoreUnknownKeys(true)
 	return dec.Decode(dst, values)
 }
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("writing JSON failed", "err", err)
+	}
+}
+
+// serverError logs err with the request and responds with 500 Internal
+// Server Error, showing the request ID so users can refer to it.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	logError(r, err)
+	http.Error(w, views.ServerErrorMessage(r), http.StatusInternalServerError)
+}
+
+// serverErrorJSON is serverError for the JSON API.
+func serverErrorJSON(w http.ResponseWriter, r *http.Request, err error) {
+	logError(r, err)
+	writeJSON(w, http.StatusInternalServerError, jsonError{Error: views.ServerErrorMessage(r)})
+}
+
+// logError logs an error which does not fail the request, with the request ID.
+func logError(r *http.Request, err error) {
+	context.Logger(r.Context()).Error("request error", "err", err)
+}
+
+// jsonError is the body of API error responses.
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+// authorize returns the role of the signed-in user in the gallery. Unless
+// the role grants at least min, it responds with 404 Not Found, so the gallery
+// is not revealed, and returns false. Everyone may view public galleries.
+func authorize(w http.ResponseWriter, r *http.Request, ms models.MemberService, gallery *models.Gallery, min string) (string, bool) {
+	var userID uint
+	if user := context.User(r.Context()); user != nil {
+		userID = user.ID
+	}
+	role, err := ms.Role(gallery, userID)
+	if err != nil {
+		serverError(w, r, err)
+		return "", false
+	}
+	if role == "" && gallery.Public {
+		role = models.RoleViewer
+	}
+	if !models.RoleAtLeast(role, min) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return "", false
+	}
+	return role, true
+}
+
+// audit records the entry in the audit log, together with the signed-in
+// user and the address and browser the request came from. Failures are
+// only logged, as the action itself already happened.
+func audit(as models.AuditService, r *http.Request, entry models.AuditEntry) {
+	if user := context.User(r.Context()); user != nil && entry.ActorID == nil {
+		entry.ActorID = &user.ID
+	}
+	entry.IP = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.IP = host
+	}
+	entry.UserAgent = r.UserAgent()
+	if err := as.Create(&entry); err != nil {
+		logError(r, err)
+	}
+}
+
+// auditImage records an action on an image, with the
+// image before and after the action, either may be nil.
+func auditImage(as models.AuditService, r *http.Request, action string, before, after *models.Image) {
+	img := before
+	if img == nil {
+		img = after
+	}
+	audit(as, r, models.AuditEntry{
+		Action:     action,
+		TargetType: models.AuditTargetImage,
+		TargetID:   img.ID,
+		Changes:    models.Diff(before, after),
+	})
+}
@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"myphoto/context"
+	"myphoto/models"
+	"myphoto/views"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// InviteForm is used to invite someone to a gallery.
+type InviteForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// RoleForm is used to change the role of a member.
+type RoleForm struct {
+	Role string `schema:"role"`
+}
+
+// InvitationPage is the data of the page where invitations are accepted.
+type InvitationPage struct {
+	Invitation *models.Invitation
+	Gallery    *models.Gallery
+}
+
+// Invite is used to invite someone by email to join the gallery.
+// POST /galleries/:id/members
+func (g *Galleries) Invite(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if _, ok := g.authorize(w, r, gallery, models.RoleOwner); !ok {
+		return
+	}
+	var vd views.Data
+	var form InviteForm
+	if err = parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	user := context.User(r.Context())
+	if err = g.ms.Invite(gallery, user, form.Email, form.Role); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	audit(g.as, r, models.AuditEntry{
+		Action:     models.AuditInvitationCreate,
+		TargetType: models.AuditTargetGallery,
+		TargetID:   gallery.ID,
+		Changes: models.Changes{
+			"email": {New: strings.TrimSpace(form.Email)},
+			"role":  {New: form.Role},
+		},
+	})
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Invitation sent to %s.", form.Email),
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound, alert)
+}
+
+// MemberRole is used to change the role of a member.
+// POST /galleries/:id/members/:userID/role
+func (g *Galleries) MemberRole(w http.ResponseWriter, r *http.Request) {
+	gallery, member, ok := g.member(w, r)
+	if !ok {
+		return
+	}
+	if _, ok = g.authorize(w, r, gallery, models.RoleOwner); !ok {
+		return
+	}
+	var vd views.Data
+	var form RoleForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	before := *member
+	member.Role = form.Role
+	if err := g.ms.Update(member); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	g.auditMember(r, models.AuditMemberUpdate, &before, member)
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+// MemberDelete is used to remove a member from the gallery.
+// Members may also remove themselves to leave the gallery.
+// POST /galleries/:id/members/:userID/delete
+func (g *Galleries) MemberDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, member, ok := g.member(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	leaving := member.UserID == user.ID
+	if !leaving {
+		if _, ok = g.authorize(w, r, gallery, models.RoleOwner); !ok {
+			return
+		}
+	}
+	if err := g.ms.Delete(gallery.ID, member.UserID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	g.auditMember(r, models.AuditMemberRemove, member, nil)
+	if leaving {
+		alert := views.Alert{
+			Level:   views.AlertLevelSuccess,
+			Message: fmt.Sprintf("You left %s.", gallery.Title),
+		}
+		views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+// InvitationDelete is used to revoke an invitation which was not accepted yet.
+// POST /galleries/:id/invitations/:invitationID/delete
+func (g *Galleries) InvitationDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if _, ok := g.authorize(w, r, gallery, models.RoleOwner); !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["invitationID"])
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusNotFound)
+		return
+	}
+	if err = g.ms.DeleteInvitation(gallery.ID, uint(id)); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd, gallery)
+		return
+	}
+	audit(g.as, r, models.AuditEntry{
+		Action:     models.AuditInvitationRevoke,
+		TargetType: models.AuditTargetGallery,
+		TargetID:   gallery.ID,
+		Changes:    models.Changes{"invitation_id": {Old: uint(id)}},
+	})
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+// Invitation is used to show an invitation to its recipient.
+// GET /invitations/:token
+func (g *Galleries) Invitation(w http.ResponseWriter, r *http.Request) {
+	invitation, gallery, ok := g.invitation(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	if invitation.Expired() {
+		vd.SetAlert(models.ErrInvitationExpired)
+	}
+	vd.Yield = InvitationPage{
+		Invitation: invitation,
+		Gallery:    gallery,
+	}
+	g.InvitationView.Render(w, r, vd)
+}
+
+// AcceptInvitation is used to join a gallery with the role of the invitation.
+// POST /invitations/:token
+func (g *Galleries) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	invitation, gallery, ok := g.invitation(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	member, err := g.ms.Accept(invitation.Token, user)
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		vd.Yield = InvitationPage{
+			Invitation: invitation,
+			Gallery:    gallery,
+		}
+		g.InvitationView.Render(w, r, vd)
+		return
+	}
+	audit(g.as, r, models.AuditEntry{
+		Action:     models.AuditInvitationAccept,
+		TargetType: models.AuditTargetGallery,
+		TargetID:   gallery.ID,
+		Changes: models.Changes{
+			"email":   {New: invitation.Email},
+			"user_id": {New: member.UserID},
+			"role":    {New: member.Role},
+		},
+	})
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("You joined %s as %s.", gallery.Title, invitation.Role),
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%d", gallery.ID), http.StatusFound, alert)
+}
+
+// auditMember records an action on a member as a change of their gallery,
+// with the member before and after the action, either may be nil.
+func (g *Galleries) auditMember(r *http.Request, action string, before, after *models.Member) {
+	member := before
+	if member == nil {
+		member = after
+	}
+	changes := models.Diff(before, after)
+	// The member is named also when only their role changed.
+	if _, ok := changes["user_id"]; !ok {
+		changes["user_id"] = models.Change{New: member.UserID}
+	}
+	audit(g.as, r, models.AuditEntry{
+		Action:     action,
+		TargetType: models.AuditTargetGallery,
+		TargetID:   member.GalleryID,
+		Changes:    changes,
+	})
+}
+
+// member looks up the gallery and the member from the URL.
+func (g *Galleries) member(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Member, bool) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return nil, nil, false
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return nil, nil, false
+	}
+	member, err := g.ms.ByUser(gallery.ID, uint(userID))
+	if err != nil {
+		if errors.Is(err, models.ErrResourceNotFound) {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return nil, nil, false
+		}
+		serverError(w, r, err)
+		return nil, nil, false
+	}
+	return gallery, member, true
+}
+
+// invitation looks up the invitation of the token in the URL and its gallery.
+func (g *Galleries) invitation(w http.ResponseWriter, r *http.Request) (*models.Invitation, *models.Gallery, bool) {
+	token := mux.Vars(r)["token"]
+	invitation, err := g.ms.InvitationByToken(token)
+	if err == nil {
+		// Only the hash of the token is stored.
+		invitation.Token = token
+		var gallery *models.Gallery
+		if gallery, err = g.gs.WithContext(r.Context()).ByID(invitation.GalleryID); err == nil {
+			return invitation, gallery, true
+		}
+	}
+	if errors.Is(err, models.ErrResourceNotFound) {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	serverError(w, r, err)
+	return nil, nil, false
+}
@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"errors"
+	"myphoto/models"
+	"myphoto/views"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// explorePageSize is the number of galleries per page of the explore page.
+	explorePageSize = 24
+)
+
+// NewProfiles creates a new Profiles controller.
+// This function will panic if templates are not correct,
+// and should be used only during initial mux setup.
+func NewProfiles(us models.UserService, gs models.GalleryService, is models.ImageService) *Profiles {
+	return &Profiles{
+		ShowView:    views.NewView("index", "profiles/show"),
+		ExploreView: views.NewView("index", "profiles/explore"),
+		us:          us,
+		gs:          gs,
+		is:          is,
+	}
+}
+
+type Profiles struct {
+	ShowView    *views.View
+	ExploreView *views.View
+	us          models.UserService
+	gs          models.GalleryService
+	is          models.ImageService
+}
+
+// Profile is the data of a public profile page.
+type Profile struct {
+	User      *models.User
+	Galleries []models.Gallery
+}
+
+// ExploreGallery is a gallery listed on the explore page, together with its owner.
+type ExploreGallery struct {
+	models.Gallery
+	Owner *models.User
+}
+
+// Explore is the data of a page of the explore page.
+type Explore struct {
+	Galleries []ExploreGallery
+	Page      int
+	PrevPage  int
+	NextPage  int
+}
+
+// Show is used to show the public profile of a user.
+// GET /u/:handle
+func (p *Profiles) Show(w http.ResponseWriter, r *http.Request) {
+	user, err := p.us.WithContext(r.Context()).ByHandle(mux.Vars(r)["handle"])
+	if err != nil {
+		if errors.Is(err, models.ErrResourceNotFound) {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err)
+		return
+	}
+	galleries, err := p.gs.WithContext(r.Context()).PublicByUserID(user.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err = p.is.WithContext(r.Context()).SetCovers(galleries); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var vd views.Data
+	vd.Yield = Profile{
+		User:      user,
+		Galleries: galleries,
+	}
+	p.ShowView.Render(w, r, vd)
+}
+
+// Explore is used to list the most recent public galleries of all users.
+// GET /explore?page=:page
+func (p *Profiles) Explore(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	// One more gallery than shown tells whether there is a next page.
+	galleries, err := p.gs.WithContext(r.Context()).RecentPublic(explorePageSize+1, (page-1)*explorePageSize)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	explore := Explore{
+		Page:     page,
+		PrevPage: page - 1,
+	}
+	if len(galleries) > explorePageSize {
+		galleries = galleries[:explorePageSize]
+		explore.NextPage = page + 1
+	}
+	if err = p.is.WithContext(r.Context()).SetCovers(galleries); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	owners := make(map[uint]*models.User)
+	for _, gallery := range galleries {
+		owner, ok := owners[gallery.UserID]
+		if !ok {
+			owner, err = p.us.WithContext(r.Context()).ByID(gallery.UserID)
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			owners[gallery.UserID] = owner
+		}
+		explore.Galleries = append(explore.Galleries, ExploreGallery{
+			Gallery: gallery,
+			Owner:   owner,
+		})
+	}
+
+	var vd views.Data
+	vd.Yield = explore
+	p.ExploreView.Render(w, r, vd)
+}
@@ -0,0 +1,410 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"mime"
+	"myphoto/context"
+	"myphoto/models"
+	"myphoto/views"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// prooferCookie keeps the token of an anonymous proofer,
+	// it is scoped to the share link of the gallery.
+	prooferCookie = "proofer"
+	// prooferCookieAge is how long anonymous proofers are recognised.
+	prooferCookieAge = 365 * 24 * time.Hour
+)
+
+// NewProofing creates a new Proofing controller.
+// This function will panic if templates are not correct,
+// and should be used only during initial mux setup.
+func NewProofing(gs models.GalleryService, is models.ImageService, ps models.ProofingService,
+	ms models.MemberService, ws models.WebhookService) *Proofing {
+	return &Proofing{
+		ShowView:   views.NewView("index", "proofing/show"),
+		ReviewView: views.NewView("index", "proofing/review"),
+		gs:         gs,
+		is:         is,
+		ps:         ps,
+		ms:         ms,
+		ws:         ws,
+	}
+}
+
+type Proofing struct {
+	ShowView   *views.View
+	ReviewView *views.View
+	gs         models.GalleryService
+	is         models.ImageService
+	ps         models.ProofingService
+	ms         models.MemberService
+	ws         models.WebhookService
+}
+
+// PickForm is used to toggle a favourite or a selection.
+type PickForm struct {
+	// Kind is either "favourite" or "selected".
+	Kind string `schema:"kind"`
+}
+
+type CommentForm struct {
+	Body string `schema:"body"`
+}
+
+type SubmitSelectionForm struct {
+	Name string `schema:"name"`
+}
+
+// ProofImage is an image of a proofing gallery, with the
+// picks and comments of the proofer viewing it.
+type ProofImage struct {
+	models.Image
+	Favourite bool
+	Selected  bool
+	Comments  []models.Comment
+}
+
+// ProofPage is the data of the proofing page of a gallery.
+type ProofPage struct {
+	Gallery *models.Gallery
+	// Proofer is nil until an anonymous visitor picks or comments on an image.
+	Proofer  *models.Proofer
+	Images   []ProofImage
+	Selected int
+}
+
+// Remaining returns how many more images can be selected,
+// or -1 if the gallery has no selection limit.
+func (pp *ProofPage) Remaining() int {
+	if pp.Gallery.SelectionLimit == 0 {
+		return -1
+	}
+	return pp.Gallery.SelectionLimit - pp.Selected
+}
+
+// Locked reports whether the proofer submitted their selection, so it can no longer be changed.
+func (pp *ProofPage) Locked() bool {
+	return pp.Proofer != nil && pp.Proofer.Submitted()
+}
+
+// ProofReview is the data of the page where owners review the picks of proofers.
+type ProofReview struct {
+	Gallery    *models.Gallery
+	Proofers   []models.Proofer
+	Selections []models.Selection
+	Comments   []models.Comment
+}
+
+// Show is used to show a proofing gallery to the holders of its share link.
+// GET /proof/:token
+func (p *Proofing) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, err := p.galleryByToken(w, r)
+	if err != nil {
+		return
+	}
+	var proofer *models.Proofer
+	// Anonymous visitors only become proofers once they pick or comment.
+	if context.User(r.Context()) != nil || p.prooferToken(r) != "" {
+		proofer, err = p.proofer(w, r, gallery)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	p.render(w, r, gallery, proofer, nil)
+}
+
+// Pick is used to mark an image as favourite or selected, or to undo it.
+// POST /proof/:token/images/:imageID/pick
+func (p *Proofing) Pick(w http.ResponseWriter, r *http.Request) {
+	gallery, proofer, imageID, ok := p.prepare(w, r)
+	if !ok {
+		return
+	}
+	var form PickForm
+	if err := parseForm(r, &form); err != nil {
+		p.render(w, r, gallery, proofer, err)
+		return
+	}
+	if err := p.ps.Toggle(gallery, proofer, imageID, form.Kind); err != nil {
+		p.render(w, r, gallery, proofer, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s#image-%d", gallery.ProofingPath(), imageID), http.StatusFound)
+}
+
+// Comment is used to comment on an image.
+// POST /proof/:token/images/:imageID/comments
+func (p *Proofing) Comment(w http.ResponseWriter, r *http.Request) {
+	gallery, proofer, imageID, ok := p.prepare(w, r)
+	if !ok {
+		return
+	}
+	var form CommentForm
+	if err := parseForm(r, &form); err != nil {
+		p.render(w, r, gallery, proofer, err)
+		return
+	}
+	if err := p.ps.Comment(gallery, proofer, imageID, form.Body); err != nil {
+		p.render(w, r, gallery, proofer, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s#image-%d", gallery.ProofingPath(), imageID), http.StatusFound)
+}
+
+// ImageFile is used to serve the file of an image to the holders of the share link.
+// GET /proof/:token/images/:imageID/file
+func (p *Proofing) ImageFile(w http.ResponseWriter, r *http.Request) {
+	gallery, err := p.galleryByToken(w, r)
+	if err != nil {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["imageID"])
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return
+	}
+	img, err := p.is.WithContext(r.Context()).ByID(uint(id))
+	if err != nil || img.GalleryID != gallery.ID {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, img.RelativePath())
+}
+
+// Submit is used to submit the selection, which locks it and notifies the owner.
+// POST /proof/:token/submit
+func (p *Proofing) Submit(w http.ResponseWriter, r *http.Request) {
+	gallery, err := p.galleryByToken(w, r)
+	if err != nil {
+		return
+	}
+	proofer, err := p.proofer(w, r, gallery)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var form SubmitSelectionForm
+	if err = parseForm(r, &form); err != nil {
+		p.render(w, r, gallery, proofer, err)
+		return
+	}
+	if err = p.ps.Submit(gallery, proofer, form.Name); err != nil {
+		p.render(w, r, gallery, proofer, err)
+		return
+	}
+	selections, err := p.ps.Selections(gallery.ID)
+	if err == nil {
+		err = p.ws.SelectionEvent(gallery, proofer, selections)
+	}
+	if err != nil {
+		logError(r, err)
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Thank you! Your selection was sent to the photographer.",
+	}
+	views.RedirectAlert(w, r, gallery.ProofingPath(), http.StatusFound, alert)
+}
+
+// Review is used to show the owner of a gallery what proofers picked and commented.
+// GET /galleries/:id/proofing
+func (p *Proofing) Review(w http.ResponseWriter, r *http.Request) {
+	gallery, err := p.ownGallery(w, r)
+	if err != nil {
+		return
+	}
+	review := ProofReview{Gallery: gallery}
+	if review.Proofers, err = p.ps.ProofersByGalleryID(gallery.ID); err == nil {
+		if review.Selections, err = p.ps.Selections(gallery.ID); err == nil {
+			review.Comments, err = p.ps.Comments(gallery.ID)
+		}
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var vd views.Data
+	vd.Yield = review
+	p.ReviewView.Render(w, r, vd)
+}
+
+// Export is used to download the selected images of all proofers as CSV.
+// GET /galleries/:id/proofing/selections.csv
+func (p *Proofing) Export(w http.ResponseWriter, r *http.Request) {
+	gallery, err := p.ownGallery(w, r)
+	if err != nil {
+		return
+	}
+	selections, err := p.ps.Selections(gallery.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	filename := fmt.Sprintf("gallery-%d-selections.csv", gallery.ID)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	cw := csv.NewWriter(w)
+	records := [][]string{{"filename", "proofer", "favourite", "submitted_at"}}
+	for _, s := range selections {
+		submittedAt := ""
+		if s.SubmittedAt != nil {
+			submittedAt = s.SubmittedAt.Format(time.RFC3339)
+		}
+		records = append(records, []string{
+			s.Filename, s.DisplayName(), strconv.FormatBool(s.Favourite), submittedAt,
+		})
+	}
+	if err = cw.WriteAll(records); err != nil {
+		logError(r, err)
+	}
+}
+
+// render shows the proofing page, with err as an alert if it is not nil.
+func (p *Proofing) render(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, proofer *models.Proofer, err error) {
+	var vd views.Data
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	page, pageErr := p.page(gallery, proofer)
+	if pageErr != nil {
+		serverError(w, r, pageErr)
+		return
+	}
+	vd.Yield = page
+	p.ShowView.Render(w, r, vd)
+}
+
+// page collects the images of the gallery with the picks of the proofer.
+// Proofers see their own comments and those of the owner, but not the
+// comments of other clients.
+func (p *Proofing) page(gallery *models.Gallery, proofer *models.Proofer) (*ProofPage, error) {
+	images, err := p.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		return nil, err
+	}
+	page := ProofPage{Gallery: gallery}
+	picks := map[uint]models.Pick{}
+	comments := map[uint][]models.Comment{}
+	if proofer != nil {
+		page.Proofer = proofer
+		if picks, err = p.ps.Picks(proofer.ID); err != nil {
+			return nil, err
+		}
+		all, err := p.ps.Comments(gallery.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range all {
+			byOwner := c.Proofer != nil && c.Proofer.UserID != nil && *c.Proofer.UserID == gallery.UserID
+			if c.ProoferID == proofer.ID || byOwner {
+				comments[c.ImageID] = append(comments[c.ImageID], c)
+			}
+		}
+	}
+	for _, img := range images {
+		pick := picks[img.ID]
+		if pick.Selected {
+			page.Selected++
+		}
+		page.Images = append(page.Images, ProofImage{
+			Image:     img,
+			Favourite: pick.Favourite,
+			Selected:  pick.Selected,
+			Comments:  comments[img.ID],
+		})
+	}
+	return &page, nil
+}
+
+// prepare finds the gallery, proofer and image of a pick or comment.
+func (p *Proofing) prepare(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Proofer, uint, bool) {
+	gallery, err := p.galleryByToken(w, r)
+	if err != nil {
+		return nil, nil, 0, false
+	}
+	imageID, err := strconv.Atoi(mux.Vars(r)["imageID"])
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return nil, nil, 0, false
+	}
+	proofer, err := p.proofer(w, r, gallery)
+	if err != nil {
+		serverError(w, r, err)
+		return nil, nil, 0, false
+	}
+	return gallery, proofer, uint(imageID), true
+}
+
+// proofer returns the proofer of the signed in user, or of the anonymous visitor.
+// New anonymous proofers are remembered with a cookie.
+func (p *Proofing) proofer(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Proofer, error) {
+	user := context.User(r.Context())
+	proofer, err := p.ps.Proofer(gallery, user, p.prooferToken(r))
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     prooferCookie,
+			Value:    proofer.Token,
+			Path:     gallery.ProofingPath(),
+			Expires:  time.Now().Add(prooferCookieAge),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return proofer, nil
+}
+
+func (p *Proofing) prooferToken(r *http.Request) string {
+	cookie, err := r.Cookie(prooferCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func (p *Proofing) galleryByToken(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	gallery, err := p.gs.WithContext(r.Context()).ByShareToken(mux.Vars(r)["token"])
+	if err != nil {
+		if errors.Is(err, models.ErrResourceNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return nil, err
+		}
+		serverError(w, r, err)
+		return nil, err
+	}
+	return gallery, nil
+}
+
+// ownGallery returns the gallery of the request if the signed in user may edit it.
+func (p *Proofing) ownGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return nil, err
+	}
+	gallery, err := p.gs.WithContext(r.Context()).ByID(uint(id))
+	if err != nil {
+		if errors.Is(err, models.ErrResourceNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return nil, err
+		}
+		serverError(w, r, err)
+		return nil, err
+	}
+	if _, ok := authorize(w, r, p.ms, gallery, models.RoleEditor); !ok {
+		return nil, models.ErrResourceNotFound
+	}
+	return gallery, nil
+}
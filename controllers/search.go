@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"fmt"
+	"myphoto/context"
+	"myphoto/models"
+	"myphoto/views"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// searchPageSize is the number of results per page of the search page.
+	searchPageSize = 20
+)
+
+// NewSearch creates a new Search controller.
+// This function will panic if templates are not correct,
+// and should be used only during initial mux setup.
+func NewSearch(ss models.SearchService) *Search {
+	return &Search{
+		IndexView: views.NewView("index", "search/index"),
+		ss:        ss,
+	}
+}
+
+type Search struct {
+	IndexView *views.View
+	ss        models.SearchService
+}
+
+// SearchPage is the data of the search page.
+type SearchPage struct {
+	Query    string
+	Results  []models.SearchResult
+	Page     int
+	PrevPage int
+	NextPage int
+}
+
+// SearchResultJSON is a search result as returned by the API.
+type SearchResultJSON struct {
+	Kind      string  `json:"kind"`
+	GalleryID uint    `json:"gallery_id"`
+	ImageID   uint    `json:"image_id,omitempty"`
+	Title     string  `json:"title"`
+	URL       string  `json:"url"`
+	ImageURL  string  `json:"image_url,omitempty"`
+	Highlight string  `json:"highlight"`
+	Rank      float64 `json:"rank"`
+}
+
+// SearchJSON is the response of the search API.
+type SearchJSON struct {
+	Query    string             `json:"query"`
+	Page     int                `json:"page"`
+	NextPage int                `json:"next_page,omitempty"`
+	Results  []SearchResultJSON `json:"results"`
+}
+
+// Index is used to search the galleries and images the user may see.
+// GET /search?q=:query&page=:page
+func (s *Search) Index(w http.ResponseWriter, r *http.Request) {
+	page, err := s.search(r)
+	var vd views.Data
+	vd.Yield = page
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	s.IndexView.Render(w, r, vd)
+}
+
+// API is used to search the galleries and images the user may see.
+// GET /api/search?q=:query&page=:page
+func (s *Search) API(w http.ResponseWriter, r *http.Request) {
+	page, err := s.search(r)
+	if err != nil {
+		serverErrorJSON(w, r, err)
+		return
+	}
+	res := SearchJSON{
+		Query:    page.Query,
+		Page:     page.Page,
+		NextPage: page.NextPage,
+		Results:  make([]SearchResultJSON, 0, len(page.Results)),
+	}
+	for _, result := range page.Results {
+		url := fmt.Sprintf("/galleries/%v", result.GalleryID)
+		if result.IsImage() {
+			url = fmt.Sprintf("/galleries/%v/images/%v", result.GalleryID, result.ImageID)
+		}
+		res.Results = append(res.Results, SearchResultJSON{
+			Kind:      result.Kind,
+			GalleryID: result.GalleryID,
+			ImageID:   result.ImageID,
+			Title:     result.Title,
+			URL:       url,
+			ImageURL:  result.ImagePath(),
+			Highlight: string(views.Highlight(result.Headline)),
+			Rank:      result.Rank,
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// search runs the query of the request for the signed-in user,
+// or only over public galleries for visitors.
+func (s *Search) search(r *http.Request) (SearchPage, error) {
+	query := r.URL.Query()
+	page := SearchPage{
+		Query: query.Get("q"),
+	}
+	page.Page, _ = strconv.Atoi(query.Get("page"))
+	if page.Page < 1 {
+		page.Page = 1
+	}
+	page.PrevPage = page.Page - 1
+
+	var viewerID uint
+	if user := context.User(r.Context()); user != nil {
+		viewerID = user.ID
+	}
+	// One more result than shown tells whether there is a next page.
+	results, err := s.ss.Search(viewerID, page.Query, searchPageSize+1, (page.Page-1)*searchPageSize)
+	if err != nil {
+		return page, err
+	}
+	if len(results) > searchPageSize {
+		results = results[:searchPageSize]
+		page.NextPage = page.Page + 1
+	}
+	page.Results = results
+	return page, nil
+}
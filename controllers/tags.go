@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"errors"
+	"myphoto/context"
+	"myphoto/models"
+	"myphoto/views"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// NewTags creates a new Tags controller.
+// This function will panic if templates are not correct,
+// and should be used only during initial mux setup.
+func NewTags(ts models.TagService) *Tags {
+	return &Tags{
+		IndexView: views.NewView("index", "tags/index"),
+		ShowView:  views.NewView("index", "tags/show"),
+		ts:        ts,
+	}
+}
+
+type Tags struct {
+	IndexView *views.View
+	ShowView  *views.View
+	ts        models.TagService
+}
+
+// TagPage is the data of the page listing everything with a tag.
+type TagPage struct {
+	Tag       *models.Tag
+	Galleries []models.Gallery
+	Images    []models.Image
+}
+
+// TagJSON is a tag as returned by the API.
+type TagJSON struct {
+	Name string `json:"name"`
+}
+
+// Index is used to list the tags of the user.
+// GET /tags
+func (t *Tags) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	tags, err := t.ts.ByUserID(user.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var vd views.Data
+	vd.Yield = tags
+	t.IndexView.Render(w, r, vd)
+}
+
+// Show is used to list the galleries and images of the user with a tag.
+// GET /tags/:name
+func (t *Tags) Show(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	tag, err := t.ts.ByName(user.ID, mux.Vars(r)["name"])
+	if err != nil {
+		if errors.Is(err, models.ErrResourceNotFound) {
+			http.Error(w, "Tag not found", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err)
+		return
+	}
+	galleries, err := t.ts.Galleries(tag.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	images, err := t.ts.Images(tag.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var vd views.Data
+	vd.Yield = TagPage{
+		Tag:       tag,
+		Galleries: galleries,
+		Images:    images,
+	}
+	t.ShowView.Render(w, r, vd)
+}
+
+// Autocomplete is used to suggest tags of the user starting with the query.
+// GET /api/tags?q=:prefix
+func (t *Tags) Autocomplete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	tags, err := t.ts.Autocomplete(user.ID, r.URL.Query().Get("q"), 0)
+	if err != nil {
+		serverErrorJSON(w, r, err)
+		return
+	}
+	res := make([]TagJSON, 0, len(tags))
+	for _, tag := range tags {
+		res = append(res, TagJSON{Name: tag.Name})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"errors"
+	"myphoto/context"
+	"myphoto/models"
+	"myphoto/views"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// NewTrash creates a new Trash controller.
+// This function will panic if templates are not correct,
+// and should be used only during initial mux setup.
+func NewTrash(ts models.TrashService, as models.AuditService) *Trash {
+	return &Trash{
+		IndexView: views.NewView("index", "trash/index"),
+		ts:        ts,
+		as:        as,
+	}
+}
+
+type Trash struct {
+	IndexView *views.View
+	ts        models.TrashService
+	as        models.AuditService
+}
+
+// Index is used to list deleted galleries and images.
+// GET /trash
+func (t *Trash) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	trash, err := t.ts.ByUserID(user.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var vd views.Data
+	vd.Yield = trash
+	t.IndexView.Render(w, r, vd)
+}
+
+// RestoreGallery is used to restore a deleted gallery.
+// POST /trash/galleries/:id/restore
+func (t *Trash) RestoreGallery(w http.ResponseWriter, r *http.Request) {
+	t.restore(w, r, t.ts.RestoreGallery, models.AuditGalleryRestore, models.AuditTargetGallery, "Gallery restored.")
+}
+
+// RestoreImage is used to restore a deleted image.
+// POST /trash/images/:id/restore
+func (t *Trash) RestoreImage(w http.ResponseWriter, r *http.Request) {
+	t.restore(w, r, t.ts.RestoreImage, models.AuditImageRestore, models.AuditTargetImage, "Image restored.")
+}
+
+func (t *Trash) restore(w http.ResponseWriter, r *http.Request, fn func(userID, id uint) error,
+	action, target, msg string) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	err = fn(user.ID, uint(id))
+	if err != nil {
+		if errors.Is(err, models.ErrResourceNotFound) {
+			http.Error(w, "Not found in trash", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err)
+		return
+	}
+	audit(t.as, r, models.AuditEntry{
+		Action:     action,
+		TargetType: target,
+		TargetID:   uint(id),
+	})
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: msg,
+	}
+	views.RedirectAlert(w, r, "/trash", http.StatusFound, alert)
+}
@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"myphoto/context"
+	"myphoto/metrics"
+	"myphoto/models"
+	"myphoto/views"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// ShowUpload route name.
+	ShowUpload = "show_upload"
+
+	// maxChunkSize limits the body of a single PATCH request.
+	maxChunkSize = 16 << 20 // 16 megabytes
+
+	tusVersion         = "1.0.0"
+	tusExtensions      = "creation,checksum,expiration,termination"
+	tusChecksums       = "sha256"
+	offsetContentType  = "application/offset+octet-stream"
+	statusChecksumFail = 460 // As defined by the tus checksum extension.
+)
+
+// NewUploads creates a new Uploads controller implementing the core of the
+// tus resumable upload protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, checksum, expiration and termination extensions.
+func NewUploads(gs models.GalleryService, is models.ImageService, us models.UploadService,
+	ms models.MemberService, as models.AuditService, ws models.WebhookService, r *mux.Router) *Uploads {
+	return &Uploads{
+		gs: gs,
+		is: is,
+		us: us,
+		ms: ms,
+		as: as,
+		ws: ws,
+		r:  r,
+	}
+}
+
+type Uploads struct {
+	gs models.GalleryService
+	is models.ImageService
+	us models.UploadService
+	ms models.MemberService
+	as models.AuditService
+	ws models.WebhookService
+	r  *mux.Router
+}
+
+// Options is used to describe the supported protocol.
+// OPTIONS /galleries/:id/uploads
+func (u *Uploads) Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksums)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(models.MaxUploadSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create is used to start a new upload to a gallery.
+// The total size is sent in the Upload-Length header and the
+// filename, with an optional checksum of the whole file, in Upload-Metadata.
+// POST /galleries/:id/uploads
+func (u *Uploads) Create(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := u.ownGallery(w, r)
+	if !ok {
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		u.error(w, r, models.ErrUploadSizeRequired)
+		return
+	}
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	upload := models.Upload{
+		UserID:    context.User(r.Context()).ID,
+		GalleryID: gallery.ID,
+		Filename:  meta["filename"],
+		Size:      size,
+		Checksum:  meta["checksum"],
+	}
+	if err = u.us.Create(&upload); err != nil {
+		u.error(w, r, err)
+		return
+	}
+	url, err := u.r.Get(ShowUpload).URL("id", fmt.Sprintf("%v", gallery.ID), "token", upload.Token)
+	if err != nil {
+		u.error(w, r, err)
+		return
+	}
+	w.Header().Set("Location", url.Path)
+	u.writeUploadHeaders(w, &upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Show is used to find out how much of an upload was already received.
+// HEAD /galleries/:id/uploads/:token
+func (u *Uploads) Show(w http.ResponseWriter, r *http.Request) {
+	_, upload, ok := u.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	u.writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Update is used to receive the next chunk of an upload. Once the last
+// chunk arrives, the file is verified and added to the gallery.
+// PATCH /galleries/:id/uploads/:token
+func (u *Uploads) Update(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != offsetContentType {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		http.Error(w, "Content-Type must be "+offsetContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	gallery, upload, ok := u.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		u.error(w, r, models.ErrUploadOffset)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxChunkSize)
+	err = u.us.WriteChunk(upload, offset, body, r.Header.Get("Upload-Checksum"))
+	if err != nil {
+		u.error(w, r, err)
+		return
+	}
+	if upload.Complete() {
+		img, err := u.us.Finish(upload)
+		if err != nil {
+			u.error(w, r, err)
+			return
+		}
+		metrics.Upload(metrics.UploadResumable, img.Size)
+		auditImage(u.as, r, models.AuditImageUpload, nil, img)
+		if err = u.ws.ImageEvent(models.EventImageUploaded, gallery, img); err != nil {
+			logError(r, err)
+		}
+		// The alert is shown when the client reloads the page after its uploads.
+		if warning := duplicateWarning(r, u.gs, u.is, gallery.UserID, img); warning != "" {
+			views.PersistAlert(w, views.Alert{Level: views.AlertLevelWarning, Message: warning})
+		}
+	}
+	u.writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete is used to abort an upload and discard everything received so far.
+// DELETE /galleries/:id/uploads/:token
+func (u *Uploads) Delete(w http.ResponseWriter, r *http.Request) {
+	_, upload, ok := u.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	if err := u.us.Abort(upload); err != nil {
+		u.error(w, r, err)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (u *Uploads) writeUploadHeaders(w http.ResponseWriter, upload *models.Upload) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// ownGallery looks up the gallery from the URL and makes sure
+// the signed-in user may upload to it.
+func (u *Uploads) ownGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return nil, false
+	}
+	gallery, err := u.gs.WithContext(r.Context()).ByID(uint(id))
+	if err != nil {
+		u.error(w, r, err)
+		return nil, false
+	}
+	if _, ok := authorize(w, r, u.ms, gallery, models.RoleContributor); !ok {
+		return nil, false
+	}
+	return gallery, true
+}
+
+// ownUpload looks up the gallery and the upload from the URL and makes sure
+// the upload belongs to both the gallery and the signed-in user.
+func (u *Uploads) ownUpload(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Upload, bool) {
+	gallery, ok := u.ownGallery(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	upload, err := u.us.ByToken(mux.Vars(r)["token"])
+	if err != nil {
+		u.error(w, r, err)
+		return nil, nil, false
+	}
+	user := context.User(r.Context())
+	if upload.GalleryID != gallery.ID || upload.UserID != user.ID {
+		u.error(w, r, models.ErrResourceNotFound)
+		return nil, nil, false
+	}
+	return gallery, upload, true
+}
+
+// error maps upload errors to the status codes expected by tus clients.
+func (u *Uploads) error(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, models.ErrResourceNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, models.ErrUploadOffset):
+		http.Error(w, "Upload offset does not match", http.StatusConflict)
+	case errors.Is(err, models.ErrUploadExpired):
+		http.Error(w, "Upload has expired", http.StatusGone)
+	case errors.Is(err, models.ErrUploadTooLarge), errors.As(err, &maxBytesErr):
+		http.Error(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, models.ErrQuotaExceeded):
+		http.Error(w, models.ErrQuotaExceeded.Public(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, models.ErrChecksumMismatch):
+		http.Error(w, "Checksum does not match", statusChecksumFail)
+	default:
+		var publicError views.PublicError
+		if errors.As(err, &publicError) {
+			http.Error(w, publicError.Public(), http.StatusBadRequest)
+			return
+		}
+		serverError(w, r, err)
+	}
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header, a comma separated
+// list of keys, each followed by a space and its base64 encoded value.
+func parseUploadMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		split := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if split[0] == "" {
+			continue
+		}
+		if len(split) == 1 {
+			meta[split[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(split[1])
+		if err != nil {
+			continue
+		}
+		meta[split[0]] = string(value)
+	}
+	return meta
+}
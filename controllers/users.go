@@ -2,28 +2,44 @@ package controllers
 
 import (
 	"errors"
+	"fmt"
 	"myphoto/context"
+	"myphoto/metrics"
 	"myphoto/models"
 	"myphoto/rand"
 	"myphoto/views"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// securityEventsLimit is the number of events shown on the security page.
+	securityEventsLimit = 50
 )
 
 type Users struct {
-	NewView   *views.View
-	LoginView *views.View
-	us        models.UserService
+	NewView      *views.View
+	LoginView    *views.View
+	AccountView  *views.View
+	SecurityView *views.View
+	us           models.UserService
+	as           models.AuditService
 }
 
 // NewUsers creates a new Users Controller.
 // This function will panic if templates are not correct,
 // and should be used only during initial mux setup.
-func NewUsers(us models.UserService) *Users {
+func NewUsers(us models.UserService, as models.AuditService) *Users {
 	return &Users{
-		NewView:   views.NewView("index", "users/new"),
-		LoginView: views.NewView("index", "users/login"),
-		us:        us,
+		NewView:      views.NewView("index", "users/new"),
+		LoginView:    views.NewView("index", "users/login"),
+		AccountView:  views.NewView("index", "users/account"),
+		SecurityView: views.NewView("index", "users/security"),
+		us:           us,
+		as:           as,
 	}
 }
 
@@ -55,11 +71,18 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := toUserModel(form)
-	if err := u.us.Create(&user); err != nil {
+	if err := u.us.WithContext(r.Context()).Create(&user); err != nil {
 		vd.SetAlert(err)
 		u.NewView.Render(w, r, vd)
 		return
 	}
+	audit(u.as, r, models.AuditEntry{
+		ActorID:    &user.ID,
+		Action:     models.AuditUserCreate,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID,
+		Changes:    models.Diff(nil, &user),
+	})
 	if err := u.signIn(w, &user); err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
@@ -96,10 +119,12 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := u.us.Authenticate(form.Email, form.Password)
+	user, err := u.us.WithContext(r.Context()).Authenticate(form.Email, form.Password)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrResourceNotFound), errors.Is(err, models.ErrInvalidPassword):
+			u.auditFailedLogin(r, form.Email)
+			metrics.LoginFailures.Inc()
 			vd.AlertError("Invalid email address or password")
 		default:
 			vd.SetAlert(err)
@@ -113,9 +138,29 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		u.LoginView.Render(w, r, vd)
 		return
 	}
+	audit(u.as, r, models.AuditEntry{
+		ActorID:    &user.ID,
+		Action:     models.AuditUserLogin,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID,
+	})
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+// auditFailedLogin records a failed login, on the account
+// of the email address if there is one.
+func (u *Users) auditFailedLogin(r *http.Request, address string) {
+	entry := models.AuditEntry{
+		Action:     models.AuditUserLoginFailed,
+		TargetType: models.AuditTargetUser,
+		Changes:    models.Changes{"email": {New: address}},
+	}
+	if user, err := u.us.WithContext(r.Context()).ByEmail(address); err == nil {
+		entry.TargetID = user.ID
+	}
+	audit(u.as, r, entry)
+}
+
 // signIn is used to sign the user in by creating a cookie.
 func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
 	if user.Remember == "" {
@@ -155,6 +200,124 @@ func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
 	token, _ := rand.RememberToken()
 	user.Remember = token
-	_ = u.us.Update(user)
+	_ = u.us.WithContext(r.Context()).Update(user)
+	audit(u.as, r, models.AuditEntry{
+		Action:     models.AuditUserLogout,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID,
+	})
 	http.Redirect(w, r, "/", http.StatusFound)
 }
+
+type AccountForm struct {
+	Name   string `schema:"name"`
+	Handle string `schema:"handle"`
+	Bio    string `schema:"bio"`
+}
+
+// Account is used to render the form where a user can
+// edit their public profile.
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = context.User(r.Context())
+	u.AccountView.Render(w, r, vd)
+}
+
+// Avatar is used to serve the current avatar of a user, which is public
+// like their profile. Replaced avatars are not served anymore.
+// GET /images/avatars/:id/:filename
+func (u *Users) Avatar(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return
+	}
+	user, err := u.us.WithContext(r.Context()).ByID(uint(id))
+	if err != nil || user.Avatar == "" || user.Avatar != vars["filename"] {
+		http.Error(w, "Avatar not found", http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, fmt.Sprintf("images/avatars/%v/%v", user.ID, user.Avatar))
+}
+
+// UpdateAccount is used to process the account form.
+// POST /account
+func (u *Users) UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = user
+	if err := r.ParseMultipartForm(maxMultipartMemory); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	var form AccountForm
+	if err := parseValues(r.PostForm, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	before := *user
+	user.Name = form.Name
+	user.Handle = form.Handle
+	user.Bio = form.Bio
+	if err := u.us.WithContext(r.Context()).Update(user); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	u.auditUpdate(r, &before, user)
+
+	if files := r.MultipartForm.File["avatar"]; len(files) > 0 {
+		file, err := files[0].Open()
+		if err != nil {
+			vd.SetAlert(err)
+			u.AccountView.Render(w, r, vd)
+			return
+		}
+		defer file.Close()
+		before = *user
+		if err = u.us.WithContext(r.Context()).SetAvatar(user, file, files[0].Filename); err != nil {
+			vd.SetAlert(err)
+			u.AccountView.Render(w, r, vd)
+			return
+		}
+		u.auditUpdate(r, &before, user)
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Account successfully updated!",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// auditUpdate records the changes of an account, if there are any.
+func (u *Users) auditUpdate(r *http.Request, before, after *models.User) {
+	changes := models.Diff(before, after)
+	if len(changes) == 0 {
+		return
+	}
+	audit(u.as, r, models.AuditEntry{
+		Action:     models.AuditUserUpdate,
+		TargetType: models.AuditTargetUser,
+		TargetID:   after.ID,
+		Changes:    changes,
+	})
+}
+
+// Security is used to show the recent logins and changes of the account.
+// GET /account/security
+func (u *Users) Security(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	events, err := u.as.SecurityEvents(user.ID, securityEventsLimit)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	var vd views.Data
+	vd.Yield = events
+	u.SecurityView.Render(w, r, vd)
+}
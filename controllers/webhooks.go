@@ -0,0 +1,286 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"myphoto/context"
+	"myphoto/models"
+	"myphoto/views"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// deliveriesLimit is the number of deliveries shown on the page of a webhook.
+	deliveriesLimit = 50
+)
+
+// NewWebhooks creates a new Webhooks controller.
+// This function will panic if templates are not correct,
+// and should be used only during initial mux setup.
+func NewWebhooks(ws models.WebhookService, as models.AuditService) *Webhooks {
+	return &Webhooks{
+		IndexView: views.NewView("index", "webhooks/index"),
+		ShowView:  views.NewView("index", "webhooks/show"),
+		ws:        ws,
+		as:        as,
+	}
+}
+
+type Webhooks struct {
+	IndexView *views.View
+	ShowView  *views.View
+	ws        models.WebhookService
+	as        models.AuditService
+}
+
+// WebhookForm is used to create and change webhooks.
+type WebhookForm struct {
+	URL    string   `schema:"url"`
+	Events []string `schema:"events"`
+	Active bool     `schema:"active"`
+}
+
+// Subscribes reports whether the event is checked in the form.
+func (f WebhookForm) Subscribes(event string) bool {
+	for _, e := range f.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhooksIndex is the data of the webhooks page.
+type WebhooksIndex struct {
+	Webhooks []models.Webhook
+	Form     WebhookForm
+	Events   []string
+}
+
+// WebhookPage is the data of the page of a single webhook.
+type WebhookPage struct {
+	Webhook    *models.Webhook
+	Form       WebhookForm
+	Deliveries []models.Delivery
+	Events     []string
+	// SignatureHeader and TimestampHeader are the names of
+	// the headers receivers check the signature with.
+	SignatureHeader string
+	TimestampHeader string
+}
+
+// Index is used to list the webhooks of the user.
+// GET /account/webhooks
+func (wh *Webhooks) Index(w http.ResponseWriter, r *http.Request) {
+	index := WebhooksIndex{
+		Form:   WebhookForm{Events: models.WebhookEvents, Active: true},
+		Events: models.WebhookEvents,
+	}
+	wh.renderIndex(w, r, views.Data{}, index)
+}
+
+// Create is used to add a webhook.
+// POST /account/webhooks
+func (wh *Webhooks) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	index := WebhooksIndex{Events: models.WebhookEvents}
+	if err := parseForm(r, &index.Form); err != nil {
+		vd.SetAlert(err)
+		wh.renderIndex(w, r, vd, index)
+		return
+	}
+	user := context.User(r.Context())
+	webhook := models.Webhook{
+		UserID: user.ID,
+		URL:    index.Form.URL,
+		Events: strings.Join(index.Form.Events, ","),
+		Active: index.Form.Active,
+	}
+	if err := wh.ws.Create(&webhook); err != nil {
+		vd.SetAlert(err)
+		wh.renderIndex(w, r, vd, index)
+		return
+	}
+	wh.audit(r, models.AuditWebhookCreate, nil, &webhook)
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Webhook created. Use its secret to check the signatures of deliveries.",
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/account/webhooks/%d", webhook.ID), http.StatusFound, alert)
+}
+
+// Show is used to show a webhook with its recent deliveries.
+// GET /account/webhooks/:id
+func (wh *Webhooks) Show(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := wh.webhook(w, r)
+	if !ok {
+		return
+	}
+	wh.renderShow(w, r, views.Data{}, webhook)
+}
+
+// Update is used to change the URL, events or state of a webhook.
+// POST /account/webhooks/:id/update
+func (wh *Webhooks) Update(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := wh.webhook(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	var form WebhookForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		wh.renderShow(w, r, vd, webhook)
+		return
+	}
+	before := *webhook
+	webhook.URL = form.URL
+	webhook.Events = strings.Join(form.Events, ",")
+	webhook.Active = form.Active
+	if err := wh.ws.Update(webhook); err != nil {
+		vd.SetAlert(err)
+		wh.renderShow(w, r, vd, webhook)
+		return
+	}
+	if len(models.Diff(&before, webhook)) > 0 {
+		wh.audit(r, models.AuditWebhookUpdate, &before, webhook)
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Webhook successfully updated!",
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/account/webhooks/%d", webhook.ID), http.StatusFound, alert)
+}
+
+// Delete is used to remove a webhook together with its deliveries.
+// POST /account/webhooks/:id/delete
+func (wh *Webhooks) Delete(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := wh.webhook(w, r)
+	if !ok {
+		return
+	}
+	if err := wh.ws.Delete(webhook.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		wh.renderShow(w, r, vd, webhook)
+		return
+	}
+	wh.audit(r, models.AuditWebhookDelete, webhook, nil)
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Webhook deleted.",
+	}
+	views.RedirectAlert(w, r, "/account/webhooks", http.StatusFound, alert)
+}
+
+// Redeliver is used to send a delivery once more.
+// POST /account/webhooks/:id/deliveries/:deliveryID/redeliver
+func (wh *Webhooks) Redeliver(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := wh.webhook(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["deliveryID"])
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusNotFound)
+		return
+	}
+	delivery, err := wh.ws.DeliveryByID(uint(id))
+	if err != nil || delivery.WebhookID != webhook.ID {
+		if err == nil || errors.Is(err, models.ErrResourceNotFound) {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err)
+		return
+	}
+	if _, err = wh.ws.Redeliver(delivery); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		wh.renderShow(w, r, vd, webhook)
+		return
+	}
+	alert := views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Delivery #%d is sent again.", delivery.ID),
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/account/webhooks/%d", webhook.ID), http.StatusFound, alert)
+}
+
+// renderIndex renders the webhooks page with the webhooks of the user.
+func (wh *Webhooks) renderIndex(w http.ResponseWriter, r *http.Request, vd views.Data, index WebhooksIndex) {
+	user := context.User(r.Context())
+	webhooks, err := wh.ws.ByUserID(user.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	index.Webhooks = webhooks
+	vd.Yield = index
+	wh.IndexView.Render(w, r, vd)
+}
+
+// renderShow renders the page of the webhook with its recent deliveries.
+func (wh *Webhooks) renderShow(w http.ResponseWriter, r *http.Request, vd views.Data, webhook *models.Webhook) {
+	deliveries, err := wh.ws.DeliveriesByWebhookID(webhook.ID, deliveriesLimit)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	vd.Yield = WebhookPage{
+		Webhook: webhook,
+		Form: WebhookForm{
+			URL:    webhook.URL,
+			Events: webhook.EventList(),
+			Active: webhook.Active,
+		},
+		Deliveries:      deliveries,
+		Events:          models.WebhookEvents,
+		SignatureHeader: models.HeaderWebhookSignature,
+		TimestampHeader: models.HeaderWebhookTimestamp,
+	}
+	wh.ShowView.Render(w, r, vd)
+}
+
+// webhook looks up the webhook in the URL, which must belong to the signed-in user.
+func (wh *Webhooks) webhook(w http.ResponseWriter, r *http.Request) (*models.Webhook, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusNotFound)
+		return nil, false
+	}
+	webhook, err := wh.ws.ByID(uint(id))
+	if err != nil {
+		if errors.Is(err, models.ErrResourceNotFound) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return nil, false
+		}
+		serverError(w, r, err)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	if webhook.UserID != user.ID {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+	return webhook, true
+}
+
+// audit records an action on a webhook, with the webhook
+// before and after the action, either may be nil.
+func (wh *Webhooks) audit(r *http.Request, action string, before, after *models.Webhook) {
+	webhook := before
+	if webhook == nil {
+		webhook = after
+	}
+	audit(wh.as, r, models.AuditEntry{
+		Action:     action,
+		TargetType: models.AuditTargetWebhook,
+		TargetID:   webhook.ID,
+		Changes:    models.Diff(before, after),
+	})
+}
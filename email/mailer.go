@@ -0,0 +1,78 @@
+package email
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// SMTPConfig is the server and account emails are sent with.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// NewSMTPMailer creates a Mailer sending emails through an SMTP server.
+// Authentication is skipped if no username is configured.
+func NewSMTPMailer(cfg SMTPConfig) Mailer {
+	return &smtpMailer{cfg}
+}
+
+type smtpMailer struct {
+	cfg SMTPConfig
+}
+
+func (sm *smtpMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if sm.cfg.Username != "" {
+		auth = smtp.PlainAuth("", sm.cfg.Username, sm.cfg.Password, sm.cfg.Host)
+	}
+	addr := net.JoinHostPort(sm.cfg.Host, strconv.Itoa(sm.cfg.Port))
+	return smtp.SendMail(addr, auth, sm.cfg.From, []string{msg.To}, sm.format(msg))
+}
+
+// format builds the headers and body of the message.
+func (sm *smtpMailer) format(msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", sm.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// NewLogMailer creates a Mailer which only logs emails,
+// it is used in development when no SMTP server is configured.
+func NewLogMailer() Mailer {
+	return &logMailer{}
+}
+
+type logMailer struct{}
+
+func (lm *logMailer) Send(msg Message) error {
+	log.Printf("Email to %s: %s\n%s\n", msg.To, msg.Subject, msg.Body)
+	return nil
+}
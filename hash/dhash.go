@@ -0,0 +1,79 @@
+package hash
+
+import (
+	"image"
+	"math/bits"
+)
+
+const (
+	dHashWidth  = 9
+	dHashHeight = 8
+
+	// maxSamples is the number of pixels sampled per row and column of a grid cell.
+	maxSamples = 16
+)
+
+// DHash computes the difference hash of an image. The image is shrunk
+// to 9x8 grayscale pixels and every bit of the result records whether a
+// pixel is brighter than its right neighbour. Resized, recompressed or
+// slightly edited copies of a photo end up with nearly the same hash.
+func DHash(img image.Image) uint64 {
+	gray := shrink(img, dHashWidth, dHashHeight)
+	var h uint64
+	for y := 0; y < dHashHeight; y++ {
+		for x := 0; x < dHashWidth-1; x++ {
+			h <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// Distance returns the number of bits which differ between two hashes.
+// A distance below about 10 means the images are likely the same photo.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// shrink averages the luminance of the pixels of img into a w x h grid.
+func shrink(img image.Image, w, h int) [][]float64 {
+	bounds := img.Bounds()
+	grid := make([][]float64, h)
+	for y := 0; y < h; y++ {
+		grid[y] = make([]float64, w)
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			grid[y][x] = luminance(img, x0, y0, x1, y1)
+		}
+	}
+	return grid
+}
+
+// luminance returns the average luminance of the given rectangle. Large
+// rectangles are sampled, as averaging every pixel of a big photo is slow
+// and makes no difference to the hash.
+func luminance(img image.Image, x0, y0, x1, y1 int) float64 {
+	stepX := (x1-x0)/maxSamples + 1
+	stepY := (y1-y0)/maxSamples + 1
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"myphoto/models"
+	"sync"
+	"time"
+)
+
+const (
+	pollInterval = time.Second
+	// staleAfter is how long a job may stay running before it is assumed
+	// its worker died and it is handed to another one.
+	staleAfter = 30 * time.Minute
+)
+
+// Handler processes a single job. Returning an error
+// schedules a retry, until the job runs out of attempts.
+type Handler func(job *models.Job) error
+
+// NewRunner creates a Runner processing jobs with the given number of workers.
+// Handlers need to be registered with Handle before the Runner is started.
+func NewRunner(js models.JobService, concurrency int) *Runner {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Runner{
+		js:          js,
+		concurrency: concurrency,
+		handlers:    make(map[string]Handler),
+	}
+}
+
+// Runner is a pool of workers polling the database for due jobs.
+type Runner struct {
+	js          models.JobService
+	concurrency int
+	handlers    map[string]Handler
+	wg          sync.WaitGroup
+}
+
+// Handle registers the handler for jobs of the given kind.
+func (r *Runner) Handle(kind string, h Handler) {
+	r.handlers[kind] = h
+}
+
+// Start launches the workers. They stop claiming new jobs once ctx is
+// done, use Wait to let the jobs already in progress finish.
+func (r *Runner) Start(ctx context.Context) {
+	if err := r.js.ReleaseStale(time.Now().Add(-staleAfter)); err != nil {
+		slog.Error("releasing stale jobs failed", "err", err)
+	}
+	for i := 0; i < r.concurrency; i++ {
+		r.wg.Add(1)
+		go r.work(ctx)
+	}
+}
+
+// Wait blocks until all workers have stopped.
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+func (r *Runner) work(ctx context.Context) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		// Drain all due jobs before waiting for the next tick.
+		for ctx.Err() == nil {
+			if !r.runNext() {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runNext claims and runs a single job and reports whether there was one.
+func (r *Runner) runNext() bool {
+	job, err := r.js.Claim(time.Now())
+	if err != nil {
+		if !errors.Is(err, models.ErrResourceNotFound) {
+			slog.Error("claiming a job failed", "err", err)
+		}
+		return false
+	}
+	logger := slog.With("job_id", job.ID, "kind", job.Kind, "attempt", job.Attempts)
+	if err = r.run(job); err != nil {
+		logger.Warn("job failed", "err", err)
+		if err = r.js.Fail(job, err); err != nil {
+			logger.Error("recording the failure of the job failed", "err", err)
+		}
+		return true
+	}
+	if err = r.js.Succeed(job); err != nil {
+		logger.Error("recording the success of the job failed", "err", err)
+	}
+	return true
+}
+
+// run calls the handler for the job, turning panics into errors,
+// so a single bad job cannot take down the whole process.
+func (r *Runner) run(job *models.Job) (err error) {
+	h, ok := r.handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("no handler registered for job kind %q", job.Kind)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return h(job)
+}
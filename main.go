@@ -1,72 +1,215 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
-	"myphoto/controllers"
-	"myphoto/middleware"
+	"log"
+	"log/slog"
+	"myphoto/migrate"
 	"myphoto/models"
-	"myphoto/rand"
-	"net/http"
-
-	"github.com/gorilla/csrf"
-	"github.com/gorilla/mux"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
 )
 
+// dateLayout formats the dates in the tables printed by commands.
+const dateLayout = "2006-01-02"
+
+// command is a subcommand of the binary, like "serve" or "user create".
+type command struct {
+	name string
+	// args describes the flags and arguments of the command.
+	args string
+	help string
+	// run parses args with the flags it adds to fs, and runs the command.
+	run func(cfg Config, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"serve", "", "Run the web server and the background jobs.", serve},
+	{"migrate", "<up|down [n]|status|to <version>>", "Apply or roll back database migrations.", runMigrate},
+	{"user create", "[-name name] [-admin] <email>", "Create a user, the password is read from stdin.", userCreate},
+	{"user list", "", "List all users.", userList},
+	{"user disable", "<email>", "Prevent a user from logging in and sign them out everywhere.", userDisable},
+	{"user enable", "<email>", "Allow a disabled user to log in again.", userEnable},
+	{"user set-password", "<email>", "Change the password of a user, the password is read from stdin.", userSetPassword},
+	{"user set-admin", "[-revoke] <email>", "Make a user an admin, or revoke it.", userSetAdmin},
+	{"gallery list", "[-user email]", "List the galleries of all users or of one user.", galleryList},
+	{"gallery delete", "[-purge] <id>", "Move a gallery to the trash, or remove it for good.", galleryDelete},
+	{"images reconcile", "[-import-orphans]", "Find stored files without images and images without files.", imagesReconcile},
+	{"storage usage", "[-recompute]", "Show the storage used by every user.", storageUsage},
+	{"config check", "", "Check the config and that the database and storage are reachable.", configCheck},
+	{"config print", "", "Print the effective config with the secrets redacted.", configPrint},
+}
+
 func main() {
-	boolPtr := flag.Bool("prod", false, "Set this flag in production. This ensures that a config.json file is loaded before the application starts.")
+	configPath := flag.String("config", "", "Path of the JSON config file, config.json is used if it exists.")
+	prod := flag.Bool("prod", false, "Run in production, same as -set env=prod. The default secrets are refused in production.")
+	var overrides overrideFlags
+	flag.Var(&overrides, "set", "Override a setting of the config by its JSON path, like -set database.host=db. Can be repeated.")
+	flag.Usage = usage
 	flag.Parse()
 
-	cfg := LoadConfig(*boolPtr)
-	svc, err := models.NewServices(
-		models.WithGorm(cfg.Database.ConnectionInfo()),
+	cmd, args, ok := findCommand(flag.Args())
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if *prod {
+		overrides = append(overrides, "env=prod")
+	}
+	path, required := *configPath, true
+	if path == "" {
+		path, required = "config.json", false
+	}
+	cfg, err := LoadConfig(path, required, overrides)
+	if err == nil && !strings.HasPrefix(cmd.name, "config ") {
+		// The config commands report on invalid configs instead of refusing them.
+		err = cfg.Validate()
+	}
+	if err == nil {
+		slog.SetDefault(cfg.Log.Logger())
+		err = cmd.run(cfg, newFlagSet(cmd), args)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// overrideFlags collects the repeated -set flags.
+type overrideFlags []string
+
+func (o *overrideFlags) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *overrideFlags) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
+// findCommand returns the command named by the first one or two arguments,
+// and the remaining arguments. Without arguments the server is started.
+func findCommand(args []string) (command, []string, bool) {
+	if len(args) == 0 {
+		return commands[0], nil, true
+	}
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] <command> [arguments]\n\ncommands:\n", filepath.Base(os.Args[0]))
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.help)
+	}
+	w.Flush()
+	fmt.Fprintln(out, "\nflags:")
+	flag.PrintDefaults()
+}
+
+// newFlagSet creates the flags of a command, which exit
+// with the usage of the command when they are invalid.
+func newFlagSet(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s %s\n\n%s\n", filepath.Base(os.Args[0]), cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of a command, which needs exactly n arguments.
+func parseArgs(fs *flag.FlagSet, args []string, n int) {
+	fs.Parse(args)
+	if fs.NArg() != n {
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// newServices connects to the database with every service
+// the commands and the web server need.
+func newServices(cfg Config) (*models.Services, error) {
+	mailer := cfg.Mail.Mailer()
+	return models.NewServices(
+		models.WithGorm(cfg.Database.Driver, cfg.Database.ConnectionInfo()),
+		models.WithTracing(),
 		models.WithUser(cfg.HMACKey),
 		models.WithGallery(),
-		models.WithImage(),
+		models.WithJob(),
+		models.WithImage(cfg.Quotas),
+		models.WithUpload(),
+		models.WithTrash(cfg.TrashRetention()),
+		models.WithTag(),
+		models.WithSearch(),
+		models.WithProofing(mailer, cfg.BaseURL),
+		models.WithMember(cfg.HMACKey, mailer, cfg.BaseURL),
+		models.WithAudit(cfg.AuditRetention()),
+		models.WithWebhook(cfg.BaseURL),
 	)
+}
+
+// newMigrator creates a migrator for the database of the services.
+func newMigrator(svc *models.Services) (*migrate.Migrator, error) {
+	sqlDB, err := svc.DB()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer svc.Close()
-	svc.AutoMigrate()
+	migrator, err := migrate.New(sqlDB, svc.Driver())
+	if err != nil {
+		return nil, err
+	}
+	migrator.Log = log.Printf
+	return migrator, nil
+}
 
-	r := mux.NewRouter()
-	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(svc.User)
-	galleriesC := controllers.NewGalleries(svc.Gallery, svc.Image, r)
+// readPassword reads a password from the first line of stdin, so it
+// neither ends up in the shell history nor in the list of processes.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no password given on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
 
-	b, err := rand.Bytes(32)
-	if err != nil {
-		panic(err)
-	}
-	csrfMw := csrf.Protect(b, csrf.Secure(cfg.IsProd()))
-	userMw := middleware.User{UserService: svc.User}
-	requireUserMw := middleware.RequireUser{User: userMw}
-
-	r.Handle("/", staticC.Home).Methods("GET")
-	r.Handle("/contact", staticC.Contact).Methods("GET")
-	r.Handle("/login", usersC.LoginView).Methods("GET")
-	r.HandleFunc("/login", usersC.Login).Methods("POST")
-	r.HandleFunc("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
-	r.HandleFunc("/signup", usersC.New).Methods("GET")
-	r.HandleFunc("/signup", usersC.Create).Methods("POST")
-
-	assetHandler := http.FileServer(http.Dir("./assets/"))
-	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", assetHandler))
-
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
-
-	r.Handle("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).Methods("GET")
-	r.Handle("/galleries/new", requireUserMw.Apply(galleriesC.New)).Methods("GET")
-	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesC.Create)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFn(galleriesC.Edit)).Methods("GET").Name(controllers.EditGallery)
-	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).Methods("GET").Name(controllers.ShowGallery)
-
-	fmt.Printf("Starting the server on :%d...\n", cfg.Port)
-	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), csrfMw(userMw.Apply(r)))
+const (
+	// cliUserAgent is recorded as the user agent of changes made from the command line.
+	cliUserAgent = "myphoto cli"
+	// jobUserAgent is recorded as the user agent of changes made by background jobs.
+	jobUserAgent = "myphoto job"
+)
+
+// auditCLI records a change made from the command line, which has no actor.
+// Failing to record it is logged but does not fail the command.
+func auditCLI(as models.AuditService, entry models.AuditEntry) {
+	entry.UserAgent = cliUserAgent
+	if err := as.Create(&entry); err != nil {
+		slog.Error("recording the audit entry failed", "err", err)
+	}
+}
+
+// auditJob records a change made by a background job, which has no actor.
+// Failing to record it is logged but does not fail the job.
+func auditJob(as models.AuditService, entry models.AuditEntry) {
+	entry.UserAgent = jobUserAgent
+	if err := as.Create(&entry); err != nil {
+		slog.Error("recording the audit entry failed", "err", err)
+	}
 }
@@ -0,0 +1,61 @@
+package markdown
+
+import (
+	"bytes"
+	"html/template"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+var (
+	// md converts Markdown to HTML. Raw HTML in the source is
+	// not rendered at all, it is replaced by a comment.
+	md = goldmark.New(
+		goldmark.WithExtensions(
+			// Alignment as attributes, style attributes are not allowed.
+			extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)),
+			extension.Strikethrough,
+			extension.Linkify,
+		),
+		goldmark.WithRendererOptions(
+			html.WithHardWraps(),
+		),
+	)
+
+	// policy only lets through the elements Markdown produces for text,
+	// lists, quotes, code and tables. Images are left out, so descriptions
+	// cannot load content from other sites.
+	policy = newPolicy()
+)
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements(
+		"p", "br", "hr", "strong", "em", "del", "code", "pre", "blockquote",
+		"h1", "h2", "h3", "h4", "h5", "h6", "ul", "ol", "li",
+		"table", "thead", "tbody", "tr", "th", "td",
+	)
+	p.AllowAttrs("start").Matching(regexp.MustCompile(`^[0-9]+$`)).OnElements("ol")
+	p.AllowAttrs("align").Matching(regexp.MustCompile(`^(left|center|right)$`)).OnElements("th", "td")
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.RequireParseableURLs(true)
+	p.RequireNoFollowOnLinks(true)
+	p.RequireNoReferrerOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+// Render converts Markdown to sanitised HTML, which is
+// safe to be included in pages as it is.
+func Render(source string) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := md.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(policy.SanitizeBytes(buf.Bytes())), nil
+}
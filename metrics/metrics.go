@@ -0,0 +1,155 @@
+// Package metrics collects the metrics of the application, which are
+// exposed to Prometheus in its text format by Handler.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "myphoto"
+
+// Upload methods label how images were uploaded.
+const (
+	UploadForm      = "form"
+	UploadResumable = "resumable"
+)
+
+// UnmatchedRoute is the route label of requests which matched no route,
+// so unknown paths cannot create any number of series.
+const UnmatchedRoute = "unmatched"
+
+// OtherMethod is the method label of requests with a method outside of
+// those defined by HTTP, which clients could otherwise make up at will.
+const OtherMethod = "OTHER"
+
+// sessionWindow is how recently a user must have made a request
+// to count as an active session.
+const sessionWindow = 15 * time.Minute
+
+// registry holds the metrics of the application, instead of the global
+// default registry, so nothing is exposed which was not asked for.
+var registry = prometheus.NewRegistry()
+
+var factory = promauto.With(registry)
+
+var (
+	// Requests counts the served requests by route template, method and status code.
+	Requests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of served HTTP requests.",
+	}, []string{"route", "method", "code"})
+
+	// RequestDuration observes how long requests take by route template and method.
+	RequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// Uploads counts the uploaded images by upload method.
+	Uploads = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_total",
+		Help:      "Number of uploaded images.",
+	}, []string{"method"})
+
+	// UploadBytes counts the bytes of the uploaded images by upload method.
+	UploadBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Size of the uploaded images in bytes.",
+	}, []string{"method"})
+
+	// ImageProcessing observes how long processing images in the
+	// background takes, by whether it succeeded or returned an error.
+	ImageProcessing = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_processing_duration_seconds",
+		Help:      "Time taken to process uploaded images.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"result"})
+
+	// LoginFailures counts the logins with an unknown email address or a wrong password.
+	LoginFailures = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_failures_total",
+		Help:      "Number of failed logins.",
+	})
+
+	// Sessions tracks the signed-in users who recently made a request.
+	Sessions = newSessionTracker(sessionWindow)
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_sessions",
+		Help:      "Number of signed-in users who made a request in the last 15 minutes.",
+	}, func() float64 {
+		return float64(Sessions.Active(time.Now()))
+	})
+}
+
+// RegisterDB exposes the connection pool statistics of the database.
+func RegisterDB(db *sql.DB) error {
+	return registry.Register(collectors.NewDBStatsCollector(db, namespace))
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// sessionTracker remembers when each signed-in user made their last request.
+type sessionTracker struct {
+	window   time.Duration
+	mu       sync.Mutex
+	lastSeen map[uint]time.Time
+}
+
+func newSessionTracker(window time.Duration) *sessionTracker {
+	return &sessionTracker{
+		window:   window,
+		lastSeen: make(map[uint]time.Time),
+	}
+}
+
+// Seen records a request of the user at t.
+func (st *sessionTracker) Seen(userID uint, t time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastSeen[userID] = t
+}
+
+// Active returns the number of users seen within the window before now,
+// and forgets the others.
+func (st *sessionTracker) Active(now time.Time) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for userID, t := range st.lastSeen {
+		if now.Sub(t) > st.window {
+			delete(st.lastSeen, userID)
+		}
+	}
+	return len(st.lastSeen)
+}
+
+// Upload counts an uploaded image of size bytes.
+func Upload(method string, size int64) {
+	Uploads.WithLabelValues(method).Inc()
+	UploadBytes.WithLabelValues(method).Add(float64(size))
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"log/slog"
+	"myphoto/context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AccessLog logs every request once it is served. It needs RequestID
+// middleware to be already executed for the request ID to be logged.
+// Only the template of the matched route is logged rather than the path,
+// which holds the tokens of proofing links, invitations and uploads.
+type AccessLog struct{}
+
+func (mw *AccessLog) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *AccessLog) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &context.RequestInfo{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r.WithContext(context.WithInfo(r.Context(), info)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		context.Logger(r.Context()).LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("route", info.Route),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.Uint64("user_id", uint64(info.UserID)),
+		)
+	}
+}
+
+// Route records the matched route and the signed-in user for the access log.
+// It is used as mux middleware, which runs once the route is known, and
+// needs User middleware to be already executed.
+func (mw *AccessLog) Route(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := context.Info(r.Context()); info != nil {
+			if route := mux.CurrentRoute(r); route != nil {
+				info.Route, _ = route.GetPathTemplate()
+			}
+			if user := context.User(r.Context()); user != nil {
+				info.UserID = user.ID
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"bytes"
+	"log/slog"
+	"myphoto/context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAccessLogLeavesOutTokens(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	accessLogMw := AccessLog{}
+	r := mux.NewRouter()
+	r.Use(accessLogMw.Route)
+	r.HandleFunc("/proof/{token}", func(w http.ResponseWriter, r *http.Request) {})
+	handler := accessLogMw.Apply(r)
+
+	req := httptest.NewRequest("GET", "/proof/secret-token", nil)
+	req = req.WithContext(context.WithRequestID(req.Context(), "request-id", logger))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	line := buf.String()
+	if strings.Contains(line, "secret-token") {
+		t.Errorf("access log contains the token: %s", line)
+	}
+	if !strings.Contains(line, "route=/proof/{token}") {
+		t.Errorf("access log lacks the route: %s", line)
+	}
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"myphoto/context"
+	"myphoto/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Metrics counts and times requests by their route template, so the
+// number of series does not grow with the IDs in the paths. It needs
+// AccessLog middleware to be already executed to know the route.
+type Metrics struct{}
+
+func (mw *Metrics) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *Metrics) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := metrics.UnmatchedRoute
+		if info := context.Info(r.Context()); info != nil {
+			if info.Route != "" {
+				route = info.Route
+			}
+			if info.UserID > 0 {
+				metrics.Sessions.Seen(info.UserID, time.Now())
+			}
+		}
+		method := metricsMethod(r.Method)
+		metrics.Requests.WithLabelValues(route, method, strconv.Itoa(rec.status)).Inc()
+		metrics.RequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsMethod returns the method label of a request method.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return metrics.OtherMethod
+	}
+}
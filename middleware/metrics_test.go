@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"myphoto/context"
+	"myphoto/metrics"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsLabels(t *testing.T) {
+	accessLogMw := AccessLog{}
+	metricsMw := Metrics{}
+	r := mux.NewRouter()
+	r.Use(accessLogMw.Route)
+	r.HandleFunc("/galleries/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {}).Name("show_gallery")
+	handler := metricsMw.Apply(r)
+
+	for _, method := range []string{"GET", "BREW"} {
+		req := httptest.NewRequest(method, "/galleries/7", nil)
+		req = req.WithContext(context.WithInfo(req.Context(), &context.RequestInfo{}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for _, method := range []string{"GET", metrics.OtherMethod} {
+		got := testutil.ToFloat64(metrics.Requests.WithLabelValues("/galleries/{id:[0-9]+}", method, "200"))
+		if got != 1 {
+			t.Errorf("%s requests = %v, want 1", method, got)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.Requests.WithLabelValues("/galleries/{id:[0-9]+}", "BREW", "200")); got != 0 {
+		t.Errorf("BREW requests = %v, want 0", got)
+	}
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"log/slog"
+	"myphoto/context"
+	"myphoto/rand"
+	"net/http"
+	"regexp"
+)
+
+// RequestIDHeader carries the ID of a request, in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDRegex matches the request IDs accepted from proxies in front of
+// the application, anything else could be used to forge log lines.
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID gives every request an ID, which is returned in a header and
+// added to everything logged about the request. The ID is taken from the
+// request if a proxy already assigned one.
+type RequestID struct {
+	Logger *slog.Logger
+}
+
+func (mw *RequestID) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequestID) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDRegex.MatchString(id) {
+			var err error
+			if id, err = rand.String(12); err != nil {
+				mw.Logger.Error("generating request ID", "err", err)
+				http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithRequestID(r.Context(), id, mw.Logger)
+		next(w, r.WithContext(ctx))
+	}
+}
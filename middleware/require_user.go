@@ -18,8 +18,7 @@ func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
-		if strings.HasPrefix(path, "/assets/") ||
-			strings.HasPrefix(path, "/images/") {
+		if strings.HasPrefix(path, "/assets/") {
 			next(w, r)
 			return
 		}
@@ -29,8 +28,8 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			next(w, r)
 			return
 		}
-		user, err := mw.UserService.ByRemember(cookie.Value)
-		if err != nil {
+		user, err := mw.UserService.WithContext(r.Context()).ByRemember(cookie.Value)
+		if err != nil || user.Disabled {
 			next(w, r)
 			return
 		}
@@ -62,3 +61,25 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
+// RequireAdmin responds with 404 Not Found to everyone but admins,
+// so the pages are not revealed. Signed out visitors are sent to the login.
+type RequireAdmin struct {
+	RequireUser
+}
+
+// Apply needs User middleware to be already executed for correct work.
+func (mw *RequireAdmin) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn needs User middleware to be already executed for correct work.
+func (mw *RequireAdmin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		if !context.User(r.Context()).Admin {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	})
+}
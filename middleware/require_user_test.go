@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"myphoto/context"
+	"myphoto/models"
+	"myphoto/models/modelstest"
+	"myphoto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// signIn creates a user and returns its remember token.
+func signIn(t *testing.T, us models.UserService, user *models.User) string {
+	t.Helper()
+	token, err := rand.RememberToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Password = "password123"
+	user.Remember = token
+	if err = us.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRequireUser(t *testing.T) {
+	us := models.NewUserServiceFromDB(modelstest.NewUserDB(), "test-hmac-key")
+	janeToken := signIn(t, us, &models.User{Email: "jane@example.com"})
+	adminToken := signIn(t, us, &models.User{Email: "admin@example.com", Admin: true})
+	disabledToken := signIn(t, us, &models.User{Email: "john@example.com", Disabled: true})
+
+	userMw := User{UserService: us}
+	requireUserMw := RequireUser{User: userMw}
+	requireAdminMw := RequireAdmin{RequireUser: requireUserMw}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		if user := context.User(r.Context()); user != nil {
+			w.Write([]byte(user.Email))
+		}
+	}
+
+	tests := []struct {
+		name         string
+		handler      http.HandlerFunc
+		path         string
+		token        string
+		wantStatus   int
+		wantLocation string
+		wantBody     string
+	}{
+		{"signed out", userMw.ApplyFn(ok), "/", "", http.StatusOK, "", ""},
+		{"signed in", userMw.ApplyFn(ok), "/", janeToken, http.StatusOK, "", "jane@example.com"},
+		{"unknown token", userMw.ApplyFn(ok), "/", "unknown", http.StatusOK, "", ""},
+		{"disabled", userMw.ApplyFn(ok), "/", disabledToken, http.StatusOK, "", ""},
+		{"assets skipped", userMw.ApplyFn(ok), "/assets/app.css", janeToken, http.StatusOK, "", ""},
+		{"images signed in", userMw.ApplyFn(ok), "/images/galleries/1/a.jpg", janeToken, http.StatusOK, "", "jane@example.com"},
+		{"require user signed out", userMw.ApplyFn(requireUserMw.ApplyFn(ok)), "/galleries", "", http.StatusFound, "/login", ""},
+		{"require user disabled", userMw.ApplyFn(requireUserMw.ApplyFn(ok)), "/galleries", disabledToken, http.StatusFound, "/login", ""},
+		{"require user signed in", userMw.ApplyFn(requireUserMw.ApplyFn(ok)), "/galleries", janeToken, http.StatusOK, "", "jane@example.com"},
+		{"require admin signed out", userMw.ApplyFn(requireAdminMw.ApplyFn(ok)), "/admin/audit", "", http.StatusFound, "/login", ""},
+		{"require admin not an admin", userMw.ApplyFn(requireAdminMw.ApplyFn(ok)), "/admin/audit", janeToken, http.StatusNotFound, "", ""},
+		{"require admin", userMw.ApplyFn(requireAdminMw.ApplyFn(ok)), "/admin/audit", adminToken, http.StatusOK, "", "admin@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.token != "" {
+				r.AddCookie(&http.Cookie{Name: "remember_token", Value: tt.token})
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("location = %q, want %q", got, tt.wantLocation)
+			}
+			if got := w.Body.String(); w.Code == http.StatusOK && got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing records a span for every request, continuing the trace of
+// the caller if the request carries one. The spans of the services
+// and queries the request makes are its children.
+type Tracing struct{}
+
+func (mw *Tracing) Apply(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}))
+}
+
+// Route names the span of the request after the matched route, like
+// "GET /galleries/{id:[0-9]+}", once it is known. It is used as mux middleware.
+func (mw *Tracing) Route(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(r.Method + " " + template)
+				span.SetAttributes(semconv.HTTPRoute(template))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,342 @@
+// Package migrate evolves the database schema with the versioned SQL
+// migrations embedded in the binary. Every migration has an up and a
+// down file named like 0002_add_albums.up.sql, and the applied
+// versions are recorded in the schema_migrations table.
+//
+// Every database driver has its own directory of migrations, which
+// have the same versions, so a version means the same schema on both.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Drivers are the databases there are migrations for.
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+// lockKey identifies the advisory lock held while migrating on Postgres,
+// so instances starting at the same time do not migrate concurrently.
+const lockKey = 4_818_146_011
+
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var embedded embed.FS
+
+var fileRegex = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var (
+	// ErrUnknownVersion is returned when migrating to a version without a migration.
+	ErrUnknownVersion = errors.New("migrate: unknown version")
+	// ErrDirty is returned when the database has a version applied
+	// which is not embedded in the binary, like after a downgrade.
+	ErrDirty = errors.New("migrate: database has migrations this binary does not know")
+	// ErrUnknownDriver is returned for a database there are no migrations for.
+	ErrUnknownDriver = errors.New("migrate: unknown database driver")
+)
+
+// Migration is a single schema change.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status tells whether a migration is applied.
+type Status struct {
+	Migration
+	// AppliedAt is nil if the migration is pending.
+	AppliedAt *time.Time
+}
+
+// Migrator applies and rolls back migrations.
+type Migrator struct {
+	db         *sql.DB
+	driver     string
+	migrations []Migration
+	// Log is called with every migration which is applied or rolled back.
+	Log func(format string, v ...interface{})
+}
+
+// New creates a Migrator for the migrations of the driver embedded in the binary.
+func New(db *sql.DB, driver string) (*Migrator, error) {
+	sub, err := fs.Sub(embedded, path.Join("migrations", driver))
+	if err != nil {
+		return nil, err
+	}
+	return NewFromFS(db, driver, sub)
+}
+
+// NewFromFS creates a Migrator for the migrations in the root of fsys,
+// which are written for the driver.
+func NewFromFS(db *sql.DB, driver string, fsys fs.FS) (*Migrator, error) {
+	if driver != Postgres && driver != SQLite {
+		return nil, fmt.Errorf("%w %q", ErrUnknownDriver, driver)
+	}
+	migrations, err := load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:         db,
+		driver:     driver,
+		migrations: migrations,
+		Log:        func(string, ...interface{}) {},
+	}, nil
+}
+
+// load reads the migrations sorted by version. Every version needs both
+// an up and a down file, and versions cannot be used twice.
+func load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		match := fileRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migrate: invalid file name %s", entry.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		b, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrate: version %d is used by %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrate: version %d needs both an up and a down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Latest returns the version of the newest migration, zero if there are none.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Current returns the newest applied version, zero if there is none. Unlike
+// Status it does not wait for migrations running at the same time.
+func (m *Migrator) Current(ctx context.Context) (int64, error) {
+	var version int64
+	err := m.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// Status returns every migration, and whether it is applied.
+func (m *Migrator) Status() ([]Status, error) {
+	var statuses []Status
+	err := m.locked(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := Status{Migration: migration}
+			if at, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &at
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Up applies all pending migrations.
+func (m *Migrator) Up() error {
+	return m.To(m.Latest())
+}
+
+// Down rolls back the given number of most recently applied migrations.
+func (m *Migrator) Down(steps int) error {
+	return m.locked(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err = m.down(conn, migration); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// To applies or rolls back migrations until version is the newest applied
+// one. Version zero rolls back every migration.
+func (m *Migrator) To(version int64) error {
+	if version != 0 && m.index(version) < 0 {
+		return fmt.Errorf("%w %d", ErrUnknownVersion, version)
+	}
+	return m.locked(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for v := range applied {
+			if m.index(v) < 0 {
+				return fmt.Errorf("%w: version %d", ErrDirty, v)
+			}
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; ok && migration.Version > version {
+				if err = m.down(conn, migration); err != nil {
+					return err
+				}
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+				if err = m.up(conn, migration); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) index(version int64) int {
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Migrator) up(conn *sql.Conn, migration Migration) error {
+	m.Log("Applying migration %d %s\n", migration.Version, migration.Name)
+	return inTx(conn, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(migration.Up); err != nil {
+			return fmt.Errorf("migrate: applying %d %s: %w", migration.Version, migration.Name, err)
+		}
+		_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+			migration.Version, migration.Name, time.Now())
+		return err
+	})
+}
+
+func (m *Migrator) down(conn *sql.Conn, migration Migration) error {
+	m.Log("Rolling back migration %d %s\n", migration.Version, migration.Name)
+	return inTx(conn, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(migration.Down); err != nil {
+			return fmt.Errorf("migrate: rolling back %d %s: %w", migration.Version, migration.Name, err)
+		}
+		_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+		return err
+	})
+}
+
+// locked runs fn on a single connection holding the advisory lock, and
+// makes sure the schema_migrations table exists. The lock is bound to
+// the connection, which is why everything has to run on it. SQLite has
+// no such lock, its database is used by a single instance.
+func (m *Migrator) locked(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	timeType := "datetime"
+	if m.driver == Postgres {
+		if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey)
+		timeType = "timestamptz"
+	}
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at `+timeType+` NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// appliedVersions returns when each applied version was applied.
+func appliedVersions(conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var at time.Time
+		if err = rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// inTx runs fn in a transaction, which is rolled back if fn fails.
+// Postgres also rolls back schema changes, so a failed migration
+// leaves nothing behind.
+func inTx(conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
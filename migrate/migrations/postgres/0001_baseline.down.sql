@@ -0,0 +1,7 @@
+-- Rolling back the baseline would remove all data, so it is refused.
+-- Restore a backup instead to get rid of the schema.
+DO $$
+BEGIN
+    RAISE EXCEPTION 'the baseline cannot be rolled back, it would remove all data';
+END
+$$;
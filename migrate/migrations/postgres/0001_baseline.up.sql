@@ -0,0 +1,337 @@
+-- The schema as it was created by gorm's AutoMigrate before migrations were
+-- introduced. Everything is created only if it does not exist yet, so
+-- databases set up by AutoMigrate are adopted. Their tables may have been
+-- created by an older version, so the columns which could have been added
+-- since are added unless they exist. Columns which are NOT NULL without a
+-- default cannot be added to tables with rows, so AutoMigrate never did.
+
+CREATE TABLE IF NOT EXISTS "users" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "name" text,
+    "email" text NOT NULL,
+    "password_hash" text NOT NULL,
+    "remember_hash" text NOT NULL,
+    "plan" text NOT NULL DEFAULT 'free',
+    "storage_bytes" bigint NOT NULL DEFAULT 0,
+    "handle" text NOT NULL DEFAULT '',
+    "bio" text NOT NULL DEFAULT '',
+    "avatar" text NOT NULL DEFAULT '',
+    "admin" boolean NOT NULL DEFAULT false,
+    PRIMARY KEY ("id")
+);
+ALTER TABLE "users"
+    ADD COLUMN IF NOT EXISTS "name" text,
+    ADD COLUMN IF NOT EXISTS "plan" text NOT NULL DEFAULT 'free',
+    ADD COLUMN IF NOT EXISTS "storage_bytes" bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "handle" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "bio" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "avatar" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "admin" boolean NOT NULL DEFAULT false;
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_handle" ON "users" ("handle") WHERE handle <> '';
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_remember_hash" ON "users" ("remember_hash");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_email" ON "users" ("email");
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "galleries" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "user_id" bigint,
+    "title" text,
+    "description" text NOT NULL DEFAULT '',
+    "storage_bytes" bigint NOT NULL DEFAULT 0,
+    "public" boolean NOT NULL DEFAULT false,
+    "proofing" boolean NOT NULL DEFAULT false,
+    "share_token" text NOT NULL DEFAULT '',
+    "selection_limit" bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY ("id")
+);
+ALTER TABLE "galleries"
+    ADD COLUMN IF NOT EXISTS "user_id" bigint,
+    ADD COLUMN IF NOT EXISTS "title" text,
+    ADD COLUMN IF NOT EXISTS "description" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "storage_bytes" bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "public" boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS "proofing" boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS "share_token" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "selection_limit" bigint NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_galleries_share_token" ON "galleries" ("share_token") WHERE share_token <> '';
+CREATE INDEX IF NOT EXISTS "idx_galleries_public" ON "galleries" ("public");
+CREATE INDEX IF NOT EXISTS "idx_galleries_user_id" ON "galleries" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_galleries_deleted_at" ON "galleries" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "uploads" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "token" text NOT NULL,
+    "user_id" bigint NOT NULL,
+    "gallery_id" bigint NOT NULL,
+    "filename" text NOT NULL,
+    "size" bigint NOT NULL,
+    "offset" bigint NOT NULL,
+    "checksum" text,
+    "expires_at" timestamptz NOT NULL,
+    PRIMARY KEY ("id")
+);
+ALTER TABLE "uploads"
+    ADD COLUMN IF NOT EXISTS "checksum" text;
+CREATE INDEX IF NOT EXISTS "idx_uploads_user_id" ON "uploads" ("user_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_uploads_token" ON "uploads" ("token");
+CREATE INDEX IF NOT EXISTS "idx_uploads_deleted_at" ON "uploads" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_uploads_expires_at" ON "uploads" ("expires_at");
+CREATE INDEX IF NOT EXISTS "idx_uploads_gallery_id" ON "uploads" ("gallery_id");
+
+CREATE TABLE IF NOT EXISTS "images" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "gallery_id" bigint NOT NULL,
+    "filename" text NOT NULL,
+    "uploader_id" bigint NOT NULL DEFAULT 0,
+    "status" text NOT NULL,
+    "width" bigint,
+    "height" bigint,
+    "size" bigint NOT NULL DEFAULT 0,
+    "content_hash" text,
+    "perceptual_hash" bigint,
+    "caption" text NOT NULL DEFAULT '',
+    "camera_make" text NOT NULL DEFAULT '',
+    "camera_model" text NOT NULL DEFAULT '',
+    "lens_model" text NOT NULL DEFAULT '',
+    "taken_at" timestamptz,
+    "iso" bigint NOT NULL DEFAULT 0,
+    "exposure_time" text NOT NULL DEFAULT '',
+    "f_number" decimal NOT NULL DEFAULT 0.000000,
+    "focal_length" decimal NOT NULL DEFAULT 0.000000,
+    PRIMARY KEY ("id")
+);
+ALTER TABLE "images"
+    ADD COLUMN IF NOT EXISTS "uploader_id" bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "width" bigint,
+    ADD COLUMN IF NOT EXISTS "height" bigint,
+    ADD COLUMN IF NOT EXISTS "size" bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "content_hash" text,
+    ADD COLUMN IF NOT EXISTS "perceptual_hash" bigint,
+    ADD COLUMN IF NOT EXISTS "caption" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "camera_make" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "camera_model" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "lens_model" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "taken_at" timestamptz,
+    ADD COLUMN IF NOT EXISTS "iso" bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "exposure_time" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "f_number" decimal NOT NULL DEFAULT 0.000000,
+    ADD COLUMN IF NOT EXISTS "focal_length" decimal NOT NULL DEFAULT 0.000000;
+CREATE INDEX IF NOT EXISTS "idx_images_content_hash" ON "images" ("content_hash");
+CREATE INDEX IF NOT EXISTS "idx_images_uploader_id" ON "images" ("uploader_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_images_gallery_filename" ON "images" ("gallery_id","filename");
+CREATE INDEX IF NOT EXISTS "idx_images_deleted_at" ON "images" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "jobs" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "kind" text NOT NULL,
+    "payload" text NOT NULL,
+    "status" text NOT NULL,
+    "run_at" timestamptz NOT NULL,
+    "attempts" bigint NOT NULL,
+    "max_attempts" bigint NOT NULL,
+    "locked_at" timestamptz,
+    "last_error" text,
+    PRIMARY KEY ("id")
+);
+ALTER TABLE "jobs"
+    ADD COLUMN IF NOT EXISTS "locked_at" timestamptz,
+    ADD COLUMN IF NOT EXISTS "last_error" text;
+CREATE INDEX IF NOT EXISTS "idx_jobs_status_run_at" ON "jobs" ("status","run_at");
+
+CREATE TABLE IF NOT EXISTS "tags" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "name" text NOT NULL,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_tags_user_name" ON "tags" ("user_id","name");
+
+CREATE TABLE IF NOT EXISTS "image_tags" (
+    "image_id" bigint,
+    "tag_id" bigint,
+    PRIMARY KEY ("image_id","tag_id"),
+    CONSTRAINT "fk_image_tags_image" FOREIGN KEY ("image_id") REFERENCES "images"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_image_tags_tag" FOREIGN KEY ("tag_id") REFERENCES "tags"("id") ON DELETE CASCADE
+);
+ALTER TABLE "image_tags"
+    ADD COLUMN IF NOT EXISTS "image_id" bigint,
+    ADD COLUMN IF NOT EXISTS "tag_id" bigint;
+CREATE INDEX IF NOT EXISTS "idx_image_tags_tag_id" ON "image_tags" ("tag_id");
+
+CREATE TABLE IF NOT EXISTS "gallery_tags" (
+    "gallery_id" bigint,
+    "tag_id" bigint,
+    PRIMARY KEY ("gallery_id","tag_id"),
+    CONSTRAINT "fk_gallery_tags_gallery" FOREIGN KEY ("gallery_id") REFERENCES "galleries"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_gallery_tags_tag" FOREIGN KEY ("tag_id") REFERENCES "tags"("id") ON DELETE CASCADE
+);
+ALTER TABLE "gallery_tags"
+    ADD COLUMN IF NOT EXISTS "gallery_id" bigint,
+    ADD COLUMN IF NOT EXISTS "tag_id" bigint;
+CREATE INDEX IF NOT EXISTS "idx_gallery_tags_tag_id" ON "gallery_tags" ("tag_id");
+
+CREATE TABLE IF NOT EXISTS "proofers" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "gallery_id" bigint NOT NULL,
+    "user_id" bigint,
+    "token" text NOT NULL,
+    "name" text NOT NULL DEFAULT '',
+    "submitted_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_proofers_gallery" FOREIGN KEY ("gallery_id") REFERENCES "galleries"("id") ON DELETE CASCADE
+);
+ALTER TABLE "proofers"
+    ADD COLUMN IF NOT EXISTS "user_id" bigint,
+    ADD COLUMN IF NOT EXISTS "name" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "submitted_at" timestamptz;
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_proofers_token" ON "proofers" ("token");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_proofers_gallery_user" ON "proofers" ("gallery_id","user_id");
+
+CREATE TABLE IF NOT EXISTS "picks" (
+    "proofer_id" bigint,
+    "image_id" bigint,
+    "favourite" boolean NOT NULL DEFAULT false,
+    "selected" boolean NOT NULL DEFAULT false,
+    PRIMARY KEY ("proofer_id","image_id"),
+    CONSTRAINT "fk_picks_proofer" FOREIGN KEY ("proofer_id") REFERENCES "proofers"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_picks_image" FOREIGN KEY ("image_id") REFERENCES "images"("id") ON DELETE CASCADE
+);
+ALTER TABLE "picks"
+    ADD COLUMN IF NOT EXISTS "proofer_id" bigint,
+    ADD COLUMN IF NOT EXISTS "image_id" bigint,
+    ADD COLUMN IF NOT EXISTS "favourite" boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS "selected" boolean NOT NULL DEFAULT false;
+CREATE INDEX IF NOT EXISTS "idx_picks_image_id" ON "picks" ("image_id");
+
+CREATE TABLE IF NOT EXISTS "comments" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "proofer_id" bigint NOT NULL,
+    "image_id" bigint NOT NULL,
+    "body" text NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_comments_proofer" FOREIGN KEY ("proofer_id") REFERENCES "proofers"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_comments_image" FOREIGN KEY ("image_id") REFERENCES "images"("id") ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_comments_image_id" ON "comments" ("image_id");
+CREATE INDEX IF NOT EXISTS "idx_comments_proofer_id" ON "comments" ("proofer_id");
+
+CREATE TABLE IF NOT EXISTS "members" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "gallery_id" bigint NOT NULL,
+    "user_id" bigint NOT NULL,
+    "role" text NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_members_gallery" FOREIGN KEY ("gallery_id") REFERENCES "galleries"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_members_user" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_members_gallery_user" ON "members" ("gallery_id","user_id");
+CREATE INDEX IF NOT EXISTS "idx_members_user_id" ON "members" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "invitations" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "gallery_id" bigint NOT NULL,
+    "invited_by_id" bigint NOT NULL,
+    "email" text NOT NULL,
+    "role" text NOT NULL,
+    "token_hash" text NOT NULL,
+    "expires_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_invitations_gallery" FOREIGN KEY ("gallery_id") REFERENCES "galleries"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_invitations_invited_by" FOREIGN KEY ("invited_by_id") REFERENCES "users"("id") ON DELETE CASCADE
+);
+ALTER TABLE "invitations"
+    ADD COLUMN IF NOT EXISTS "expires_at" timestamptz;
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_invitations_token_hash" ON "invitations" ("token_hash");
+CREATE INDEX IF NOT EXISTS "idx_invitations_gallery_id" ON "invitations" ("gallery_id");
+
+CREATE TABLE IF NOT EXISTS "audit_entries" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "actor_id" bigint,
+    "action" text NOT NULL,
+    "target_type" text NOT NULL,
+    "target_id" bigint NOT NULL,
+    "ip" text NOT NULL DEFAULT '',
+    "user_agent" text NOT NULL DEFAULT '',
+    "changes" text,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_audit_entries_actor" FOREIGN KEY ("actor_id") REFERENCES "users"("id") ON DELETE SET NULL
+);
+ALTER TABLE "audit_entries"
+    ADD COLUMN IF NOT EXISTS "actor_id" bigint,
+    ADD COLUMN IF NOT EXISTS "ip" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "user_agent" text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "changes" text;
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_actor_id" ON "audit_entries" ("actor_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_created_at" ON "audit_entries" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_target" ON "audit_entries" ("target_type","target_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_action" ON "audit_entries" ("action");
+
+CREATE TABLE IF NOT EXISTS "webhooks" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "url" text NOT NULL,
+    "events" text NOT NULL,
+    "secret" text NOT NULL,
+    "active" boolean NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_webhooks_user" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_webhooks_user_id" ON "webhooks" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "deliveries" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "webhook_id" bigint NOT NULL,
+    "event" text NOT NULL,
+    "payload" text NOT NULL,
+    "attempts" bigint NOT NULL DEFAULT 0,
+    "status_code" bigint,
+    "response" text,
+    "error" text,
+    "delivered_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_deliveries_webhook" FOREIGN KEY ("webhook_id") REFERENCES "webhooks"("id") ON DELETE CASCADE
+);
+ALTER TABLE "deliveries"
+    ADD COLUMN IF NOT EXISTS "attempts" bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "status_code" bigint,
+    ADD COLUMN IF NOT EXISTS "response" text,
+    ADD COLUMN IF NOT EXISTS "error" text,
+    ADD COLUMN IF NOT EXISTS "delivered_at" timestamptz;
+CREATE INDEX IF NOT EXISTS "idx_deliveries_webhook_id" ON "deliveries" ("webhook_id");
+
+-- Full-text search indexes. Their expressions have to match the documents
+-- searched by models/search.go exactly, otherwise Postgres ignores them.
+-- idx_galleries_search was replaced by idx_galleries_search_text, which includes the description.
+DROP INDEX IF EXISTS idx_galleries_search;
+CREATE INDEX IF NOT EXISTS idx_galleries_search_text
+    ON galleries USING GIN (to_tsvector('english', galleries.title || ' ' || galleries.description));
+CREATE INDEX IF NOT EXISTS idx_images_search
+    ON images USING GIN (to_tsvector('english', images.caption || ' ' || images.filename || ' ' || images.camera_make || ' ' || images.camera_model || ' ' || images.lens_model));
+CREATE INDEX IF NOT EXISTS idx_tags_search
+    ON tags USING GIN (to_tsvector('english', tags.name));
@@ -0,0 +1,2 @@
+-- Responses of webhook deliveries are no longer kept.
+ALTER TABLE "deliveries" DROP COLUMN "response";
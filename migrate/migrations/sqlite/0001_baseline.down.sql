@@ -0,0 +1,9 @@
+-- Rolling back the baseline would remove all data, so it is refused.
+-- Restore a backup instead to get rid of the schema. SQLite only raises
+-- errors in triggers, the temporary ones are rolled back with the error.
+CREATE TEMP TABLE "baseline_rollback" ("refused" boolean);
+CREATE TEMP TRIGGER "baseline_rollback_refused" BEFORE INSERT ON "baseline_rollback"
+BEGIN
+    SELECT RAISE(ABORT, 'the baseline cannot be rolled back, it would remove all data');
+END;
+INSERT INTO "baseline_rollback" VALUES (true);
@@ -0,0 +1,245 @@
+-- The schema of the Postgres baseline for SQLite. Times are stored as
+-- datetime, so the driver reads them back as times.
+
+CREATE TABLE IF NOT EXISTS "users" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "name" text,
+    "email" text NOT NULL,
+    "password_hash" text NOT NULL,
+    "remember_hash" text NOT NULL,
+    "plan" text NOT NULL DEFAULT 'free',
+    "storage_bytes" bigint NOT NULL DEFAULT 0,
+    "handle" text NOT NULL DEFAULT '',
+    "bio" text NOT NULL DEFAULT '',
+    "avatar" text NOT NULL DEFAULT '',
+    "admin" boolean NOT NULL DEFAULT false
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_handle" ON "users" ("handle") WHERE handle <> '';
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_remember_hash" ON "users" ("remember_hash");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_email" ON "users" ("email");
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "galleries" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "user_id" bigint,
+    "title" text,
+    "description" text NOT NULL DEFAULT '',
+    "storage_bytes" bigint NOT NULL DEFAULT 0,
+    "public" boolean NOT NULL DEFAULT false,
+    "proofing" boolean NOT NULL DEFAULT false,
+    "share_token" text NOT NULL DEFAULT '',
+    "selection_limit" bigint NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_galleries_share_token" ON "galleries" ("share_token") WHERE share_token <> '';
+CREATE INDEX IF NOT EXISTS "idx_galleries_public" ON "galleries" ("public");
+CREATE INDEX IF NOT EXISTS "idx_galleries_user_id" ON "galleries" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_galleries_deleted_at" ON "galleries" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "uploads" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "token" text NOT NULL,
+    "user_id" bigint NOT NULL,
+    "gallery_id" bigint NOT NULL,
+    "filename" text NOT NULL,
+    "size" bigint NOT NULL,
+    "offset" bigint NOT NULL,
+    "checksum" text,
+    "expires_at" datetime NOT NULL
+);
+CREATE INDEX IF NOT EXISTS "idx_uploads_user_id" ON "uploads" ("user_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_uploads_token" ON "uploads" ("token");
+CREATE INDEX IF NOT EXISTS "idx_uploads_deleted_at" ON "uploads" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_uploads_expires_at" ON "uploads" ("expires_at");
+CREATE INDEX IF NOT EXISTS "idx_uploads_gallery_id" ON "uploads" ("gallery_id");
+
+CREATE TABLE IF NOT EXISTS "images" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "deleted_at" datetime,
+    "gallery_id" bigint NOT NULL,
+    "filename" text NOT NULL,
+    "uploader_id" bigint NOT NULL DEFAULT 0,
+    "status" text NOT NULL,
+    "width" bigint,
+    "height" bigint,
+    "size" bigint NOT NULL DEFAULT 0,
+    "content_hash" text,
+    "perceptual_hash" bigint,
+    "caption" text NOT NULL DEFAULT '',
+    "camera_make" text NOT NULL DEFAULT '',
+    "camera_model" text NOT NULL DEFAULT '',
+    "lens_model" text NOT NULL DEFAULT '',
+    "taken_at" datetime,
+    "iso" bigint NOT NULL DEFAULT 0,
+    "exposure_time" text NOT NULL DEFAULT '',
+    "f_number" decimal NOT NULL DEFAULT 0.000000,
+    "focal_length" decimal NOT NULL DEFAULT 0.000000
+);
+CREATE INDEX IF NOT EXISTS "idx_images_content_hash" ON "images" ("content_hash");
+CREATE INDEX IF NOT EXISTS "idx_images_uploader_id" ON "images" ("uploader_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_images_gallery_filename" ON "images" ("gallery_id","filename");
+CREATE INDEX IF NOT EXISTS "idx_images_deleted_at" ON "images" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "jobs" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "kind" text NOT NULL,
+    "payload" text NOT NULL,
+    "status" text NOT NULL,
+    "run_at" datetime NOT NULL,
+    "attempts" bigint NOT NULL,
+    "max_attempts" bigint NOT NULL,
+    "locked_at" datetime,
+    "last_error" text
+);
+CREATE INDEX IF NOT EXISTS "idx_jobs_status_run_at" ON "jobs" ("status","run_at");
+
+CREATE TABLE IF NOT EXISTS "tags" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "user_id" bigint NOT NULL,
+    "name" text NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_tags_user_name" ON "tags" ("user_id","name");
+
+CREATE TABLE IF NOT EXISTS "image_tags" (
+    "image_id" bigint,
+    "tag_id" bigint,
+    PRIMARY KEY ("image_id","tag_id"),
+    CONSTRAINT "fk_image_tags_image" FOREIGN KEY ("image_id") REFERENCES "images"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_image_tags_tag" FOREIGN KEY ("tag_id") REFERENCES "tags"("id") ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_image_tags_tag_id" ON "image_tags" ("tag_id");
+
+CREATE TABLE IF NOT EXISTS "gallery_tags" (
+    "gallery_id" bigint,
+    "tag_id" bigint,
+    PRIMARY KEY ("gallery_id","tag_id"),
+    CONSTRAINT "fk_gallery_tags_gallery" FOREIGN KEY ("gallery_id") REFERENCES "galleries"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_gallery_tags_tag" FOREIGN KEY ("tag_id") REFERENCES "tags"("id") ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_gallery_tags_tag_id" ON "gallery_tags" ("tag_id");
+
+CREATE TABLE IF NOT EXISTS "proofers" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "gallery_id" bigint NOT NULL,
+    "user_id" bigint,
+    "token" text NOT NULL,
+    "name" text NOT NULL DEFAULT '',
+    "submitted_at" datetime,
+    CONSTRAINT "fk_proofers_gallery" FOREIGN KEY ("gallery_id") REFERENCES "galleries"("id") ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_proofers_token" ON "proofers" ("token");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_proofers_gallery_user" ON "proofers" ("gallery_id","user_id");
+
+CREATE TABLE IF NOT EXISTS "picks" (
+    "proofer_id" bigint,
+    "image_id" bigint,
+    "favourite" boolean NOT NULL DEFAULT false,
+    "selected" boolean NOT NULL DEFAULT false,
+    PRIMARY KEY ("proofer_id","image_id"),
+    CONSTRAINT "fk_picks_proofer" FOREIGN KEY ("proofer_id") REFERENCES "proofers"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_picks_image" FOREIGN KEY ("image_id") REFERENCES "images"("id") ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_picks_image_id" ON "picks" ("image_id");
+
+CREATE TABLE IF NOT EXISTS "comments" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "proofer_id" bigint NOT NULL,
+    "image_id" bigint NOT NULL,
+    "body" text NOT NULL,
+    CONSTRAINT "fk_comments_proofer" FOREIGN KEY ("proofer_id") REFERENCES "proofers"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_comments_image" FOREIGN KEY ("image_id") REFERENCES "images"("id") ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_comments_image_id" ON "comments" ("image_id");
+CREATE INDEX IF NOT EXISTS "idx_comments_proofer_id" ON "comments" ("proofer_id");
+
+CREATE TABLE IF NOT EXISTS "members" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "gallery_id" bigint NOT NULL,
+    "user_id" bigint NOT NULL,
+    "role" text NOT NULL,
+    CONSTRAINT "fk_members_gallery" FOREIGN KEY ("gallery_id") REFERENCES "galleries"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_members_user" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_members_gallery_user" ON "members" ("gallery_id","user_id");
+CREATE INDEX IF NOT EXISTS "idx_members_user_id" ON "members" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "invitations" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "gallery_id" bigint NOT NULL,
+    "invited_by_id" bigint NOT NULL,
+    "email" text NOT NULL,
+    "role" text NOT NULL,
+    "token_hash" text NOT NULL,
+    "expires_at" datetime,
+    CONSTRAINT "fk_invitations_gallery" FOREIGN KEY ("gallery_id") REFERENCES "galleries"("id") ON DELETE CASCADE,
+    CONSTRAINT "fk_invitations_invited_by" FOREIGN KEY ("invited_by_id") REFERENCES "users"("id") ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_invitations_token_hash" ON "invitations" ("token_hash");
+CREATE INDEX IF NOT EXISTS "idx_invitations_gallery_id" ON "invitations" ("gallery_id");
+
+CREATE TABLE IF NOT EXISTS "audit_entries" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "actor_id" bigint,
+    "action" text NOT NULL,
+    "target_type" text NOT NULL,
+    "target_id" bigint NOT NULL,
+    "ip" text NOT NULL DEFAULT '',
+    "user_agent" text NOT NULL DEFAULT '',
+    "changes" text,
+    CONSTRAINT "fk_audit_entries_actor" FOREIGN KEY ("actor_id") REFERENCES "users"("id") ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_actor_id" ON "audit_entries" ("actor_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_created_at" ON "audit_entries" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_target" ON "audit_entries" ("target_type","target_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_action" ON "audit_entries" ("action");
+
+CREATE TABLE IF NOT EXISTS "webhooks" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "user_id" bigint NOT NULL,
+    "url" text NOT NULL,
+    "events" text NOT NULL,
+    "secret" text NOT NULL,
+    "active" boolean NOT NULL,
+    CONSTRAINT "fk_webhooks_user" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_webhooks_user_id" ON "webhooks" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "deliveries" (
+    "id" integer PRIMARY KEY AUTOINCREMENT,
+    "created_at" datetime,
+    "updated_at" datetime,
+    "webhook_id" bigint NOT NULL,
+    "event" text NOT NULL,
+    "payload" text NOT NULL,
+    "attempts" bigint NOT NULL DEFAULT 0,
+    "status_code" bigint,
+    "response" text,
+    "error" text,
+    "delivered_at" datetime,
+    CONSTRAINT "fk_deliveries_webhook" FOREIGN KEY ("webhook_id") REFERENCES "webhooks"("id") ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_deliveries_webhook_id" ON "deliveries" ("webhook_id");
+
+-- Search matches words with LIKE on SQLite, which cannot use indexes.
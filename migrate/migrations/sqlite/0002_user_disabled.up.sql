@@ -0,0 +1,2 @@
+-- Disabled users cannot log in.
+ALTER TABLE "users" ADD COLUMN "disabled" boolean NOT NULL DEFAULT false;
@@ -0,0 +1 @@
+ALTER TABLE "deliveries" ADD COLUMN "response" text;
@@ -0,0 +1,396 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	AuditUserCreate       = "user.create"
+	AuditUserUpdate       = "user.update"
+	AuditUserLogin        = "user.login"
+	AuditUserLoginFailed  = "user.login_failed"
+	AuditUserLogout       = "user.logout"
+	AuditGalleryCreate    = "gallery.create"
+	AuditGalleryUpdate    = "gallery.update"
+	AuditGalleryDelete    = "gallery.delete"
+	AuditGalleryRestore   = "gallery.restore"
+	AuditGalleryPurge     = "gallery.purge"
+	AuditImageUpload      = "image.upload"
+	AuditImageUpdate      = "image.update"
+	AuditImageDelete      = "image.delete"
+	AuditImageRestore     = "image.restore"
+	AuditImagePurge       = "image.purge"
+	AuditMemberUpdate     = "member.update"
+	AuditMemberRemove     = "member.remove"
+	AuditInvitationCreate = "invitation.create"
+	AuditInvitationRevoke = "invitation.revoke"
+	AuditInvitationAccept = "invitation.accept"
+	AuditWebhookCreate    = "webhook.create"
+	AuditWebhookUpdate    = "webhook.update"
+	AuditWebhookDelete    = "webhook.delete"
+
+	AuditTargetUser    = "user"
+	AuditTargetGallery = "gallery"
+	AuditTargetImage   = "image"
+	AuditTargetWebhook = "webhook"
+
+	// maxAuditPageSize limits the number of entries returned by a single search.
+	maxAuditPageSize = 200
+	// maxUserAgentLength limits the stored user agents, the header can be of any length.
+	maxUserAgentLength = 512
+	// maxIPLength limits the stored addresses, which fits any IPv6 address with a zone.
+	maxIPLength = 64
+
+	// redacted replaces the values of secrets in changes.
+	redacted = "[redacted]"
+)
+
+// AuditActions lists every action recorded in the audit log.
+var AuditActions = []string{
+	AuditUserCreate, AuditUserUpdate, AuditUserLogin, AuditUserLoginFailed, AuditUserLogout,
+	AuditGalleryCreate, AuditGalleryUpdate, AuditGalleryDelete, AuditGalleryRestore, AuditGalleryPurge,
+	AuditImageUpload, AuditImageUpdate, AuditImageDelete, AuditImageRestore, AuditImagePurge,
+	AuditMemberUpdate, AuditMemberRemove,
+	AuditInvitationCreate, AuditInvitationRevoke, AuditInvitationAccept,
+	AuditWebhookCreate, AuditWebhookUpdate, AuditWebhookDelete,
+}
+
+// AuditTargets lists the kinds of targets of audit entries. Members and
+// invitations are recorded as changes of their gallery, members are
+// only ever added by accepting an invitation.
+var AuditTargets = []string{AuditTargetUser, AuditTargetGallery, AuditTargetImage, AuditTargetWebhook}
+
+// securityActions are the actions on an account shown to its user.
+var securityActions = []string{
+	AuditUserCreate, AuditUserUpdate, AuditUserLogin, AuditUserLoginFailed, AuditUserLogout,
+}
+
+// AuditEntry records who did what to which user, gallery or image.
+// Entries are never changed, they are only removed once they are
+// older than the retention window.
+type AuditEntry struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	// ActorID is the user who did it, it is nil for visitors
+	// who were not signed in, such as failed logins.
+	ActorID *uint  `gorm:"index"`
+	Action  string `gorm:"not null;index"`
+	// TargetID is zero if the target is unknown, like the
+	// account of a failed login with an unknown email address.
+	TargetType string  `gorm:"not null;index:idx_audit_entries_target"`
+	TargetID   uint    `gorm:"not null;index:idx_audit_entries_target"`
+	IP         string  `gorm:"not null;default:''"`
+	UserAgent  string  `gorm:"not null;default:''"`
+	Changes    Changes `gorm:"type:text"`
+	Actor      *User   `gorm:"constraint:OnDelete:SET NULL"`
+}
+
+// Change is the value of a field before and after an action.
+type Change struct {
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// String formats the change as "old → new" for display.
+func (c Change) String() string {
+	switch {
+	case c.Old == nil:
+		return fmt.Sprint(c.New)
+	case c.New == nil:
+		return fmt.Sprintf("%v (removed)", c.Old)
+	}
+	return fmt.Sprintf("%v → %v", c.Old, c.New)
+}
+
+// Changes maps the column names of changed fields to their change.
+type Changes map[string]Change
+
+// Value stores the changes as JSON.
+func (c Changes) Value() (driver.Value, error) {
+	if len(c) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan reads changes stored as JSON.
+func (c *Changes) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("models: cannot scan %T into Changes", value)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, c)
+}
+
+// Diff returns the changed columns between two values of the same model,
+// either of which may be nil for models which are created or deleted.
+// Only plain columns are compared, associations and the fields of
+// gorm.Model are left out. Passwords, hashes and tokens are redacted.
+func Diff(before, after interface{}) Changes {
+	changes := Changes{}
+	b, a := structValue(before), structValue(after)
+	t := a
+	if !t.IsValid() {
+		t = b
+	}
+	if !t.IsValid() {
+		return changes
+	}
+	naming := schema.NamingStrategy{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Type().Field(i)
+		if !auditedField(field) {
+			continue
+		}
+		var change Change
+		if b.IsValid() {
+			change.Old = b.Field(i).Interface()
+		}
+		if a.IsValid() {
+			change.New = a.Field(i).Interface()
+		}
+		if b.IsValid() && a.IsValid() {
+			if reflect.DeepEqual(change.Old, change.New) {
+				continue
+			}
+		} else if t.Field(i).IsZero() {
+			continue
+		}
+		if secretField(field.Name) {
+			change = redact(change)
+		}
+		changes[naming.ColumnName("", field.Name)] = change
+	}
+	return changes
+}
+
+// structValue dereferences v, the result is invalid if v is nil.
+func structValue(v interface{}) reflect.Value {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return reflect.Value{}
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	return rv
+}
+
+// auditedField reports whether the field is a plain column.
+func auditedField(field reflect.StructField) bool {
+	if field.Anonymous || field.PkgPath != "" {
+		return false
+	}
+	tag := field.Tag.Get("gorm")
+	if tag == "-" || strings.Contains(tag, "->") {
+		return false
+	}
+	switch field.Type.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Ptr, reflect.Interface:
+		return false
+	case reflect.Struct:
+		return field.Type == reflect.TypeOf(time.Time{})
+	}
+	return true
+}
+
+func secretField(name string) bool {
+	return strings.Contains(name, "Password") ||
+		strings.HasSuffix(name, "Hash") ||
+		strings.HasSuffix(name, "Token") ||
+		strings.HasSuffix(name, "Secret")
+}
+
+// redact keeps whether a secret was set, but not its value.
+func redact(change Change) Change {
+	if change.Old != nil && !reflect.ValueOf(change.Old).IsZero() {
+		change.Old = redacted
+	}
+	if change.New != nil && !reflect.ValueOf(change.New).IsZero() {
+		change.New = redacted
+	}
+	return change
+}
+
+// AuditQuery filters the entries of the audit log, zero values do not filter.
+type AuditQuery struct {
+	ActorID    uint
+	Actions    []string
+	TargetType string
+	TargetID   uint
+	// From is inclusive and Until is exclusive.
+	From  time.Time
+	Until time.Time
+	// Limit is at most 200, entries are returned newest first.
+	Limit  int
+	Offset int
+}
+
+// AuditDB is used to interact with the audit log database.
+// There is no way to change entries, they can only be
+// added and removed once they are old enough.
+type AuditDB interface {
+	Create(entry *AuditEntry) error
+	// Search returns the entries matching the query with their actors.
+	Search(q AuditQuery) ([]AuditEntry, error)
+	// DeleteBefore removes the entries created before the time
+	// and returns how many were removed.
+	DeleteBefore(before time.Time) (int64, error)
+}
+
+// AuditService is a set of methods used to record and read the audit log.
+type AuditService interface {
+	AuditDB
+	// SecurityEvents returns the most recent logins, failed logins and
+	// changes of the account of the user, newest first.
+	SecurityEvents(userID uint, limit int) ([]AuditEntry, error)
+	// Prune removes entries older than the retention window
+	// and returns how many were removed. Without a retention
+	// window of at least a day, every entry is kept.
+	Prune(now time.Time) (int64, error)
+}
+
+func NewAuditService(db *gorm.DB, retention time.Duration) AuditService {
+	return &auditService{
+		AuditDB:   &auditValidator{&auditGorm{db}},
+		retention: retention,
+	}
+}
+
+// Confirm that auditService implements AuditService interface.
+var _ AuditService = &auditService{}
+
+type auditService struct {
+	AuditDB
+	retention time.Duration
+}
+
+func (as *auditService) SecurityEvents(userID uint, limit int) ([]AuditEntry, error) {
+	return as.Search(AuditQuery{
+		Actions:    securityActions,
+		TargetType: AuditTargetUser,
+		TargetID:   userID,
+		Limit:      limit,
+	})
+}
+
+func (as *auditService) Prune(now time.Time) (int64, error) {
+	if as.retention < 24*time.Hour {
+		return 0, nil
+	}
+	return as.DeleteBefore(now.Add(-as.retention))
+}
+
+// Confirm that auditValidator implements AuditDB interface.
+var _ AuditDB = &auditValidator{}
+
+type auditValidator struct {
+	AuditDB
+}
+
+func (av *auditValidator) Create(entry *AuditEntry) error {
+	if entry.Action == "" {
+		return ErrAuditActionRequired
+	}
+	if entry.TargetType == "" {
+		return ErrAuditTargetRequired
+	}
+	// Both come from the client, which must not be able to make the insert fail.
+	entry.IP = clientText(entry.IP, maxIPLength)
+	entry.UserAgent = clientText(entry.UserAgent, maxUserAgentLength)
+	return av.AuditDB.Create(entry)
+}
+
+// clientText makes text sent by a client storable in any database, by replacing
+// invalid UTF-8, dropping NUL bytes and cutting it to at most max bytes
+// without splitting a character.
+func clientText(s string, max int) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, string(utf8.RuneError)), "\x00", "")
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+func (av *auditValidator) Search(q AuditQuery) ([]AuditEntry, error) {
+	if q.Limit <= 0 || q.Limit > maxAuditPageSize {
+		q.Limit = maxAuditPageSize
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	return av.AuditDB.Search(q)
+}
+
+// Confirm that auditGorm implements AuditDB interface.
+var _ AuditDB = &auditGorm{}
+
+type auditGorm struct {
+	db *gorm.DB
+}
+
+func (ag *auditGorm) Create(entry *AuditEntry) error {
+	return ag.db.Omit("Actor").Create(entry).Error
+}
+
+func (ag *auditGorm) Search(q AuditQuery) ([]AuditEntry, error) {
+	db := ag.db.Preload("Actor")
+	if q.ActorID > 0 {
+		db = db.Where("actor_id = ?", q.ActorID)
+	}
+	if len(q.Actions) > 0 {
+		db = db.Where("action IN ?", q.Actions)
+	}
+	if q.TargetType != "" {
+		db = db.Where("target_type = ?", q.TargetType)
+	}
+	if q.TargetID > 0 {
+		db = db.Where("target_id = ?", q.TargetID)
+	}
+	if !q.From.IsZero() {
+		db = db.Where("created_at >= ?", q.From)
+	}
+	if !q.Until.IsZero() {
+		db = db.Where("created_at < ?", q.Until)
+	}
+	var entries []AuditEntry
+	err := db.Order("id DESC").Limit(q.Limit).Offset(q.Offset).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (ag *auditGorm) DeleteBefore(before time.Time) (int64, error) {
+	result := ag.db.Where("created_at < ?", before).Delete(&AuditEntry{})
+	return result.RowsAffected, result.Error
+}
@@ -17,6 +17,9 @@ const (
 	// ErrTitleRequired is returned when a title is not provided.
 	ErrTitleRequired publicError = "title is required"
 
+	// ErrDescriptionTooLong is returned when a description is longer than 10000 characters.
+	ErrDescriptionTooLong publicError = "description must be at most 10000 characters"
+
 	// ErrInvalidPassword is returned when an invalid password is used for login.
 	ErrInvalidPassword publicError = "password is invalid"
 
@@ -40,6 +43,128 @@ const (
 
 	// ErrRequiredRemember is returned when an empty remember token is provided
 	ErrRequiredRemember privateError = "remember token is required"
+
+	// ErrInvalidHandle is returned when a handle contains characters other than letters, numbers and underscores.
+	ErrInvalidHandle publicError = "handle must be 3 to 30 letters, numbers or underscores"
+
+	// ErrUnavailableHandle is returned when a handle is already taken.
+	ErrUnavailableHandle publicError = "handle is already taken"
+
+	// ErrInvalidAvatar is returned when an avatar is not a JPEG, PNG or GIF image up to 5 megabytes and 4096 pixels wide and high.
+	ErrInvalidAvatar publicError = "avatar must be a jpg, png or gif image of up to 5 MB and 4096x4096 pixels"
+
+	// ErrGalleryIDRequired is returned when a gallery ID is not provided.
+	ErrGalleryIDRequired privateError = "gallery ID is required"
+
+	// ErrInvalidImagePath is returned when a file to be imported
+	// is not stored in the directory of a gallery.
+	ErrInvalidImagePath privateError = "path is not in the directory of a gallery"
+
+	// ErrJobKindRequired is returned when a job is enqueued without a kind.
+	ErrJobKindRequired privateError = "job kind is required"
+
+	// ErrFilenameRequired is returned when an upload is started without a filename.
+	ErrFilenameRequired publicError = "filename is required"
+
+	// ErrUploadSizeRequired is returned when an upload is started without its total size.
+	ErrUploadSizeRequired publicError = "upload size is required"
+
+	// ErrUploadTooLarge is returned when an upload exceeds MaxUploadSize or its declared size.
+	ErrUploadTooLarge publicError = "upload is too large"
+
+	// ErrUploadOffset is returned when a chunk does not continue where the upload left off.
+	ErrUploadOffset publicError = "upload offset does not match"
+
+	// ErrUploadIncomplete is returned when an upload is finished before all chunks are received.
+	ErrUploadIncomplete publicError = "upload is incomplete"
+
+	// ErrUploadExpired is returned when a chunk is sent to an abandoned upload.
+	ErrUploadExpired publicError = "upload has expired"
+
+	// ErrQuotaExceeded is returned when storing a file would take a user over their storage quota.
+	ErrQuotaExceeded publicError = "upload exceeds your storage quota"
+
+	// ErrChecksumAlgorithm is returned when a checksum uses an algorithm other than sha256.
+	ErrChecksumAlgorithm publicError = "checksum algorithm is not supported"
+
+	// ErrChecksumInvalid is returned when a checksum cannot be decoded.
+	ErrChecksumInvalid publicError = "checksum is invalid"
+
+	// ErrChecksumMismatch is returned when received data does not match its checksum.
+	ErrChecksumMismatch publicError = "checksum does not match"
+
+	// ErrTagNameRequired is returned when a tag has no name.
+	ErrTagNameRequired publicError = "tag name is required"
+
+	// ErrInvalidTagName is returned when a tag name is too long or contains a comma or slash.
+	ErrInvalidTagName publicError = "tags must be up to 50 characters and cannot contain commas or slashes"
+
+	// ErrInvalidCursor is returned when a pagination cursor cannot be decoded.
+	ErrInvalidCursor publicError = "page link is invalid"
+
+	// ErrInvalidDate is returned when a date is not formatted as YYYY-MM-DD.
+	ErrInvalidDate publicError = "date is invalid"
+
+	// ErrInvalidRole is returned when a member is given a role other than viewer, contributor, editor or owner.
+	ErrInvalidRole publicError = "role must be viewer, contributor, editor or owner"
+
+	// ErrInvitationExpired is returned when an invitation is accepted after it expired.
+	ErrInvitationExpired publicError = "invitation has expired, ask for a new one"
+
+	// ErrInvitationEmail is returned when an invitation is accepted by a user with another email address.
+	ErrInvitationEmail publicError = "invitation was sent to another email address, sign in with that one"
+
+	// ErrInvalidSelectionLimit is returned when the selection limit of a gallery is negative.
+	ErrInvalidSelectionLimit publicError = "selection limit cannot be negative"
+
+	// ErrProofingDisabled is returned when a gallery is proofed which does not have proofing enabled.
+	ErrProofingDisabled publicError = "proofing is not enabled for this gallery"
+
+	// ErrInvalidPick is returned when an image is picked as something other than a favourite or a selection.
+	ErrInvalidPick privateError = "pick must be a favourite or a selection"
+
+	// ErrSelectionLimit is returned when selecting an image would exceed the selection limit of a gallery.
+	ErrSelectionLimit publicError = "selection limit is reached, unselect an image first"
+
+	// ErrSelectionSubmitted is returned when a submitted selection is changed.
+	ErrSelectionSubmitted publicError = "selection was already submitted"
+
+	// ErrSelectionEmpty is returned when a selection is submitted without any selected images.
+	ErrSelectionEmpty publicError = "select at least one image before submitting"
+
+	// ErrProoferNameRequired is returned when a selection is submitted without a name.
+	ErrProoferNameRequired publicError = "name is required"
+
+	// ErrProoferNameTooLong is returned when the name of a proofer is longer than 100 characters.
+	ErrProoferNameTooLong publicError = "name must be at most 100 characters"
+
+	// ErrCommentRequired is returned when a comment is empty.
+	ErrCommentRequired publicError = "comment is required"
+
+	// ErrCommentTooLong is returned when a comment is longer than 2000 characters.
+	ErrCommentTooLong publicError = "comment must be at most 2000 characters"
+
+	// ErrWebhookURLRequired is returned when a webhook is saved without a URL.
+	ErrWebhookURLRequired publicError = "URL is required"
+
+	// ErrInvalidWebhookURL is returned when the URL of a webhook is not an absolute http or https URL.
+	ErrInvalidWebhookURL publicError = "URL must start with http:// or https://"
+
+	// ErrPrivateWebhookURL is returned when the URL of a webhook points into
+	// the network of the server, which webhooks must not be able to reach.
+	ErrPrivateWebhookURL publicError = "URL must not point to a local or private address"
+
+	// ErrInvalidWebhookEvents is returned when a webhook subscribes to no or to unknown events.
+	ErrInvalidWebhookEvents publicError = "select at least one event"
+
+	// ErrAccountDisabled is returned when a disabled user tries to log in.
+	ErrAccountDisabled publicError = "account is disabled, contact the administrator"
+
+	// ErrAuditActionRequired is returned when an audit entry is created without an action.
+	ErrAuditActionRequired privateError = "audit entry action is required"
+
+	// ErrAuditTargetRequired is returned when an audit entry is created without a target type.
+	ErrAuditTargetRequired privateError = "audit entry target is required"
 )
 
 type publicError string
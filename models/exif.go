@@ -0,0 +1,102 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Exif holds the camera settings a photo was taken with,
+// as far as they are recorded in the file.
+type Exif struct {
+	CameraMake   string `gorm:"not null;default:''"`
+	CameraModel  string `gorm:"not null;default:''"`
+	LensModel    string `gorm:"not null;default:''"`
+	TakenAt      *time.Time
+	ISO          int     `gorm:"not null;default:0"`
+	ExposureTime string  `gorm:"not null;default:''"`
+	FNumber      float64 `gorm:"not null;default:0"`
+	FocalLength  float64 `gorm:"not null;default:0"`
+}
+
+// Camera returns the make and model of the camera. Most cameras already
+// start their model with the brand, e.g. "NIKON CORPORATION" makes the
+// "NIKON D2H", which is not repeated.
+func (e *Exif) Camera() string {
+	brand := strings.ToLower(e.CameraMake)
+	if i := strings.IndexByte(brand, ' '); i > 0 {
+		brand = brand[:i]
+	}
+	if strings.HasPrefix(strings.ToLower(e.CameraModel), brand) {
+		return e.CameraModel
+	}
+	return strings.TrimSpace(e.CameraMake + " " + e.CameraModel)
+}
+
+// Aperture returns the f-number formatted as e.g. f/2.8.
+func (e *Exif) Aperture() string {
+	if e.FNumber == 0 {
+		return ""
+	}
+	return fmt.Sprintf("f/%g", e.FNumber)
+}
+
+// HasExif reports whether any camera settings are known.
+func (e *Exif) HasExif() bool {
+	return *e != Exif{}
+}
+
+// readExif returns the Exif data of a photo. Files without
+// Exif data, e.g. PNG images, result in empty Exif data.
+func readExif(r io.Reader) Exif {
+	var e Exif
+	x, err := exif.Decode(r)
+	if err != nil {
+		return e
+	}
+	e.CameraMake = exifString(x, exif.Make)
+	e.CameraModel = exifString(x, exif.Model)
+	e.LensModel = exifString(x, exif.LensModel)
+	if t, err := x.DateTime(); err == nil {
+		e.TakenAt = &t
+	}
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		e.ISO, _ = tag.Int(0)
+	}
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if r, err := tag.Rat(0); err == nil {
+			e.ExposureTime = r.RatString()
+		}
+	}
+	e.FNumber = exifFloat(x, exif.FNumber)
+	e.FocalLength = exifFloat(x, exif.FocalLength)
+	return e
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifFloat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	r, err := tag.Rat(0)
+	if err != nil {
+		return 0
+	}
+	f, _ := r.Float64()
+	return f
+}
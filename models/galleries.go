@@ -1,13 +1,175 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"myphoto/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// GallerySortCreated sorts galleries by when they were created.
+	GallerySortCreated = "created"
+	// GallerySortUpdated sorts galleries by when they were last changed.
+	GallerySortUpdated = "updated"
+	// GallerySortTitle sorts galleries alphabetically.
+	GallerySortTitle = "title"
+	// GallerySortImages sorts galleries by their number of images.
+	GallerySortImages = "images"
+
+	// GalleryOrderAsc and GalleryOrderDesc are the directions galleries are sorted in.
+	GalleryOrderAsc  = "asc"
+	GalleryOrderDesc = "desc"
+
+	// GalleriesPublic and GalleriesPrivate filter galleries by visibility.
+	GalleriesPublic  = "public"
+	GalleriesPrivate = "private"
+
+	maxDescriptionLength = 10000
+
+	defaultGalleryPageSize = 20
+	maxGalleryPageSize     = 100
+
+	// galleryImageCount counts the images of a gallery which are not in the trash.
+	galleryImageCount = "(SELECT count(*) FROM images " +
+		"WHERE images.gallery_id = galleries.id AND images.deleted_at IS NULL)"
+)
+
+// gallerySortColumns are the expressions galleries are sorted by.
+var gallerySortColumns = map[string]string{
+	GallerySortCreated: "galleries.created_at",
+	GallerySortUpdated: "galleries.updated_at",
+	GallerySortTitle:   "lower(galleries.title)",
+	GallerySortImages:  galleryImageCount,
+}
+
+// GalleryQuery selects a page of the galleries of a user.
+type GalleryQuery struct {
+	UserID uint
+	// Sort is one of the GallerySort constants, and Order one of the GalleryOrder
+	// constants. Without an Order titles ascend and everything else descends.
+	Sort  string
+	Order string
+	// Visibility is either empty, GalleriesPublic or GalleriesPrivate.
+	Visibility string
+	// Tag only selects galleries with the tag, if it is not empty.
+	Tag string
+	// CreatedFrom and CreatedUntil limit the galleries to those created
+	// in the range, including CreatedFrom and excluding CreatedUntil.
+	CreatedFrom  time.Time
+	CreatedUntil time.Time
+	// After selects the page following the cursor, and Before the page
+	// preceding it. Without a cursor the first page is selected.
+	After  string
+	Before string
+	Limit  int
+}
+
+// GalleryPage is a page of galleries. Next and Prev are the cursors of the
+// following and preceding pages, they are empty if there is no such page.
+type GalleryPage struct {
+	Galleries []Gallery
+	Next      string
+	Prev      string
+}
+
+// galleryCursor is the position of a gallery in a sorted list,
+// its value depends on what the list is sorted by.
+type galleryCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func newGalleryCursor(sort string, g *Gallery) string {
+	c := galleryCursor{
+		Sort: sort,
+		ID:   g.ID,
+	}
+	switch sort {
+	case GallerySortCreated:
+		c.Value = g.CreatedAt.Format(time.RFC3339Nano)
+	case GallerySortUpdated:
+		c.Value = g.UpdatedAt.Format(time.RFC3339Nano)
+	case GallerySortTitle:
+		c.Value = strings.ToLower(g.Title)
+	case GallerySortImages:
+		c.Value = strconv.Itoa(g.ImageCount)
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeGalleryCursor returns the sort value and ID of the cursor.
+func decodeGalleryCursor(sort, cursor string) (interface{}, uint, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	var c galleryCursor
+	if err = json.Unmarshal(b, &c); err != nil || c.Sort != sort {
+		return nil, 0, ErrInvalidCursor
+	}
+	var value interface{}
+	switch sort {
+	case GallerySortCreated, GallerySortUpdated:
+		value, err = time.Parse(time.RFC3339Nano, c.Value)
+	case GallerySortTitle:
+		value = c.Value
+	case GallerySortImages:
+		value, err = strconv.Atoi(c.Value)
+	}
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	return value, c.ID, nil
+}
 
 // Gallery represents the image resources stored in the database.
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not_null;index"`
-	Title  string  `gorm:"not_null"`
-	Images []Image `gorm:"-"`
+	UserID uint   `gorm:"not_null;index"`
+	Title  string `gorm:"not_null"`
+	// Description is written in Markdown.
+	Description  string `gorm:"not null;default:''"`
+	StorageBytes int64  `gorm:"not null;default:0"`
+	// Public galleries are listed on the profile of their
+	// owner and in the directory of the explore page.
+	Public bool `gorm:"not null;default:false;index"`
+	// Proofing galleries can be opened by anyone with the share link,
+	// who can pick favourites, select images and leave comments.
+	Proofing bool `gorm:"not null;default:false"`
+	// ShareToken is the secret of the share link, it is
+	// generated when proofing is enabled.
+	ShareToken string `gorm:"not null;default:'';uniqueIndex:idx_galleries_share_token,where:share_token <> ''"`
+	// SelectionLimit is the number of images each proofer may select, zero means unlimited.
+	SelectionLimit int     `gorm:"not null;default:0"`
+	Images         []Image `gorm:"-"`
+	// Cover is the image shown for the gallery in listings, if it has any.
+	Cover *Image `gorm:"-"`
+	Tags  []Tag  `gorm:"-"`
+	// ImageCount is the number of images, it is only set by GalleryDB.List.
+	ImageCount int `gorm:"->;-:migration"`
+}
+
+// ProofingPath returns the share link of the gallery, or an
+// empty string if proofing has never been enabled.
+func (g *Gallery) ProofingPath() string {
+	if g.ShareToken == "" {
+		return ""
+	}
+	return "/proof/" + g.ShareToken
+}
+
+// ProofingAdminPath returns the URL of the page where the owner reviews the picks of proofers.
+func (g *Gallery) ProofingAdminPath() string {
+	return fmt.Sprintf("/galleries/%d/proofing", g.ID)
 }
 
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
@@ -24,24 +186,67 @@ func (g *Gallery) ImagesSplitN(n int) [][]Image {
 
 type GalleryService interface {
 	GalleryDB
+	// WithContext returns the service running its queries
+	// as part of the trace in ctx, like that of a request.
+	WithContext(ctx context.Context) GalleryService
 }
 
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
 	ByUserID(userID uint) ([]Gallery, error)
+	// All returns the galleries of all users ordered by ID.
+	All() ([]Gallery, error)
+	// SharedWith returns the galleries of other users which the user is a member of, by title.
+	SharedWith(userID uint) ([]Gallery, error)
+	// ByShareToken returns the proofing gallery with the share token.
+	ByShareToken(token string) (*Gallery, error)
+	// List returns a page of the galleries of a user, sorted and filtered
+	// as requested. ErrInvalidCursor is returned for a malformed cursor.
+	List(q GalleryQuery) (*GalleryPage, error)
+	// PublicByUserID returns the public galleries of a user, newest first.
+	PublicByUserID(userID uint) ([]Gallery, error)
+	// RecentPublic returns a page of the public galleries of all users, newest first.
+	RecentPublic(limit, offset int) ([]Gallery, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
+	// Delete moves a gallery to the trash, it can be restored until it is purged.
 	Delete(id uint) error
+
+	// TrashedByID returns a gallery only if it is in the trash.
+	TrashedByID(id uint) (*Gallery, error)
+	TrashedByUserID(userID uint) ([]Gallery, error)
+	// TrashedBefore returns all galleries moved to the trash before t.
+	TrashedBefore(t time.Time) ([]Gallery, error)
+	Restore(id uint) error
+	// Purge removes a gallery from the database for good.
+	Purge(id uint) error
 }
 
 func NewGalleryService(db *gorm.DB) GalleryService {
 	return &galleryService{
 		GalleryDB: &galleryValidator{&galleryGorm{db}},
+		db:        db,
 	}
 }
 
+// NewGalleryServiceFromDB validates galleries like NewGalleryService,
+// but stores them in gdb, like the in-memory GalleryDB of tests.
+func NewGalleryServiceFromDB(gdb GalleryDB) GalleryService {
+	return &galleryService{GalleryDB: &galleryValidator{gdb}}
+}
+
 type galleryService struct {
 	GalleryDB
+	// db is nil for services created by NewGalleryServiceFromDB.
+	db *gorm.DB
+}
+
+func (gs *galleryService) WithContext(ctx context.Context) GalleryService {
+	if gs.db == nil {
+		// Without a database there are no queries to trace.
+		return gs
+	}
+	return NewGalleryService(gs.db.WithContext(ctx))
 }
 
 type galleryValidator struct {
@@ -61,13 +266,52 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 func (gv *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalleryValFuncs(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.descriptionLength,
+		gv.selectionLimit,
+		gv.setShareToken)
 	if err != nil {
 		return err
 	}
 	return gv.GalleryDB.Update(gallery)
 }
 
+// ByShareToken finds nothing for an empty token, rather
+// than the first gallery without a share link.
+func (gv *galleryValidator) ByShareToken(token string) (*Gallery, error) {
+	if token == "" {
+		return nil, ErrResourceNotFound
+	}
+	return gv.GalleryDB.ByShareToken(token)
+}
+
+// List applies the defaults of the query before calling List on the GalleryDB field.
+func (gv *galleryValidator) List(q GalleryQuery) (*GalleryPage, error) {
+	if q.UserID <= 0 {
+		return nil, ErrUserIDRequired
+	}
+	if _, ok := gallerySortColumns[q.Sort]; !ok {
+		q.Sort = GallerySortCreated
+	}
+	if q.Order != GalleryOrderAsc && q.Order != GalleryOrderDesc {
+		q.Order = GalleryOrderDesc
+		if q.Sort == GallerySortTitle {
+			q.Order = GalleryOrderAsc
+		}
+	}
+	if q.Visibility != GalleriesPublic && q.Visibility != GalleriesPrivate {
+		q.Visibility = ""
+	}
+	q.Tag = normalizeTagName(q.Tag)
+	if q.Limit <= 0 {
+		q.Limit = defaultGalleryPageSize
+	}
+	if q.Limit > maxGalleryPageSize {
+		q.Limit = maxGalleryPageSize
+	}
+	return gv.GalleryDB.List(q)
+}
+
 func (gv *galleryValidator) Delete(id uint) error {
 	if id <= 0 {
 		return ErrInvalidID
@@ -75,6 +319,20 @@ func (gv *galleryValidator) Delete(id uint) error {
 	return gv.GalleryDB.Delete(id)
 }
 
+func (gv *galleryValidator) Restore(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+	return gv.GalleryDB.Restore(id)
+}
+
+func (gv *galleryValidator) Purge(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+	return gv.GalleryDB.Purge(id)
+}
+
 type galleryValFunc func(*Gallery) error
 
 func (gv *galleryValidator) userIDRequired(g *Gallery) error {
@@ -91,6 +349,34 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) descriptionLength(g *Gallery) error {
+	if len([]rune(g.Description)) > maxDescriptionLength {
+		return ErrDescriptionTooLong
+	}
+	return nil
+}
+
+func (gv *galleryValidator) selectionLimit(g *Gallery) error {
+	if g.SelectionLimit < 0 {
+		return ErrInvalidSelectionLimit
+	}
+	return nil
+}
+
+// setShareToken generates a share link for galleries with proofing enabled, and
+// keeps an existing one, so links stay valid when proofing is turned off and on.
+func (gv *galleryValidator) setShareToken(g *Gallery) error {
+	if !g.Proofing || g.ShareToken != "" {
+		return nil
+	}
+	token, err := rand.String(shareTokenBytes)
+	if err != nil {
+		return err
+	}
+	g.ShareToken = token
+	return nil
+}
+
 func runGalleryValFuncs(gallery *Gallery, fns ...galleryValFunc) error {
 	for _, fn := range fns {
 		if err := fn(gallery); err != nil {
@@ -122,15 +408,190 @@ func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	return galleries, nil
 }
 
+func (gg *galleryGorm) All() ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Order("id").Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) SharedWith(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Select("galleries.*").
+		Joins("JOIN members ON members.gallery_id = galleries.id").
+		Where("members.user_id = ?", userID).
+		Order("lower(galleries.title), galleries.id").
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) ByShareToken(token string) (*Gallery, error) {
+	var gallery Gallery
+	err := first(gg.db.Where("share_token = ? AND proofing", token), &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+// List uses keyset pagination: a page continues right after the sort
+// value and ID of the last gallery of the previous page, so pages stay
+// consistent while galleries are added and queries do not slow down with
+// the page number like OFFSET does. Before pages are selected in reverse.
+func (gg *galleryGorm) List(q GalleryQuery) (*GalleryPage, error) {
+	column := gallerySortColumns[q.Sort]
+	db := gg.db.Model(&Gallery{}).
+		Select("galleries.*, "+galleryImageCount+" AS image_count").
+		Where("galleries.user_id = ?", q.UserID)
+	switch q.Visibility {
+	case GalleriesPublic:
+		db = db.Where("galleries.public")
+	case GalleriesPrivate:
+		db = db.Where("NOT galleries.public")
+	}
+	if q.Tag != "" {
+		db = db.Where(`EXISTS (SELECT 1 FROM gallery_tags
+			JOIN tags ON tags.id = gallery_tags.tag_id
+			WHERE gallery_tags.gallery_id = galleries.id AND tags.name = ?)`, q.Tag)
+	}
+	if !q.CreatedFrom.IsZero() {
+		db = db.Where("galleries.created_at >= ?", q.CreatedFrom)
+	}
+	if !q.CreatedUntil.IsZero() {
+		db = db.Where("galleries.created_at < ?", q.CreatedUntil)
+	}
+
+	cursor, backward := q.After, false
+	if cursor == "" && q.Before != "" {
+		cursor, backward = q.Before, true
+	}
+	// Walking backward the order is reversed, and so is the comparison.
+	desc := (q.Order == GalleryOrderDesc) != backward
+	op, dir := ">", "ASC"
+	if desc {
+		op, dir = "<", "DESC"
+	}
+	if cursor != "" {
+		value, id, err := decodeGalleryCursor(q.Sort, cursor)
+		if err != nil {
+			return nil, err
+		}
+		db = db.Where(fmt.Sprintf("(%s, galleries.id) %s (?, ?)", column, op), value, id)
+	}
+
+	var galleries []Gallery
+	err := db.Order(fmt.Sprintf("%s %s, galleries.id %s", column, dir, dir)).
+		Limit(q.Limit + 1).
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	more := len(galleries) > q.Limit
+	if more {
+		galleries = galleries[:q.Limit]
+	}
+	if backward {
+		for i, j := 0, len(galleries)-1; i < j; i, j = i+1, j-1 {
+			galleries[i], galleries[j] = galleries[j], galleries[i]
+		}
+	}
+
+	page := GalleryPage{Galleries: galleries}
+	if len(galleries) == 0 {
+		return &page, nil
+	}
+	first, last := &galleries[0], &galleries[len(galleries)-1]
+	// There is always a page on the other side of the cursor.
+	if backward {
+		page.Next = newGalleryCursor(q.Sort, last)
+		if more {
+			page.Prev = newGalleryCursor(q.Sort, first)
+		}
+	} else {
+		if more {
+			page.Next = newGalleryCursor(q.Sort, last)
+		}
+		if q.After != "" {
+			page.Prev = newGalleryCursor(q.Sort, first)
+		}
+	}
+	return &page, nil
+}
+
+func (gg *galleryGorm) PublicByUserID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Where("user_id = ? AND public", userID).Order("created_at DESC").Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) RecentPublic(limit, offset int) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Where("public").
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
 func (gg *galleryGorm) Create(gallery *Gallery) error {
 	return gg.db.Create(gallery).Error
 }
 
+// Update leaves out the stored bytes, which are only changed by the
+// ImageDB, so a gallery loaded before an upload cannot undo its usage.
 func (gg *galleryGorm) Update(gallery *Gallery) error {
-	return gg.db.Save(gallery).Error
+	return gg.db.Omit("storage_bytes").Save(gallery).Error
 }
 
 func (gg *galleryGorm) Delete(id uint) error {
 	gallery := Gallery{Model: gorm.Model{ID: id}}
 	return gg.db.Delete(&gallery).Error
 }
+
+func (gg *galleryGorm) TrashedByID(id uint) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	err := first(db, &gallery)
+	return &gallery, err
+}
+
+func (gg *galleryGorm) TrashedByUserID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Unscoped().
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at DESC").
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) TrashedBefore(t time.Time) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Unscoped().Where("deleted_at < ?", t).Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) Restore(id uint) error {
+	return gg.db.Unscoped().Model(&Gallery{}).Where("id = ?", id).Update("deleted_at", nil).Error
+}
+
+func (gg *galleryGorm) Purge(id uint) error {
+	return gg.db.Unscoped().Delete(&Gallery{}, id).Error
+}
@@ -0,0 +1,300 @@
+package models_test
+
+import (
+	"errors"
+	"fmt"
+	"myphoto/models"
+	"myphoto/models/modelstest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newGalleryService() (models.GalleryService, *modelstest.GalleryDB) {
+	gdb := modelstest.NewGalleryDB()
+	return models.NewGalleryServiceFromDB(gdb), gdb
+}
+
+func TestGalleryValidatorCreate(t *testing.T) {
+	tests := []struct {
+		name    string
+		gallery models.Gallery
+		wantErr error
+	}{
+		{"valid", models.Gallery{UserID: 1, Title: "Holiday"}, nil},
+		{"title required", models.Gallery{UserID: 1}, models.ErrTitleRequired},
+		{"user ID required", models.Gallery{Title: "Holiday"}, models.ErrUserIDRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs, _ := newGalleryService()
+			gallery := tt.gallery
+			err := gs.Create(&gallery)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Create() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && gallery.ID == 0 {
+				t.Error("created gallery has no ID")
+			}
+		})
+	}
+}
+
+func TestGalleryValidatorUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  func(g *models.Gallery)
+		wantErr error
+		check   func(t *testing.T, g *models.Gallery)
+	}{
+		{
+			name:   "valid",
+			update: func(g *models.Gallery) { g.Title = "Summer" },
+		},
+		{
+			name:    "title required",
+			update:  func(g *models.Gallery) { g.Title = "" },
+			wantErr: models.ErrTitleRequired,
+		},
+		{
+			name:    "user ID required",
+			update:  func(g *models.Gallery) { g.UserID = 0 },
+			wantErr: models.ErrUserIDRequired,
+		},
+		{
+			name:   "description at the limit",
+			update: func(g *models.Gallery) { g.Description = strings.Repeat("ä", 10000) },
+		},
+		{
+			name:    "description too long",
+			update:  func(g *models.Gallery) { g.Description = strings.Repeat("a", 10001) },
+			wantErr: models.ErrDescriptionTooLong,
+		},
+		{
+			name:   "selection limit",
+			update: func(g *models.Gallery) { g.SelectionLimit = 10 },
+		},
+		{
+			name:    "selection limit negative",
+			update:  func(g *models.Gallery) { g.SelectionLimit = -1 },
+			wantErr: models.ErrInvalidSelectionLimit,
+		},
+		{
+			name:   "share token generated with proofing",
+			update: func(g *models.Gallery) { g.Proofing = true },
+			check: func(t *testing.T, g *models.Gallery) {
+				if g.ShareToken == "" || g.ProofingPath() != "/proof/"+g.ShareToken {
+					t.Errorf("share token = %q, path = %q", g.ShareToken, g.ProofingPath())
+				}
+			},
+		},
+		{
+			name: "share token kept",
+			update: func(g *models.Gallery) {
+				g.Proofing = true
+				g.ShareToken = "existing"
+			},
+			check: func(t *testing.T, g *models.Gallery) {
+				if g.ShareToken != "existing" {
+					t.Errorf("share token = %q, want existing", g.ShareToken)
+				}
+			},
+		},
+		{
+			name:   "no share token without proofing",
+			update: func(g *models.Gallery) { g.Public = true },
+			check: func(t *testing.T, g *models.Gallery) {
+				if g.ShareToken != "" {
+					t.Errorf("share token = %q, want none", g.ShareToken)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs, _ := newGalleryService()
+			gallery := &models.Gallery{UserID: 1, Title: "Holiday"}
+			if err := gs.Create(gallery); err != nil {
+				t.Fatal(err)
+			}
+			tt.update(gallery)
+			err := gs.Update(gallery)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Update() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil || tt.check == nil {
+				return
+			}
+			saved, err := gs.ByID(gallery.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, saved)
+		})
+	}
+}
+
+func TestGalleryValidatorByShareToken(t *testing.T) {
+	gs, _ := newGalleryService()
+	// A gallery which never had proofing enabled has no share token.
+	plain := &models.Gallery{UserID: 1, Title: "Plain"}
+	proofed := &models.Gallery{UserID: 1, Title: "Proofed", Proofing: true}
+	for _, g := range []*models.Gallery{plain, proofed} {
+		if err := gs.Create(g); err != nil {
+			t.Fatal(err)
+		}
+		if err := gs.Update(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := gs.ByShareToken(""); !errors.Is(err, models.ErrResourceNotFound) {
+		t.Errorf("ByShareToken(\"\") error = %v, want %v", err, models.ErrResourceNotFound)
+	}
+	g, err := gs.ByShareToken(proofed.ShareToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.ID != proofed.ID {
+		t.Errorf("found gallery %d, want %d", g.ID, proofed.ID)
+	}
+}
+
+func TestGalleryValidatorList(t *testing.T) {
+	gs, _ := newGalleryService()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 120; i++ {
+		g := models.Gallery{
+			UserID: 1,
+			Title:  fmt.Sprintf("Gallery %03d", i),
+			Public: i%2 == 0,
+		}
+		g.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+		if i < 3 {
+			g.Tags = []models.Tag{{Name: "beach"}}
+		}
+		if err := gs.Create(&g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := models.Gallery{UserID: 2, Title: "Someone else's"}
+	if err := gs.Create(&other); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		query     models.GalleryQuery
+		wantErr   error
+		wantCount int
+		wantFirst string
+	}{
+		{
+			name:    "user ID required",
+			query:   models.GalleryQuery{},
+			wantErr: models.ErrUserIDRequired,
+		},
+		{
+			name:      "newest first by default",
+			query:     models.GalleryQuery{UserID: 1},
+			wantCount: 20,
+			wantFirst: "Gallery 119",
+		},
+		{
+			name:      "unknown sort",
+			query:     models.GalleryQuery{UserID: 1, Sort: "size"},
+			wantCount: 20,
+			wantFirst: "Gallery 119",
+		},
+		{
+			name:      "oldest first",
+			query:     models.GalleryQuery{UserID: 1, Order: models.GalleryOrderAsc},
+			wantCount: 20,
+			wantFirst: "Gallery 000",
+		},
+		{
+			name:      "sort by title",
+			query:     models.GalleryQuery{UserID: 1, Sort: models.GallerySortTitle},
+			wantCount: 20,
+			wantFirst: "Gallery 000",
+		},
+		{
+			name:      "limit capped",
+			query:     models.GalleryQuery{UserID: 1, Limit: 1000},
+			wantCount: 100,
+			wantFirst: "Gallery 119",
+		},
+		{
+			name:      "public only",
+			query:     models.GalleryQuery{UserID: 1, Visibility: models.GalleriesPublic, Limit: 100},
+			wantCount: 60,
+			wantFirst: "Gallery 118",
+		},
+		{
+			name:      "unknown visibility",
+			query:     models.GalleryQuery{UserID: 1, Visibility: "hidden", Limit: 100},
+			wantCount: 100,
+			wantFirst: "Gallery 119",
+		},
+		{
+			name:      "tag normalized",
+			query:     models.GalleryQuery{UserID: 1, Tag: " #Beach "},
+			wantCount: 3,
+			wantFirst: "Gallery 002",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := gs.List(tt.query)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("List() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(page.Galleries) != tt.wantCount {
+				t.Fatalf("got %d galleries, want %d", len(page.Galleries), tt.wantCount)
+			}
+			if first := page.Galleries[0].Title; first != tt.wantFirst {
+				t.Errorf("first gallery = %q, want %q", first, tt.wantFirst)
+			}
+		})
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		q := models.GalleryQuery{UserID: 1, Sort: models.GallerySortTitle, Limit: 50}
+		first, err := gs.List(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.After = first.Next
+		second, err := gs.List(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := second.Galleries[0].Title; got != "Gallery 050" {
+			t.Errorf("second page starts with %q, want Gallery 050", got)
+		}
+		q.After, q.Before = "", second.Prev
+		back, err := gs.List(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := back.Galleries[0].Title; got != "Gallery 000" || back.Prev != "" {
+			t.Errorf("previous page starts with %q and has prev %q, want the first page", got, back.Prev)
+		}
+	})
+}
+
+func TestGalleryValidatorInvalidID(t *testing.T) {
+	gs, _ := newGalleryService()
+	for name, fn := range map[string]func(uint) error{
+		"Delete":  gs.Delete,
+		"Restore": gs.Restore,
+		"Purge":   gs.Purge,
+	} {
+		if err := fn(0); !errors.Is(err, models.ErrInvalidID) {
+			t.Errorf("%s(0) error = %v, want %v", name, err, models.ErrInvalidID)
+		}
+	}
+}
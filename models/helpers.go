@@ -6,6 +6,11 @@ import (
 	"gorm.io/gorm"
 )
 
+// isSQLite reports whether db is SQLite, which lacks some features of Postgres.
+func isSQLite(db *gorm.DB) bool {
+	return db.Dialector.Name() == DriverSQLite
+}
+
 func first(db *gorm.DB, dst interface{}) error {
 	err := db.First(dst).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -0,0 +1,24 @@
+package models_test
+
+import (
+	"os"
+	"testing"
+)
+
+// chdir changes the working directory to dir until the test finishes,
+// as files are stored relative to it.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
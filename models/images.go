@@ -1,18 +1,71 @@
 package models
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"  // Register GIF decoder for image.Decode.
+	_ "image/jpeg" // Register JPEG decoder for image.Decode.
+	_ "image/png"  // Register PNG decoder for image.Decode.
 	"io"
+	"myphoto/hash"
+	"myphoto/tracing"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// ImageProcessing images are waiting for their background job to finish.
+	ImageProcessing = "processing"
+	// ImageReady images were processed successfully.
+	ImageReady = "ready"
+	// ImageFailed images could not be processed, e.g. they are not an image at all.
+	ImageFailed = "failed"
+
+	// JobProcessImage is the kind of job processing newly created images.
+	JobProcessImage = "image.process"
+
+	// duplicateDistance is the largest number of differing bits between
+	// perceptual hashes of images which are considered possible duplicates.
+	duplicateDistance = 8
 )
 
-// Image is stored on local filesystem
+// Image is stored on local filesystem,
+// while its metadata is kept in the database.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	GalleryID uint   `gorm:"not null;uniqueIndex:idx_images_gallery_filename"`
+	Filename  string `gorm:"not null;uniqueIndex:idx_images_gallery_filename"`
+	// UploaderID is the user who added the image, which is not always
+	// the owner of the gallery. It is zero for images uploaded before
+	// uploaders were recorded.
+	UploaderID uint   `gorm:"not null;default:0;index"`
+	Status     string `gorm:"not null"`
+	Width      int
+	Height     int
+	Size       int64 `gorm:"not null;default:0"`
+	// ContentHash is the hex encoded SHA-256 of the file.
+	ContentHash string `gorm:"index"`
+	// PerceptualHash is the difference hash of the picture,
+	// it is nil until the image is processed or if it cannot be decoded.
+	PerceptualHash *int64
+	Caption        string `gorm:"not null;default:''"`
+	Exif           `gorm:"embedded"`
+	Tags           []Tag `gorm:"-"`
+}
+
+// ImageJob is the payload of JobProcessImage jobs.
+type ImageJob struct {
+	ImageID uint `json:"image_id"`
 }
 
 func (i *Image) Path() string {
@@ -22,62 +75,504 @@ func (i *Image) Path() string {
 	return imgURL.String()
 }
 
+// PagePath returns the URL of the page showing the image within its gallery.
+func (i *Image) PagePath() string {
+	return fmt.Sprintf("/galleries/%v/images/%v", i.GalleryID, i.ID)
+}
+
+// DownloadPath returns the URL downloading the original file of the image.
+func (i *Image) DownloadPath() string {
+	return i.PagePath() + "/download"
+}
+
 func (i *Image) RelativePath() string {
 	return fmt.Sprintf("images/galleries/%v/%v", i.GalleryID, i.Filename)
 }
 
+// Processing reports whether the image is still waiting for its background job.
+func (i *Image) Processing() bool {
+	return i.Status == ImageProcessing
+}
+
 type ImageService interface {
-	Create(galleryID uint, src io.Reader, filename string) error
+	// Create stores the file and computes its content hash while it
+	// is written. Everything requiring to decode the picture is left
+	// to Process, which is run in the background. The storage is
+	// counted against the owner of the gallery, not the uploader.
+	Create(galleryID, uploaderID uint, src io.Reader, filename string) (*Image, error)
+	ByID(id uint) (*Image, error)
 	ByGalleryID(galleryID uint) ([]Image, error)
+	ByUserID(userID uint) ([]Image, error)
+	// SetCovers sets the cover of each gallery to its first processed image.
+	SetCovers(galleries []Gallery) error
+	// SetCaption updates the caption of an image of a gallery.
+	SetCaption(galleryID uint, filename, caption string) error
+	// Process is run in the background for every created image.
+	// It records the dimensions, the perceptual hash and the Exif data of
+	// the image and marks it as ready, or as failed if the file cannot be decoded.
+	Process(id uint) error
+	// ExactDuplicates returns the other images of the user with the same content.
+	ExactDuplicates(userID uint, img *Image) ([]Image, error)
+	// DuplicateGroups returns groups of the users' images which are
+	// identical or look nearly the same, across all of their galleries.
+	DuplicateGroups(userID uint) ([][]Image, error)
+	// DeleteGallery permanently removes all images of a gallery, including trashed ones.
 	DeleteGallery(galleryID uint) error
+	// Delete moves an image to the trash, its file is
+	// kept until the image is purged.
 	Delete(i *Image) error
+
+	// TrashedByID returns an image only if it is in the trash.
+	TrashedByID(id uint) (*Image, error)
+	// TrashedByUserID returns the trashed images in the galleries of a user,
+	// skipping galleries which are in the trash themselves.
+	TrashedByUserID(userID uint) ([]Image, error)
+	// TrashedBefore returns all images moved to the trash before t.
+	TrashedBefore(t time.Time) ([]Image, error)
+	Restore(img *Image) error
+	// Purge permanently removes a trashed image and its file.
+	Purge(img *Image) error
+
+	// Usage returns how much storage the user takes up and is allowed to.
+	Usage(userID uint) (*Usage, error)
+	// UsageByGalleryID returns the usage of the owner of a gallery,
+	// which uploads to the gallery count against.
+	UsageByGalleryID(galleryID uint) (*Usage, error)
+	// RecomputeUsage corrects the recorded size of every image from the
+	// files in storage, and then the totals of all galleries and users.
+	RecomputeUsage() error
+	// Reconcile compares the images in the database, including trashed
+	// ones, with the files in storage without changing either.
+	Reconcile() (*Reconciliation, error)
+	// Import creates the image of an orphaned file found by Reconcile,
+	// like those stored before images were kept in the database.
+	Import(path string) (*Image, error)
+
+	// WithContext returns the service tracing its operations and
+	// queries as part of the trace in ctx, like that of a request.
+	WithContext(ctx context.Context) ImageService
+}
+
+// ImageDB is used to interact with the images' database.
+type ImageDB interface {
+	ByID(id uint) (*Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByUserID(userID uint) ([]Image, error)
+	ByContentHash(userID uint, contentHash string) ([]Image, error)
+	// ReadyByGalleryIDs returns the processed images of the given galleries.
+	ReadyByGalleryIDs(galleryIDs []uint) ([]Image, error)
+
+	Create(image *Image) error
+	Update(image *Image) error
+	Delete(id uint) error
+	// DeleteByGalleryID permanently removes all images of a gallery.
+	DeleteByGalleryID(galleryID uint) error
+	// SizeByGalleryID returns the total size of all images of a gallery, including trashed ones.
+	SizeByGalleryID(galleryID uint) (int64, error)
+
+	TrashedByID(id uint) (*Image, error)
+	TrashedByFilename(galleryID uint, filename string) (*Image, error)
+	TrashedByUserID(userID uint) ([]Image, error)
+	TrashedBefore(t time.Time) ([]Image, error)
+	Restore(id uint) error
+	Purge(id uint) error
+
+	// ForEach calls fn for every image, loading them in batches.
+	ForEach(fn func(*Image) error) error
+	// UsageByUserID returns the plan and stored bytes of a user.
+	UsageByUserID(userID uint) (*Usage, error)
+	// UsageByGalleryID returns the plan and stored bytes of the owner of a gallery.
+	UsageByGalleryID(galleryID uint) (*Usage, error)
+	// AddUsage adds delta bytes to a gallery and to its owner.
+	AddUsage(galleryID uint, delta int64) error
+	// ReserveUsage adds delta bytes like AddUsage, unless the owner would
+	// store more than quota bytes, which fails with ErrQuotaExceeded. The
+	// check and the update are one statement, so concurrent uploads cannot
+	// both pass the check. A quota of zero or less means there is no limit.
+	ReserveUsage(galleryID uint, delta, quota int64) error
+	// RecomputeTotals recalculates stored bytes of galleries and users from their images.
+	RecomputeTotals() error
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+func NewImageService(db *gorm.DB, js JobService, quotas Quotas) ImageService {
+	is := &imageService{
+		ctx:    context.Background(),
+		db:     db,
+		idb:    &imageGorm{db},
+		js:     js,
+		quotas: quotas,
+	}
+	return &imageTracing{is: is, ctx: context.Background()}
+}
+
+type imageService struct {
+	// ctx is the context of the trace the files are written as part of.
+	ctx    context.Context
+	db     *gorm.DB
+	idb    ImageDB
+	js     JobService
+	quotas Quotas
 }
 
-type imageService struct{}
+// withContext returns a copy of the service running its queries with ctx.
+func (is *imageService) withContext(ctx context.Context) *imageService {
+	c := *is
+	c.ctx = ctx
+	c.idb = &imageGorm{is.db.WithContext(ctx)}
+	return &c
+}
+
+// Create refuses files which would take the owner of the gallery over
+// their quota with ErrQuotaExceeded. The file is written to a temporary
+// file first, so an existing image is only replaced by a complete upload.
+// The usage read before is only used to stop writing files which are too
+// large early, the quota is enforced when the size is added to it.
+func (is *imageService) Create(galleryID, uploaderID uint, src io.Reader, filename string) (*Image, error) {
+	usage, err := is.idb.UsageByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	is.quotas.apply(usage)
+
+	// Uploading a file with the same name replaces the previous image.
+	img, err := is.idb.ByFilename(galleryID, filename)
+	switch {
+	case err == nil:
+		usage.Used -= img.Size
+	case errors.Is(err, ErrResourceNotFound):
+		img = &Image{
+			GalleryID: galleryID,
+			Filename:  filename,
+		}
+	default:
+		return nil, err
+	}
+	oldSize := img.Size
+
+	// A trashed image with the same name cannot be restored
+	// once its file is overwritten, so it is purged instead.
+	trashed, err := is.idb.TrashedByFilename(galleryID, filename)
+	switch {
+	case err == nil:
+		usage.Used -= trashed.Size
+		oldSize += trashed.Size
+	case errors.Is(err, ErrResourceNotFound):
+		trashed = nil
+	default:
+		return nil, err
+	}
 
-func (is *imageService) Create(galleryID uint, src io.Reader, filename string) error {
 	path, err := is.mkdirGallery(galleryID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(path, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	var r io.Reader = io.TeeReader(src, h)
+	if !usage.Unlimited() {
+		// Read one byte more than allowed to detect files exceeding the quota.
+		r = io.LimitReader(r, usage.Remaining()+1)
+	}
+	_, span := tracing.Start(is.ctx, "write file")
+	size, err := io.Copy(tmp, r)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if !usage.Allows(size) {
+		return nil, ErrQuotaExceeded
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	img.UploaderID = uploaderID
+	img.Status = ImageProcessing
+	img.Size = size
+	img.ContentHash = hex.EncodeToString(h.Sum(nil))
+	img.PerceptualHash = nil
+	err = is.db.WithContext(is.ctx).Transaction(func(tx *gorm.DB) error {
+		if trashed != nil {
+			if err := (&imageGorm{tx}).Purge(trashed.ID); err != nil {
+				return err
+			}
+		}
+		if err := is.save(tx, img, size-oldSize, usage.Quota); err != nil {
+			return err
+		}
+		// The file is moved into place last, so the image is
+		// not stored if it cannot be, and neither is its job.
+		return os.Rename(tmp.Name(), path+filename)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Import counts the file against the owner of the gallery of its
+// directory, without enforcing the quota as the file is stored already.
+// Like uploaded images, it is processed in the background.
+func (is *imageService) Import(path string) (*Image, error) {
+	rel, err := filepath.Rel(filepath.FromSlash(galleriesDir), path)
+	if err != nil {
+		return nil, ErrInvalidImagePath
+	}
+	dir, filename := filepath.Split(rel)
+	galleryID, err := strconv.ParseUint(filepath.Clean(dir), 10, 64)
+	if err != nil || galleryID == 0 || filename == "" || strings.HasPrefix(filename, ".") {
+		return nil, ErrInvalidImagePath
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		GalleryID:   uint(galleryID),
+		Filename:    filename,
+		Status:      ImageProcessing,
+		Size:        size,
+		ContentHash: hex.EncodeToString(h.Sum(nil)),
+	}
+	err = is.db.WithContext(is.ctx).Transaction(func(tx *gorm.DB) error {
+		// The gallery may have been deleted with its files left behind.
+		if err := first(tx.Unscoped().Where("id = ?", galleryID), &Gallery{}); err != nil {
+			return err
+		}
+		return is.save(tx, img, size, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// save creates or updates the image, adds delta bytes to the usage of its
+// gallery within the quota and enqueues its processing, as part of the
+// transaction tx.
+func (is *imageService) save(tx *gorm.DB, img *Image, delta, quota int64) error {
+	idb := &imageGorm{tx}
+	var err error
+	if img.ID == 0 {
+		err = idb.Create(img)
+	} else {
+		err = idb.Update(img)
 	}
-	dst, err := os.Create(path + filename)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, src)
+	if err = idb.ReserveUsage(img.GalleryID, delta, quota); err != nil {
+		return err
+	}
+	return is.js.WithTx(tx).Enqueue(JobProcessImage, ImageJob{ImageID: img.ID})
+}
+
+func (is *imageService) ByID(id uint) (*Image, error) {
+	return is.idb.ByID(id)
+}
+
+func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
+	return is.idb.ByGalleryID(galleryID)
+}
+
+func (is *imageService) ByUserID(userID uint) ([]Image, error) {
+	return is.idb.ByUserID(userID)
+}
+
+func (is *imageService) SetCovers(galleries []Gallery) error {
+	if len(galleries) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(galleries))
+	for i := range galleries {
+		ids[i] = galleries[i].ID
+	}
+	images, err := is.idb.ReadyByGalleryIDs(ids)
 	if err != nil {
 		return err
 	}
+	covers := make(map[uint]*Image)
+	for i := range images {
+		if _, ok := covers[images[i].GalleryID]; !ok {
+			covers[images[i].GalleryID] = &images[i]
+		}
+	}
+	for i := range galleries {
+		galleries[i].Cover = covers[galleries[i].ID]
+	}
 	return nil
 }
 
-func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	imgPaths, err := filepath.Glob(path + "*")
+func (is *imageService) SetCaption(galleryID uint, filename, caption string) error {
+	img, err := is.idb.ByFilename(galleryID, filename)
+	if err != nil {
+		return err
+	}
+	img.Caption = strings.TrimSpace(caption)
+	return is.idb.Update(img)
+}
+
+func (is *imageService) Process(id uint) error {
+	img, err := is.idb.ByID(id)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(img.RelativePath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	picture, _, err := image.Decode(f)
+	if err != nil {
+		// Retrying will not turn the file into an image.
+		img.Status = ImageFailed
+		return is.idb.Update(img)
+	}
+	img.Width = picture.Bounds().Dx()
+	img.Height = picture.Bounds().Dy()
+	// Postgres has no unsigned integers, the bits are stored as they are.
+	dHash := int64(hash.DHash(picture))
+	img.PerceptualHash = &dHash
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img.Exif = readExif(f)
+	img.Status = ImageReady
+	return is.idb.Update(img)
+}
+
+func (is *imageService) ExactDuplicates(userID uint, img *Image) ([]Image, error) {
+	images, err := is.idb.ByContentHash(userID, img.ContentHash)
 	if err != nil {
 		return nil, err
 	}
-	images := make([]Image, len(imgPaths))
-	for i := range imgPaths {
-		images[i] = Image{
-			Filename:  strings.Replace(imgPaths[i], path, "", 1),
-			GalleryID: galleryID,
+	duplicates := make([]Image, 0, len(images))
+	for _, i := range images {
+		if i.ID != img.ID {
+			duplicates = append(duplicates, i)
 		}
 	}
-	return images, nil
+	return duplicates, nil
+}
+
+func (is *imageService) DuplicateGroups(userID uint) ([][]Image, error) {
+	images, err := is.idb.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Union-find over all pairs of images, a user rarely has enough
+	// images for the quadratic comparison to matter.
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if similarImages(&images[i], &images[j]) {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	byRoot := make(map[int][]Image)
+	var roots []int
+	for i := range images {
+		root := find(i)
+		if _, ok := byRoot[root]; !ok {
+			roots = append(roots, root)
+		}
+		byRoot[root] = append(byRoot[root], images[i])
+	}
+	var groups [][]Image
+	for _, root := range roots {
+		if len(byRoot[root]) > 1 {
+			groups = append(groups, byRoot[root])
+		}
+	}
+	return groups, nil
+}
+
+// similarImages reports whether two images have the same
+// content or their perceptual hashes are close enough.
+func similarImages(a, b *Image) bool {
+	if a.ContentHash != "" && a.ContentHash == b.ContentHash {
+		return true
+	}
+	if a.PerceptualHash == nil || b.PerceptualHash == nil {
+		return false
+	}
+	return hash.Distance(uint64(*a.PerceptualHash), uint64(*b.PerceptualHash)) <= duplicateDistance
 }
 
 func (is *imageService) DeleteGallery(galleryID uint) error {
+	size, err := is.idb.SizeByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	if err = is.idb.DeleteByGalleryID(galleryID); err != nil {
+		return err
+	}
+	if err = is.idb.AddUsage(galleryID, -size); err != nil {
+		return err
+	}
 	return os.RemoveAll(is.imagePath(galleryID))
 }
 
 func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+	img, err := is.idb.ByFilename(i.GalleryID, i.Filename)
+	if err != nil {
+		return err
+	}
+	return is.idb.Delete(img.ID)
+}
+
+func (is *imageService) TrashedByID(id uint) (*Image, error) {
+	return is.idb.TrashedByID(id)
+}
+
+func (is *imageService) TrashedByUserID(userID uint) ([]Image, error) {
+	return is.idb.TrashedByUserID(userID)
+}
+
+func (is *imageService) TrashedBefore(t time.Time) ([]Image, error) {
+	return is.idb.TrashedBefore(t)
+}
+
+func (is *imageService) Restore(img *Image) error {
+	return is.idb.Restore(img.ID)
+}
+
+// Purge keeps counting the image towards the usage of its owner
+// until its file is actually removed.
+func (is *imageService) Purge(img *Image) error {
+	if err := os.Remove(img.RelativePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := is.idb.Purge(img.ID); err != nil {
+		return err
+	}
+	return is.idb.AddUsage(img.GalleryID, -img.Size)
 }
 
 func (is *imageService) imagePath(galleryID uint) string {
@@ -92,3 +587,146 @@ func (is *imageService) mkdirGallery(galleryID uint) (string, error) {
 	}
 	return galleryPath, nil
 }
+
+// Confirm that imageGorm implements ImageDB interface.
+var _ ImageDB = &imageGorm{}
+
+type imageGorm struct {
+	db *gorm.DB
+}
+
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var img Image
+	err := first(ig.db.Where("id = ?", id), &img)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+func (ig *imageGorm) ByFilename(galleryID uint, filename string) (*Image, error) {
+	var img Image
+	err := first(ig.db.Where("gallery_id = ? AND filename = ?", galleryID, filename), &img)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Where("gallery_id = ?", galleryID).Order("filename").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ByUserID(userID uint) ([]Image, error) {
+	var images []Image
+	err := ig.byUser(userID).Order("images.gallery_id, images.filename").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ByContentHash(userID uint, contentHash string) ([]Image, error) {
+	var images []Image
+	err := ig.byUser(userID).Where("images.content_hash = ?", contentHash).Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ReadyByGalleryIDs(galleryIDs []uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Where("gallery_id IN ? AND status = ?", galleryIDs, ImageReady).
+		Order("gallery_id, filename").
+		Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// byUser scopes a query to the images in the galleries of a user.
+func (ig *imageGorm) byUser(userID uint) *gorm.DB {
+	return ig.db.Select("images.*").
+		Joins("JOIN galleries ON galleries.id = images.gallery_id AND galleries.deleted_at IS NULL").
+		Where("galleries.user_id = ?", userID)
+}
+
+func (ig *imageGorm) Create(image *Image) error {
+	return ig.db.Create(image).Error
+}
+
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
+}
+
+func (ig *imageGorm) Delete(id uint) error {
+	return ig.db.Delete(&Image{}, id).Error
+}
+
+func (ig *imageGorm) SizeByGalleryID(galleryID uint) (int64, error) {
+	var size int64
+	err := ig.db.Unscoped().Model(&Image{}).
+		Select("COALESCE(SUM(size), 0)").
+		Where("gallery_id = ?", galleryID).
+		Scan(&size).Error
+	return size, err
+}
+
+func (ig *imageGorm) TrashedByID(id uint) (*Image, error) {
+	var img Image
+	err := first(ig.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id), &img)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+func (ig *imageGorm) TrashedByFilename(galleryID uint, filename string) (*Image, error) {
+	var img Image
+	db := ig.db.Unscoped().Where("gallery_id = ? AND filename = ? AND deleted_at IS NOT NULL", galleryID, filename)
+	err := first(db, &img)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+func (ig *imageGorm) TrashedByUserID(userID uint) ([]Image, error) {
+	var images []Image
+	err := ig.byUser(userID).Unscoped().
+		Where("images.deleted_at IS NOT NULL").
+		Order("images.deleted_at DESC").
+		Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) TrashedBefore(t time.Time) ([]Image, error) {
+	var images []Image
+	err := ig.db.Unscoped().Where("deleted_at < ?", t).Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) Restore(id uint) error {
+	return ig.db.Unscoped().Model(&Image{}).Where("id = ?", id).Update("deleted_at", nil).Error
+}
+
+func (ig *imageGorm) Purge(id uint) error {
+	return ig.db.Unscoped().Delete(&Image{}, id).Error
+}
+
+func (ig *imageGorm) DeleteByGalleryID(galleryID uint) error {
+	return ig.db.Unscoped().Where("gallery_id = ?", galleryID).Delete(&Image{}).Error
+}
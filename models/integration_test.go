@@ -0,0 +1,828 @@
+package models_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"myphoto/migrate"
+	"myphoto/models"
+	"myphoto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// postgresEnv holds the connection string of the Postgres database the
+// integration tests run against, like "host=localhost user=postgres
+// password=password dbname=myphoto_test sslmode=disable". Every test
+// creates its own schema in it and drops it again. Without it, the
+// tests only run against SQLite.
+const postgresEnv = "MYPHOTO_TEST_POSTGRES"
+
+// integrationTest runs fn with the gorm services on a migrated, empty
+// database of every driver.
+func integrationTest(t *testing.T, fn func(t *testing.T, svc *models.Services)) {
+	t.Run(models.DriverSQLite, func(t *testing.T) {
+		dsn := "file:" + filepath.Join(t.TempDir(), "myphoto.db") +
+			"?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)"
+		fn(t, newIntegrationServices(t, models.DriverSQLite, dsn))
+	})
+	t.Run(models.DriverPostgres, func(t *testing.T) {
+		dsn := os.Getenv(postgresEnv)
+		if dsn == "" {
+			t.Skipf("%s is not set", postgresEnv)
+		}
+		schema := createSchema(t, dsn)
+		fn(t, newIntegrationServices(t, models.DriverPostgres, withSearchPath(dsn, schema)))
+	})
+}
+
+func newIntegrationServices(t *testing.T, driver, dsn string) *models.Services {
+	t.Helper()
+	svc, err := models.NewServices(
+		models.WithGorm(driver, dsn),
+		models.WithUser("test-hmac-key"),
+		models.WithGallery(),
+		models.WithJob(),
+		models.WithImage(models.Quotas{models.DefaultPlan: 1 << 20}),
+		models.WithTrash(retention),
+		models.WithTag(),
+		models.WithSearch(),
+		models.WithProofing(nil, "http://localhost:3000"),
+		models.WithMember("test-hmac-key", nil, "http://localhost:3000"),
+		models.WithWebhook("http://localhost:3000"),
+		models.WithAudit(retention),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.Close() })
+	migrator := newIntegrationMigrator(t, svc)
+	if err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func newIntegrationMigrator(t *testing.T, svc *models.Services) *migrate.Migrator {
+	t.Helper()
+	sqlDB, err := svc.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := migrate.New(sqlDB, svc.Driver())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator
+}
+
+// createSchema creates a schema only the test uses,
+// which is dropped with everything in it afterwards.
+func createSchema(t *testing.T, dsn string) string {
+	t.Helper()
+	svc, err := models.NewServices(models.WithGorm(models.DriverPostgres, dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.Close() })
+	db, err := svc.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	suffix, err := rand.String(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(suffix))
+	if _, err = db.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Error(err)
+		}
+	})
+	return schema
+}
+
+// withSearchPath makes the schema the only one of the connections,
+// for connection strings both as URL and as keywords and values.
+func withSearchPath(dsn, schema string) string {
+	if !strings.Contains(dsn, "://") {
+		return dsn + " search_path=" + schema
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&search_path=" + schema
+	}
+	return dsn + "?search_path=" + schema
+}
+
+func createUser(t *testing.T, us models.UserService, handle string) *models.User {
+	t.Helper()
+	user := &models.User{
+		Name:     handle,
+		Email:    handle + "@example.com",
+		Handle:   handle,
+		Password: "password123",
+	}
+	if err := us.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestIntegrationMigrations(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		migrator := newIntegrationMigrator(t, svc)
+		status, err := migrator.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every migration but the baseline can be rolled back and applied again.
+		if err = migrator.Down(len(status) - 1); err != nil {
+			t.Fatal(err)
+		}
+		if current, err := migrator.Current(context.Background()); err != nil || current != 1 {
+			t.Fatalf("current version = %d, %v, want the baseline", current, err)
+		}
+		if err = migrator.Down(1); err == nil || !strings.Contains(err.Error(), "cannot be rolled back") {
+			t.Errorf("rolling back the baseline = %v, want it refused", err)
+		}
+		if err = migrator.Up(); err != nil {
+			t.Fatal(err)
+		}
+		current, err := migrator.Current(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current != migrator.Latest() {
+			t.Errorf("current version = %d, want %d", current, migrator.Latest())
+		}
+	})
+}
+
+func TestIntegrationUsers(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		us := svc.User
+		token, err := rand.RememberToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		jane := &models.User{Email: " Jane@Example.com", Handle: "Jane", Password: "password123", Remember: token}
+		if err = us.Create(jane); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = us.ByEmail("JANE@example.com"); err != nil {
+			t.Errorf("ByEmail() error = %v", err)
+		}
+		if _, err = us.ByHandle("jane"); err != nil {
+			t.Errorf("ByHandle() error = %v", err)
+		}
+		if got, err := us.ByRemember(token); err != nil || got.ID != jane.ID {
+			t.Errorf("ByRemember() = %v, %v", got, err)
+		}
+		if _, err = us.Authenticate("jane@example.com", "password123"); err != nil {
+			t.Errorf("Authenticate() error = %v", err)
+		}
+		if _, err = us.Authenticate("jane@example.com", "wrong password"); !errors.Is(err, models.ErrInvalidPassword) {
+			t.Errorf("Authenticate() with a wrong password error = %v, want %v", err, models.ErrInvalidPassword)
+		}
+
+		taken := &models.User{Email: "jane@example.com", Password: "password123"}
+		if err = us.Create(taken); !errors.Is(err, models.ErrUnavailableEmail) {
+			t.Errorf("Create() with a taken email error = %v, want %v", err, models.ErrUnavailableEmail)
+		}
+		taken = &models.User{Email: "john@example.com", Handle: "JANE", Password: "password123"}
+		if err = us.Create(taken); !errors.Is(err, models.ErrUnavailableHandle) {
+			t.Errorf("Create() with a taken handle error = %v, want %v", err, models.ErrUnavailableHandle)
+		}
+
+		jane.Name = "Jane Doe"
+		if err = us.Update(jane); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := us.ByID(jane.ID); err != nil || got.Name != "Jane Doe" {
+			t.Errorf("updated user = %v, %v", got, err)
+		}
+		if err = us.Delete(jane.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = us.ByID(jane.ID); !errors.Is(err, models.ErrResourceNotFound) {
+			t.Errorf("deleted user: error = %v, want %v", err, models.ErrResourceNotFound)
+		}
+	})
+}
+
+func TestIntegrationGalleries(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		alice := createUser(t, svc.User, "alice")
+		bob := createUser(t, svc.User, "bob")
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		galleries := make([]models.Gallery, 25)
+		for i := range galleries {
+			g := &galleries[i]
+			g.UserID = alice.ID
+			g.Title = fmt.Sprintf("Gallery %02d", i)
+			g.Public = i%5 == 0
+			g.CreatedAt = start.Add(time.Duration(i) * 24 * time.Hour)
+			if err := svc.Gallery.Create(g); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, i := range []int{3, 4, 7} {
+			if err := svc.Tag.SetGalleryTags(alice.ID, galleries[i].ID, []string{"beach"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		t.Run("pages", func(t *testing.T) {
+			q := models.GalleryQuery{UserID: alice.ID, Sort: models.GallerySortTitle, Limit: 10}
+			var titles []string
+			for page := 0; page < 3; page++ {
+				p, err := svc.Gallery.List(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, g := range p.Galleries {
+					titles = append(titles, g.Title)
+				}
+				if q.After = p.Next; q.After == "" {
+					break
+				}
+			}
+			if len(titles) != 25 || titles[0] != "Gallery 00" || titles[24] != "Gallery 24" {
+				t.Errorf("paged through %d galleries, %v", len(titles), titles)
+			}
+		})
+
+		tests := []struct {
+			name      string
+			query     models.GalleryQuery
+			wantCount int
+			wantFirst string
+		}{
+			{"newest first", models.GalleryQuery{UserID: alice.ID, Limit: 100}, 25, "Gallery 24"},
+			{"public", models.GalleryQuery{UserID: alice.ID, Visibility: models.GalleriesPublic}, 5, "Gallery 20"},
+			{"private", models.GalleryQuery{UserID: alice.ID, Visibility: models.GalleriesPrivate, Limit: 100}, 20, "Gallery 24"},
+			{"tag", models.GalleryQuery{UserID: alice.ID, Tag: "Beach"}, 3, "Gallery 07"},
+			{"created between", models.GalleryQuery{UserID: alice.ID, CreatedFrom: start.Add(24 * time.Hour), CreatedUntil: start.Add(72 * time.Hour)}, 2, "Gallery 02"},
+			{"other user", models.GalleryQuery{UserID: bob.ID}, 0, ""},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				p, err := svc.Gallery.List(tt.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(p.Galleries) != tt.wantCount {
+					t.Fatalf("got %d galleries, want %d", len(p.Galleries), tt.wantCount)
+				}
+				if tt.wantCount > 0 && p.Galleries[0].Title != tt.wantFirst {
+					t.Errorf("first gallery = %q, want %q", p.Galleries[0].Title, tt.wantFirst)
+				}
+			})
+		}
+
+		t.Run("shared", func(t *testing.T) {
+			member := &models.Member{GalleryID: galleries[1].ID, UserID: bob.ID, Role: models.RoleEditor}
+			if err := svc.Member.Create(member); err != nil {
+				t.Fatal(err)
+			}
+			shared, err := svc.Gallery.SharedWith(bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(shared) != 1 || shared[0].ID != galleries[1].ID {
+				t.Fatalf("shared with bob: %v", shared)
+			}
+			if role, err := svc.Member.Role(&galleries[1], bob.ID); err != nil || role != models.RoleEditor {
+				t.Errorf("role of bob = %q, %v", role, err)
+			}
+		})
+
+		t.Run("trash", func(t *testing.T) {
+			id := galleries[2].ID
+			if err := svc.Gallery.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.Gallery.ByID(id); !errors.Is(err, models.ErrResourceNotFound) {
+				t.Errorf("trashed gallery: error = %v, want %v", err, models.ErrResourceNotFound)
+			}
+			if _, err := svc.Gallery.TrashedByID(id); err != nil {
+				t.Errorf("TrashedByID() error = %v", err)
+			}
+			if err := svc.Gallery.Restore(id); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.Gallery.ByID(id); err != nil {
+				t.Errorf("restored gallery: error = %v", err)
+			}
+		})
+	})
+}
+
+func TestIntegrationSearch(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		alice := createUser(t, svc.User, "alice")
+		bob := createUser(t, svc.User, "bob")
+		for _, g := range []*models.Gallery{
+			{UserID: alice.ID, Title: "Sunset over the sea", Public: true},
+			{UserID: alice.ID, Title: "Sunset in the mountains"},
+			{UserID: alice.ID, Title: "City at night", Public: true},
+		} {
+			if err := svc.Gallery.Create(g); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name      string
+			viewerID  uint
+			query     string
+			wantCount int
+		}{
+			{"anonymous", 0, "sunset", 1},
+			{"owner", alice.ID, "sunset", 2},
+			{"other user", bob.ID, "sunset", 1},
+			{"no match", alice.ID, "forest", 0},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				results, err := svc.Search.Search(tt.viewerID, tt.query, 10, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(results) != tt.wantCount {
+					t.Errorf("got %d results, want %d: %v", len(results), tt.wantCount, results)
+				}
+			})
+		}
+	})
+}
+
+func TestIntegrationJobs(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		const n = 20
+		for i := 0; i < n; i++ {
+			if err := svc.Job.Enqueue(models.JobProcessImage, map[string]int{"id": i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Workers claiming at the same time never get the same job.
+		now := time.Now().Add(time.Second)
+		var mu sync.Mutex
+		claimed := make(map[uint]int)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					job, err := svc.Job.Claim(now)
+					if errors.Is(err, models.ErrResourceNotFound) {
+						return
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					claimed[job.ID]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(claimed) != n {
+			t.Fatalf("claimed %d jobs, want %d", len(claimed), n)
+		}
+		for id, times := range claimed {
+			if times != 1 {
+				t.Errorf("job %d claimed %d times", id, times)
+			}
+		}
+
+		job, err := svc.Job.ByID(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != models.JobRunning || job.Attempts != 1 {
+			t.Errorf("claimed job has status %q after %d attempts", job.Status, job.Attempts)
+		}
+		if err = svc.Job.Fail(job, errors.New("decoding failed")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = svc.Job.Claim(now); !errors.Is(err, models.ErrResourceNotFound) {
+			t.Errorf("failed job claimed before its retry: error = %v", err)
+		}
+		retried, err := svc.Job.Claim(job.RunAt.Add(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retried.ID != job.ID || retried.Attempts != 2 || retried.LastError != "decoding failed" {
+			t.Errorf("retried job = %+v", retried)
+		}
+		if err = svc.Job.Succeed(retried); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = svc.Job.ByID(job.ID); !errors.Is(err, models.ErrResourceNotFound) {
+			t.Errorf("finished job: error = %v, want %v", err, models.ErrResourceNotFound)
+		}
+	})
+}
+
+func TestIntegrationImages(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		chdir(t, t.TempDir())
+		alice := createUser(t, svc.User, "alice")
+		holiday := &models.Gallery{UserID: alice.ID, Title: "Holiday"}
+		other := &models.Gallery{UserID: alice.ID, Title: "Other"}
+		for _, g := range []*models.Gallery{holiday, other} {
+			if err := svc.Gallery.Create(g); err != nil {
+				t.Fatal(err)
+			}
+		}
+		picture := pngImage(t)
+		img, err := svc.Image.Create(holiday.ID, alice.ID, bytes.NewReader(picture), "beach.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = svc.Image.Process(img.ID); err != nil {
+			t.Fatal(err)
+		}
+		if img, err = svc.Image.ByID(img.ID); err != nil {
+			t.Fatal(err)
+		}
+		if img.Processing() || img.Width != 16 || img.Height != 16 {
+			t.Errorf("processed image = %+v", img)
+		}
+		copied, err := svc.Image.Create(other.ID, alice.ID, bytes.NewReader(picture), "copy.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		duplicates, err := svc.Image.ExactDuplicates(alice.ID, copied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(duplicates) != 1 || duplicates[0].ID != img.ID {
+			t.Errorf("duplicates = %v, want the first image", duplicates)
+		}
+
+		usage, err := svc.Image.Usage(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(2 * len(picture)); usage.Used != want {
+			t.Errorf("used %d bytes, want %d", usage.Used, want)
+		}
+		_, err = svc.Image.Create(holiday.ID, alice.ID, bytes.NewReader(make([]byte, 1<<20)), "huge.png")
+		if !errors.Is(err, models.ErrQuotaExceeded) {
+			t.Errorf("Create() over the quota error = %v, want %v", err, models.ErrQuotaExceeded)
+		}
+
+		if err = svc.Image.Delete(img); err != nil {
+			t.Fatal(err)
+		}
+		trashed, err := svc.Image.TrashedByUserID(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trashed) != 1 || trashed[0].ID != img.ID {
+			t.Fatalf("trashed images = %v", trashed)
+		}
+		if err = svc.Trash.RestoreImage(alice.ID, img.ID); err != nil {
+			t.Fatal(err)
+		}
+		if images, err := svc.Image.ByGalleryID(holiday.ID); err != nil || len(images) != 1 {
+			t.Errorf("images after restoring = %v, %v", images, err)
+		}
+	})
+}
+
+func TestIntegrationQuota(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		chdir(t, t.TempDir())
+		alice := createUser(t, svc.User, "alice")
+		holiday := &models.Gallery{UserID: alice.ID, Title: "Holiday"}
+		if err := svc.Gallery.Create(holiday); err != nil {
+			t.Fatal(err)
+		}
+		// Each upload fits into the quota of 1 MiB, but not both of them.
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = svc.Image.Create(holiday.ID, alice.ID,
+					bytes.NewReader(make([]byte, 600<<10)), fmt.Sprintf("%d.png", i))
+			}(i)
+		}
+		wg.Wait()
+		exceeded := 0
+		for _, err := range errs {
+			switch {
+			case errors.Is(err, models.ErrQuotaExceeded):
+				exceeded++
+			case err != nil:
+				t.Fatal(err)
+			}
+		}
+		if exceeded != 1 {
+			t.Errorf("%d uploads exceeded the quota, want 1", exceeded)
+		}
+		usage, err := svc.Image.Usage(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.Used != 600<<10 {
+			t.Errorf("used %d bytes, want %d", usage.Used, 600<<10)
+		}
+		if images, err := svc.Image.ByGalleryID(holiday.ID); err != nil || len(images) != 1 {
+			t.Errorf("images = %v, %v, want one", images, err)
+		}
+	})
+}
+
+func TestIntegrationProofing(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		chdir(t, t.TempDir())
+		alice := createUser(t, svc.User, "alice")
+		wedding := &models.Gallery{UserID: alice.ID, Title: "Wedding", Proofing: true, SelectionLimit: 1}
+		if err := svc.Gallery.Create(wedding); err != nil {
+			t.Fatal(err)
+		}
+		proofer, err := svc.Proofing.Proofer(wedding, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		images := make([]*models.Image, 2)
+		for i := range images {
+			images[i], err = svc.Image.Create(wedding.ID, alice.ID, bytes.NewReader(pngImage(t)), fmt.Sprintf("%d.png", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Each image fits into the selection limit, but not both of them.
+		var wg sync.WaitGroup
+		errs := make([]error, len(images))
+		for i := range images {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = svc.Proofing.Toggle(wedding, proofer, images[i].ID, models.PickSelected)
+			}(i)
+		}
+		wg.Wait()
+		exceeded := 0
+		for _, err := range errs {
+			switch {
+			case errors.Is(err, models.ErrSelectionLimit):
+				exceeded++
+			case err != nil:
+				t.Fatal(err)
+			}
+		}
+		if exceeded != 1 {
+			t.Errorf("%d picks exceeded the selection limit, want 1", exceeded)
+		}
+		if n, err := svc.Proofing.CountSelected(proofer.ID); err != nil || n != 1 {
+			t.Errorf("CountSelected() = %d, %v, want 1", n, err)
+		}
+
+		if err = svc.Proofing.Submit(wedding, proofer, "Bob"); err != nil {
+			t.Fatal(err)
+		}
+		// A copy of the proofer from before the submission cannot change the selection.
+		stale := *proofer
+		stale.SubmittedAt = nil
+		if err = svc.Proofing.Toggle(wedding, &stale, images[0].ID, models.PickFavourite); !errors.Is(err, models.ErrSelectionSubmitted) {
+			t.Errorf("Toggle() after Submit() error = %v, want %v", err, models.ErrSelectionSubmitted)
+		}
+		notified := false
+		for {
+			job, err := svc.Job.Claim(time.Now().Add(time.Second))
+			if errors.Is(err, models.ErrResourceNotFound) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			notified = notified || job.Kind == models.JobNotifySubmission
+		}
+		if !notified {
+			t.Error("Submit() did not enqueue the notification")
+		}
+	})
+}
+
+func TestIntegrationUsageUpdates(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		chdir(t, t.TempDir())
+		alice := createUser(t, svc.User, "alice")
+		holiday := &models.Gallery{UserID: alice.ID, Title: "Holiday"}
+		if err := svc.Gallery.Create(holiday); err != nil {
+			t.Fatal(err)
+		}
+		// Both are loaded before the upload and saved after it, like
+		// when signing in or editing a gallery while an upload finishes.
+		user, err := svc.User.ByID(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gallery, err := svc.Gallery.ByID(holiday.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := svc.Image.Create(holiday.ID, alice.ID, bytes.NewReader(pngImage(t)), "beach.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Name = "Alice"
+		if err = svc.User.Update(user); err != nil {
+			t.Fatal(err)
+		}
+		gallery.Title = "Summer"
+		if err = svc.Gallery.Update(gallery); err != nil {
+			t.Fatal(err)
+		}
+
+		usage, err := svc.Image.Usage(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.Used != img.Size {
+			t.Errorf("user stores %d bytes, want %d", usage.Used, img.Size)
+		}
+		if gallery, err = svc.Gallery.ByID(holiday.ID); err != nil {
+			t.Fatal(err)
+		}
+		if gallery.StorageBytes != img.Size || gallery.Title != "Summer" {
+			t.Errorf("gallery %q stores %d bytes, want %q with %d", gallery.Title, gallery.StorageBytes, "Summer", img.Size)
+		}
+	})
+}
+
+func TestIntegrationAudit(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		// Clients send any bytes in their headers, which must not keep what they did out of the log.
+		entry := &models.AuditEntry{
+			Action:     models.AuditUserLoginFailed,
+			TargetType: models.AuditTargetUser,
+			IP:         "192.0.2.1\xff",
+			UserAgent:  "agent\xff\x00" + strings.Repeat("é", 300),
+		}
+		if err := svc.Audit.Create(entry); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := svc.Audit.Search(models.AuditQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("entries = %v, want one", entries)
+		}
+		got := entries[0]
+		if got.IP != "192.0.2.1\uFFFD" {
+			t.Errorf("IP = %q", got.IP)
+		}
+		if !utf8.ValidString(got.UserAgent) || len(got.UserAgent) > 512 || !strings.HasPrefix(got.UserAgent, "agent\uFFFDé") {
+			t.Errorf("user agent = %q (%d bytes)", got.UserAgent, len(got.UserAgent))
+		}
+	})
+}
+
+func TestIntegrationImport(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		chdir(t, t.TempDir())
+		alice := createUser(t, svc.User, "alice")
+		holiday := &models.Gallery{UserID: alice.ID, Title: "Holiday"}
+		if err := svc.Gallery.Create(holiday); err != nil {
+			t.Fatal(err)
+		}
+		// Files uploaded before images were kept in the database.
+		dir := filepath.Join("images", "galleries", fmt.Sprint(holiday.ID))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		picture := pngImage(t)
+		if err := os.WriteFile(filepath.Join(dir, "old.png"), picture, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// An upload which is still being written is not orphaned.
+		if err := os.WriteFile(filepath.Join(dir, ".upload-123"), picture[:10], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rec, err := svc.Image.Reconcile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.Orphans) != 1 {
+			t.Fatalf("orphans = %v, want the old file", rec.Orphans)
+		}
+		img, err := svc.Image.Import(rec.Orphans[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.GalleryID != holiday.ID || img.Filename != "old.png" || img.Size != int64(len(picture)) {
+			t.Errorf("imported image = %+v", img)
+		}
+		if images, err := svc.Image.ByGalleryID(holiday.ID); err != nil || len(images) != 1 {
+			t.Errorf("images after importing = %v, %v", images, err)
+		}
+		if usage, err := svc.Image.Usage(alice.ID); err != nil || usage.Used != img.Size {
+			t.Errorf("usage after importing = %+v, %v", usage, err)
+		}
+		job, err := svc.Job.Claim(time.Now())
+		if err != nil || job.Kind != models.JobProcessImage {
+			t.Errorf("job after importing = %+v, %v", job, err)
+		}
+		if rec, err = svc.Image.Reconcile(); err != nil || len(rec.Orphans) != 0 {
+			t.Errorf("orphans after importing = %v, %v", rec, err)
+		}
+		if _, err = svc.Image.Import(filepath.Join(dir, "old.png")); err == nil {
+			t.Error("importing the file twice succeeded")
+		}
+	})
+}
+
+func TestIntegrationWebhooks(t *testing.T) {
+	integrationTest(t, func(t *testing.T, svc *models.Services) {
+		alice := createUser(t, svc.User, "alice")
+		for _, url := range []string{
+			"http://127.0.0.1:8080/hooks",
+			"http://[::1]/hooks",
+			"http://169.254.169.254/latest/meta-data",
+			"http://10.0.0.1/hooks",
+			"http://localhost/hooks",
+			"http://api.localhost/hooks",
+		} {
+			webhook := &models.Webhook{UserID: alice.ID, URL: url, Events: models.EventGalleryCreated}
+			if err := svc.Webhook.Create(webhook); !errors.Is(err, models.ErrPrivateWebhookURL) {
+				t.Errorf("Create(%q) error = %v, want %v", url, err, models.ErrPrivateWebhookURL)
+			}
+		}
+
+		// Hosts could resolve to a private address only after they are
+		// validated, which the webhook must not connect to either.
+		var requests int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+		}))
+		defer server.Close()
+		webhook := &models.Webhook{UserID: alice.ID, URL: "https://example.com/hooks", Events: models.EventGalleryCreated, Active: true}
+		if err := svc.Webhook.Create(webhook); err != nil {
+			t.Fatal(err)
+		}
+		db, err := svc.DB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec(`UPDATE webhooks SET url = $1 WHERE id = $2`, server.URL, webhook.ID); err != nil {
+			t.Fatal(err)
+		}
+		gallery := &models.Gallery{UserID: alice.ID, Title: "Holiday"}
+		if err = svc.Gallery.Create(gallery); err != nil {
+			t.Fatal(err)
+		}
+		if err = svc.Webhook.GalleryEvent(models.EventGalleryCreated, gallery); err != nil {
+			t.Fatal(err)
+		}
+		deliveries, err := svc.Webhook.DeliveriesByWebhookID(webhook.ID, 10)
+		if err != nil || len(deliveries) != 1 {
+			t.Fatalf("deliveries = %v, %v", deliveries, err)
+		}
+		if err = svc.Webhook.Deliver(deliveries[0].ID); !errors.Is(err, models.ErrPrivateWebhookURL) {
+			t.Errorf("Deliver() error = %v, want %v", err, models.ErrPrivateWebhookURL)
+		}
+		if requests != 0 {
+			t.Errorf("server received %d requests, want none", requests)
+		}
+	})
+}
+
+func pngImage(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		img.Set(x, x, color.White)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
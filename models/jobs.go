@@ -0,0 +1,251 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// JobQueued jobs wait for a worker until their RunAt time is reached.
+	JobQueued = "queued"
+	// JobRunning jobs have been claimed by a worker.
+	JobRunning = "running"
+	// JobDead jobs failed too many times and are no longer retried.
+	JobDead = "dead"
+
+	defaultJobAttempts = 5
+	jobBackoffBase     = 10 * time.Second
+	jobBackoffMax      = time.Hour
+)
+
+// Job is a unit of background work stored in the database, so it
+// survives restarts and can be shared by several application instances.
+// Successful jobs are removed, dead jobs are kept for inspection.
+type Job struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Kind        string    `gorm:"not null"`
+	Payload     string    `gorm:"not null"`
+	Status      string    `gorm:"not null;index:idx_jobs_status_run_at"`
+	RunAt       time.Time `gorm:"not null;index:idx_jobs_status_run_at"`
+	Attempts    int       `gorm:"not null"`
+	MaxAttempts int       `gorm:"not null"`
+	LockedAt    *time.Time
+	LastError   string
+}
+
+// Decode unmarshals the JSON payload of the job into dst.
+func (j *Job) Decode(dst interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), dst)
+}
+
+// JobDB is used to interact with the jobs' database.
+type JobDB interface {
+	ByID(id uint) (*Job, error)
+	// Claim marks the next due job as running and returns it.
+	// If no job is due, ErrResourceNotFound is returned.
+	Claim(now time.Time) (*Job, error)
+	// ReleaseStale requeues running jobs locked before t, which
+	// belonged to a worker that stopped without finishing them.
+	ReleaseStale(t time.Time) error
+
+	Create(job *Job) error
+	Update(job *Job) error
+	Delete(id uint) error
+}
+
+// JobService is a set of methods used to schedule background
+// work and to keep track of its progress.
+type JobService interface {
+	JobDB
+	// Enqueue schedules a job of the given kind to run as soon as possible.
+	// The payload is marshalled as JSON.
+	Enqueue(kind string, payload interface{}) error
+	// Succeed removes a finished job.
+	Succeed(job *Job) error
+	// Fail records the error of a job and schedules a retry with
+	// exponential backoff, or marks it as dead once it ran out of attempts.
+	Fail(job *Job, err error) error
+	// WithTx returns the service storing jobs as part of the transaction
+	// tx, so a job is only enqueued if the work it follows is committed.
+	WithTx(tx *gorm.DB) JobService
+}
+
+func NewJobService(db *gorm.DB) JobService {
+	return &jobService{
+		JobDB: &jobValidator{&jobGorm{db}},
+	}
+}
+
+// Confirm that jobService implements JobService interface.
+var _ JobService = &jobService{}
+
+type jobService struct {
+	JobDB
+}
+
+func (js *jobService) Enqueue(kind string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return js.Create(&Job{
+		Kind:    kind,
+		Payload: string(b),
+	})
+}
+
+func (js *jobService) WithTx(tx *gorm.DB) JobService {
+	return NewJobService(tx)
+}
+
+func (js *jobService) Succeed(job *Job) error {
+	return js.Delete(job.ID)
+}
+
+func (js *jobService) Fail(job *Job, err error) error {
+	job.LastError = err.Error()
+	job.LockedAt = nil
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = JobDead
+		return js.Update(job)
+	}
+	job.Status = JobQueued
+	job.RunAt = time.Now().Add(jobBackoff(job.Attempts))
+	return js.Update(job)
+}
+
+// jobBackoff doubles the delay before each retry, up to jobBackoffMax.
+func jobBackoff(attempts int) time.Duration {
+	d := jobBackoffBase
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= jobBackoffMax {
+			return jobBackoffMax
+		}
+	}
+	return d
+}
+
+// Confirm that jobValidator implements JobDB interface.
+var _ JobDB = &jobValidator{}
+
+type jobValidator struct {
+	JobDB
+}
+
+func (jv *jobValidator) Create(job *Job) error {
+	err := runJobValFuncs(job,
+		jv.kindRequired,
+		jv.setDefaults,
+	)
+	if err != nil {
+		return err
+	}
+	return jv.JobDB.Create(job)
+}
+
+func (jv *jobValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+	return jv.JobDB.Delete(id)
+}
+
+type jobValFunc func(*Job) error
+
+func runJobValFuncs(job *Job, fns ...jobValFunc) error {
+	for _, fn := range fns {
+		if err := fn(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (jv *jobValidator) kindRequired(j *Job) error {
+	if j.Kind == "" {
+		return ErrJobKindRequired
+	}
+	return nil
+}
+
+func (jv *jobValidator) setDefaults(j *Job) error {
+	if j.Status == "" {
+		j.Status = JobQueued
+	}
+	if j.RunAt.IsZero() {
+		j.RunAt = time.Now()
+	}
+	if j.MaxAttempts <= 0 {
+		j.MaxAttempts = defaultJobAttempts
+	}
+	if j.Payload == "" {
+		j.Payload = "{}"
+	}
+	return nil
+}
+
+// Confirm that jobGorm implements JobDB interface.
+var _ JobDB = &jobGorm{}
+
+type jobGorm struct {
+	db *gorm.DB
+}
+
+func (jg *jobGorm) ByID(id uint) (*Job, error) {
+	var job Job
+	err := first(jg.db.Where("id = ?", id), &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Claim uses SKIP LOCKED, so concurrent workers never pick up the same job.
+// SQLite lacks it, but only ever runs a single write at a time anyway.
+func (jg *jobGorm) Claim(now time.Time) (*Job, error) {
+	lock := "FOR UPDATE SKIP LOCKED"
+	if isSQLite(jg.db) {
+		lock = ""
+	}
+	var jobs []Job
+	err := jg.db.Raw(`UPDATE jobs
+		SET status = ?, locked_at = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status = ? AND run_at <= ?
+			ORDER BY run_at, id
+			LIMIT 1
+			`+lock+`
+		)
+		RETURNING *`, JobRunning, now, now, JobQueued, now).Scan(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, ErrResourceNotFound
+	}
+	return &jobs[0], nil
+}
+
+func (jg *jobGorm) ReleaseStale(t time.Time) error {
+	return jg.db.Model(&Job{}).
+		Where("status = ? AND locked_at < ?", JobRunning, t).
+		Updates(map[string]interface{}{"status": JobQueued, "locked_at": nil}).Error
+}
+
+func (jg *jobGorm) Create(job *Job) error {
+	return jg.db.Create(job).Error
+}
+
+func (jg *jobGorm) Update(job *Job) error {
+	return jg.db.Save(job).Error
+}
+
+func (jg *jobGorm) Delete(id uint) error {
+	return jg.db.Delete(&Job{}, id).Error
+}
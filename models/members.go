@@ -0,0 +1,348 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"myphoto/email"
+	"myphoto/hash"
+	"myphoto/rand"
+	"strings"
+	"time"
+
+	"github.com/badoux/checkmail"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// RoleViewer members can see a gallery even if it is not public.
+	RoleViewer = "viewer"
+	// RoleContributor members can also upload images, and delete the images they uploaded.
+	RoleContributor = "contributor"
+	// RoleEditor members can also change the gallery and all of its images.
+	RoleEditor = "editor"
+	// RoleOwner members can also manage the members and delete the gallery.
+	// The user who created a gallery is always its owner.
+	RoleOwner = "owner"
+
+	invitationTokenBytes = 32
+	invitationExpiry     = 7 * 24 * time.Hour
+)
+
+// roleRanks orders the roles, every role has the permissions of the lower ones.
+var roleRanks = map[string]int{
+	RoleViewer:      1,
+	RoleContributor: 2,
+	RoleEditor:      3,
+	RoleOwner:       4,
+}
+
+// Roles lists the roles from the least to the most permissions.
+var Roles = []string{RoleViewer, RoleContributor, RoleEditor, RoleOwner}
+
+// RoleAtLeast reports whether role grants the permissions of min.
+// An empty or unknown role grants nothing.
+func RoleAtLeast(role, min string) bool {
+	return roleRanks[role] > 0 && roleRanks[role] >= roleRanks[min]
+}
+
+// Member gives a user a role in a gallery of somebody else.
+type Member struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	GalleryID uint     `gorm:"not null;uniqueIndex:idx_members_gallery_user"`
+	UserID    uint     `gorm:"not null;uniqueIndex:idx_members_gallery_user;index"`
+	Role      string   `gorm:"not null"`
+	Gallery   *Gallery `gorm:"constraint:OnDelete:CASCADE"`
+	User      *User    `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// Invitation asks someone by email to join a gallery with a role.
+// Only the hash of its token is stored, the token itself is in
+// the link of the email.
+type Invitation struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	GalleryID   uint   `gorm:"not null;index"`
+	InvitedByID uint   `gorm:"not null"`
+	Email       string `gorm:"not null"`
+	Role        string `gorm:"not null"`
+	Token       string `gorm:"-"`
+	TokenHash   string `gorm:"not null;uniqueIndex"`
+	ExpiresAt   time.Time
+	Gallery     *Gallery `gorm:"constraint:OnDelete:CASCADE"`
+	InvitedBy   *User    `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// Expired reports whether the invitation can no longer be accepted.
+func (i *Invitation) Expired() bool {
+	return time.Now().After(i.ExpiresAt)
+}
+
+// MemberDB is used to interact with the gallery members' database.
+type MemberDB interface {
+	// ByGalleryID returns the members of a gallery with their users.
+	ByGalleryID(galleryID uint) ([]Member, error)
+	ByUser(galleryID, userID uint) (*Member, error)
+	// Create adds a member, or changes the role of an existing one.
+	Create(member *Member) error
+	Update(member *Member) error
+	Delete(galleryID, userID uint) error
+
+	// InvitationByToken returns the invitation with the token, also if it expired.
+	InvitationByToken(token string) (*Invitation, error)
+	// InvitationsByGalleryID returns the invitations of a gallery
+	// which have not expired, newest first.
+	InvitationsByGalleryID(galleryID uint) ([]Invitation, error)
+	CreateInvitation(invitation *Invitation) error
+	DeleteInvitation(galleryID, id uint) error
+}
+
+// MemberService is a set of methods used to share galleries with other
+// users and to decide what they are allowed to do.
+type MemberService interface {
+	MemberDB
+	// Role returns the role of the user in the gallery, RoleOwner for the
+	// user who created it, or an empty string if the user is no member.
+	Role(gallery *Gallery, userID uint) (string, error)
+	// Invite emails an invitation to join the gallery with the role.
+	Invite(gallery *Gallery, inviter *User, address, role string) error
+	// Accept makes the user a member with the role of the invitation,
+	// which is used up. Expired invitations fail with ErrInvitationExpired,
+	// and invitations sent to another address with ErrInvitationEmail.
+	Accept(token string, user *User) (*Member, error)
+}
+
+// NewMemberService sends invitations with the mailer,
+// the links in them start with baseURL.
+func NewMemberService(db *gorm.DB, hmacKey string, mailer email.Mailer, baseURL string) MemberService {
+	return &memberService{
+		MemberDB: &memberValidator{
+			MemberDB: &memberGorm{db},
+			hmac:     hash.NewHMAC(hmacKey),
+		},
+		mailer:  mailer,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Confirm that memberService implements MemberService interface.
+var _ MemberService = &memberService{}
+
+type memberService struct {
+	MemberDB
+	mailer  email.Mailer
+	baseURL string
+}
+
+func (ms *memberService) Role(gallery *Gallery, userID uint) (string, error) {
+	if userID == 0 {
+		return "", nil
+	}
+	if gallery.UserID == userID {
+		return RoleOwner, nil
+	}
+	member, err := ms.ByUser(gallery.ID, userID)
+	if err != nil {
+		if errors.Is(err, ErrResourceNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	return member.Role, nil
+}
+
+func (ms *memberService) Invite(gallery *Gallery, inviter *User, address, role string) error {
+	invitation := Invitation{
+		GalleryID:   gallery.ID,
+		InvitedByID: inviter.ID,
+		Email:       address,
+		Role:        role,
+	}
+	if err := ms.CreateInvitation(&invitation); err != nil {
+		return err
+	}
+	name := inviter.Name
+	if name == "" {
+		name = inviter.Email
+	}
+	err := ms.mailer.Send(email.Message{
+		To:      invitation.Email,
+		Subject: fmt.Sprintf("%s invited you to %s", name, gallery.Title),
+		Body: fmt.Sprintf("%s invited you to join the gallery %s as %s.\n\n"+
+			"Accept the invitation within 7 days at %s/invitations/%s\n",
+			name, gallery.Title, role, ms.baseURL, invitation.Token),
+	})
+	if err != nil {
+		// An invitation nobody received is of no use.
+		if delErr := ms.DeleteInvitation(invitation.GalleryID, invitation.ID); delErr != nil {
+			return delErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (ms *memberService) Accept(token string, user *User) (*Member, error) {
+	invitation, err := ms.InvitationByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if invitation.Expired() {
+		return nil, ErrInvitationExpired
+	}
+	// Whoever else got hold of the link cannot use it.
+	if !strings.EqualFold(strings.TrimSpace(invitation.Email), strings.TrimSpace(user.Email)) {
+		return nil, ErrInvitationEmail
+	}
+	member := Member{
+		GalleryID: invitation.GalleryID,
+		UserID:    user.ID,
+		Role:      invitation.Role,
+	}
+	if err = ms.Create(&member); err != nil {
+		return nil, err
+	}
+	if err = ms.DeleteInvitation(invitation.GalleryID, invitation.ID); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// Confirm that memberValidator implements MemberDB interface.
+var _ MemberDB = &memberValidator{}
+
+type memberValidator struct {
+	MemberDB
+	hmac hash.HMAC
+}
+
+func (mv *memberValidator) Create(member *Member) error {
+	if member.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	if member.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	if err := validateRole(member.Role); err != nil {
+		return err
+	}
+	return mv.MemberDB.Create(member)
+}
+
+func (mv *memberValidator) Update(member *Member) error {
+	if err := validateRole(member.Role); err != nil {
+		return err
+	}
+	return mv.MemberDB.Update(member)
+}
+
+// InvitationByToken hashes the token before calling
+// InvitationByToken on the MemberDB field.
+func (mv *memberValidator) InvitationByToken(token string) (*Invitation, error) {
+	if token == "" {
+		return nil, ErrResourceNotFound
+	}
+	return mv.MemberDB.InvitationByToken(mv.hmac.Hash(token))
+}
+
+// CreateInvitation generates the token of the invitation and its expiry.
+func (mv *memberValidator) CreateInvitation(invitation *Invitation) error {
+	invitation.Email = strings.ToLower(strings.TrimSpace(invitation.Email))
+	if invitation.Email == "" {
+		return ErrRequiredEmail
+	}
+	if err := checkmail.ValidateFormat(invitation.Email); err != nil {
+		return ErrInvalidEmail
+	}
+	if err := validateRole(invitation.Role); err != nil {
+		return err
+	}
+	token, err := rand.String(invitationTokenBytes)
+	if err != nil {
+		return err
+	}
+	invitation.Token = token
+	invitation.TokenHash = mv.hmac.Hash(token)
+	invitation.ExpiresAt = time.Now().Add(invitationExpiry)
+	return mv.MemberDB.CreateInvitation(invitation)
+}
+
+func validateRole(role string) error {
+	if _, ok := roleRanks[role]; !ok {
+		return ErrInvalidRole
+	}
+	return nil
+}
+
+// Confirm that memberGorm implements MemberDB interface.
+var _ MemberDB = &memberGorm{}
+
+type memberGorm struct {
+	db *gorm.DB
+}
+
+func (mg *memberGorm) ByGalleryID(galleryID uint) ([]Member, error) {
+	var members []Member
+	err := mg.db.Preload("User").
+		Where("gallery_id = ?", galleryID).
+		Order("created_at").
+		Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (mg *memberGorm) ByUser(galleryID, userID uint) (*Member, error) {
+	var member Member
+	err := first(mg.db.Where("gallery_id = ? AND user_id = ?", galleryID, userID), &member)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (mg *memberGorm) Create(member *Member) error {
+	return mg.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "gallery_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"role", "updated_at"}),
+	}).Create(member).Error
+}
+
+func (mg *memberGorm) Update(member *Member) error {
+	return mg.db.Save(member).Error
+}
+
+func (mg *memberGorm) Delete(galleryID, userID uint) error {
+	return mg.db.Where("gallery_id = ? AND user_id = ?", galleryID, userID).Delete(&Member{}).Error
+}
+
+func (mg *memberGorm) InvitationByToken(tokenHash string) (*Invitation, error) {
+	var invitation Invitation
+	err := first(mg.db.Where("token_hash = ?", tokenHash), &invitation)
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+func (mg *memberGorm) InvitationsByGalleryID(galleryID uint) ([]Invitation, error) {
+	var invitations []Invitation
+	err := mg.db.Where("gallery_id = ? AND expires_at > ?", galleryID, time.Now()).
+		Order("created_at DESC").
+		Find(&invitations).Error
+	if err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+func (mg *memberGorm) CreateInvitation(invitation *Invitation) error {
+	return mg.db.Create(invitation).Error
+}
+
+func (mg *memberGorm) DeleteInvitation(galleryID, id uint) error {
+	return mg.db.Where("gallery_id = ? AND id = ?", galleryID, id).Delete(&Invitation{}).Error
+}
@@ -0,0 +1,316 @@
+package modelstest
+
+import (
+	"fmt"
+	"myphoto/models"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Confirm that GalleryDB implements models.GalleryDB interface.
+var _ models.GalleryDB = &GalleryDB{}
+
+// GalleryDB keeps galleries in memory, deleted ones stay in the trash
+// until they are purged. The cursors of List are the IDs of the galleries
+// on the edges of a page, rather than the encoded sort values of the database.
+type GalleryDB struct {
+	mu        sync.Mutex
+	galleries map[uint]models.Gallery
+	// members maps gallery IDs to the IDs of the users they are shared with.
+	members map[uint][]uint
+	nextID  uint
+}
+
+// NewGalleryDB returns an empty GalleryDB, wrap it with
+// models.NewGalleryServiceFromDB to have galleries validated.
+func NewGalleryDB() *GalleryDB {
+	return &GalleryDB{
+		galleries: make(map[uint]models.Gallery),
+		members:   make(map[uint][]uint),
+		nextID:    1,
+	}
+}
+
+// Share makes the user a member of the gallery, for SharedWith.
+func (gdb *GalleryDB) Share(galleryID, userID uint) {
+	gdb.mu.Lock()
+	defer gdb.mu.Unlock()
+	gdb.members[galleryID] = append(gdb.members[galleryID], userID)
+}
+
+func (gdb *GalleryDB) ByID(id uint) (*models.Gallery, error) {
+	return gdb.first(func(g *models.Gallery) bool { return g.ID == id && !trashed(g) })
+}
+
+func (gdb *GalleryDB) ByUserID(userID uint) ([]models.Gallery, error) {
+	return gdb.filter(byID, func(g *models.Gallery) bool { return g.UserID == userID && !trashed(g) }), nil
+}
+
+func (gdb *GalleryDB) All() ([]models.Gallery, error) {
+	return gdb.filter(byID, func(g *models.Gallery) bool { return !trashed(g) }), nil
+}
+
+func (gdb *GalleryDB) SharedWith(userID uint) ([]models.Gallery, error) {
+	gdb.mu.Lock()
+	shared := make(map[uint]bool)
+	for galleryID, userIDs := range gdb.members {
+		for _, id := range userIDs {
+			if id == userID {
+				shared[galleryID] = true
+			}
+		}
+	}
+	gdb.mu.Unlock()
+	byTitle := func(a, b *models.Gallery) bool {
+		if ta, tb := strings.ToLower(a.Title), strings.ToLower(b.Title); ta != tb {
+			return ta < tb
+		}
+		return a.ID < b.ID
+	}
+	return gdb.filter(byTitle, func(g *models.Gallery) bool { return shared[g.ID] && !trashed(g) }), nil
+}
+
+func (gdb *GalleryDB) ByShareToken(token string) (*models.Gallery, error) {
+	return gdb.first(func(g *models.Gallery) bool {
+		return g.ShareToken == token && g.Proofing && !trashed(g)
+	})
+}
+
+func (gdb *GalleryDB) List(q models.GalleryQuery) (*models.GalleryPage, error) {
+	less := galleryLess(q.Sort)
+	if q.Order == models.GalleryOrderDesc {
+		asc := less
+		less = func(a, b *models.Gallery) bool { return asc(b, a) }
+	}
+	galleries := gdb.filter(less, func(g *models.Gallery) bool {
+		switch {
+		case g.UserID != q.UserID || trashed(g):
+			return false
+		case q.Visibility == models.GalleriesPublic && !g.Public,
+			q.Visibility == models.GalleriesPrivate && g.Public:
+			return false
+		case q.Tag != "" && !hasTag(g, q.Tag):
+			return false
+		case !q.CreatedFrom.IsZero() && g.CreatedAt.Before(q.CreatedFrom),
+			!q.CreatedUntil.IsZero() && !g.CreatedAt.Before(q.CreatedUntil):
+			return false
+		}
+		return true
+	})
+
+	start, end := 0, len(galleries)
+	if q.After != "" {
+		i, err := cursorIndex(galleries, q.After)
+		if err != nil {
+			return nil, err
+		}
+		start = i + 1
+		end = min(start+q.Limit, len(galleries))
+	} else if q.Before != "" {
+		i, err := cursorIndex(galleries, q.Before)
+		if err != nil {
+			return nil, err
+		}
+		end = i
+		start = max(end-q.Limit, 0)
+	} else {
+		end = min(q.Limit, len(galleries))
+	}
+	page := models.GalleryPage{Galleries: galleries[start:end]}
+	if len(page.Galleries) == 0 {
+		return &page, nil
+	}
+	if end < len(galleries) {
+		page.Next = strconv.FormatUint(uint64(galleries[end-1].ID), 10)
+	}
+	if start > 0 {
+		page.Prev = strconv.FormatUint(uint64(galleries[start].ID), 10)
+	}
+	return &page, nil
+}
+
+func (gdb *GalleryDB) PublicByUserID(userID uint) ([]models.Gallery, error) {
+	return gdb.filter(newestFirst, func(g *models.Gallery) bool {
+		return g.UserID == userID && g.Public && !trashed(g)
+	}), nil
+}
+
+func (gdb *GalleryDB) RecentPublic(limit, offset int) ([]models.Gallery, error) {
+	galleries := gdb.filter(newestFirst, func(g *models.Gallery) bool { return g.Public && !trashed(g) })
+	if offset >= len(galleries) {
+		return nil, nil
+	}
+	galleries = galleries[offset:]
+	if len(galleries) > limit {
+		galleries = galleries[:limit]
+	}
+	return galleries, nil
+}
+
+func (gdb *GalleryDB) Create(gallery *models.Gallery) error {
+	gdb.mu.Lock()
+	defer gdb.mu.Unlock()
+	if gallery.ID == 0 {
+		gallery.ID = gdb.nextID
+	}
+	if _, ok := gdb.galleries[gallery.ID]; ok {
+		return fmt.Errorf("modelstest: gallery %d already exists", gallery.ID)
+	}
+	if gallery.ID >= gdb.nextID {
+		gdb.nextID = gallery.ID + 1
+	}
+	now := time.Now()
+	if gallery.CreatedAt.IsZero() {
+		gallery.CreatedAt = now
+	}
+	gallery.UpdatedAt = now
+	gdb.galleries[gallery.ID] = *gallery
+	return nil
+}
+
+// Update saves the gallery like gorm does, creating it if it has no ID yet.
+func (gdb *GalleryDB) Update(gallery *models.Gallery) error {
+	gdb.mu.Lock()
+	if _, ok := gdb.galleries[gallery.ID]; !ok {
+		gdb.mu.Unlock()
+		return gdb.Create(gallery)
+	}
+	defer gdb.mu.Unlock()
+	gallery.UpdatedAt = time.Now()
+	gdb.galleries[gallery.ID] = *gallery
+	return nil
+}
+
+func (gdb *GalleryDB) Delete(id uint) error {
+	return gdb.update(id, func(g *models.Gallery) {
+		if !trashed(g) {
+			g.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+		}
+	})
+}
+
+func (gdb *GalleryDB) TrashedByID(id uint) (*models.Gallery, error) {
+	return gdb.first(func(g *models.Gallery) bool { return g.ID == id && trashed(g) })
+}
+
+func (gdb *GalleryDB) TrashedByUserID(userID uint) ([]models.Gallery, error) {
+	lastDeleted := func(a, b *models.Gallery) bool { return a.DeletedAt.Time.After(b.DeletedAt.Time) }
+	return gdb.filter(lastDeleted, func(g *models.Gallery) bool { return g.UserID == userID && trashed(g) }), nil
+}
+
+func (gdb *GalleryDB) TrashedBefore(t time.Time) ([]models.Gallery, error) {
+	return gdb.filter(byID, func(g *models.Gallery) bool { return trashed(g) && g.DeletedAt.Time.Before(t) }), nil
+}
+
+func (gdb *GalleryDB) Restore(id uint) error {
+	return gdb.update(id, func(g *models.Gallery) { g.DeletedAt = gorm.DeletedAt{} })
+}
+
+func (gdb *GalleryDB) Purge(id uint) error {
+	gdb.mu.Lock()
+	defer gdb.mu.Unlock()
+	delete(gdb.galleries, id)
+	delete(gdb.members, id)
+	return nil
+}
+
+func (gdb *GalleryDB) first(match func(*models.Gallery) bool) (*models.Gallery, error) {
+	galleries := gdb.filter(byID, match)
+	if len(galleries) == 0 {
+		return nil, models.ErrResourceNotFound
+	}
+	return &galleries[0], nil
+}
+
+// filter returns copies of the matching galleries sorted by less.
+func (gdb *GalleryDB) filter(less func(a, b *models.Gallery) bool, match func(*models.Gallery) bool) []models.Gallery {
+	gdb.mu.Lock()
+	defer gdb.mu.Unlock()
+	var galleries []models.Gallery
+	for _, g := range gdb.galleries {
+		if match(&g) {
+			galleries = append(galleries, g)
+		}
+	}
+	sort.Slice(galleries, func(i, j int) bool { return less(&galleries[i], &galleries[j]) })
+	return galleries
+}
+
+// update changes a gallery in place, whether or not it is in the trash.
+// Unknown galleries are ignored like they are by the database.
+func (gdb *GalleryDB) update(id uint, fn func(*models.Gallery)) error {
+	gdb.mu.Lock()
+	defer gdb.mu.Unlock()
+	g, ok := gdb.galleries[id]
+	if !ok {
+		return nil
+	}
+	fn(&g)
+	gdb.galleries[id] = g
+	return nil
+}
+
+func trashed(g *models.Gallery) bool {
+	return g.DeletedAt.Valid
+}
+
+func hasTag(g *models.Gallery, name string) bool {
+	for _, t := range g.Tags {
+		if strings.EqualFold(t.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func byID(a, b *models.Gallery) bool {
+	return a.ID < b.ID
+}
+
+func newestFirst(a, b *models.Gallery) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
+
+// galleryLess orders galleries ascending by the sort of a
+// GalleryQuery, and by ID when their sort values are equal.
+func galleryLess(sort string) func(a, b *models.Gallery) bool {
+	return func(a, b *models.Gallery) bool {
+		var c int
+		switch sort {
+		case models.GallerySortCreated:
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		case models.GallerySortUpdated:
+			c = a.UpdatedAt.Compare(b.UpdatedAt)
+		case models.GallerySortTitle:
+			c = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+		case models.GallerySortImages:
+			c = a.ImageCount - b.ImageCount
+		}
+		if c != 0 {
+			return c < 0
+		}
+		return a.ID < b.ID
+	}
+}
+
+// cursorIndex returns the position of the gallery the cursor points at.
+func cursorIndex(galleries []models.Gallery, cursor string) (int, error) {
+	id, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return 0, models.ErrInvalidCursor
+	}
+	for i := range galleries {
+		if galleries[i].ID == uint(id) {
+			return i, nil
+		}
+	}
+	return 0, models.ErrInvalidCursor
+}
@@ -0,0 +1,333 @@
+package modelstest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"myphoto/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Confirm that ImageService implements models.ImageService interface.
+var _ models.ImageService = &ImageService{}
+
+// ImageService keeps images in memory without storing their files. Created
+// images are processing until Process marks them as ready, and possible
+// duplicates are only found by their content. The owners of galleries are
+// looked up in the GalleryDB given to NewImageService.
+type ImageService struct {
+	mu     sync.Mutex
+	images map[uint]models.Image
+	gdb    models.GalleryDB
+	quotas models.Quotas
+	nextID uint
+}
+
+// NewImageService returns an ImageService without images, for the galleries
+// of gdb. The storage of users is limited by quotas, which may be nil.
+func NewImageService(gdb models.GalleryDB, quotas models.Quotas) *ImageService {
+	return &ImageService{
+		images: make(map[uint]models.Image),
+		gdb:    gdb,
+		quotas: quotas,
+		nextID: 1,
+	}
+}
+
+// Create reads the whole of src to record its size and content hash,
+// replacing the image of the gallery with the same filename.
+func (is *ImageService) Create(galleryID, uploaderID uint, src io.Reader, filename string) (*models.Image, error) {
+	gallery, err := is.gdb.ByID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, src)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := is.Usage(gallery.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !usage.Allows(size) {
+		return nil, models.ErrQuotaExceeded
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for id, img := range is.images {
+		if img.GalleryID == galleryID && img.Filename == filename {
+			delete(is.images, id)
+		}
+	}
+	now := time.Now()
+	img := models.Image{
+		Model:       gorm.Model{ID: is.nextID, CreatedAt: now, UpdatedAt: now},
+		GalleryID:   galleryID,
+		Filename:    filename,
+		UploaderID:  uploaderID,
+		Status:      models.ImageProcessing,
+		Size:        size,
+		ContentHash: hex.EncodeToString(h.Sum(nil)),
+	}
+	is.nextID++
+	is.images[img.ID] = img
+	return &img, nil
+}
+
+func (is *ImageService) ByID(id uint) (*models.Image, error) {
+	return is.first(func(img *models.Image) bool { return img.ID == id && !img.DeletedAt.Valid })
+}
+
+func (is *ImageService) ByGalleryID(galleryID uint) ([]models.Image, error) {
+	return is.filter(func(img *models.Image) bool { return img.GalleryID == galleryID && !img.DeletedAt.Valid }), nil
+}
+
+func (is *ImageService) ByUserID(userID uint) ([]models.Image, error) {
+	owned, err := is.galleryIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	return is.filter(func(img *models.Image) bool { return owned[img.GalleryID] && !img.DeletedAt.Valid }), nil
+}
+
+func (is *ImageService) SetCovers(galleries []models.Gallery) error {
+	for i := range galleries {
+		galleries[i].Cover = nil
+		images, _ := is.ByGalleryID(galleries[i].ID)
+		for j := range images {
+			if images[j].Status == models.ImageReady {
+				galleries[i].Cover = &images[j]
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (is *ImageService) SetCaption(galleryID uint, filename, caption string) error {
+	img, err := is.first(func(img *models.Image) bool {
+		return img.GalleryID == galleryID && img.Filename == filename && !img.DeletedAt.Valid
+	})
+	if err != nil {
+		return err
+	}
+	return is.update(img.ID, func(img *models.Image) { img.Caption = strings.TrimSpace(caption) })
+}
+
+// Process marks the image as ready, as there is no file to decode.
+func (is *ImageService) Process(id uint) error {
+	if _, err := is.ByID(id); err != nil {
+		return err
+	}
+	return is.update(id, func(img *models.Image) { img.Status = models.ImageReady })
+}
+
+func (is *ImageService) ExactDuplicates(userID uint, img *models.Image) ([]models.Image, error) {
+	images, err := is.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	var duplicates []models.Image
+	for _, i := range images {
+		if i.ID != img.ID && i.ContentHash == img.ContentHash {
+			duplicates = append(duplicates, i)
+		}
+	}
+	return duplicates, nil
+}
+
+func (is *ImageService) DuplicateGroups(userID uint) ([][]models.Image, error) {
+	images, err := is.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	byHash := make(map[string][]models.Image)
+	var hashes []string
+	for _, img := range images {
+		if _, ok := byHash[img.ContentHash]; !ok {
+			hashes = append(hashes, img.ContentHash)
+		}
+		byHash[img.ContentHash] = append(byHash[img.ContentHash], img)
+	}
+	var groups [][]models.Image
+	for _, h := range hashes {
+		if len(byHash[h]) > 1 {
+			groups = append(groups, byHash[h])
+		}
+	}
+	return groups, nil
+}
+
+func (is *ImageService) DeleteGallery(galleryID uint) error {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for id, img := range is.images {
+		if img.GalleryID == galleryID {
+			delete(is.images, id)
+		}
+	}
+	return nil
+}
+
+func (is *ImageService) Delete(i *models.Image) error {
+	img, err := is.first(func(img *models.Image) bool {
+		return img.GalleryID == i.GalleryID && img.Filename == i.Filename && !img.DeletedAt.Valid
+	})
+	if err != nil {
+		return err
+	}
+	return is.update(img.ID, func(img *models.Image) {
+		img.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	})
+}
+
+func (is *ImageService) TrashedByID(id uint) (*models.Image, error) {
+	return is.first(func(img *models.Image) bool { return img.ID == id && img.DeletedAt.Valid })
+}
+
+func (is *ImageService) TrashedByUserID(userID uint) ([]models.Image, error) {
+	// Galleries in the trash are not returned by ByUserID.
+	owned, err := is.galleryIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	return is.filter(func(img *models.Image) bool { return owned[img.GalleryID] && img.DeletedAt.Valid }), nil
+}
+
+func (is *ImageService) TrashedBefore(t time.Time) ([]models.Image, error) {
+	return is.filter(func(img *models.Image) bool { return img.DeletedAt.Valid && img.DeletedAt.Time.Before(t) }), nil
+}
+
+func (is *ImageService) Restore(img *models.Image) error {
+	return is.update(img.ID, func(img *models.Image) { img.DeletedAt = gorm.DeletedAt{} })
+}
+
+func (is *ImageService) Purge(img *models.Image) error {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	delete(is.images, img.ID)
+	return nil
+}
+
+// Usage counts the sizes of the images in the galleries of the user,
+// including trashed ones, against the quota of the default plan.
+func (is *ImageService) Usage(userID uint) (*models.Usage, error) {
+	owned, err := is.galleryIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	usage := models.Usage{Plan: models.DefaultPlan, Quota: is.quotas[models.DefaultPlan]}
+	for _, img := range is.filter(func(img *models.Image) bool { return owned[img.GalleryID] }) {
+		usage.Used += img.Size
+	}
+	return &usage, nil
+}
+
+func (is *ImageService) UsageByGalleryID(galleryID uint) (*models.Usage, error) {
+	gallery, err := is.gdb.ByID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	return is.Usage(gallery.UserID)
+}
+
+// RecomputeUsage does nothing, the usage is always computed from the images.
+func (is *ImageService) RecomputeUsage() error {
+	return nil
+}
+
+// Reconcile finds nothing, as there are no files to disagree with.
+func (is *ImageService) Reconcile() (*models.Reconciliation, error) {
+	return &models.Reconciliation{}, nil
+}
+
+// Import fails, as there are no files which could be orphaned.
+func (is *ImageService) Import(path string) (*models.Image, error) {
+	return nil, models.ErrInvalidImagePath
+}
+
+func (is *ImageService) WithContext(ctx context.Context) models.ImageService {
+	return is
+}
+
+// Add stores an image as it is, like one created and processed earlier.
+func (is *ImageService) Add(img models.Image) (*models.Image, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if img.ID == 0 {
+		img.ID = is.nextID
+	}
+	if _, ok := is.images[img.ID]; ok {
+		return nil, fmt.Errorf("modelstest: image %d already exists", img.ID)
+	}
+	if img.ID >= is.nextID {
+		is.nextID = img.ID + 1
+	}
+	if img.Status == "" {
+		img.Status = models.ImageReady
+	}
+	is.images[img.ID] = img
+	return &img, nil
+}
+
+// galleryIDs returns the IDs of the galleries of the user which are not in the trash.
+func (is *ImageService) galleryIDs(userID uint) (map[uint]bool, error) {
+	galleries, err := is.gdb.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[uint]bool, len(galleries))
+	for _, g := range galleries {
+		ids[g.ID] = true
+	}
+	return ids, nil
+}
+
+func (is *ImageService) first(match func(*models.Image) bool) (*models.Image, error) {
+	images := is.filter(match)
+	if len(images) == 0 {
+		return nil, models.ErrResourceNotFound
+	}
+	return &images[0], nil
+}
+
+// filter returns copies of the matching images by gallery and filename.
+func (is *ImageService) filter(match func(*models.Image) bool) []models.Image {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	var images []models.Image
+	for _, img := range is.images {
+		if match(&img) {
+			images = append(images, img)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].GalleryID != images[j].GalleryID {
+			return images[i].GalleryID < images[j].GalleryID
+		}
+		return images[i].Filename < images[j].Filename
+	})
+	return images
+}
+
+func (is *ImageService) update(id uint, fn func(*models.Image)) error {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	img, ok := is.images[id]
+	if !ok {
+		return models.ErrResourceNotFound
+	}
+	fn(&img)
+	img.UpdatedAt = time.Now()
+	is.images[id] = img
+	return nil
+}
@@ -0,0 +1,141 @@
+// Package modelstest provides in-memory implementations of the databases
+// and services of the models package, for tests which do not need a real
+// database. They keep to the contracts of the interfaces they implement,
+// like returning models.ErrResourceNotFound for missing records.
+package modelstest
+
+import (
+	"fmt"
+	"myphoto/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Confirm that UserDB implements models.UserDB interface.
+var _ models.UserDB = &UserDB{}
+
+// UserDB keeps users in memory. Like the database, it refuses users whose
+// email address, remember token hash or handle is already taken, so tests
+// notice when the validation in front of it is missing.
+type UserDB struct {
+	mu     sync.Mutex
+	users  map[uint]models.User
+	nextID uint
+}
+
+// NewUserDB returns an empty UserDB, wrap it with models.NewUserServiceFromDB
+// to have users validated like they are in production.
+func NewUserDB() *UserDB {
+	return &UserDB{users: make(map[uint]models.User), nextID: 1}
+}
+
+func (udb *UserDB) ByID(id uint) (*models.User, error) {
+	return udb.find(func(u *models.User) bool { return u.ID == id })
+}
+
+func (udb *UserDB) ByEmail(email string) (*models.User, error) {
+	return udb.find(func(u *models.User) bool { return u.Email == email })
+}
+
+func (udb *UserDB) ByRemember(rememberHash string) (*models.User, error) {
+	return udb.find(func(u *models.User) bool { return u.RememberHash == rememberHash })
+}
+
+func (udb *UserDB) ByHandle(handle string) (*models.User, error) {
+	return udb.find(func(u *models.User) bool { return u.Handle == handle })
+}
+
+func (udb *UserDB) All() ([]models.User, error) {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+	users := make([]models.User, 0, len(udb.users))
+	for _, u := range udb.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (udb *UserDB) Create(user *models.User) error {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+	if user.ID == 0 {
+		user.ID = udb.nextID
+	}
+	if _, ok := udb.users[user.ID]; ok {
+		return fmt.Errorf("modelstest: user %d already exists", user.ID)
+	}
+	if err := udb.unique(user); err != nil {
+		return err
+	}
+	if user.ID >= udb.nextID {
+		udb.nextID = user.ID + 1
+	}
+	now := time.Now()
+	user.CreatedAt, user.UpdatedAt = now, now
+	if user.Plan == "" {
+		user.Plan = models.DefaultPlan
+	}
+	udb.users[user.ID] = stored(*user)
+	return nil
+}
+
+// Update saves the user like gorm does, creating it if it has no ID yet.
+func (udb *UserDB) Update(user *models.User) error {
+	udb.mu.Lock()
+	if _, ok := udb.users[user.ID]; !ok {
+		udb.mu.Unlock()
+		return udb.Create(user)
+	}
+	defer udb.mu.Unlock()
+	if err := udb.unique(user); err != nil {
+		return err
+	}
+	user.UpdatedAt = time.Now()
+	udb.users[user.ID] = stored(*user)
+	return nil
+}
+
+func (udb *UserDB) Delete(id uint) error {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+	delete(udb.users, id)
+	return nil
+}
+
+func (udb *UserDB) find(match func(*models.User) bool) (*models.User, error) {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+	for _, u := range udb.users {
+		if match(&u) {
+			return &u, nil
+		}
+	}
+	return nil, models.ErrResourceNotFound
+}
+
+// unique fails like the unique indexes of the users table.
+func (udb *UserDB) unique(user *models.User) error {
+	for _, u := range udb.users {
+		if u.ID == user.ID {
+			continue
+		}
+		switch {
+		case u.Email == user.Email:
+			return fmt.Errorf("modelstest: duplicate email %q", user.Email)
+		case u.RememberHash == user.RememberHash:
+			return fmt.Errorf("modelstest: duplicate remember hash")
+		case user.Handle != "" && u.Handle == user.Handle:
+			return fmt.Errorf("modelstest: duplicate handle %q", user.Handle)
+		}
+	}
+	return nil
+}
+
+// stored drops the fields of a user which are not stored in the database.
+func stored(u models.User) models.User {
+	u.Password = ""
+	u.Remember = ""
+	return u
+}
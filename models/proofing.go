@@ -0,0 +1,539 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"myphoto/email"
+	"myphoto/rand"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// PickFavourite and PickSelected are the kinds of picks proofers make.
+	// Favourites are only a note, selections count towards the limit of the gallery.
+	PickFavourite = "favourite"
+	PickSelected  = "selected"
+
+	// JobNotifySubmission is the kind of job emailing the owner of a gallery about a submitted selection.
+	JobNotifySubmission = "proofing.notify"
+
+	maxCommentLength     = 2000
+	maxProoferNameLength = 100
+
+	shareTokenBytes   = 24
+	prooferTokenBytes = 24
+)
+
+// Proofer is someone proofing a gallery, the owner, a signed in user or
+// an anonymous holder of the share link. Anonymous proofers are
+// recognised by their token, which is kept in a cookie.
+type Proofer struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	GalleryID uint     `gorm:"not null;uniqueIndex:idx_proofers_gallery_user"`
+	Gallery   *Gallery `gorm:"constraint:OnDelete:CASCADE"`
+	UserID    *uint    `gorm:"uniqueIndex:idx_proofers_gallery_user"`
+	Token     string   `gorm:"not null;uniqueIndex"`
+	Name      string   `gorm:"not null;default:''"`
+	// SubmittedAt is set once the selection is submitted, the picks cannot be changed afterwards.
+	SubmittedAt *time.Time
+	// Selected and Favourites are the number of picks,
+	// they are only set by ProofingDB.ProofersByGalleryID.
+	Selected   int `gorm:"->;-:migration"`
+	Favourites int `gorm:"->;-:migration"`
+}
+
+// Submitted reports whether the proofer submitted their selection.
+func (p *Proofer) Submitted() bool {
+	return p.SubmittedAt != nil
+}
+
+// DisplayName returns the name of the proofer, or a placeholder for anonymous proofers who did not submit yet.
+func (p *Proofer) DisplayName() string {
+	if p.Name == "" {
+		return fmt.Sprintf("Guest #%d", p.ID)
+	}
+	return p.Name
+}
+
+// Pick is a favourite or selected image of a proofer.
+type Pick struct {
+	ProoferID uint     `gorm:"primaryKey"`
+	ImageID   uint     `gorm:"primaryKey;index"`
+	Favourite bool     `gorm:"not null;default:false"`
+	Selected  bool     `gorm:"not null;default:false"`
+	Proofer   *Proofer `gorm:"constraint:OnDelete:CASCADE"`
+	Image     *Image   `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// Comment is a note of a proofer on an image.
+type Comment struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	ProoferID uint     `gorm:"not null;index"`
+	ImageID   uint     `gorm:"not null;index"`
+	Body      string   `gorm:"not null"`
+	Proofer   *Proofer `gorm:"constraint:OnDelete:CASCADE"`
+	Image     *Image   `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// Selection is an image selected by a proofer.
+type Selection struct {
+	ProoferID   uint
+	ProoferName string
+	SubmittedAt *time.Time
+	ImageID     uint
+	Filename    string
+	Favourite   bool
+}
+
+// DisplayName returns the name of the proofer who selected the image.
+func (s *Selection) DisplayName() string {
+	p := Proofer{ID: s.ProoferID, Name: s.ProoferName}
+	return p.DisplayName()
+}
+
+// ProofingJob is the payload of JobNotifySubmission jobs.
+type ProofingJob struct {
+	ProoferID uint `json:"proofer_id"`
+}
+
+// ProofingDB is used to interact with the proofing database.
+type ProofingDB interface {
+	ProoferByID(id uint) (*Proofer, error)
+	ProoferByToken(galleryID uint, token string) (*Proofer, error)
+	ProoferByUserID(galleryID, userID uint) (*Proofer, error)
+	// ProofersByGalleryID returns the proofers of a gallery with their number of picks.
+	ProofersByGalleryID(galleryID uint) ([]Proofer, error)
+	CreateProofer(proofer *Proofer) error
+	UpdateProofer(proofer *Proofer) error
+
+	// Picks returns the picks of a proofer by image ID.
+	Picks(prooferID uint) (map[uint]Pick, error)
+	// SavePick stores a pick, or removes it if the image is neither a favourite nor selected.
+	SavePick(pick *Pick) error
+	// CountSelected returns the number of images selected by a proofer.
+	CountSelected(prooferID uint) (int, error)
+	// Selections returns the images selected by the proofers of a gallery, by proofer and filename.
+	Selections(galleryID uint) ([]Selection, error)
+
+	// Comments returns the comments on the images of a gallery,
+	// oldest first, together with their proofers and images.
+	Comments(galleryID uint) ([]Comment, error)
+	CreateComment(comment *Comment) error
+}
+
+// ProofingService is a set of methods used by clients to pick
+// and comment on the images of a gallery, and by owners to
+// review their choices.
+type ProofingService interface {
+	ProofingDB
+	// Proofer returns the proofer of the gallery for a signed in user, or for the token
+	// of an anonymous proofer. A new proofer is created if there is none yet.
+	Proofer(gallery *Gallery, user *User, token string) (*Proofer, error)
+	// Toggle flips the pick of the given kind of an image. Selecting more images than
+	// allowed by the gallery fails with ErrSelectionLimit, and changing a submitted
+	// selection with ErrSelectionSubmitted.
+	Toggle(gallery *Gallery, proofer *Proofer, imageID uint, kind string) error
+	// Comment adds a comment of the proofer on an image of the gallery.
+	Comment(gallery *Gallery, proofer *Proofer, imageID uint, body string) error
+	// Submit locks the picks of the proofer and notifies the owner of the gallery in the background.
+	Submit(gallery *Gallery, proofer *Proofer, name string) error
+	// NotifySubmission emails the owner of a gallery about a submitted selection.
+	NotifySubmission(prooferID uint) error
+}
+
+// NewProofingService needs the gallery, user and image services to check
+// what is proofed and whom to notify, which is done by JobNotifySubmission jobs.
+// Links in emails start with baseURL.
+func NewProofingService(db *gorm.DB, gs GalleryService, us UserService, is ImageService,
+	js JobService, mailer email.Mailer, baseURL string) ProofingService {
+	return &proofingService{
+		ProofingDB: newProofingDB(db),
+		db:         db,
+		gs:         gs,
+		us:         us,
+		is:         is,
+		js:         js,
+		mailer:     mailer,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Confirm that proofingService implements ProofingService interface.
+var _ ProofingService = &proofingService{}
+
+type proofingService struct {
+	ProofingDB
+	// db runs the transactions changing a selection.
+	db      *gorm.DB
+	gs      GalleryService
+	us      UserService
+	is      ImageService
+	js      JobService
+	mailer  email.Mailer
+	baseURL string
+}
+
+func (ps *proofingService) Proofer(gallery *Gallery, user *User, token string) (*Proofer, error) {
+	if !gallery.Proofing {
+		return nil, ErrProofingDisabled
+	}
+	var proofer *Proofer
+	var err error
+	if user != nil {
+		proofer, err = ps.ProoferByUserID(gallery.ID, user.ID)
+	} else {
+		proofer, err = ps.ProoferByToken(gallery.ID, token)
+	}
+	if err == nil {
+		return proofer, nil
+	}
+	if !errors.Is(err, ErrResourceNotFound) {
+		return nil, err
+	}
+	proofer = &Proofer{GalleryID: gallery.ID}
+	if user != nil {
+		proofer.UserID = &user.ID
+		proofer.Name = user.Name
+		if proofer.Name == "" {
+			proofer.Name = user.Email
+		}
+	}
+	if err = ps.CreateProofer(proofer); err != nil {
+		return nil, err
+	}
+	return proofer, nil
+}
+
+func (ps *proofingService) Toggle(gallery *Gallery, proofer *Proofer, imageID uint, kind string) error {
+	if err := ps.check(gallery, proofer, imageID); err != nil {
+		return err
+	}
+	if proofer.Submitted() {
+		return ErrSelectionSubmitted
+	}
+	if kind != PickFavourite && kind != PickSelected {
+		return ErrInvalidPick
+	}
+	return ps.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockSelection(tx, proofer.ID); err != nil {
+			return err
+		}
+		pdb := newProofingDB(tx)
+		picks, err := pdb.Picks(proofer.ID)
+		if err != nil {
+			return err
+		}
+		pick, ok := picks[imageID]
+		if !ok {
+			pick = Pick{ProoferID: proofer.ID, ImageID: imageID}
+		}
+		if kind == PickFavourite {
+			pick.Favourite = !pick.Favourite
+			return pdb.SavePick(&pick)
+		}
+		pick.Selected = !pick.Selected
+		if pick.Selected && gallery.SelectionLimit > 0 {
+			n, err := pdb.CountSelected(proofer.ID)
+			if err != nil {
+				return err
+			}
+			if n >= gallery.SelectionLimit {
+				return ErrSelectionLimit
+			}
+		}
+		return pdb.SavePick(&pick)
+	})
+}
+
+func (ps *proofingService) Comment(gallery *Gallery, proofer *Proofer, imageID uint, body string) error {
+	if err := ps.check(gallery, proofer, imageID); err != nil {
+		return err
+	}
+	return ps.CreateComment(&Comment{
+		ProoferID: proofer.ID,
+		ImageID:   imageID,
+		Body:      body,
+	})
+}
+
+// Submit refuses to submit an empty selection, there is nothing for the owner to do.
+func (ps *proofingService) Submit(gallery *Gallery, proofer *Proofer, name string) error {
+	if !gallery.Proofing || proofer.GalleryID != gallery.ID {
+		return ErrProofingDisabled
+	}
+	if proofer.Submitted() {
+		return ErrSelectionSubmitted
+	}
+	// The selection is locked and the owner notified together, or not at all.
+	err := ps.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockSelection(tx, proofer.ID); err != nil {
+			return err
+		}
+		pdb := newProofingDB(tx)
+		n, err := pdb.CountSelected(proofer.ID)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrSelectionEmpty
+		}
+		if proofer.UserID == nil {
+			proofer.Name = name
+		}
+		now := time.Now()
+		proofer.SubmittedAt = &now
+		if err = pdb.UpdateProofer(proofer); err != nil {
+			return err
+		}
+		return ps.js.WithTx(tx).Enqueue(JobNotifySubmission, ProofingJob{ProoferID: proofer.ID})
+	})
+	if err != nil {
+		proofer.SubmittedAt = nil
+		return err
+	}
+	return nil
+}
+
+// lockSelection locks the picks of the proofer until the end of the transaction tx,
+// so the picks are checked and changed without concurrent requests in between.
+// It fails with ErrSelectionSubmitted once the selection was submitted.
+func lockSelection(tx *gorm.DB, prooferID uint) error {
+	res := tx.Model(&Proofer{}).
+		Where("id = ? AND submitted_at IS NULL", prooferID).
+		Update("updated_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSelectionSubmitted
+	}
+	return nil
+}
+
+func (ps *proofingService) NotifySubmission(prooferID uint) error {
+	proofer, err := ps.ProoferByID(prooferID)
+	if err != nil {
+		return err
+	}
+	gallery, err := ps.gs.ByID(proofer.GalleryID)
+	if err != nil {
+		return err
+	}
+	owner, err := ps.us.ByID(gallery.UserID)
+	if err != nil {
+		return err
+	}
+	n, err := ps.CountSelected(proofer.ID)
+	if err != nil {
+		return err
+	}
+	return ps.mailer.Send(email.Message{
+		To:      owner.Email,
+		Subject: fmt.Sprintf("%s submitted a selection of %s", proofer.DisplayName(), gallery.Title),
+		Body: fmt.Sprintf("%s selected %d images of %s.\n\nReview the selection at %s%s\n",
+			proofer.DisplayName(), n, gallery.Title, ps.baseURL, gallery.ProofingAdminPath()),
+	})
+}
+
+// check makes sure that proofing is enabled for the gallery, and that
+// both the proofer and the image belong to it.
+func (ps *proofingService) check(gallery *Gallery, proofer *Proofer, imageID uint) error {
+	if !gallery.Proofing || proofer.GalleryID != gallery.ID {
+		return ErrProofingDisabled
+	}
+	img, err := ps.is.ByID(imageID)
+	if err != nil {
+		return err
+	}
+	if img.GalleryID != gallery.ID {
+		return ErrResourceNotFound
+	}
+	return nil
+}
+
+// newProofingDB returns the ProofingDB running its queries on db.
+func newProofingDB(db *gorm.DB) ProofingDB {
+	return &proofingValidator{&proofingGorm{db}}
+}
+
+// Confirm that proofingValidator implements ProofingDB interface.
+var _ ProofingDB = &proofingValidator{}
+
+type proofingValidator struct {
+	ProofingDB
+}
+
+func (pv *proofingValidator) ProoferByToken(galleryID uint, token string) (*Proofer, error) {
+	if token == "" {
+		return nil, ErrResourceNotFound
+	}
+	return pv.ProofingDB.ProoferByToken(galleryID, token)
+}
+
+// CreateProofer generates the token of the proofer.
+func (pv *proofingValidator) CreateProofer(proofer *Proofer) error {
+	if proofer.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	if proofer.Token == "" {
+		token, err := rand.String(prooferTokenBytes)
+		if err != nil {
+			return err
+		}
+		proofer.Token = token
+	}
+	return pv.ProofingDB.CreateProofer(proofer)
+}
+
+func (pv *proofingValidator) UpdateProofer(proofer *Proofer) error {
+	proofer.Name = strings.TrimSpace(proofer.Name)
+	if proofer.Name == "" {
+		return ErrProoferNameRequired
+	}
+	if len([]rune(proofer.Name)) > maxProoferNameLength {
+		return ErrProoferNameTooLong
+	}
+	return pv.ProofingDB.UpdateProofer(proofer)
+}
+
+func (pv *proofingValidator) CreateComment(comment *Comment) error {
+	comment.Body = strings.TrimSpace(comment.Body)
+	if comment.Body == "" {
+		return ErrCommentRequired
+	}
+	if len([]rune(comment.Body)) > maxCommentLength {
+		return ErrCommentTooLong
+	}
+	return pv.ProofingDB.CreateComment(comment)
+}
+
+// Confirm that proofingGorm implements ProofingDB interface.
+var _ ProofingDB = &proofingGorm{}
+
+type proofingGorm struct {
+	db *gorm.DB
+}
+
+func (pg *proofingGorm) ProoferByID(id uint) (*Proofer, error) {
+	var proofer Proofer
+	err := first(pg.db.Where("id = ?", id), &proofer)
+	if err != nil {
+		return nil, err
+	}
+	return &proofer, nil
+}
+
+func (pg *proofingGorm) ProoferByToken(galleryID uint, token string) (*Proofer, error) {
+	var proofer Proofer
+	err := first(pg.db.Where("gallery_id = ? AND token = ?", galleryID, token), &proofer)
+	if err != nil {
+		return nil, err
+	}
+	return &proofer, nil
+}
+
+func (pg *proofingGorm) ProoferByUserID(galleryID, userID uint) (*Proofer, error) {
+	var proofer Proofer
+	err := first(pg.db.Where("gallery_id = ? AND user_id = ?", galleryID, userID), &proofer)
+	if err != nil {
+		return nil, err
+	}
+	return &proofer, nil
+}
+
+func (pg *proofingGorm) ProofersByGalleryID(galleryID uint) ([]Proofer, error) {
+	var proofers []Proofer
+	err := pg.db.Model(&Proofer{}).
+		Select(`proofers.*,
+			(SELECT count(*) FROM picks WHERE picks.proofer_id = proofers.id AND picks.selected) AS selected,
+			(SELECT count(*) FROM picks WHERE picks.proofer_id = proofers.id AND picks.favourite) AS favourites`).
+		Where("proofers.gallery_id = ?", galleryID).
+		Order("proofers.submitted_at IS NULL, proofers.submitted_at, proofers.id").
+		Find(&proofers).Error
+	if err != nil {
+		return nil, err
+	}
+	return proofers, nil
+}
+
+func (pg *proofingGorm) CreateProofer(proofer *Proofer) error {
+	return pg.db.Create(proofer).Error
+}
+
+func (pg *proofingGorm) UpdateProofer(proofer *Proofer) error {
+	return pg.db.Save(proofer).Error
+}
+
+func (pg *proofingGorm) Picks(prooferID uint) (map[uint]Pick, error) {
+	var picks []Pick
+	err := pg.db.Where("proofer_id = ?", prooferID).Find(&picks).Error
+	if err != nil {
+		return nil, err
+	}
+	byImage := make(map[uint]Pick, len(picks))
+	for _, pick := range picks {
+		byImage[pick.ImageID] = pick
+	}
+	return byImage, nil
+}
+
+func (pg *proofingGorm) SavePick(pick *Pick) error {
+	if !pick.Favourite && !pick.Selected {
+		return pg.db.Where("proofer_id = ? AND image_id = ?", pick.ProoferID, pick.ImageID).
+			Delete(&Pick{}).Error
+	}
+	return pg.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "proofer_id"}, {Name: "image_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"favourite", "selected"}),
+	}).Create(pick).Error
+}
+
+// CountSelected skips images which were moved to the trash.
+func (pg *proofingGorm) CountSelected(prooferID uint) (int, error) {
+	var n int64
+	err := pg.db.Model(&Pick{}).
+		Joins("JOIN images ON images.id = picks.image_id AND images.deleted_at IS NULL").
+		Where("picks.proofer_id = ? AND picks.selected", prooferID).
+		Count(&n).Error
+	return int(n), err
+}
+
+func (pg *proofingGorm) Selections(galleryID uint) ([]Selection, error) {
+	var selections []Selection
+	err := pg.db.Model(&Pick{}).
+		Select(`proofers.id AS proofer_id, proofers.name AS proofer_name, proofers.submitted_at,
+			images.id AS image_id, images.filename, picks.favourite`).
+		Joins("JOIN proofers ON proofers.id = picks.proofer_id").
+		Joins("JOIN images ON images.id = picks.image_id AND images.deleted_at IS NULL").
+		Where("proofers.gallery_id = ? AND picks.selected", galleryID).
+		Order("proofers.id, images.filename").
+		Scan(&selections).Error
+	if err != nil {
+		return nil, err
+	}
+	return selections, nil
+}
+
+func (pg *proofingGorm) Comments(galleryID uint) ([]Comment, error) {
+	var comments []Comment
+	err := pg.db.Preload("Proofer").Preload("Image").
+		Joins("JOIN proofers ON proofers.id = comments.proofer_id").
+		Where("proofers.gallery_id = ?", galleryID).
+		Order("comments.created_at, comments.id").
+		Find(&comments).Error
+	if err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (pg *proofingGorm) CreateComment(comment *Comment) error {
+	return pg.db.Create(comment).Error
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// galleriesDir holds the files of the images of all galleries.
+const galleriesDir = "images/galleries"
+
+// Reconciliation lists where the database and the stored files disagree.
+type Reconciliation struct {
+	// Orphans are the paths of files without an image in the database.
+	// Dotfiles are skipped, like the temporary files of uploads
+	// which are still being written.
+	Orphans []string
+	// Missing are the images whose file is not in storage.
+	Missing []Image
+}
+
+func (is *imageService) Reconcile() (*Reconciliation, error) {
+	var rec Reconciliation
+	known := make(map[string]bool)
+	err := is.idb.ForEach(func(img *Image) error {
+		path := filepath.FromSlash(img.RelativePath())
+		known[path] = true
+		_, err := os.Stat(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			rec.Missing = append(rec.Missing, *img)
+		case err != nil:
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(galleriesDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && path == galleriesDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if path != galleriesDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !known[path] {
+			rec.Orphans = append(rec.Orphans, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rec.Orphans)
+	return &rec, nil
+}
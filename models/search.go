@@ -0,0 +1,372 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// HighlightStart and HighlightStop surround the matched words in the
+	// headline of a search result. They are characters of the Unicode
+	// private use area, so they cannot be confused with anything users
+	// write, and the headline can be escaped before they are replaced
+	// with markup.
+	HighlightStart = "\ue000"
+	HighlightStop  = "\ue001"
+
+	// SearchResultGallery results match the title, description or tags of a gallery.
+	SearchResultGallery = "gallery"
+	// SearchResultImage results match the caption, filename, Exif data or tags of an image.
+	SearchResultImage = "image"
+
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	// searchConfig is the text search configuration used for
+	// both the indexes and the queries, so the indexes are used.
+	searchConfig = "english"
+
+	// galleryDocument, imageDocument and tagDocument are the text which is searched.
+	// The expressions match the ones of the GIN indexes created by the
+	// migrations exactly, otherwise Postgres ignores the indexes.
+	galleryDocument = "galleries.title || ' ' || galleries.description"
+	imageDocument   = "images.caption || ' ' || images.filename || ' ' || images.camera_make || ' ' || " +
+		"images.camera_model || ' ' || images.lens_model"
+	tagDocument = "tags.name"
+
+	// galleryVisible limits the search to the galleries the viewer owns or is a
+	// member of, and to public galleries. It takes the viewer ID twice.
+	galleryVisible = "(galleries.user_id = ? OR galleries.public OR EXISTS (SELECT 1 FROM members " +
+		"WHERE members.gallery_id = galleries.id AND members.user_id = ?))"
+)
+
+// headlineOptions configures ts_headline to mark matches with the sentinels.
+var headlineOptions = fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxWords=35, MinWords=15`,
+	HighlightStart, HighlightStop)
+
+// SearchResult is a gallery or an image matching a search query.
+type SearchResult struct {
+	Kind      string
+	GalleryID uint
+	ImageID   uint
+	// Title is the title of the gallery, also for images.
+	Title    string
+	Filename string
+	// Headline is an excerpt of the matched text, with the matched
+	// words surrounded by HighlightStart and HighlightStop.
+	Headline string
+	Rank     float64
+}
+
+// IsImage reports whether the result is an image rather than a gallery.
+func (sr *SearchResult) IsImage() bool {
+	return sr.Kind == SearchResultImage
+}
+
+// ImagePath returns the URL of the image file of image results.
+func (sr *SearchResult) ImagePath() string {
+	if !sr.IsImage() {
+		return ""
+	}
+	img := Image{GalleryID: sr.GalleryID, Filename: sr.Filename}
+	return img.Path()
+}
+
+// SearchDB is used to search the database.
+type SearchDB interface {
+	// Search returns the galleries and images matching the query, the best
+	// matches first. Only galleries the viewer owns or is a member of and public
+	// galleries are searched, a viewerID of 0 searches only public galleries.
+	Search(viewerID uint, query string, limit, offset int) ([]SearchResult, error)
+}
+
+// SearchService is a set of methods used to find galleries and images.
+type SearchService interface {
+	SearchDB
+}
+
+// NewSearchService searches with the full-text search of Postgres, and
+// falls back to matching words with LIKE on SQLite, which has no stemming,
+// ranks every matched text the same and highlights the words as they are.
+func NewSearchService(db *gorm.DB) SearchService {
+	var sdb SearchDB = &searchGorm{db}
+	if isSQLite(db) {
+		sdb = &searchLikeGorm{db}
+	}
+	return &searchService{
+		SearchDB: &searchValidator{sdb},
+	}
+}
+
+// Confirm that searchService implements SearchService interface.
+var _ SearchService = &searchService{}
+
+type searchService struct {
+	SearchDB
+}
+
+// Confirm that searchValidator implements SearchDB interface.
+var _ SearchDB = &searchValidator{}
+
+type searchValidator struct {
+	SearchDB
+}
+
+// Search returns no results for an empty query, rather than everything.
+func (sv *searchValidator) Search(viewerID uint, query string, limit, offset int) ([]SearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return sv.SearchDB.Search(viewerID, query, limit, offset)
+}
+
+// Confirm that searchGorm implements SearchDB interface.
+var _ SearchDB = &searchGorm{}
+
+type searchGorm struct {
+	db *gorm.DB
+}
+
+func (sg *searchGorm) Search(viewerID uint, query string, limit, offset int) ([]SearchResult, error) {
+	var results []SearchResult
+	// Every branch matches one document of a gallery or an image, the
+	// matches of the same gallery or image are added up in the end.
+	sql := fmt.Sprintf(`SELECT kind, gallery_id, image_id, title, filename,
+			string_agg(headline, ' · ' ORDER BY rank DESC) AS headline,
+			sum(rank) AS rank
+		FROM (
+			SELECT CAST(? AS text) AS kind, galleries.id AS gallery_id, 0 AS image_id,
+				galleries.title AS title, '' AS filename,
+				ts_headline('%[1]s', %[2]s, q, ?) AS headline,
+				ts_rank(to_tsvector('%[1]s', %[2]s), q) AS rank
+			FROM galleries, websearch_to_tsquery('%[1]s', ?) q
+			WHERE galleries.deleted_at IS NULL
+				AND %[5]s
+				AND to_tsvector('%[1]s', %[2]s) @@ q
+			UNION ALL
+			SELECT ?, galleries.id, 0,
+				galleries.title, '',
+				ts_headline('%[1]s', %[4]s, q, ?),
+				ts_rank(to_tsvector('%[1]s', %[4]s), q)
+			FROM galleries
+				JOIN gallery_tags ON gallery_tags.gallery_id = galleries.id
+				JOIN tags ON tags.id = gallery_tags.tag_id,
+				websearch_to_tsquery('%[1]s', ?) q
+			WHERE galleries.deleted_at IS NULL
+				AND %[5]s
+				AND to_tsvector('%[1]s', %[4]s) @@ q
+			UNION ALL
+			SELECT ?, galleries.id, images.id,
+				galleries.title, images.filename,
+				ts_headline('%[1]s', %[3]s, q, ?),
+				ts_rank(to_tsvector('%[1]s', %[3]s), q)
+			FROM images
+				JOIN galleries ON galleries.id = images.gallery_id,
+				websearch_to_tsquery('%[1]s', ?) q
+			WHERE images.deleted_at IS NULL AND galleries.deleted_at IS NULL
+				AND %[5]s
+				AND to_tsvector('%[1]s', %[3]s) @@ q
+			UNION ALL
+			SELECT ?, galleries.id, images.id,
+				galleries.title, images.filename,
+				ts_headline('%[1]s', %[4]s, q, ?),
+				ts_rank(to_tsvector('%[1]s', %[4]s), q)
+			FROM images
+				JOIN galleries ON galleries.id = images.gallery_id
+				JOIN image_tags ON image_tags.image_id = images.id
+				JOIN tags ON tags.id = image_tags.tag_id,
+				websearch_to_tsquery('%[1]s', ?) q
+			WHERE images.deleted_at IS NULL AND galleries.deleted_at IS NULL
+				AND %[5]s
+				AND to_tsvector('%[1]s', %[4]s) @@ q
+		) matches
+		GROUP BY kind, gallery_id, image_id, title, filename
+		ORDER BY rank DESC, gallery_id, image_id
+		LIMIT ? OFFSET ?`, searchConfig, galleryDocument, imageDocument, tagDocument, galleryVisible)
+	err := sg.db.Raw(sql,
+		SearchResultGallery, headlineOptions, query, viewerID, viewerID,
+		SearchResultGallery, headlineOptions, query, viewerID, viewerID,
+		SearchResultImage, headlineOptions, query, viewerID, viewerID,
+		SearchResultImage, headlineOptions, query, viewerID, viewerID,
+		limit, offset,
+	).Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// headlineWords is the number of words in headlines matched with LIKE,
+// like the MaxWords of the headlineOptions.
+const headlineWords = 35
+
+// Confirm that searchLikeGorm implements SearchDB interface.
+var _ SearchDB = &searchLikeGorm{}
+
+// searchLikeGorm searches databases without full-text search. A text
+// matches if it contains every word of the query, and none of the words
+// starting with a minus.
+type searchLikeGorm struct {
+	db *gorm.DB
+}
+
+func (sg *searchLikeGorm) Search(viewerID uint, query string, limit, offset int) ([]SearchResult, error) {
+	words, excluded := searchWords(query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	match := func(document string) (string, []interface{}) {
+		conditions := make([]string, 0, len(words)+len(excluded))
+		args := make([]interface{}, 0, len(words)+len(excluded))
+		for _, w := range words {
+			conditions = append(conditions, document+` LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+escapeLike(w)+"%")
+		}
+		for _, w := range excluded {
+			conditions = append(conditions, document+` NOT LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+escapeLike(w)+"%")
+		}
+		return strings.Join(conditions, " AND "), args
+	}
+	galleryMatch, galleryArgs := match(galleryDocument)
+	imageMatch, imageArgs := match(imageDocument)
+	tagMatch, tagArgs := match(tagDocument)
+
+	var args []interface{}
+	branch := func(kind string, matchArgs []interface{}) {
+		args = append(args, kind, viewerID, viewerID)
+		args = append(args, matchArgs...)
+	}
+	branch(SearchResultGallery, galleryArgs)
+	branch(SearchResultGallery, tagArgs)
+	branch(SearchResultImage, imageArgs)
+	branch(SearchResultImage, tagArgs)
+	args = append(args, limit, offset)
+
+	var results []SearchResult
+	sql := fmt.Sprintf(`SELECT kind, gallery_id, image_id, title, filename,
+			group_concat(headline, ' · ') AS headline,
+			count(*) AS rank
+		FROM (
+			SELECT CAST(? AS text) AS kind, galleries.id AS gallery_id, 0 AS image_id,
+				galleries.title AS title, '' AS filename, %[1]s AS headline
+			FROM galleries
+			WHERE galleries.deleted_at IS NULL
+				AND %[4]s
+				AND %[5]s
+			UNION ALL
+			SELECT ?, galleries.id, 0, galleries.title, '', %[3]s
+			FROM galleries
+				JOIN gallery_tags ON gallery_tags.gallery_id = galleries.id
+				JOIN tags ON tags.id = gallery_tags.tag_id
+			WHERE galleries.deleted_at IS NULL
+				AND %[4]s
+				AND %[7]s
+			UNION ALL
+			SELECT ?, galleries.id, images.id, galleries.title, images.filename, %[2]s
+			FROM images
+				JOIN galleries ON galleries.id = images.gallery_id
+			WHERE images.deleted_at IS NULL AND galleries.deleted_at IS NULL
+				AND %[4]s
+				AND %[6]s
+			UNION ALL
+			SELECT ?, galleries.id, images.id, galleries.title, images.filename, %[3]s
+			FROM images
+				JOIN galleries ON galleries.id = images.gallery_id
+				JOIN image_tags ON image_tags.image_id = images.id
+				JOIN tags ON tags.id = image_tags.tag_id
+			WHERE images.deleted_at IS NULL AND galleries.deleted_at IS NULL
+				AND %[4]s
+				AND %[7]s
+		) matches
+		GROUP BY kind, gallery_id, image_id, title, filename
+		ORDER BY rank DESC, gallery_id, image_id
+		LIMIT ? OFFSET ?`, galleryDocument, imageDocument, tagDocument, galleryVisible,
+		galleryMatch, imageMatch, tagMatch)
+	err := sg.db.Raw(sql, args...).Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Headline = likeHeadline(results[i].Headline, words)
+	}
+	return results, nil
+}
+
+// searchWords splits a query like those of websearch_to_tsquery into the
+// words to match and those to exclude. Quotes are ignored and so is "or",
+// as every word has to match.
+func searchWords(query string) (words, excluded []string) {
+	for _, w := range strings.Fields(strings.ReplaceAll(query, `"`, " ")) {
+		switch {
+		case strings.EqualFold(w, "or"):
+		case strings.HasPrefix(w, "-"):
+			if w = strings.TrimLeft(w, "-"); w != "" {
+				excluded = append(excluded, w)
+			}
+		default:
+			words = append(words, w)
+		}
+	}
+	return words, excluded
+}
+
+// escapeLike escapes the wildcards of LIKE in s, with backslashes.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// likeHeadline returns an excerpt of text starting shortly before the first
+// matched word, with the words surrounded by HighlightStart and HighlightStop.
+func likeHeadline(text string, words []string) string {
+	fields := strings.Fields(text)
+	start := -1
+	for i, f := range fields {
+		highlighted := highlightWords(f, words)
+		if highlighted != f && start < 0 {
+			start = i
+		}
+		fields[i] = highlighted
+	}
+	if start -= 5; start < 0 {
+		start = 0
+	}
+	end := start + headlineWords
+	if end > len(fields) {
+		end = len(fields)
+	}
+	return strings.Join(fields[start:end], " ")
+}
+
+// highlightWords surrounds every occurrence of the words in s, ignoring case.
+func highlightWords(s string, words []string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		matched := 0
+		for _, w := range words {
+			if len(w) > matched && i+len(w) <= len(s) && strings.EqualFold(s[i:i+len(w)], w) {
+				matched = len(w)
+			}
+		}
+		if matched == 0 {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+		b.WriteString(HighlightStart + s[i:i+matched] + HighlightStop)
+		i += matched
+	}
+	return b.String()
+}
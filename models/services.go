@@ -1,22 +1,57 @@
 package models
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"myphoto/email"
+	"myphoto/tracing"
+	"time"
+
+	"github.com/glebarez/sqlite"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery  GalleryService
+	User     UserService
+	Image    ImageService
+	Upload   UploadService
+	Job      JobService
+	Trash    TrashService
+	Search   SearchService
+	Tag      TagService
+	Proofing ProofingService
+	Member   MemberService
+	Audit    AuditService
+	Webhook  WebhookService
+	db       *gorm.DB
 }
 
 type ServicesConfig func(*Services) error
 
-func WithGorm(dsn string) ServicesConfig {
+// Database drivers supported by WithGorm.
+const (
+	DriverPostgres = "postgres"
+	// DriverSQLite uses a pure Go SQLite, for self-hosting by a single
+	// user without a database server. Search matches words with LIKE.
+	DriverSQLite = "sqlite"
+)
+
+// WithGorm connects to the database of the driver with the data source name.
+func WithGorm(driver, dsn string) ServicesConfig {
 	return func(s *Services) error {
-		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		var dialector gorm.Dialector
+		switch driver {
+		case DriverPostgres:
+			dialector = postgres.Open(dsn)
+		case DriverSQLite:
+			dialector = sqlite.Open(dsn)
+		default:
+			return fmt.Errorf("models: unknown database driver %q", driver)
+		}
+		db, err := gorm.Open(dialector, &gorm.Config{})
 		if err != nil {
 			return err
 		}
@@ -25,6 +60,14 @@ func WithGorm(dsn string) ServicesConfig {
 	}
 }
 
+// WithTracing needs to be applied after WithGorm. The queries of services
+// given a context by WithContext are traced as part of its trace.
+func WithTracing() ServicesConfig {
+	return func(s *Services) error {
+		return s.db.Use(tracing.GormPlugin{})
+	}
+}
+
 func WithUser(hmacKey string) ServicesConfig {
 	return func(s *Services) error {
 		s.User = NewUserService(s.db, hmacKey)
@@ -39,9 +82,86 @@ func WithGallery() ServicesConfig {
 	}
 }
 
-func WithImage() ServicesConfig {
+// WithImage needs to be applied after WithJob,
+// as created images are processed in the background.
+func WithImage(quotas Quotas) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.Image = NewImageService(s.db, s.Job, quotas)
+		return nil
+	}
+}
+
+func WithJob() ServicesConfig {
+	return func(s *Services) error {
+		s.Job = NewJobService(s.db)
+		return nil
+	}
+}
+
+// WithUpload needs to be applied after WithImage,
+// as finished uploads are stored by the ImageService.
+func WithUpload() ServicesConfig {
+	return func(s *Services) error {
+		s.Upload = NewUploadService(s.db, s.Image)
+		return nil
+	}
+}
+
+// WithTrash needs to be applied after WithGallery and WithImage.
+// Deleted galleries and images are purged after the retention window.
+func WithTrash(retention time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.Trash = NewTrashService(s.Gallery, s.Image, retention)
+		return nil
+	}
+}
+
+func WithTag() ServicesConfig {
+	return func(s *Services) error {
+		s.Tag = NewTagService(s.db)
+		return nil
+	}
+}
+
+// WithProofing needs to be applied after WithGallery, WithUser, WithImage
+// and WithJob. Owners are notified of submitted selections by the mailer,
+// with links starting with baseURL.
+func WithProofing(mailer email.Mailer, baseURL string) ServicesConfig {
+	return func(s *Services) error {
+		s.Proofing = NewProofingService(s.db, s.Gallery, s.User, s.Image, s.Job, mailer, baseURL)
+		return nil
+	}
+}
+
+// WithMember emails invitations with the mailer, with links starting with baseURL.
+// The tokens of invitations are hashed with hmacKey.
+func WithMember(hmacKey string, mailer email.Mailer, baseURL string) ServicesConfig {
+	return func(s *Services) error {
+		s.Member = NewMemberService(s.db, hmacKey, mailer, baseURL)
+		return nil
+	}
+}
+
+// WithAudit keeps the entries of the audit log for the retention window.
+func WithAudit(retention time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.Audit = NewAuditService(s.db, retention)
+		return nil
+	}
+}
+
+// WithWebhook needs to be applied after WithJob, as deliveries are sent
+// in the background. URLs in payloads start with baseURL.
+func WithWebhook(baseURL string) ServicesConfig {
+	return func(s *Services) error {
+		s.Webhook = NewWebhookService(s.db, s.Job, baseURL)
+		return nil
+	}
+}
+
+func WithSearch() ServicesConfig {
+	return func(s *Services) error {
+		s.Search = NewSearchService(s.db)
 		return nil
 	}
 }
@@ -65,15 +185,22 @@ func (s *Services) Close() error {
 	return sqlDB.Close()
 }
 
-// DestructiveReset will drop all tables and rebuild them.
-func (s *Services) DestructiveReset() error {
-	if err := s.db.Migrator().DropTable(&User{}, &Gallery{}); err != nil {
+// Ping checks that the database can be reached.
+func (s *Services) Ping(ctx context.Context) error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
 		return err
 	}
-	return s.AutoMigrate()
+	return sqlDB.PingContext(ctx)
+}
+
+// Driver returns the driver of the database, DriverPostgres or DriverSQLite.
+func (s *Services) Driver() string {
+	return s.db.Dialector.Name()
 }
 
-// AutoMigrate will attempt to automatically migrate all tables.
-func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{})
+// DB returns the database connection pool, which is used
+// to migrate the schema of the database.
+func (s *Services) DB() (*sql.DB, error) {
+	return s.db.DB()
 }
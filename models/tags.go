@@ -0,0 +1,445 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxTagLength = 50
+
+	defaultTagSuggestions = 10
+)
+
+// Tag is a label a user attaches to their images and galleries.
+// Tags belong to a user and their names are unique per user.
+type Tag struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"not null;uniqueIndex:idx_tags_user_name"`
+	Name      string `gorm:"not null;uniqueIndex:idx_tags_user_name"`
+	// Count is the number of images and galleries with the tag,
+	// it is only set by TagDB.ByUserID.
+	Count int `gorm:"->;-:migration"`
+}
+
+// ImageTag links an image to a tag.
+type ImageTag struct {
+	ImageID uint   `gorm:"primaryKey"`
+	TagID   uint   `gorm:"primaryKey;index"`
+	Image   *Image `gorm:"constraint:OnDelete:CASCADE"`
+	Tag     *Tag   `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// GalleryTag links a gallery to a tag.
+type GalleryTag struct {
+	GalleryID uint     `gorm:"primaryKey"`
+	TagID     uint     `gorm:"primaryKey;index"`
+	Gallery   *Gallery `gorm:"constraint:OnDelete:CASCADE"`
+	Tag       *Tag     `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// ParseTags splits a comma separated list of tag names.
+// The names are normalized when they are stored.
+func ParseTags(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// TagDB is used to interact with the tags' database.
+type TagDB interface {
+	// ByUserID returns all tags of a user by name, with their counts.
+	ByUserID(userID uint) ([]Tag, error)
+	ByName(userID uint, name string) (*Tag, error)
+	// Autocomplete returns the tags of a user starting with prefix.
+	Autocomplete(userID uint, prefix string, limit int) ([]Tag, error)
+	ByGalleryID(galleryID uint) ([]Tag, error)
+	// ByImageIDs returns the tags of each of the given images.
+	ByImageIDs(imageIDs []uint) (map[uint][]Tag, error)
+	// Galleries returns the galleries with the tag.
+	Galleries(tagID uint) ([]Gallery, error)
+	// Images returns the images with the tag.
+	Images(tagID uint) ([]Image, error)
+
+	Create(tag *Tag) error
+	// AddImages tags the given images, skipping images which
+	// are not in a gallery of the user or already have the tag.
+	AddImages(userID, tagID uint, imageIDs []uint) error
+	RemoveImages(tagID uint, imageIDs []uint) error
+	// SetGallery replaces the tags of a gallery.
+	SetGallery(galleryID uint, tagIDs []uint) error
+	// DeleteUnused removes the tags of a user which are no longer used.
+	DeleteUnused(userID uint) error
+}
+
+// TagService is a set of methods used to organize
+// images and galleries of a user by tags.
+type TagService interface {
+	TagDB
+	// TagImages adds the named tags to the images, creating tags as needed.
+	TagImages(userID uint, imageIDs []uint, names []string) error
+	// UntagImages removes the named tags from the images.
+	UntagImages(userID uint, imageIDs []uint, names []string) error
+	// SetGalleryTags replaces the tags of a gallery with the named ones.
+	SetGalleryTags(userID, galleryID uint, names []string) error
+	// LoadTags sets the tags of the gallery and of its images.
+	LoadTags(gallery *Gallery) error
+}
+
+func NewTagService(db *gorm.DB) TagService {
+	return &tagService{
+		TagDB: &tagValidator{&tagGorm{db}},
+	}
+}
+
+// Confirm that tagService implements TagService interface.
+var _ TagService = &tagService{}
+
+type tagService struct {
+	TagDB
+}
+
+func (ts *tagService) TagImages(userID uint, imageIDs []uint, names []string) error {
+	tags, err := ts.findOrCreate(userID, names)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err = ts.AddImages(userID, tag.ID, imageIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ts *tagService) UntagImages(userID uint, imageIDs []uint, names []string) error {
+	for _, name := range names {
+		tag, err := ts.ByName(userID, name)
+		if err != nil {
+			if errors.Is(err, ErrResourceNotFound) {
+				continue
+			}
+			return err
+		}
+		if err = ts.RemoveImages(tag.ID, imageIDs); err != nil {
+			return err
+		}
+	}
+	return ts.DeleteUnused(userID)
+}
+
+func (ts *tagService) SetGalleryTags(userID, galleryID uint, names []string) error {
+	tags, err := ts.findOrCreate(userID, names)
+	if err != nil {
+		return err
+	}
+	tagIDs := make([]uint, len(tags))
+	for i, tag := range tags {
+		tagIDs[i] = tag.ID
+	}
+	if err = ts.SetGallery(galleryID, tagIDs); err != nil {
+		return err
+	}
+	return ts.DeleteUnused(userID)
+}
+
+func (ts *tagService) LoadTags(gallery *Gallery) error {
+	tags, err := ts.ByGalleryID(gallery.ID)
+	if err != nil {
+		return err
+	}
+	gallery.Tags = tags
+	imageIDs := make([]uint, len(gallery.Images))
+	for i, img := range gallery.Images {
+		imageIDs[i] = img.ID
+	}
+	imageTags, err := ts.ByImageIDs(imageIDs)
+	if err != nil {
+		return err
+	}
+	for i := range gallery.Images {
+		gallery.Images[i].Tags = imageTags[gallery.Images[i].ID]
+	}
+	return nil
+}
+
+// findOrCreate returns the named tags of the user, creating the missing
+// ones. Names which are the same once normalized result in a single tag.
+func (ts *tagService) findOrCreate(userID uint, names []string) ([]Tag, error) {
+	tags := make([]Tag, 0, len(names))
+	seen := make(map[uint]bool)
+	for _, name := range names {
+		tag, err := ts.ByName(userID, name)
+		if errors.Is(err, ErrResourceNotFound) {
+			tag = &Tag{UserID: userID, Name: name}
+			err = ts.Create(tag)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag.ID] {
+			seen[tag.ID] = true
+			tags = append(tags, *tag)
+		}
+	}
+	return tags, nil
+}
+
+// Confirm that tagValidator implements TagDB interface.
+var _ TagDB = &tagValidator{}
+
+type tagValidator struct {
+	TagDB
+}
+
+// ByName will normalize the name before calling
+// ByName on the TagDB field.
+func (tv *tagValidator) ByName(userID uint, name string) (*Tag, error) {
+	tag := Tag{
+		UserID: userID,
+		Name:   name,
+	}
+	if err := runTagValFuncs(&tag, tv.normalizeName); err != nil {
+		return nil, err
+	}
+	return tv.TagDB.ByName(userID, tag.Name)
+}
+
+func (tv *tagValidator) Autocomplete(userID uint, prefix string, limit int) ([]Tag, error) {
+	tag := Tag{
+		UserID: userID,
+		Name:   prefix,
+	}
+	if err := runTagValFuncs(&tag, tv.normalizeName); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = defaultTagSuggestions
+	}
+	return tv.TagDB.Autocomplete(userID, tag.Name, limit)
+}
+
+func (tv *tagValidator) Create(tag *Tag) error {
+	err := runTagValFuncs(tag,
+		tv.userIDRequired,
+		tv.normalizeName,
+		tv.nameRequired,
+		tv.validateName,
+	)
+	if err != nil {
+		return err
+	}
+	return tv.TagDB.Create(tag)
+}
+
+type tagValFunc func(*Tag) error
+
+func runTagValFuncs(tag *Tag, fns ...tagValFunc) error {
+	for _, fn := range fns {
+		if err := fn(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tv *tagValidator) userIDRequired(t *Tag) error {
+	if t.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+// normalizeName lower cases the name, drops a leading # and
+// collapses whitespace, so "#Wedding  Day" and "wedding day"
+// are the same tag.
+func (tv *tagValidator) normalizeName(t *Tag) error {
+	t.Name = normalizeTagName(t.Name)
+	return nil
+}
+
+func normalizeTagName(name string) string {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "#")
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+func (tv *tagValidator) nameRequired(t *Tag) error {
+	if t.Name == "" {
+		return ErrTagNameRequired
+	}
+	return nil
+}
+
+func (tv *tagValidator) validateName(t *Tag) error {
+	// Tag names are part of the URLs of tag pages, which cannot contain slashes.
+	if len([]rune(t.Name)) > maxTagLength || strings.ContainsAny(t.Name, ",/") {
+		return ErrInvalidTagName
+	}
+	return nil
+}
+
+// Confirm that tagGorm implements TagDB interface.
+var _ TagDB = &tagGorm{}
+
+type tagGorm struct {
+	db *gorm.DB
+}
+
+func (tg *tagGorm) ByUserID(userID uint) ([]Tag, error) {
+	var tags []Tag
+	err := tg.db.Raw(`SELECT tags.*,
+			(SELECT count(*) FROM image_tags
+				JOIN images ON images.id = image_tags.image_id AND images.deleted_at IS NULL
+				WHERE image_tags.tag_id = tags.id) +
+			(SELECT count(*) FROM gallery_tags
+				JOIN galleries ON galleries.id = gallery_tags.gallery_id AND galleries.deleted_at IS NULL
+				WHERE gallery_tags.tag_id = tags.id) AS count
+		FROM tags
+		WHERE tags.user_id = ?
+		ORDER BY tags.name`, userID).Scan(&tags).Error
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (tg *tagGorm) ByName(userID uint, name string) (*Tag, error) {
+	var tag Tag
+	err := first(tg.db.Where("user_id = ? AND name = ?", userID, name), &tag)
+	if err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+func (tg *tagGorm) Autocomplete(userID uint, prefix string, limit int) ([]Tag, error) {
+	var tags []Tag
+	// Escape the wildcards of LIKE, so they match literally.
+	prefix = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+	err := tg.db.Where("user_id = ? AND name LIKE ?", userID, prefix+"%").
+		Order("name").
+		Limit(limit).
+		Find(&tags).Error
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (tg *tagGorm) ByGalleryID(galleryID uint) ([]Tag, error) {
+	var tags []Tag
+	err := tg.db.Select("tags.*").
+		Joins("JOIN gallery_tags ON gallery_tags.tag_id = tags.id").
+		Where("gallery_tags.gallery_id = ?", galleryID).
+		Order("tags.name").
+		Find(&tags).Error
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (tg *tagGorm) ByImageIDs(imageIDs []uint) (map[uint][]Tag, error) {
+	imageTags := make(map[uint][]Tag)
+	if len(imageIDs) == 0 {
+		return imageTags, nil
+	}
+	var rows []struct {
+		ImageID uint
+		Tag     `gorm:"embedded"`
+	}
+	err := tg.db.Table("tags").
+		Select("image_tags.image_id, tags.*").
+		Joins("JOIN image_tags ON image_tags.tag_id = tags.id").
+		Where("image_tags.image_id IN ?", imageIDs).
+		Order("tags.name").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		imageTags[row.ImageID] = append(imageTags[row.ImageID], row.Tag)
+	}
+	return imageTags, nil
+}
+
+func (tg *tagGorm) Galleries(tagID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := tg.db.Select("galleries.*").
+		Joins("JOIN gallery_tags ON gallery_tags.gallery_id = galleries.id").
+		Where("gallery_tags.tag_id = ?", tagID).
+		Order("galleries.title").
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (tg *tagGorm) Images(tagID uint) ([]Image, error) {
+	var images []Image
+	err := tg.db.Joins("JOIN image_tags ON image_tags.image_id = images.id").
+		Joins("JOIN galleries ON galleries.id = images.gallery_id AND galleries.deleted_at IS NULL").
+		Where("image_tags.tag_id = ?", tagID).
+		Order("images.gallery_id, images.filename").
+		Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (tg *tagGorm) Create(tag *Tag) error {
+	return tg.db.Create(tag).Error
+}
+
+func (tg *tagGorm) AddImages(userID, tagID uint, imageIDs []uint) error {
+	if len(imageIDs) == 0 {
+		return nil
+	}
+	return tg.db.Exec(`INSERT INTO image_tags (image_id, tag_id)
+		SELECT images.id, ? FROM images
+			JOIN galleries ON galleries.id = images.gallery_id
+		WHERE images.id IN ? AND galleries.user_id = ?
+		ON CONFLICT DO NOTHING`, tagID, imageIDs, userID).Error
+}
+
+func (tg *tagGorm) RemoveImages(tagID uint, imageIDs []uint) error {
+	if len(imageIDs) == 0 {
+		return nil
+	}
+	return tg.db.Where("tag_id = ? AND image_id IN ?", tagID, imageIDs).Delete(&ImageTag{}).Error
+}
+
+func (tg *tagGorm) SetGallery(galleryID uint, tagIDs []uint) error {
+	return tg.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("gallery_id = ?", galleryID).Delete(&GalleryTag{}).Error
+		if err != nil {
+			return err
+		}
+		if len(tagIDs) == 0 {
+			return nil
+		}
+		links := make([]GalleryTag, len(tagIDs))
+		for i, tagID := range tagIDs {
+			links[i] = GalleryTag{GalleryID: galleryID, TagID: tagID}
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&links).Error
+	})
+}
+
+func (tg *tagGorm) DeleteUnused(userID uint) error {
+	return tg.db.Exec(`DELETE FROM tags
+		WHERE user_id = ?
+			AND NOT EXISTS (SELECT 1 FROM image_tags WHERE image_tags.tag_id = tags.id)
+			AND NOT EXISTS (SELECT 1 FROM gallery_tags WHERE gallery_tags.tag_id = tags.id)`, userID).Error
+}
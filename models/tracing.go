@@ -0,0 +1,199 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"myphoto/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes of the spans of the services.
+const (
+	attrGalleryID = attribute.Key("myphoto.gallery_id")
+	attrImageID   = attribute.Key("myphoto.image_id")
+	attrUserID    = attribute.Key("myphoto.user_id")
+	attrFilename  = attribute.Key("myphoto.filename")
+	attrPath      = attribute.Key("myphoto.path")
+)
+
+// endSpan ends the span of an operation of a service. Not finding
+// a resource is expected, and does not mark the span as failed.
+func endSpan(span trace.Span, err error) {
+	if errors.Is(err, ErrResourceNotFound) {
+		err = nil
+	}
+	tracing.End(span, err)
+}
+
+// Confirm that imageTracing implements ImageService interface.
+var _ ImageService = &imageTracing{}
+
+// imageTracing records a span for every operation of the image service,
+// with the queries it makes as its children. Spans are children of the
+// span in ctx, set by WithContext, and start a new trace otherwise.
+type imageTracing struct {
+	is  *imageService
+	ctx context.Context
+}
+
+func (it *imageTracing) WithContext(ctx context.Context) ImageService {
+	return &imageTracing{is: it.is, ctx: ctx}
+}
+
+// start starts the span of the operation, returning the image
+// service running its queries as children of the span.
+func (it *imageTracing) start(operation string, attrs ...attribute.KeyValue) (*imageService, trace.Span) {
+	ctx, span := tracing.Start(it.ctx, "ImageService."+operation, trace.WithAttributes(attrs...))
+	return it.is.withContext(ctx), span
+}
+
+func (it *imageTracing) Create(galleryID, uploaderID uint, src io.Reader, filename string) (*Image, error) {
+	is, span := it.start("Create", attrGalleryID.Int64(int64(galleryID)), attrFilename.String(filename))
+	img, err := is.Create(galleryID, uploaderID, src, filename)
+	endSpan(span, err)
+	return img, err
+}
+
+func (it *imageTracing) ByID(id uint) (*Image, error) {
+	is, span := it.start("ByID", attrImageID.Int64(int64(id)))
+	img, err := is.ByID(id)
+	endSpan(span, err)
+	return img, err
+}
+
+func (it *imageTracing) ByGalleryID(galleryID uint) ([]Image, error) {
+	is, span := it.start("ByGalleryID", attrGalleryID.Int64(int64(galleryID)))
+	images, err := is.ByGalleryID(galleryID)
+	endSpan(span, err)
+	return images, err
+}
+
+func (it *imageTracing) ByUserID(userID uint) ([]Image, error) {
+	is, span := it.start("ByUserID", attrUserID.Int64(int64(userID)))
+	images, err := is.ByUserID(userID)
+	endSpan(span, err)
+	return images, err
+}
+
+func (it *imageTracing) SetCovers(galleries []Gallery) error {
+	is, span := it.start("SetCovers")
+	err := is.SetCovers(galleries)
+	endSpan(span, err)
+	return err
+}
+
+func (it *imageTracing) SetCaption(galleryID uint, filename, caption string) error {
+	is, span := it.start("SetCaption", attrGalleryID.Int64(int64(galleryID)), attrFilename.String(filename))
+	err := is.SetCaption(galleryID, filename, caption)
+	endSpan(span, err)
+	return err
+}
+
+func (it *imageTracing) Process(id uint) error {
+	is, span := it.start("Process", attrImageID.Int64(int64(id)))
+	err := is.Process(id)
+	endSpan(span, err)
+	return err
+}
+
+func (it *imageTracing) ExactDuplicates(userID uint, img *Image) ([]Image, error) {
+	is, span := it.start("ExactDuplicates", attrUserID.Int64(int64(userID)), attrImageID.Int64(int64(img.ID)))
+	images, err := is.ExactDuplicates(userID, img)
+	endSpan(span, err)
+	return images, err
+}
+
+func (it *imageTracing) DuplicateGroups(userID uint) ([][]Image, error) {
+	is, span := it.start("DuplicateGroups", attrUserID.Int64(int64(userID)))
+	groups, err := is.DuplicateGroups(userID)
+	endSpan(span, err)
+	return groups, err
+}
+
+func (it *imageTracing) DeleteGallery(galleryID uint) error {
+	is, span := it.start("DeleteGallery", attrGalleryID.Int64(int64(galleryID)))
+	err := is.DeleteGallery(galleryID)
+	endSpan(span, err)
+	return err
+}
+
+func (it *imageTracing) Delete(img *Image) error {
+	is, span := it.start("Delete", attrImageID.Int64(int64(img.ID)))
+	err := is.Delete(img)
+	endSpan(span, err)
+	return err
+}
+
+func (it *imageTracing) TrashedByID(id uint) (*Image, error) {
+	is, span := it.start("TrashedByID", attrImageID.Int64(int64(id)))
+	img, err := is.TrashedByID(id)
+	endSpan(span, err)
+	return img, err
+}
+
+func (it *imageTracing) TrashedByUserID(userID uint) ([]Image, error) {
+	is, span := it.start("TrashedByUserID", attrUserID.Int64(int64(userID)))
+	images, err := is.TrashedByUserID(userID)
+	endSpan(span, err)
+	return images, err
+}
+
+func (it *imageTracing) TrashedBefore(t time.Time) ([]Image, error) {
+	is, span := it.start("TrashedBefore")
+	images, err := is.TrashedBefore(t)
+	endSpan(span, err)
+	return images, err
+}
+
+func (it *imageTracing) Restore(img *Image) error {
+	is, span := it.start("Restore", attrImageID.Int64(int64(img.ID)))
+	err := is.Restore(img)
+	endSpan(span, err)
+	return err
+}
+
+func (it *imageTracing) Purge(img *Image) error {
+	is, span := it.start("Purge", attrImageID.Int64(int64(img.ID)))
+	err := is.Purge(img)
+	endSpan(span, err)
+	return err
+}
+
+func (it *imageTracing) Usage(userID uint) (*Usage, error) {
+	is, span := it.start("Usage", attrUserID.Int64(int64(userID)))
+	usage, err := is.Usage(userID)
+	endSpan(span, err)
+	return usage, err
+}
+
+func (it *imageTracing) UsageByGalleryID(galleryID uint) (*Usage, error) {
+	is, span := it.start("UsageByGalleryID", attrGalleryID.Int64(int64(galleryID)))
+	usage, err := is.UsageByGalleryID(galleryID)
+	endSpan(span, err)
+	return usage, err
+}
+
+func (it *imageTracing) RecomputeUsage() error {
+	is, span := it.start("RecomputeUsage")
+	err := is.RecomputeUsage()
+	endSpan(span, err)
+	return err
+}
+
+func (it *imageTracing) Reconcile() (*Reconciliation, error) {
+	is, span := it.start("Reconcile")
+	rec, err := is.Reconcile()
+	endSpan(span, err)
+	return rec, err
+}
+
+func (it *imageTracing) Import(path string) (*Image, error) {
+	is, span := it.start("Import", attrPath.String(path))
+	img, err := is.Import(path)
+	endSpan(span, err)
+	return img, err
+}
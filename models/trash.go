@@ -0,0 +1,130 @@
+package models
+
+import (
+	"time"
+)
+
+// Trash holds the galleries and images a user deleted,
+// which can still be restored.
+type Trash struct {
+	Galleries []Gallery
+	Images    []Image
+	Retention time.Duration
+}
+
+// PurgeAt returns when something deleted at deletedAt is removed for good.
+func (t *Trash) PurgeAt(deletedAt time.Time) time.Time {
+	return deletedAt.Add(t.Retention)
+}
+
+// TrashService is a set of methods used to restore deleted
+// galleries and images, and to purge them once their
+// retention window has passed.
+type TrashService interface {
+	// ByUserID returns everything the user moved to the trash.
+	ByUserID(userID uint) (*Trash, error)
+	// RestoreGallery restores a gallery of the user,
+	// ErrResourceNotFound is returned if it is not in their trash.
+	RestoreGallery(userID, galleryID uint) error
+	// RestoreImage restores an image of the user,
+	// ErrResourceNotFound is returned if it is not in their trash.
+	RestoreImage(userID, imageID uint) error
+	// Purge permanently removes galleries and images, including their files,
+	// which were moved to the trash longer than the retention window ago.
+	// It returns the galleries and images which were removed, also
+	// those removed before failing.
+	Purge(now time.Time) (*Trash, error)
+	// PurgeGallery permanently removes a gallery with its images and
+	// files right away, whether or not it is in the trash.
+	PurgeGallery(galleryID uint) error
+}
+
+func NewTrashService(gs GalleryService, is ImageService, retention time.Duration) TrashService {
+	return &trashService{
+		gs:        gs,
+		is:        is,
+		retention: retention,
+	}
+}
+
+type trashService struct {
+	gs        GalleryService
+	is        ImageService
+	retention time.Duration
+}
+
+func (ts *trashService) ByUserID(userID uint) (*Trash, error) {
+	galleries, err := ts.gs.TrashedByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	images, err := ts.is.TrashedByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &Trash{
+		Galleries: galleries,
+		Images:    images,
+		Retention: ts.retention,
+	}, nil
+}
+
+func (ts *trashService) RestoreGallery(userID, galleryID uint) error {
+	gallery, err := ts.gs.TrashedByID(galleryID)
+	if err != nil {
+		return err
+	}
+	if gallery.UserID != userID {
+		return ErrResourceNotFound
+	}
+	return ts.gs.Restore(gallery.ID)
+}
+
+func (ts *trashService) RestoreImage(userID, imageID uint) error {
+	img, err := ts.is.TrashedByID(imageID)
+	if err != nil {
+		return err
+	}
+	// Images in a trashed gallery come back together with their gallery.
+	gallery, err := ts.gs.ByID(img.GalleryID)
+	if err != nil {
+		return err
+	}
+	if gallery.UserID != userID {
+		return ErrResourceNotFound
+	}
+	return ts.is.Restore(img)
+}
+
+func (ts *trashService) Purge(now time.Time) (*Trash, error) {
+	before := now.Add(-ts.retention)
+	purged := &Trash{Retention: ts.retention}
+	galleries, err := ts.gs.TrashedBefore(before)
+	if err != nil {
+		return purged, err
+	}
+	for _, gallery := range galleries {
+		if err = ts.PurgeGallery(gallery.ID); err != nil {
+			return purged, err
+		}
+		purged.Galleries = append(purged.Galleries, gallery)
+	}
+	images, err := ts.is.TrashedBefore(before)
+	if err != nil {
+		return purged, err
+	}
+	for i := range images {
+		if err = ts.is.Purge(&images[i]); err != nil {
+			return purged, err
+		}
+		purged.Images = append(purged.Images, images[i])
+	}
+	return purged, nil
+}
+
+func (ts *trashService) PurgeGallery(galleryID uint) error {
+	if err := ts.is.DeleteGallery(galleryID); err != nil {
+		return err
+	}
+	return ts.gs.Purge(galleryID)
+}
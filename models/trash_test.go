@@ -0,0 +1,127 @@
+package models_test
+
+import (
+	"errors"
+	"myphoto/models"
+	"myphoto/models/modelstest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const retention = 30 * 24 * time.Hour
+
+// newTrash returns a trash service over in-memory galleries and images,
+// with a gallery of user 1 holding one image.
+func newTrash(t *testing.T) (models.TrashService, models.GalleryService, *modelstest.ImageService, *models.Image) {
+	t.Helper()
+	gs, gdb := newGalleryService()
+	is := modelstest.NewImageService(gdb, nil)
+	gallery := &models.Gallery{UserID: 1, Title: "Holiday"}
+	if err := gs.Create(gallery); err != nil {
+		t.Fatal(err)
+	}
+	img, err := is.Create(gallery.ID, 1, strings.NewReader("picture"), "beach.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return models.NewTrashService(gs, is, retention), gs, is, img
+}
+
+func TestTrashRestoreGallery(t *testing.T) {
+	ts, gs, _, img := newTrash(t)
+	if err := gs.Delete(img.GalleryID); err != nil {
+		t.Fatal(err)
+	}
+	trash, err := ts.ByUserID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.Galleries) != 1 || trash.Retention != retention {
+		t.Fatalf("trash = %+v, want the gallery", trash)
+	}
+
+	if err = ts.RestoreGallery(2, img.GalleryID); !errors.Is(err, models.ErrResourceNotFound) {
+		t.Errorf("restoring the gallery of another user: error = %v, want %v", err, models.ErrResourceNotFound)
+	}
+	if err = ts.RestoreGallery(1, img.GalleryID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = gs.ByID(img.GalleryID); err != nil {
+		t.Errorf("restored gallery not found: %v", err)
+	}
+	if err = ts.RestoreGallery(1, img.GalleryID); !errors.Is(err, models.ErrResourceNotFound) {
+		t.Errorf("restoring a gallery which is not in the trash: error = %v, want %v", err, models.ErrResourceNotFound)
+	}
+}
+
+func TestTrashRestoreImage(t *testing.T) {
+	ts, _, is, img := newTrash(t)
+	if err := is.Delete(img); err != nil {
+		t.Fatal(err)
+	}
+	trash, err := ts.ByUserID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.Images) != 1 {
+		t.Fatalf("trash has %d images, want 1", len(trash.Images))
+	}
+
+	if err = ts.RestoreImage(2, img.ID); !errors.Is(err, models.ErrResourceNotFound) {
+		t.Errorf("restoring the image of another user: error = %v, want %v", err, models.ErrResourceNotFound)
+	}
+	if err = ts.RestoreImage(1, img.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = is.ByID(img.ID); err != nil {
+		t.Errorf("restored image not found: %v", err)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	ts, gs, is, img := newTrash(t)
+	kept := &models.Gallery{UserID: 1, Title: "Kept"}
+	if err := gs.Create(kept); err != nil {
+		t.Fatal(err)
+	}
+	trashedImg, err := is.Create(kept.ID, 1, strings.NewReader("other picture"), "sea.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gs.Delete(img.GalleryID); err != nil {
+		t.Fatal(err)
+	}
+	if err = is.Delete(trashedImg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing has been in the trash for longer than the retention window yet.
+	purged, err := ts.Purge(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged.Galleries) != 0 || len(purged.Images) != 0 {
+		t.Errorf("purged %+v within the retention window, want nothing", purged)
+	}
+
+	purged, err = ts.Purge(time.Now().Add(retention + time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged.Galleries) != 1 || len(purged.Images) != 1 || purged.Images[0].ID != trashedImg.ID {
+		t.Errorf("purged %+v, want the gallery and the image", purged)
+	}
+	if _, err = gs.TrashedByID(img.GalleryID); !errors.Is(err, models.ErrResourceNotFound) {
+		t.Errorf("purged gallery still in the trash: %v", err)
+	}
+	if _, err = is.TrashedByID(img.ID); !errors.Is(err, models.ErrResourceNotFound) {
+		t.Errorf("image of the purged gallery still exists: %v", err)
+	}
+	if _, err = is.TrashedByID(trashedImg.ID); !errors.Is(err, models.ErrResourceNotFound) {
+		t.Errorf("purged image still in the trash: %v", err)
+	}
+	if _, err = gs.ByID(kept.ID); err != nil {
+		t.Errorf("gallery of the purged image was removed: %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"myphoto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxUploadSize is the largest file accepted by a resumable upload.
+	MaxUploadSize = 512 << 20 // 512 megabytes
+
+	// uploadTTL is how long an upload may stay incomplete before it is removed.
+	uploadTTL = 24 * time.Hour
+
+	// uploadDir holds the chunks of incomplete uploads. It is deliberately
+	// outside of images/ so partial files are never served to anyone.
+	uploadDir = "uploads/"
+
+	checksumAlgorithm = "sha256"
+)
+
+// Upload represents a resumable, chunked file upload to a gallery.
+// Chunks are appended to a temporary file until Offset reaches Size,
+// after which the file is handed over to the ImageService.
+type Upload struct {
+	gorm.Model
+	Token string `gorm:"not null;uniqueIndex"`
+	// UserID is who uploads the file, which may be a contributor
+	// rather than the owner of the gallery.
+	UserID    uint      `gorm:"not null;index"`
+	GalleryID uint      `gorm:"not null;index"`
+	Filename  string    `gorm:"not null"`
+	Size      int64     `gorm:"not null"`
+	Offset    int64     `gorm:"not null"`
+	Checksum  string    // Optional "sha256 <base64>" of the complete file.
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// Complete reports whether all chunks of the upload have been received.
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Size
+}
+
+func (u *Upload) path() string {
+	return uploadDir + u.Token
+}
+
+// UploadDB is used to interact with the uploads' database.
+type UploadDB interface {
+	ByToken(token string) (*Upload, error)
+	Expired(t time.Time) ([]Upload, error)
+
+	Create(upload *Upload) error
+	Update(upload *Upload) error
+	Delete(id uint) error
+}
+
+// UploadService is a set of methods used to receive files in chunks,
+// so an interrupted upload can be resumed instead of started over.
+type UploadService interface {
+	UploadDB
+	// WriteChunk appends src to the upload, starting at offset.
+	// The offset must match the number of bytes already received,
+	// otherwise ErrUploadOffset is returned. When checksum is not empty
+	// it is verified against the chunk and ErrChecksumMismatch is
+	// returned on a mismatch, discarding the chunk.
+	WriteChunk(upload *Upload, offset int64, src io.Reader, checksum string) error
+	// Finish verifies the checksum of a complete upload and stores the
+	// file in its gallery. The upload is removed afterwards.
+	Finish(upload *Upload) (*Image, error)
+	// Abort removes the upload and any chunks received so far.
+	Abort(upload *Upload) error
+	// DeleteExpired removes all uploads which expired before t and
+	// returns how many were removed.
+	DeleteExpired(t time.Time) (int, error)
+}
+
+func NewUploadService(db *gorm.DB, is ImageService) UploadService {
+	return &uploadService{
+		UploadDB: &uploadValidator{&uploadGorm{db}},
+		is:       is,
+	}
+}
+
+// Confirm that uploadService implements UploadService interface.
+var _ UploadService = &uploadService{}
+
+type uploadService struct {
+	UploadDB
+	is ImageService
+}
+
+// Create refuses uploads which would not fit into the quota of
+// the gallery owner, before any of their chunks are received.
+func (us *uploadService) Create(upload *Upload) error {
+	usage, err := us.is.UsageByGalleryID(upload.GalleryID)
+	if err != nil {
+		return err
+	}
+	if !usage.Allows(upload.Size) {
+		return ErrQuotaExceeded
+	}
+	return us.UploadDB.Create(upload)
+}
+
+func (us *uploadService) WriteChunk(upload *Upload, offset int64, src io.Reader, checksum string) error {
+	if time.Now().After(upload.ExpiresAt) {
+		return ErrUploadExpired
+	}
+	if offset != upload.Offset {
+		return ErrUploadOffset
+	}
+	var h hash.Hash
+	if checksum != "" {
+		if err := validateChecksum(checksum); err != nil {
+			return err
+		}
+		h = sha256.New()
+		src = io.TeeReader(src, h)
+	}
+
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(upload.path(), os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// Read one byte more than allowed to detect chunks overflowing the upload.
+	n, err := io.Copy(f, io.LimitReader(src, upload.Size-offset+1))
+	if err == nil && offset+n > upload.Size {
+		err = ErrUploadTooLarge
+	}
+	if err == nil && h != nil && formatChecksum(h) != checksum {
+		err = ErrChecksumMismatch
+	}
+	if err != nil {
+		// Discard the partial chunk, the client can resend it from the last offset.
+		if tErr := f.Truncate(offset); tErr != nil {
+			return tErr
+		}
+		return err
+	}
+
+	upload.Offset = offset + n
+	return us.Update(upload)
+}
+
+func (us *uploadService) Finish(upload *Upload) (*Image, error) {
+	if !upload.Complete() {
+		return nil, ErrUploadIncomplete
+	}
+	f, err := os.Open(upload.path())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if upload.Checksum != "" {
+		h := sha256.New()
+		if _, err = io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		if formatChecksum(h) != upload.Checksum {
+			if err = us.Abort(upload); err != nil {
+				return nil, err
+			}
+			return nil, ErrChecksumMismatch
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	img, err := us.is.Create(upload.GalleryID, upload.UserID, f, upload.Filename)
+	if err != nil {
+		return nil, err
+	}
+	return img, us.Abort(upload)
+}
+
+func (us *uploadService) Abort(upload *Upload) error {
+	if err := os.Remove(upload.path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return us.Delete(upload.ID)
+}
+
+func (us *uploadService) DeleteExpired(t time.Time) (int, error) {
+	uploads, err := us.Expired(t)
+	if err != nil {
+		return 0, err
+	}
+	for i := range uploads {
+		if err := us.Abort(&uploads[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(uploads), nil
+}
+
+// formatChecksum returns a digest in the same "<algorithm> <base64>"
+// format as the Upload-Checksum header of the tus protocol.
+func formatChecksum(h hash.Hash) string {
+	return checksumAlgorithm + " " + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func validateChecksum(checksum string) error {
+	split := strings.SplitN(checksum, " ", 2)
+	if len(split) != 2 || split[0] != checksumAlgorithm {
+		return ErrChecksumAlgorithm
+	}
+	b, err := base64.StdEncoding.DecodeString(split[1])
+	if err != nil || len(b) != sha256.Size {
+		return ErrChecksumInvalid
+	}
+	return nil
+}
+
+// Confirm that uploadValidator implements UploadDB interface.
+var _ UploadDB = &uploadValidator{}
+
+type uploadValidator struct {
+	UploadDB
+}
+
+func (uv *uploadValidator) Create(upload *Upload) error {
+	err := runUploadValFuncs(upload,
+		uv.userIDRequired,
+		uv.galleryIDRequired,
+		uv.normalizeFilename,
+		uv.filenameRequired,
+		uv.validateSize,
+		uv.validateChecksum,
+		uv.ensureToken,
+		uv.ensureExpiry,
+	)
+	if err != nil {
+		return err
+	}
+	return uv.UploadDB.Create(upload)
+}
+
+func (uv *uploadValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+	return uv.UploadDB.Delete(id)
+}
+
+type uploadValFunc func(*Upload) error
+
+func runUploadValFuncs(upload *Upload, fns ...uploadValFunc) error {
+	for _, fn := range fns {
+		if err := fn(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (uv *uploadValidator) userIDRequired(u *Upload) error {
+	if u.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (uv *uploadValidator) galleryIDRequired(u *Upload) error {
+	if u.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+// normalizeFilename strips any directories from the client provided
+// name, so an upload can never be written outside its gallery.
+func (uv *uploadValidator) normalizeFilename(u *Upload) error {
+	name := filepath.Base(filepath.Clean("/" + strings.TrimSpace(u.Filename)))
+	if name == "/" || name == "." {
+		name = ""
+	}
+	u.Filename = name
+	return nil
+}
+
+func (uv *uploadValidator) filenameRequired(u *Upload) error {
+	if u.Filename == "" {
+		return ErrFilenameRequired
+	}
+	return nil
+}
+
+func (uv *uploadValidator) validateSize(u *Upload) error {
+	if u.Size <= 0 {
+		return ErrUploadSizeRequired
+	}
+	if u.Size > MaxUploadSize {
+		return ErrUploadTooLarge
+	}
+	return nil
+}
+
+func (uv *uploadValidator) validateChecksum(u *Upload) error {
+	if u.Checksum == "" {
+		return nil
+	}
+	return validateChecksum(u.Checksum)
+}
+
+func (uv *uploadValidator) ensureToken(u *Upload) error {
+	if u.Token == "" {
+		token, err := rand.String(24)
+		if err != nil {
+			return err
+		}
+		u.Token = token
+	}
+	return nil
+}
+
+func (uv *uploadValidator) ensureExpiry(u *Upload) error {
+	if u.ExpiresAt.IsZero() {
+		u.ExpiresAt = time.Now().Add(uploadTTL)
+	}
+	return nil
+}
+
+// Confirm that uploadGorm implements UploadDB interface.
+var _ UploadDB = &uploadGorm{}
+
+type uploadGorm struct {
+	db *gorm.DB
+}
+
+func (ug *uploadGorm) ByToken(token string) (*Upload, error) {
+	var upload Upload
+	err := first(ug.db.Where("token = ?", token), &upload)
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (ug *uploadGorm) Expired(t time.Time) ([]Upload, error) {
+	var uploads []Upload
+	err := ug.db.Where("expires_at < ?", t).Find(&uploads).Error
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (ug *uploadGorm) Create(upload *Upload) error {
+	return ug.db.Create(upload).Error
+}
+
+func (ug *uploadGorm) Update(upload *Upload) error {
+	return ug.db.Save(upload).Error
+}
+
+func (ug *uploadGorm) Delete(id uint) error {
+	// Uploads are temporary, there is nothing to keep a soft deleted row for.
+	return ug.db.Unscoped().Delete(&Upload{}, id).Error
+}
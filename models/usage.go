@@ -0,0 +1,177 @@
+package models
+
+import (
+	"errors"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+// DefaultPlan is the plan of newly created users.
+const DefaultPlan = "free"
+
+// Quotas maps plan names to the number of bytes users on that plan may
+// store. Users on a plan missing from Quotas get the quota of DefaultPlan.
+// A quota of zero or less means there is no limit.
+type Quotas map[string]int64
+
+// apply sets the quota of the usage according to its plan.
+func (q Quotas) apply(u *Usage) {
+	quota, ok := q[u.Plan]
+	if !ok {
+		quota = q[DefaultPlan]
+	}
+	u.Quota = quota
+}
+
+// Usage describes how much storage a user takes up and is allowed to.
+type Usage struct {
+	Plan  string
+	Used  int64
+	Quota int64
+}
+
+// Unlimited reports whether the user may store any amount of bytes.
+func (u *Usage) Unlimited() bool {
+	return u.Quota <= 0
+}
+
+// Remaining returns how many more bytes the user may store.
+func (u *Usage) Remaining() int64 {
+	if u.Used >= u.Quota {
+		return 0
+	}
+	return u.Quota - u.Used
+}
+
+// Allows reports whether n more bytes fit into the quota.
+func (u *Usage) Allows(n int64) bool {
+	return u.Unlimited() || n <= u.Remaining()
+}
+
+// Percent returns the used share of the quota, capped at 100.
+func (u *Usage) Percent() int {
+	if u.Unlimited() {
+		return 0
+	}
+	if u.Used >= u.Quota {
+		return 100
+	}
+	return int(u.Used * 100 / u.Quota)
+}
+
+func (is *imageService) Usage(userID uint) (*Usage, error) {
+	usage, err := is.idb.UsageByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	is.quotas.apply(usage)
+	return usage, nil
+}
+
+func (is *imageService) UsageByGalleryID(galleryID uint) (*Usage, error) {
+	usage, err := is.idb.UsageByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	is.quotas.apply(usage)
+	return usage, nil
+}
+
+func (is *imageService) RecomputeUsage() error {
+	err := is.idb.ForEach(func(img *Image) error {
+		var size int64
+		info, err := os.Stat(img.RelativePath())
+		switch {
+		case err == nil:
+			size = info.Size()
+		case !errors.Is(err, os.ErrNotExist):
+			return err
+		}
+		if size == img.Size {
+			return nil
+		}
+		img.Size = size
+		return is.idb.Update(img)
+	})
+	if err != nil {
+		return err
+	}
+	return is.idb.RecomputeTotals()
+}
+
+func (ig *imageGorm) ForEach(fn func(*Image) error) error {
+	var images []Image
+	return ig.db.Unscoped().FindInBatches(&images, 500, func(tx *gorm.DB, batch int) error {
+		for i := range images {
+			if err := fn(&images[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+func (ig *imageGorm) UsageByUserID(userID uint) (*Usage, error) {
+	var usage Usage
+	err := ig.db.Raw("SELECT plan, storage_bytes AS used FROM users WHERE id = ?", userID).Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (ig *imageGorm) UsageByGalleryID(galleryID uint) (*Usage, error) {
+	var usage Usage
+	err := ig.db.Raw(`SELECT users.plan, users.storage_bytes AS used
+		FROM users JOIN galleries ON galleries.user_id = users.id
+		WHERE galleries.id = ?`, galleryID).Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (ig *imageGorm) AddUsage(galleryID uint, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("UPDATE galleries SET storage_bytes = storage_bytes + ? WHERE id = ?", delta, galleryID).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec(`UPDATE users SET storage_bytes = storage_bytes + ?
+			WHERE id = (SELECT user_id FROM galleries WHERE id = ?)`, delta, galleryID).Error
+	})
+}
+
+func (ig *imageGorm) ReserveUsage(galleryID uint, delta, quota int64) error {
+	if delta <= 0 || quota <= 0 {
+		return ig.AddUsage(galleryID, delta)
+	}
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`UPDATE users SET storage_bytes = storage_bytes + ?
+			WHERE id = (SELECT user_id FROM galleries WHERE id = ?) AND storage_bytes + ? <= ?`,
+			delta, galleryID, delta, quota)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrQuotaExceeded
+		}
+		return tx.Exec("UPDATE galleries SET storage_bytes = storage_bytes + ? WHERE id = ?", delta, galleryID).Error
+	})
+}
+
+func (ig *imageGorm) RecomputeTotals() error {
+	return ig.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`UPDATE galleries SET storage_bytes = COALESCE(
+			(SELECT SUM(images.size) FROM images WHERE images.gallery_id = galleries.id), 0)`).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec(`UPDATE users SET storage_bytes = COALESCE(
+			(SELECT SUM(galleries.storage_bytes) FROM galleries WHERE galleries.user_id = users.id), 0)`).Error
+	})
+}
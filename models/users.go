@@ -1,9 +1,18 @@
 package models
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"image"
+	"io"
 	"myphoto/hash"
 	"myphoto/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/badoux/checkmail"
@@ -13,8 +22,16 @@ import (
 
 const (
 	minPasswordLength = 8
+
+	// maxAvatarSize limits the size of uploaded avatars.
+	maxAvatarSize = 5 << 20 // 5 megabytes
+	// maxAvatarDimension limits the width and height of uploaded avatars.
+	maxAvatarDimension = 4096
 )
 
+// handleRegex matches the handles used in public profile URLs.
+var handleRegex = regexp.MustCompile(`^[a-z0-9_]{3,30}$`)
+
 // User represents the user model stored in the database.
 // Used for user accounts, storing both an email and a
 // password so users can log in and gain access to content.
@@ -26,6 +43,29 @@ type User struct {
 	PasswordHash string `gorm:"not null"`
 	Remember     string `gorm:"-"`
 	RememberHash string `gorm:"not null;uniqueIndex"`
+	Plan         string `gorm:"not null;default:free"`
+	StorageBytes int64  `gorm:"not null;default:0"`
+	// Handle is the unique name in the URL of the public profile,
+	// users without a handle have no public profile.
+	Handle string `gorm:"not null;default:'';uniqueIndex:idx_users_handle,where:handle <> ''"`
+	Bio    string `gorm:"not null;default:''"`
+	Avatar string `gorm:"not null;default:''"`
+	// Admin users can see the audit log of everyone.
+	Admin bool `gorm:"not null;default:false"`
+	// Disabled users cannot log in, and are signed out everywhere.
+	Disabled bool `gorm:"not null;default:false"`
+}
+
+// AvatarPath returns the URL of the avatar of the user,
+// or an empty string if the user has not uploaded one.
+func (u *User) AvatarPath() string {
+	if u.Avatar == "" {
+		return ""
+	}
+	avatarURL := url.URL{
+		Path: fmt.Sprintf("/images/avatars/%v/%v", u.ID, u.Avatar),
+	}
+	return avatarURL.String()
 }
 
 // UserDB is used to interact with the users' database.
@@ -41,6 +81,9 @@ type UserDB interface {
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
 	ByRemember(rememberToken string) (*User, error)
+	ByHandle(handle string) (*User, error)
+	// All returns every user ordered by ID.
+	All() ([]User, error)
 
 	Create(user *User) error
 	Update(user *User) error
@@ -54,16 +97,33 @@ type UserService interface {
 	// Authenticate will verify the provided email and
 	// password are correct. If they are correct, the
 	// User corresponding to that email is returned.
-	// Otherwise, either ErrResourceNotFound, ErrInvalidPassword or
-	// another error.
+	// Otherwise, either ErrResourceNotFound, ErrInvalidPassword,
+	// ErrAccountDisabled or another error.
 	Authenticate(email, password string) (*User, error)
+	// SetAvatar stores the image read from src as the avatar of the user.
+	// Only JPEG, PNG and GIF images are accepted.
+	SetAvatar(user *User, src io.Reader, filename string) error
+	// WithContext returns the service running its queries
+	// as part of the trace in ctx, like that of a request.
+	WithContext(ctx context.Context) UserService
 }
 
 func NewUserService(db *gorm.DB, hmacSecretKey string) UserService {
-	ug := &userGorm{db: db}
+	us := newUserService(&userGorm{db: db}, hmacSecretKey)
+	us.db = db
+	return us
+}
+
+// NewUserServiceFromDB validates users like NewUserService, but
+// stores them in udb, like the in-memory UserDB of tests.
+func NewUserServiceFromDB(udb UserDB, hmacSecretKey string) UserService {
+	return newUserService(udb, hmacSecretKey)
+}
+
+func newUserService(udb UserDB, hmacSecretKey string) *userService {
 	hmac := hash.NewHMAC(hmacSecretKey)
-	uv := &userValidator{UserDB: ug, hmac: hmac}
-	return &userService{UserDB: uv}
+	uv := &userValidator{UserDB: udb, hmac: hmac}
+	return &userService{UserDB: uv, hmacSecretKey: hmacSecretKey}
 }
 
 // Confirm that userService implements UserDB interface.
@@ -71,6 +131,17 @@ var _ UserDB = &userService{}
 
 type userService struct {
 	UserDB
+	// db is nil for services created by NewUserServiceFromDB.
+	db            *gorm.DB
+	hmacSecretKey string
+}
+
+func (us *userService) WithContext(ctx context.Context) UserService {
+	if us.db == nil {
+		// Without a database there are no queries to trace.
+		return us
+	}
+	return NewUserService(us.db.WithContext(ctx), us.hmacSecretKey)
 }
 
 func (us *userService) Authenticate(email, password string) (*User, error) {
@@ -85,9 +156,60 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 		}
 		return nil, err
 	}
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
 	return user, nil
 }
 
+func (us *userService) SetAvatar(user *User, src io.Reader, filename string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	formats := map[string]string{".jpg": "jpeg", ".jpeg": "jpeg", ".png": "png", ".gif": "gif"}
+	if _, ok := formats[ext]; !ok {
+		return ErrInvalidAvatar
+	}
+	data, err := io.ReadAll(io.LimitReader(src, maxAvatarSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxAvatarSize {
+		return ErrInvalidAvatar
+	}
+	// Check the content too, the extension is whatever the client sent.
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != formats[ext] ||
+		cfg.Width < 1 || cfg.Width > maxAvatarDimension ||
+		cfg.Height < 1 || cfg.Height > maxAvatarDimension {
+		return ErrInvalidAvatar
+	}
+	dir := fmt.Sprintf("images/avatars/%v/", user.ID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	// A new name for every upload, so browsers do not show a cached old avatar.
+	name, err := rand.String(12)
+	if err != nil {
+		return err
+	}
+	name += ext
+	if err := os.WriteFile(dir+name, data, 0o644); err != nil {
+		os.Remove(dir + name)
+		return err
+	}
+
+	old := user.Avatar
+	user.Avatar = name
+	if err = us.Update(user); err != nil {
+		return err
+	}
+	if old != "" {
+		if err = os.Remove(dir + old); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
 // Confirm that userValidator implements UserDB interface.
 var _ UserDB = &userValidator{}
 
@@ -116,6 +238,20 @@ func (uv *userValidator) ByRemember(token string) (*User, error) {
 	return uv.UserDB.ByRemember(user.RememberHash)
 }
 
+func (uv *userValidator) ByHandle(handle string) (*User, error) {
+	var user User
+	user.Handle = handle
+	err := runUserValFuncs(&user, uv.normalizeHandle)
+	if err != nil {
+		return nil, err
+	}
+	// Users without a handle have no public profile.
+	if user.Handle == "" {
+		return nil, ErrResourceNotFound
+	}
+	return uv.UserDB.ByHandle(user.Handle)
+}
+
 func (uv *userValidator) Create(user *User) error {
 	err := runUserValFuncs(user,
 		uv.requireEmail,
@@ -130,6 +266,9 @@ func (uv *userValidator) Create(user *User) error {
 		uv.validateRemember,
 		uv.hashRemember,
 		uv.requiredRememberHash,
+		uv.normalizeHandle,
+		uv.validateHandle,
+		uv.availableHandle,
 	)
 	if err != nil {
 		return err
@@ -149,6 +288,9 @@ func (uv *userValidator) Update(user *User) error {
 		uv.validateRemember,
 		uv.hashRemember,
 		uv.requiredRememberHash,
+		uv.normalizeHandle,
+		uv.validateHandle,
+		uv.availableHandle,
 	)
 	if err != nil {
 		return err
@@ -297,6 +439,38 @@ func (uv *userValidator) availableEmail(u *User) error {
 	return nil
 }
 
+func (uv *userValidator) normalizeHandle(u *User) error {
+	u.Handle = strings.TrimPrefix(strings.TrimSpace(u.Handle), "@")
+	u.Handle = strings.ToLower(u.Handle)
+	return nil
+}
+
+// validateHandle allows an empty handle, as not every user needs a public profile.
+func (uv *userValidator) validateHandle(u *User) error {
+	if u.Handle != "" && !handleRegex.MatchString(u.Handle) {
+		return ErrInvalidHandle
+	}
+	return nil
+}
+
+func (uv *userValidator) availableHandle(u *User) error {
+	if u.Handle == "" {
+		return nil
+	}
+	existingUser, err := uv.UserDB.ByHandle(u.Handle)
+	if err != nil {
+		if errors.Is(err, ErrResourceNotFound) {
+			// Handle is available
+			return nil
+		}
+		return err
+	}
+	if existingUser.ID != u.ID {
+		return ErrUnavailableHandle
+	}
+	return nil
+}
+
 // Confirm that userGorm implements UserDB interface.
 var _ UserDB = &userGorm{}
 
@@ -329,12 +503,33 @@ func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
 	return &user, nil
 }
 
+func (ug *userGorm) ByHandle(handle string) (*User, error) {
+	var user User
+	err := first(ug.db.Where("handle = ?", handle), &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (ug *userGorm) All() ([]User, error) {
+	var users []User
+	err := ug.db.Order("id").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 func (ug *userGorm) Create(user *User) error {
 	return ug.db.Create(user).Error
 }
 
+// Update leaves out the plan and the stored bytes, which are only changed
+// on their own. A user loaded before an upload finished would otherwise
+// write back the usage from before the upload.
 func (ug *userGorm) Update(user *User) error {
-	return ug.db.Save(user).Error
+	return ug.db.Omit("plan", "storage_bytes").Save(user).Error
 }
 
 func (ug *userGorm) Delete(id uint) error {
@@ -0,0 +1,398 @@
+package models_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"myphoto/models"
+	"myphoto/models/modelstest"
+	"myphoto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testHMACKey = "test-hmac-key"
+
+// newUserService returns a user service over an in-memory UserDB,
+// which already has a user jane@example.com with the handle jane.
+func newUserService(t *testing.T) (models.UserService, *models.User) {
+	t.Helper()
+	us := models.NewUserServiceFromDB(modelstest.NewUserDB(), testHMACKey)
+	jane := &models.User{Name: "Jane", Email: "jane@example.com", Password: "jane's password", Handle: "jane"}
+	if err := us.Create(jane); err != nil {
+		t.Fatalf("creating jane: %v", err)
+	}
+	return us, jane
+}
+
+func rememberToken(t *testing.T) string {
+	t.Helper()
+	token, err := rand.RememberToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestUserValidatorCreate(t *testing.T) {
+	shortToken, _ := rand.String(rand.RememberTokenBytes - 1)
+	tests := []struct {
+		name    string
+		user    models.User
+		wantErr error
+		check   func(t *testing.T, u *models.User)
+	}{
+		{
+			name:    "email required",
+			user:    models.User{Password: "password123"},
+			wantErr: models.ErrRequiredEmail,
+		},
+		{
+			name: "email normalized",
+			user: models.User{Email: "  John@Example.COM ", Password: "password123"},
+			check: func(t *testing.T, u *models.User) {
+				if u.Email != "john@example.com" {
+					t.Errorf("email = %q, want john@example.com", u.Email)
+				}
+			},
+		},
+		{
+			name:    "email invalid",
+			user:    models.User{Email: "john", Password: "password123"},
+			wantErr: models.ErrInvalidEmail,
+		},
+		{
+			name:    "email taken",
+			user:    models.User{Email: "JANE@example.com", Password: "password123"},
+			wantErr: models.ErrUnavailableEmail,
+		},
+		{
+			name:    "password required",
+			user:    models.User{Email: "john@example.com"},
+			wantErr: models.ErrRequiredPassword,
+		},
+		{
+			name:    "password too short",
+			user:    models.User{Email: "john@example.com", Password: "short"},
+			wantErr: models.ErrShortPassword,
+		},
+		{
+			name: "password length counted in characters",
+			user: models.User{Email: "john@example.com", Password: "ääääääää"},
+		},
+		{
+			name: "password hashed",
+			user: models.User{Email: "john@example.com", Password: "password123"},
+			check: func(t *testing.T, u *models.User) {
+				if u.Password != "" {
+					t.Error("password was kept after hashing")
+				}
+				if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte("password123")); err != nil {
+					t.Errorf("password hash does not match: %v", err)
+				}
+			},
+		},
+		{
+			name: "remember token generated",
+			user: models.User{Email: "john@example.com", Password: "password123"},
+			check: func(t *testing.T, u *models.User) {
+				if u.Remember == "" || u.RememberHash == "" {
+					t.Errorf("remember = %q, hash = %q, want both set", u.Remember, u.RememberHash)
+				}
+				if u.RememberHash == u.Remember {
+					t.Error("remember token was not hashed")
+				}
+			},
+		},
+		{
+			name:    "remember token too short",
+			user:    models.User{Email: "john@example.com", Password: "password123", Remember: shortToken},
+			wantErr: models.ErrShortRemember,
+		},
+		{
+			name: "handle normalized",
+			user: models.User{Email: "john@example.com", Password: "password123", Handle: " @John_Doe "},
+			check: func(t *testing.T, u *models.User) {
+				if u.Handle != "john_doe" {
+					t.Errorf("handle = %q, want john_doe", u.Handle)
+				}
+			},
+		},
+		{
+			name:    "handle too short",
+			user:    models.User{Email: "john@example.com", Password: "password123", Handle: "jd"},
+			wantErr: models.ErrInvalidHandle,
+		},
+		{
+			name:    "handle with invalid characters",
+			user:    models.User{Email: "john@example.com", Password: "password123", Handle: "john-doe"},
+			wantErr: models.ErrInvalidHandle,
+		},
+		{
+			name:    "handle taken",
+			user:    models.User{Email: "john@example.com", Password: "password123", Handle: "@Jane"},
+			wantErr: models.ErrUnavailableHandle,
+		},
+		{
+			name: "handle optional",
+			user: models.User{Email: "john@example.com", Password: "password123"},
+			check: func(t *testing.T, u *models.User) {
+				if u.Handle != "" {
+					t.Errorf("handle = %q, want none", u.Handle)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us, _ := newUserService(t)
+			user := tt.user
+			err := us.Create(&user)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Create() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if user.ID == 0 {
+				t.Error("created user has no ID")
+			}
+			if tt.check != nil {
+				tt.check(t, &user)
+			}
+		})
+	}
+}
+
+func TestUserValidatorUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  func(u *models.User)
+		wantErr error
+		check   func(t *testing.T, u *models.User)
+	}{
+		{
+			name:   "own email kept",
+			update: func(u *models.User) { u.Name = "Jane Doe" },
+		},
+		{
+			name:    "email required",
+			update:  func(u *models.User) { u.Email = "" },
+			wantErr: models.ErrRequiredEmail,
+		},
+		{
+			name:    "email invalid",
+			update:  func(u *models.User) { u.Email = "jane@" },
+			wantErr: models.ErrInvalidEmail,
+		},
+		{
+			name:    "email of another user",
+			update:  func(u *models.User) { u.Email = "John@example.com" },
+			wantErr: models.ErrUnavailableEmail,
+		},
+		{
+			name: "password kept without a new one",
+			update: func(u *models.User) {
+				u.Name = "Jane Doe"
+			},
+			check: func(t *testing.T, u *models.User) {
+				if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte("jane's password")); err != nil {
+					t.Errorf("password changed: %v", err)
+				}
+			},
+		},
+		{
+			name:   "password changed",
+			update: func(u *models.User) { u.Password = "new password" },
+			check: func(t *testing.T, u *models.User) {
+				if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte("new password")); err != nil {
+					t.Errorf("password not changed: %v", err)
+				}
+			},
+		},
+		{
+			name:    "password too short",
+			update:  func(u *models.User) { u.Password = "short" },
+			wantErr: models.ErrShortPassword,
+		},
+		{
+			name:    "password hash required",
+			update:  func(u *models.User) { u.PasswordHash = "" },
+			wantErr: models.ErrRequiredPassword,
+		},
+		{
+			name: "remember hash required",
+			update: func(u *models.User) {
+				u.Remember = ""
+				u.RememberHash = ""
+			},
+			wantErr: models.ErrRequiredRemember,
+		},
+		{
+			name:   "own handle kept",
+			update: func(u *models.User) { u.Handle = "Jane" },
+		},
+		{
+			name:    "handle of another user",
+			update:  func(u *models.User) { u.Handle = "john" },
+			wantErr: models.ErrUnavailableHandle,
+		},
+		{
+			name:    "handle invalid",
+			update:  func(u *models.User) { u.Handle = "jane doe" },
+			wantErr: models.ErrInvalidHandle,
+		},
+		{
+			name:   "handle removed",
+			update: func(u *models.User) { u.Handle = "" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us, jane := newUserService(t)
+			john := &models.User{Email: "john@example.com", Password: "password123", Handle: "john"}
+			if err := us.Create(john); err != nil {
+				t.Fatal(err)
+			}
+			user, err := us.ByID(jane.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.update(user)
+			err = us.Update(user)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Update() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.check != nil {
+				saved, err := us.ByID(jane.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.check(t, saved)
+			}
+		})
+	}
+}
+
+func TestUserValidatorLookups(t *testing.T) {
+	us, jane := newUserService(t)
+	token := rememberToken(t)
+	jane.Remember = token
+	if err := us.Update(jane); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		lookup  func() (*models.User, error)
+		wantErr error
+	}{
+		{"by email", func() (*models.User, error) { return us.ByEmail("jane@example.com") }, nil},
+		{"by email normalized", func() (*models.User, error) { return us.ByEmail(" Jane@Example.com") }, nil},
+		{"by email required", func() (*models.User, error) { return us.ByEmail("") }, models.ErrRequiredEmail},
+		{"by email invalid", func() (*models.User, error) { return us.ByEmail("jane") }, models.ErrInvalidEmail},
+		{"by email unknown", func() (*models.User, error) { return us.ByEmail("john@example.com") }, models.ErrResourceNotFound},
+		{"by remember token", func() (*models.User, error) { return us.ByRemember(token) }, nil},
+		{"by remember token unknown", func() (*models.User, error) { return us.ByRemember(rememberToken(t)) }, models.ErrResourceNotFound},
+		{"by remember hash", func() (*models.User, error) { return us.ByRemember(jane.RememberHash) }, models.ErrResourceNotFound},
+		{"by handle", func() (*models.User, error) { return us.ByHandle("jane") }, nil},
+		{"by handle normalized", func() (*models.User, error) { return us.ByHandle("@Jane") }, nil},
+		{"by handle empty", func() (*models.User, error) { return us.ByHandle(" ") }, models.ErrResourceNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := tt.lookup()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && user.ID != jane.ID {
+				t.Errorf("found user %d, want %d", user.ID, jane.ID)
+			}
+		})
+	}
+}
+
+func TestUserValidatorDelete(t *testing.T) {
+	us, jane := newUserService(t)
+	if err := us.Delete(0); !errors.Is(err, models.ErrInvalidID) {
+		t.Errorf("Delete(0) error = %v, want %v", err, models.ErrInvalidID)
+	}
+	if err := us.Delete(jane.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.ByID(jane.ID); !errors.Is(err, models.ErrResourceNotFound) {
+		t.Errorf("ByID() after Delete error = %v, want %v", err, models.ErrResourceNotFound)
+	}
+}
+
+func TestUserServiceAuthenticate(t *testing.T) {
+	us, jane := newUserService(t)
+	disabled := &models.User{Email: "john@example.com", Password: "password123", Disabled: true}
+	if err := us.Create(disabled); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		wantErr  error
+	}{
+		{"valid", "jane@example.com", "jane's password", nil},
+		{"email normalized", "JANE@example.com ", "jane's password", nil},
+		{"wrong password", "jane@example.com", "password123", models.ErrInvalidPassword},
+		{"unknown email", "anna@example.com", "password123", models.ErrResourceNotFound},
+		{"disabled", "john@example.com", "password123", models.ErrAccountDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := us.Authenticate(tt.email, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && user.ID != jane.ID {
+				t.Errorf("authenticated user %d, want %d", user.ID, jane.ID)
+			}
+		})
+	}
+}
+
+func TestUserServiceSetAvatar(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	us, jane := newUserService(t)
+
+	wide := new(bytes.Buffer)
+	if err := png.Encode(wide, image.NewGray(image.Rect(0, 0, 4097, 1))); err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		data     []byte
+		filename string
+	}{
+		"bmp":        {pngImage(t), "avatar.bmp"},
+		"not image":  {[]byte("GIF89a"), "avatar.gif"},
+		"wrong type": {pngImage(t), "avatar.gif"},
+		"too wide":   {wide.Bytes(), "avatar.png"},
+	} {
+		if err := us.SetAvatar(jane, bytes.NewReader(tc.data), tc.filename); !errors.Is(err, models.ErrInvalidAvatar) {
+			t.Errorf("SetAvatar(%s) error = %v, want %v", name, err, models.ErrInvalidAvatar)
+		}
+	}
+	if err := us.SetAvatar(jane, bytes.NewReader(pngImage(t)), "avatar.PNG"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := us.ByID(jane.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(saved.Avatar, ".png") || !strings.HasPrefix(saved.AvatarPath(), "/images/avatars/") {
+		t.Errorf("avatar = %q, path = %q", saved.Avatar, saved.AvatarPath())
+	}
+}
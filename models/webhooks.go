@@ -0,0 +1,594 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"myphoto/hash"
+	"myphoto/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	EventGalleryCreated     = "gallery.created"
+	EventGalleryUpdated     = "gallery.updated"
+	EventGalleryDeleted     = "gallery.deleted"
+	EventImageUploaded      = "image.uploaded"
+	EventImageDeleted       = "image.deleted"
+	EventSelectionSubmitted = "selection.submitted"
+
+	// JobDeliverWebhook jobs send a delivery to its webhook.
+	JobDeliverWebhook = "webhook.deliver"
+
+	// Headers of webhook requests.
+	HeaderWebhookEvent     = "X-MyPhoto-Event"
+	HeaderWebhookDelivery  = "X-MyPhoto-Delivery"
+	HeaderWebhookTimestamp = "X-MyPhoto-Timestamp"
+	// HeaderWebhookSignature is the HMAC-SHA256 of the timestamp header,
+	// a dot and the body, keyed with the secret of the webhook and
+	// encoded as URL safe base64.
+	HeaderWebhookSignature = "X-MyPhoto-Signature"
+
+	webhookSecretBytes  = 32
+	webhookTimeout      = 10 * time.Second
+	maxWebhookURLLength = 2000
+)
+
+// WebhookEvents lists the events webhooks can subscribe to.
+var WebhookEvents = []string{
+	EventGalleryCreated, EventGalleryUpdated, EventGalleryDeleted,
+	EventImageUploaded, EventImageDeleted, EventSelectionSubmitted,
+}
+
+// Webhook sends the events of the galleries of a user to a URL.
+type Webhook struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	UserID    uint   `gorm:"not null;index"`
+	URL       string `gorm:"not null"`
+	// Events is a comma separated list of the subscribed events.
+	Events string `gorm:"not null"`
+	// Secret is the key the requests are signed with,
+	// it is generated when the webhook is created.
+	Secret string `gorm:"not null"`
+	Active bool   `gorm:"not null"`
+	User   *User  `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// EventList returns the subscribed events.
+func (w *Webhook) EventList() []string {
+	if w.Events == "" {
+		return nil
+	}
+	return strings.Split(w.Events, ",")
+}
+
+// Subscribes reports whether the webhook receives the event.
+func (w *Webhook) Subscribes(event string) bool {
+	for _, e := range w.EventList() {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is a request sent, or to be sent, to a webhook.
+// Every attempt updates it, so it shows the latest response.
+type Delivery struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	WebhookID uint   `gorm:"not null;index"`
+	Event     string `gorm:"not null"`
+	Payload   string `gorm:"not null"`
+	Attempts  int    `gorm:"not null;default:0"`
+	// StatusCode is the HTTP status of the last response, zero if there was none.
+	// The body of the response is not kept, as the delivery log would show
+	// whatever the URL returns to the user who set it.
+	StatusCode int
+	Error      string
+	// DeliveredAt is set once the webhook responded with a 2xx status.
+	DeliveredAt *time.Time
+	Webhook     *Webhook `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// Delivered reports whether the webhook accepted the delivery.
+func (d *Delivery) Delivered() bool {
+	return d.DeliveredAt != nil
+}
+
+// DeliveryJob is the payload of JobDeliverWebhook jobs.
+type DeliveryJob struct {
+	DeliveryID uint `json:"delivery_id"`
+}
+
+// WebhookPayload is the JSON body of webhook requests.
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// GalleryEventData describes the gallery of gallery events.
+type GalleryEventData struct {
+	ID     uint   `json:"id"`
+	Title  string `json:"title"`
+	Public bool   `json:"public"`
+	URL    string `json:"url"`
+}
+
+// ImageEventData describes the image of image events.
+type ImageEventData struct {
+	ID        uint   `json:"id"`
+	GalleryID uint   `json:"gallery_id"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	URL       string `json:"url"`
+}
+
+// SelectionEventData describes a selection submitted by a proofer.
+type SelectionEventData struct {
+	Gallery     GalleryEventData `json:"gallery"`
+	ProoferID   uint             `json:"proofer_id"`
+	ProoferName string           `json:"proofer_name"`
+	SubmittedAt *time.Time       `json:"submitted_at"`
+	Images      []SelectedImage  `json:"images"`
+	ReviewURL   string           `json:"review_url"`
+}
+
+// SelectedImage is an image of a submitted selection.
+type SelectedImage struct {
+	ID        uint   `json:"id"`
+	Filename  string `json:"filename"`
+	Favourite bool   `json:"favourite"`
+}
+
+// WebhookDB is used to interact with the webhooks' database.
+type WebhookDB interface {
+	ByID(id uint) (*Webhook, error)
+	ByUserID(userID uint) ([]Webhook, error)
+	Create(webhook *Webhook) error
+	Update(webhook *Webhook) error
+	Delete(id uint) error
+
+	DeliveryByID(id uint) (*Delivery, error)
+	// DeliveriesByWebhookID returns the most recent deliveries of the webhook.
+	DeliveriesByWebhookID(webhookID uint, limit int) ([]Delivery, error)
+	CreateDelivery(delivery *Delivery) error
+	UpdateDelivery(delivery *Delivery) error
+}
+
+// WebhookService is a set of methods used to notify other
+// applications about what happens to the galleries of a user.
+type WebhookService interface {
+	WebhookDB
+	// GalleryEvent sends a gallery event to the webhooks of the owner of the gallery.
+	GalleryEvent(event string, gallery *Gallery) error
+	// ImageEvent sends an image event to the webhooks of the owner of the gallery.
+	ImageEvent(event string, gallery *Gallery, img *Image) error
+	// SelectionEvent sends the submitted selection of the proofer
+	// to the webhooks of the owner of the gallery.
+	SelectionEvent(gallery *Gallery, proofer *Proofer, selections []Selection) error
+	// Deliver sends a delivery to its webhook and records the response.
+	// An error is returned unless the webhook accepted it, so the
+	// JobDeliverWebhook job is retried with backoff.
+	Deliver(deliveryID uint) error
+	// Redeliver sends the payload of a delivery once more,
+	// as a new delivery which is returned.
+	Redeliver(delivery *Delivery) (*Delivery, error)
+}
+
+// NewWebhookService sends deliveries with JobDeliverWebhook jobs.
+// URLs in payloads start with baseURL.
+func NewWebhookService(db *gorm.DB, js JobService, baseURL string) WebhookService {
+	return &webhookService{
+		WebhookDB: &webhookValidator{&webhookGorm{db}},
+		js:        js,
+		client:    newWebhookClient(),
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// newWebhookClient returns a client which only connects to public addresses
+// and does not follow redirects, which could lead anywhere. The addresses
+// are checked when connecting, so a host cannot resolve to a public
+// address when the URL is validated and to a private one later.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return ErrPrivateWebhookURL
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		// Without a proxy, which would connect to the host instead of the dialer.
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicIP reports whether ip is an address on the internet, rather than
+// one of the server itself, of its network or of the cloud metadata service.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// Confirm that webhookService implements WebhookService interface.
+var _ WebhookService = &webhookService{}
+
+type webhookService struct {
+	WebhookDB
+	js      JobService
+	client  *http.Client
+	baseURL string
+}
+
+func (ws *webhookService) GalleryEvent(event string, gallery *Gallery) error {
+	return ws.publish(gallery.UserID, event, ws.galleryData(gallery))
+}
+
+func (ws *webhookService) ImageEvent(event string, gallery *Gallery, img *Image) error {
+	return ws.publish(gallery.UserID, event, ImageEventData{
+		ID:        img.ID,
+		GalleryID: img.GalleryID,
+		Filename:  img.Filename,
+		Size:      img.Size,
+		URL:       ws.baseURL + img.PagePath(),
+	})
+}
+
+func (ws *webhookService) SelectionEvent(gallery *Gallery, proofer *Proofer, selections []Selection) error {
+	data := SelectionEventData{
+		Gallery:     ws.galleryData(gallery),
+		ProoferID:   proofer.ID,
+		ProoferName: proofer.DisplayName(),
+		SubmittedAt: proofer.SubmittedAt,
+		Images:      []SelectedImage{},
+		ReviewURL:   ws.baseURL + gallery.ProofingAdminPath(),
+	}
+	for _, s := range selections {
+		if s.ProoferID == proofer.ID {
+			data.Images = append(data.Images, SelectedImage{
+				ID:        s.ImageID,
+				Filename:  s.Filename,
+				Favourite: s.Favourite,
+			})
+		}
+	}
+	return ws.publish(gallery.UserID, EventSelectionSubmitted, data)
+}
+
+func (ws *webhookService) galleryData(gallery *Gallery) GalleryEventData {
+	return GalleryEventData{
+		ID:     gallery.ID,
+		Title:  gallery.Title,
+		Public: gallery.Public,
+		URL:    fmt.Sprintf("%s/galleries/%d", ws.baseURL, gallery.ID),
+	}
+}
+
+// publish queues a delivery of the event for every active
+// webhook of the user which subscribes to it.
+func (ws *webhookService) publish(userID uint, event string, data interface{}) error {
+	webhooks, err := ws.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	for _, webhook := range webhooks {
+		if !webhook.Active || !webhook.Subscribes(event) {
+			continue
+		}
+		if payload == nil {
+			payload, err = json.Marshal(WebhookPayload{
+				Event:     event,
+				CreatedAt: time.Now().UTC(),
+				Data:      data,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = ws.enqueue(webhook.ID, event, string(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ws *webhookService) enqueue(webhookID uint, event, payload string) (*Delivery, error) {
+	delivery := Delivery{
+		WebhookID: webhookID,
+		Event:     event,
+		Payload:   payload,
+	}
+	if err := ws.CreateDelivery(&delivery); err != nil {
+		return nil, err
+	}
+	if err := ws.js.Enqueue(JobDeliverWebhook, DeliveryJob{DeliveryID: delivery.ID}); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (ws *webhookService) Deliver(deliveryID uint) error {
+	delivery, err := ws.DeliveryByID(deliveryID)
+	if err != nil {
+		// The webhook was deleted together with its deliveries.
+		if errors.Is(err, ErrResourceNotFound) {
+			return nil
+		}
+		return err
+	}
+	if delivery.Delivered() {
+		return nil
+	}
+	webhook, err := ws.ByID(delivery.WebhookID)
+	if err != nil {
+		return err
+	}
+	delivery.Attempts++
+	sendErr := ws.send(webhook, delivery)
+	if sendErr != nil {
+		delivery.Error = sendErr.Error()
+	} else {
+		now := time.Now()
+		delivery.DeliveredAt = &now
+		delivery.Error = ""
+	}
+	if err = ws.UpdateDelivery(delivery); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// send posts the signed payload of the delivery to the webhook
+// and records the status of the response.
+func (ws *webhookService) send(webhook *Webhook, delivery *Delivery) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "MyPhoto-Webhooks")
+	req.Header.Set(HeaderWebhookEvent, delivery.Event)
+	req.Header.Set(HeaderWebhookDelivery, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(HeaderWebhookTimestamp, timestamp)
+	req.Header.Set(HeaderWebhookSignature, SignWebhook(webhook.Secret, timestamp, delivery.Payload))
+
+	delivery.StatusCode = 0
+	res, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	delivery.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns the signature of a webhook request, which receivers
+// compute the same way to check that the request came from us.
+func SignWebhook(secret, timestamp, body string) string {
+	return hash.NewHMAC(secret).Hash(timestamp + "." + body)
+}
+
+func (ws *webhookService) Redeliver(delivery *Delivery) (*Delivery, error) {
+	return ws.enqueue(delivery.WebhookID, delivery.Event, delivery.Payload)
+}
+
+// Confirm that webhookValidator implements WebhookDB interface.
+var _ WebhookDB = &webhookValidator{}
+
+type webhookValidator struct {
+	WebhookDB
+}
+
+func (wv *webhookValidator) Create(webhook *Webhook) error {
+	err := runWebhookValFuncs(webhook,
+		wv.userIDRequired,
+		wv.validateURL,
+		wv.validateEvents,
+		wv.generateSecret,
+	)
+	if err != nil {
+		return err
+	}
+	return wv.WebhookDB.Create(webhook)
+}
+
+func (wv *webhookValidator) Update(webhook *Webhook) error {
+	err := runWebhookValFuncs(webhook,
+		wv.userIDRequired,
+		wv.validateURL,
+		wv.validateEvents,
+	)
+	if err != nil {
+		return err
+	}
+	return wv.WebhookDB.Update(webhook)
+}
+
+func (wv *webhookValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+	return wv.WebhookDB.Delete(id)
+}
+
+type webhookValFunc func(*Webhook) error
+
+func runWebhookValFuncs(webhook *Webhook, fns ...webhookValFunc) error {
+	for _, fn := range fns {
+		if err := fn(webhook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wv *webhookValidator) userIDRequired(w *Webhook) error {
+	if w.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+// validateURL only accepts absolute http and https URLs
+// which do not point to a local or private address.
+func (wv *webhookValidator) validateURL(w *Webhook) error {
+	w.URL = strings.TrimSpace(w.URL)
+	if w.URL == "" {
+		return ErrWebhookURLRequired
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		len(w.URL) > maxWebhookURLLength {
+		return ErrInvalidWebhookURL
+	}
+	// Hosts with a name are only checked once they are resolved, when connecting.
+	host := strings.ToLower(u.Hostname())
+	if ip := net.ParseIP(host); (ip != nil && !publicIP(ip)) ||
+		host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivateWebhookURL
+	}
+	return nil
+}
+
+// validateEvents removes duplicate events and makes sure at least one known event is subscribed.
+func (wv *webhookValidator) validateEvents(w *Webhook) error {
+	var events []string
+	for _, event := range WebhookEvents {
+		for _, e := range w.EventList() {
+			if strings.TrimSpace(e) == event {
+				events = append(events, event)
+				break
+			}
+		}
+	}
+	if len(events) == 0 || len(events) != len(uniqueStrings(w.EventList())) {
+		return ErrInvalidWebhookEvents
+	}
+	w.Events = strings.Join(events, ",")
+	return nil
+}
+
+func (wv *webhookValidator) generateSecret(w *Webhook) error {
+	if w.Secret != "" {
+		return nil
+	}
+	secret, err := rand.String(webhookSecretBytes)
+	if err != nil {
+		return err
+	}
+	w.Secret = secret
+	return nil
+}
+
+// uniqueStrings returns the distinct trimmed strings of s.
+func uniqueStrings(s []string) []string {
+	seen := make(map[string]bool, len(s))
+	var unique []string
+	for _, v := range s {
+		v = strings.TrimSpace(v)
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// Confirm that webhookGorm implements WebhookDB interface.
+var _ WebhookDB = &webhookGorm{}
+
+type webhookGorm struct {
+	db *gorm.DB
+}
+
+func (wg *webhookGorm) ByID(id uint) (*Webhook, error) {
+	var webhook Webhook
+	err := first(wg.db.Where("id = ?", id), &webhook)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (wg *webhookGorm) ByUserID(userID uint) ([]Webhook, error) {
+	var webhooks []Webhook
+	err := wg.db.Where("user_id = ?", userID).Order("id").Find(&webhooks).Error
+	if err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (wg *webhookGorm) Create(webhook *Webhook) error {
+	return wg.db.Create(webhook).Error
+}
+
+func (wg *webhookGorm) Update(webhook *Webhook) error {
+	return wg.db.Save(webhook).Error
+}
+
+func (wg *webhookGorm) Delete(id uint) error {
+	return wg.db.Delete(&Webhook{}, id).Error
+}
+
+func (wg *webhookGorm) DeliveryByID(id uint) (*Delivery, error) {
+	var delivery Delivery
+	err := first(wg.db.Where("id = ?", id), &delivery)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (wg *webhookGorm) DeliveriesByWebhookID(webhookID uint, limit int) ([]Delivery, error) {
+	var deliveries []Delivery
+	err := wg.db.Where("webhook_id = ?", webhookID).
+		Order("id DESC").
+		Limit(limit).
+		Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (wg *webhookGorm) CreateDelivery(delivery *Delivery) error {
+	return wg.db.Create(delivery).Error
+}
+
+func (wg *webhookGorm) UpdateDelivery(delivery *Delivery) error {
+	return wg.db.Save(delivery).Error
+}
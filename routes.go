@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log/slog"
+	"myphoto/controllers"
+	"myphoto/middleware"
+	"myphoto/models"
+	"myphoto/rand"
+	"net/http"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+)
+
+// newRouter routes the pages and the API of the web application to the
+// controllers using the services. It panics if a template is not correct.
+func newRouter(svc *models.Services) *mux.Router {
+	r := mux.NewRouter()
+	staticC := controllers.NewStatic()
+	usersC := controllers.NewUsers(svc.User, svc.Audit)
+	galleriesC := controllers.NewGalleries(svc.Gallery, svc.Image, svc.Tag, svc.Member, svc.Audit, svc.Webhook, r)
+	uploadsC := controllers.NewUploads(svc.Gallery, svc.Image, svc.Upload, svc.Member, svc.Audit, svc.Webhook, r)
+	trashC := controllers.NewTrash(svc.Trash, svc.Audit)
+	profilesC := controllers.NewProfiles(svc.User, svc.Gallery, svc.Image)
+	searchC := controllers.NewSearch(svc.Search)
+	tagsC := controllers.NewTags(svc.Tag)
+	proofingC := controllers.NewProofing(svc.Gallery, svc.Image, svc.Proofing, svc.Member, svc.Webhook)
+	auditC := controllers.NewAudit(svc.Audit)
+	webhooksC := controllers.NewWebhooks(svc.Webhook, svc.Audit)
+
+	userMw := middleware.User{UserService: svc.User}
+	requireUserMw := middleware.RequireUser{User: userMw}
+	requireAdminMw := middleware.RequireAdmin{RequireUser: requireUserMw}
+
+	r.Handle("/", staticC.Home).Methods("GET")
+	r.Handle("/contact", staticC.Contact).Methods("GET")
+	r.Handle("/login", usersC.LoginView).Methods("GET")
+	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.HandleFunc("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
+	r.HandleFunc("/signup", usersC.New).Methods("GET")
+	r.HandleFunc("/signup", usersC.Create).Methods("POST")
+	r.HandleFunc("/account", requireUserMw.ApplyFn(usersC.Account)).Methods("GET")
+	r.HandleFunc("/account", requireUserMw.ApplyFn(usersC.UpdateAccount)).Methods("POST")
+	r.HandleFunc("/account/security", requireUserMw.ApplyFn(usersC.Security)).Methods("GET")
+	r.HandleFunc("/account/webhooks", requireUserMw.ApplyFn(webhooksC.Index)).Methods("GET")
+	r.HandleFunc("/account/webhooks", requireUserMw.ApplyFn(webhooksC.Create)).Methods("POST")
+	r.HandleFunc("/account/webhooks/{id:[0-9]+}", requireUserMw.ApplyFn(webhooksC.Show)).Methods("GET")
+	r.HandleFunc("/account/webhooks/{id:[0-9]+}/update", requireUserMw.ApplyFn(webhooksC.Update)).Methods("POST")
+	r.HandleFunc("/account/webhooks/{id:[0-9]+}/delete", requireUserMw.ApplyFn(webhooksC.Delete)).Methods("POST")
+	r.HandleFunc("/account/webhooks/{id:[0-9]+}/deliveries/{deliveryID:[0-9]+}/redeliver", requireUserMw.ApplyFn(webhooksC.Redeliver)).Methods("POST")
+	r.HandleFunc("/admin/audit", requireAdminMw.ApplyFn(auditC.Index)).Methods("GET")
+	r.HandleFunc("/u/{handle}", profilesC.Show).Methods("GET")
+	r.HandleFunc("/explore", profilesC.Explore).Methods("GET")
+	r.HandleFunc("/search", searchC.Index).Methods("GET")
+	r.HandleFunc("/api/search", searchC.API).Methods("GET")
+
+	assetHandler := http.FileServer(http.Dir("./assets/"))
+	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", assetHandler))
+
+	// Image files are served one by one after checking who may see them,
+	// never by listing images/, which holds trashed and unfinished files too.
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}", galleriesC.ImageFile).Methods("GET")
+	r.HandleFunc("/images/avatars/{id:[0-9]+}/{filename}", usersC.Avatar).Methods("GET")
+
+	r.Handle("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).Methods("GET")
+	r.Handle("/galleries/new", requireUserMw.Apply(galleriesC.New)).Methods("GET")
+	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesC.Create)).Methods("POST")
+	r.HandleFunc("/galleries/preview", requireUserMw.ApplyFn(galleriesC.Preview)).Methods("POST")
+	r.HandleFunc("/galleries/duplicates", requireUserMw.ApplyFn(galleriesC.Duplicates)).Methods("GET")
+	r.HandleFunc("/galleries/duplicates", requireUserMw.ApplyFn(galleriesC.ResolveDuplicates)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFn(galleriesC.Edit)).Methods("GET").Name(controllers.EditGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads", requireUserMw.ApplyFn(uploadsC.Options)).Methods("OPTIONS")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads", requireUserMw.ApplyFn(uploadsC.Create)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{token}", requireUserMw.ApplyFn(uploadsC.Show)).Methods("HEAD").Name(controllers.ShowUpload)
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{token}", requireUserMw.ApplyFn(uploadsC.Update)).Methods("PATCH")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{token}", requireUserMw.ApplyFn(uploadsC.Delete)).Methods("DELETE")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/tags", requireUserMw.ApplyFn(galleriesC.ImageTags)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/caption", requireUserMw.ApplyFn(galleriesC.ImageCaption)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members", requireUserMw.ApplyFn(galleriesC.Invite)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members/{userID:[0-9]+}/role", requireUserMw.ApplyFn(galleriesC.MemberRole)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members/{userID:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.MemberDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/invitations/{invitationID:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.InvitationDelete)).Methods("POST")
+	r.HandleFunc("/invitations/{token}", requireUserMw.ApplyFn(galleriesC.Invitation)).Methods("GET")
+	r.HandleFunc("/invitations/{token}", requireUserMw.ApplyFn(galleriesC.AcceptInvitation)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/proofing", requireUserMw.ApplyFn(proofingC.Review)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/proofing/selections.csv", requireUserMw.ApplyFn(proofingC.Export)).Methods("GET")
+	r.HandleFunc("/trash", requireUserMw.ApplyFn(trashC.Index)).Methods("GET")
+	r.HandleFunc("/tags", requireUserMw.ApplyFn(tagsC.Index)).Methods("GET")
+	r.HandleFunc("/tags/{name}", requireUserMw.ApplyFn(tagsC.Show)).Methods("GET")
+	r.HandleFunc("/api/tags", requireUserMw.ApplyFn(tagsC.Autocomplete)).Methods("GET")
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/restore", requireUserMw.ApplyFn(trashC.RestoreGallery)).Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/restore", requireUserMw.ApplyFn(trashC.RestoreImage)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}", galleriesC.ImageShow).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/download", galleriesC.ImageDownload).Methods("GET")
+	r.HandleFunc("/proof/{token}", proofingC.Show).Methods("GET")
+	r.HandleFunc("/proof/{token}/images/{imageID:[0-9]+}/file", proofingC.ImageFile).Methods("GET")
+	r.HandleFunc("/proof/{token}/images/{imageID:[0-9]+}/pick", proofingC.Pick).Methods("POST")
+	r.HandleFunc("/proof/{token}/images/{imageID:[0-9]+}/comments", proofingC.Comment).Methods("POST")
+	r.HandleFunc("/proof/{token}/submit", proofingC.Submit).Methods("POST")
+	return r
+}
+
+// newHandler serves the router behind the middleware every request passes
+// through. The probes of healthC are served apart from it, so they are kept
+// out of the access log and the metrics of requests.
+func newHandler(cfg Config, svc *models.Services, r *mux.Router, healthC *controllers.Health) (http.Handler, error) {
+	b, err := rand.Bytes(32)
+	if err != nil {
+		return nil, err
+	}
+	csrfMw := csrf.Protect(b, csrf.Secure(cfg.IsProd()))
+	requestIDMw := middleware.RequestID{Logger: slog.Default()}
+	accessLogMw := middleware.AccessLog{}
+	metricsMw := middleware.Metrics{}
+	tracingMw := middleware.Tracing{}
+	userMw := middleware.User{UserService: svc.User}
+
+	r.Use(accessLogMw.Route, tracingMw.Route)
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", healthC.Live)
+	root.HandleFunc("/readyz", healthC.Ready)
+	root.Handle("/", tracingMw.Apply(requestIDMw.Apply(accessLogMw.Apply(metricsMw.Apply(csrfMw(userMw.Apply(r)))))))
+	return root, nil
+}
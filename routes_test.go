@@ -0,0 +1,1079 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"log/slog"
+	"mime/multipart"
+	"myphoto/controllers"
+	"myphoto/models"
+	"myphoto/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// repoDir is where the templates and assets the application needs are.
+var repoDir string
+
+func TestMain(m *testing.M) {
+	// The log mailer and the access log would drown the test output.
+	log.SetOutput(io.Discard)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	repoDir = wd
+	os.Exit(m.Run())
+}
+
+// testApp is the web application on an SQLite database in a temporary
+// directory, with users and galleries to run requests against.
+type testApp struct {
+	t      *testing.T
+	svc    *models.Services
+	router *mux.Router
+	srv    *httptest.Server
+	// tokens are the remember tokens of the users by their handle.
+	tokens  map[string]string
+	clients map[string]*testClient
+
+	alice, bob, carol, admin *models.User
+	// private is only shared with carol, public is visible to everyone
+	// and proofing has a share link. All of them belong to alice.
+	private, public, proofing, trashed *models.Gallery
+	beach, dupe, portrait, ring        *models.Image
+	trashedImg                         *models.Image
+	// accept and revoke are the tokens and IDs of invitations to public.
+	accept, revoke *models.Invitation
+	webhook        *models.Webhook
+	delivery       models.Delivery
+	// upload and abort are resumable uploads of alice to private.
+	upload, abort *models.Upload
+	tusImage      []byte
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"views", "assets"} {
+		if err := os.Symlink(filepath.Join(repoDir, name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, dir)
+
+	cfg := DefaultConfig()
+	cfg.Database.Driver = models.DriverSQLite
+	cfg.Database.Path = filepath.Join(dir, "myphoto.db")
+	svc, err := newServices(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.Close() })
+	migrator, err := newMigrator(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	healthC := controllers.NewHealth(controllers.HealthCheck{Name: "database", Check: svc.Ping})
+	router := newRouter(svc)
+	handler, err := newHandler(cfg, svc, router, healthC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	a := &testApp{
+		t:       t,
+		svc:     svc,
+		router:  router,
+		srv:     srv,
+		tokens:  make(map[string]string),
+		clients: make(map[string]*testClient),
+	}
+	a.seed()
+	return a
+}
+
+// seed creates the users, galleries and everything else the requests refer to.
+func (a *testApp) seed() {
+	a.alice = a.user("alice", false)
+	a.bob = a.user("bob", false)
+	a.carol = a.user("carol", false)
+	a.admin = a.user("admin", true)
+	a.must(a.svc.User.SetAvatar(a.alice, bytes.NewReader(pngImage(a.t, color.Black)), "alice.png"))
+
+	a.private = a.gallery(&models.Gallery{Title: "Holiday"})
+	a.public = a.gallery(&models.Gallery{Title: "Portfolio", Public: true})
+	a.proofing = a.gallery(&models.Gallery{Title: "Wedding", Proofing: true})
+	a.trashed = a.gallery(&models.Gallery{Title: "Old"})
+	a.beach = a.image(a.private, "beach.png", color.RGBA{R: 255, A: 255})
+	a.dupe = a.image(a.private, "copy.png", color.RGBA{R: 255, A: 255})
+	a.portrait = a.image(a.public, "portrait.png", color.RGBA{G: 255, A: 255})
+	a.ring = a.image(a.proofing, "ring.png", color.RGBA{B: 255, A: 255})
+	a.trashedImg = a.image(a.private, "blurry.png", color.Gray{Y: 128})
+	a.must(a.svc.Image.Delete(a.trashedImg))
+	a.must(a.svc.Gallery.Delete(a.trashed.ID))
+	a.must(a.svc.Tag.SetGalleryTags(a.alice.ID, a.private.ID, []string{"summer"}))
+
+	a.must(a.svc.Member.Create(&models.Member{
+		GalleryID: a.private.ID,
+		UserID:    a.carol.ID,
+		Role:      models.RoleViewer,
+	}))
+	a.accept = a.invitation("carol@example.com")
+	a.revoke = a.invitation("dave@example.com")
+
+	a.webhook = &models.Webhook{
+		UserID: a.alice.ID,
+		URL:    "https://example.com/hooks",
+		Events: models.EventGalleryCreated,
+		Active: true,
+	}
+	a.must(a.svc.Webhook.Create(a.webhook))
+	a.must(a.svc.Webhook.GalleryEvent(models.EventGalleryCreated, a.private))
+	deliveries, err := a.svc.Webhook.DeliveriesByWebhookID(a.webhook.ID, 1)
+	a.must(err)
+	a.delivery = deliveries[0]
+
+	a.tusImage = pngImage(a.t, color.White)
+	a.upload = a.newUpload("tus.png")
+	a.abort = a.newUpload("aborted.png")
+}
+
+func (a *testApp) must(err error) {
+	a.t.Helper()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+// user creates a user signed in with a known remember token.
+func (a *testApp) user(handle string, admin bool) *models.User {
+	a.t.Helper()
+	token, err := rand.RememberToken()
+	a.must(err)
+	user := &models.User{
+		Name:     handle,
+		Email:    handle + "@example.com",
+		Handle:   handle,
+		Password: "password123",
+		Remember: token,
+		Admin:    admin,
+	}
+	a.must(a.svc.User.Create(user))
+	a.tokens[handle] = token
+	return user
+}
+
+// gallery creates a gallery of alice. Galleries with proofing
+// are updated as well, which generates their share token.
+func (a *testApp) gallery(g *models.Gallery) *models.Gallery {
+	a.t.Helper()
+	g.UserID = a.alice.ID
+	a.must(a.svc.Gallery.Create(g))
+	if g.Proofing {
+		a.must(a.svc.Gallery.Update(g))
+	}
+	return g
+}
+
+// image adds a processed picture of a single colour to the gallery.
+func (a *testApp) image(g *models.Gallery, filename string, c color.Color) *models.Image {
+	a.t.Helper()
+	img, err := a.svc.Image.Create(g.ID, g.UserID, bytes.NewReader(pngImage(a.t, c)), filename)
+	a.must(err)
+	a.must(a.svc.Image.Process(img.ID))
+	img, err = a.svc.Image.ByID(img.ID)
+	a.must(err)
+	return img
+}
+
+func (a *testApp) invitation(address string) *models.Invitation {
+	a.t.Helper()
+	invitation := &models.Invitation{
+		GalleryID:   a.public.ID,
+		InvitedByID: a.alice.ID,
+		Email:       address,
+		Role:        models.RoleContributor,
+	}
+	a.must(a.svc.Member.CreateInvitation(invitation))
+	return invitation
+}
+
+func (a *testApp) newUpload(filename string) *models.Upload {
+	a.t.Helper()
+	upload := &models.Upload{
+		UserID:    a.alice.ID,
+		GalleryID: a.private.ID,
+		Filename:  filename,
+		Size:      int64(len(a.tusImage)),
+	}
+	a.must(a.svc.Upload.Create(upload))
+	return upload
+}
+
+func pngImage(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// chdir changes the working directory to dir until the test finishes,
+// as templates and files are found relative to it.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// testClient is a browser of a user, or of an anonymous visitor
+// if there is no user with the handle.
+type testClient struct {
+	http *http.Client
+	// csrf is the token of the forms, which is checked against a cookie.
+	csrf string
+}
+
+var csrfFieldRe = regexp.MustCompile(`name="gorilla.csrf.Token" value="([^"]+)"`)
+
+// client returns the browser of the user with the handle, which keeps its
+// cookies between requests. It does not follow redirects.
+func (a *testApp) client(handle string) *testClient {
+	if c, ok := a.clients[handle]; ok {
+		return c
+	}
+	jar, err := cookiejar.New(nil)
+	a.must(err)
+	if token := a.tokens[handle]; token != "" {
+		u, err := url.Parse(a.srv.URL)
+		a.must(err)
+		jar.SetCookies(u, []*http.Cookie{{Name: "remember_token", Value: token, Path: "/"}})
+	}
+	c := &testClient{http: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+
+	// Without a path the CSRF cookie is only sent back under the path of
+	// the first request, so it is issued for the root before anything else.
+	res, err := c.http.Get(a.srv.URL + "/login")
+	a.must(err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	a.must(err)
+	m := csrfFieldRe.FindSubmatch(body)
+	if m == nil {
+		a.t.Fatal("no CSRF token on the login page")
+	}
+	c.csrf = string(m[1])
+	a.clients[handle] = c
+	return c
+}
+
+// routeTest is a request and the response expected for it.
+type routeTest struct {
+	method string
+	path   string
+	// as is the handle of the signed-in user, anonymous if empty.
+	as     string
+	form   url.Values
+	header http.Header
+	body   []byte
+	// files are uploaded with the form as multipart, by field.
+	files map[string][]namedFile
+	// noCSRF leaves out the CSRF token of unsafe requests.
+	noCSRF bool
+
+	wantStatus   int
+	wantLocation string
+	// locationPrefix only compares the start of the location, for
+	// redirects to something with a generated token.
+	locationPrefix bool
+}
+
+type namedFile struct {
+	name string
+	data []byte
+}
+
+func (rt routeTest) String() string {
+	as := rt.as
+	if as == "" {
+		as = "anonymous"
+	}
+	return fmt.Sprintf("%s %s as %s", rt.method, rt.path, as)
+}
+
+// do sends the request of the test with the client of its user.
+func (a *testApp) do(t *testing.T, rt routeTest) *http.Response {
+	t.Helper()
+	c := a.client(rt.as)
+	body := bytes.NewReader(rt.body)
+	contentType := ""
+	switch {
+	case rt.files != nil:
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for key, values := range rt.form {
+			for _, v := range values {
+				if err := mw.WriteField(key, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for field, files := range rt.files {
+			for _, f := range files {
+				fw, err := mw.CreateFormFile(field, f.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = fw.Write(f.data); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := mw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(buf.Bytes())
+		contentType = mw.FormDataContentType()
+	case rt.form != nil:
+		body = bytes.NewReader([]byte(rt.form.Encode()))
+		contentType = "application/x-www-form-urlencoded"
+	}
+	req, err := http.NewRequest(rt.method, a.srv.URL+rt.path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for key, values := range rt.header {
+		req.Header[key] = values
+	}
+	switch rt.method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if !rt.noCSRF {
+			req.Header.Set("X-CSRF-Token", c.csrf)
+		}
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res
+}
+
+// check sends the requests in order and compares the responses with the expected ones.
+func (a *testApp) check(t *testing.T, tests []routeTest) {
+	t.Helper()
+	for _, rt := range tests {
+		res := a.do(t, rt)
+		if res.StatusCode != rt.wantStatus {
+			t.Errorf("%v: status = %d, want %d", rt, res.StatusCode, rt.wantStatus)
+		}
+		got := res.Header.Get("Location")
+		if rt.locationPrefix && strings.HasPrefix(got, rt.wantLocation) {
+			continue
+		}
+		if got != rt.wantLocation {
+			t.Errorf("%v: location = %q, want %q", rt, got, rt.wantLocation)
+		}
+	}
+}
+
+// routes returns a request for every route of the application, in an order
+// in which the ones changing something do not break the ones after them.
+func (a *testApp) routes() []routeTest {
+	private := fmt.Sprintf("/galleries/%d", a.private.ID)
+	public := fmt.Sprintf("/galleries/%d", a.public.ID)
+	proofing := fmt.Sprintf("/galleries/%d", a.proofing.ID)
+	proof := a.proofing.ProofingPath()
+	webhook := fmt.Sprintf("/account/webhooks/%d", a.webhook.ID)
+	upload := fmt.Sprintf("%s/uploads/%s", private, a.upload.Token)
+	tusMeta := "filename " + base64.StdEncoding.EncodeToString([]byte("resumed.png"))
+	// The galleries and webhooks created by the requests get the next IDs.
+	created := fmt.Sprintf("/galleries/%d/edit", a.trashed.ID+1)
+	createdWebhook := fmt.Sprintf("/account/webhooks/%d", a.webhook.ID+1)
+	uploaded := []namedFile{{"sunset.png", pngImage(a.t, color.RGBA{R: 255, G: 128, A: 255})}}
+
+	return []routeTest{
+		// Pages everyone can see.
+		{method: "GET", path: "/", wantStatus: 200},
+		{method: "GET", path: "/contact", wantStatus: 200},
+		{method: "GET", path: "/login", wantStatus: 200},
+		{method: "GET", path: "/signup", wantStatus: 200},
+		{method: "GET", path: "/u/alice", wantStatus: 200},
+		{method: "GET", path: "/u/nobody", wantStatus: 404},
+		{method: "GET", path: "/explore", wantStatus: 200},
+		{method: "GET", path: "/search?q=portfolio", wantStatus: 200},
+		{method: "GET", path: "/api/search?q=portfolio", wantStatus: 200},
+		{method: "GET", path: "/assets/styles.css", wantStatus: 200},
+		{method: "GET", path: "/" + a.portrait.RelativePath(), wantStatus: 200},
+		{method: "GET", path: "/" + a.beach.RelativePath(), wantStatus: 404},
+		{method: "GET", path: fmt.Sprintf("/images/galleries/%d/", a.private.ID), wantStatus: 404},
+		{method: "GET", path: a.alice.AvatarPath(), wantStatus: 200},
+		{method: "GET", path: fmt.Sprintf("/images/avatars/%d/other.png", a.alice.ID), wantStatus: 404},
+		{method: "GET", path: public, wantStatus: 200},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d", public, a.portrait.ID), wantStatus: 200},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d/download", public, a.portrait.ID), wantStatus: 200},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d", public, a.beach.ID), wantStatus: 404},
+		{method: "GET", path: private, wantStatus: 404},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d", private, a.beach.ID), wantStatus: 404},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d/download", private, a.beach.ID), wantStatus: 404},
+		{method: "GET", path: "/galleries/999", wantStatus: 404},
+		{method: "GET", path: "/healthz", wantStatus: 200},
+		{method: "GET", path: "/readyz", wantStatus: 200},
+
+		// Proofing through the share link.
+		{method: "GET", path: proof, wantStatus: 200},
+		{method: "GET", path: "/proof/unknown", wantStatus: 404},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d/file", proof, a.ring.ID), wantStatus: 200},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d/file", proof, a.beach.ID), wantStatus: 404},
+		{
+			method: "POST", path: fmt.Sprintf("%s/images/%d/pick", proof, a.ring.ID),
+			form:       url.Values{"kind": {models.PickSelected}},
+			wantStatus: 302, wantLocation: fmt.Sprintf("%s#image-%d", proof, a.ring.ID),
+		},
+		{
+			method: "POST", path: fmt.Sprintf("%s/images/%d/comments", proof, a.ring.ID),
+			form:       url.Values{"body": {"Lovely!"}},
+			wantStatus: 302, wantLocation: fmt.Sprintf("%s#image-%d", proof, a.ring.ID),
+		},
+		{
+			method: "POST", path: proof + "/submit",
+			form:       url.Values{"name": {"Jane"}},
+			wantStatus: 302, wantLocation: proof,
+		},
+		{method: "GET", path: proofing + "/proofing", as: "alice", wantStatus: 200},
+		{method: "GET", path: proofing + "/proofing/selections.csv", as: "alice", wantStatus: 200},
+
+		// Signing up and failing to log in.
+		{
+			method: "POST", path: "/signup", as: "dave",
+			form:       url.Values{"name": {"Dave"}, "email": {"dave@example.com"}, "password": {"password123"}},
+			wantStatus: 302, wantLocation: "/galleries",
+		},
+		{
+			method: "POST", path: "/login",
+			form:       url.Values{"email": {"alice@example.com"}, "password": {"wrong password"}},
+			wantStatus: 200,
+		},
+
+		// The galleries of alice.
+		{method: "GET", path: "/galleries", as: "alice", wantStatus: 200},
+		{method: "GET", path: "/galleries?sort=title&visibility=public", as: "alice", wantStatus: 200},
+		{method: "GET", path: "/galleries/new", as: "alice", wantStatus: 200},
+		{
+			method: "POST", path: "/galleries", as: "alice",
+			form:       url.Values{"title": {"Trip"}},
+			wantStatus: 302, wantLocation: created,
+		},
+		{
+			method: "POST", path: "/galleries/preview", as: "alice",
+			form:       url.Values{"description": {"**Sunny**"}},
+			wantStatus: 200,
+		},
+		{method: "GET", path: private, as: "alice", wantStatus: 200},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d", private, a.beach.ID), as: "alice", wantStatus: 200},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d/download", private, a.beach.ID), as: "alice", wantStatus: 200},
+		{method: "GET", path: "/" + a.beach.RelativePath(), as: "alice", wantStatus: 200},
+		{method: "GET", path: "/" + a.beach.RelativePath(), as: "carol", wantStatus: 200},
+		{method: "GET", path: "/" + a.trashedImg.RelativePath(), as: "alice", wantStatus: 404},
+		{method: "GET", path: private + "/edit", as: "alice", wantStatus: 200},
+		{
+			method: "POST", path: private + "/update", as: "alice",
+			form:       url.Values{"title": {"Summer holiday"}, "description": {"At the sea"}, "tags": {"summer, sea"}},
+			wantStatus: 200,
+		},
+		{
+			method: "POST", path: private + "/images", as: "alice",
+			files:      map[string][]namedFile{"images": uploaded},
+			wantStatus: 302, wantLocation: private + "/edit",
+		},
+		{
+			method: "POST", path: private + "/images/tags", as: "alice",
+			form:       url.Values{"images": {fmt.Sprint(a.beach.ID)}, "tags": {"sea"}},
+			wantStatus: 302, wantLocation: private + "/edit",
+		},
+		{
+			method: "POST", path: private + "/images/beach.png/caption", as: "alice",
+			form:       url.Values{"caption": {"The beach"}},
+			wantStatus: 302, wantLocation: private + "/edit",
+		},
+		{
+			method: "POST", path: private + "/images/sunset.png/delete", as: "alice",
+			wantStatus: 302, wantLocation: private + "/edit",
+		},
+		{method: "GET", path: "/galleries/duplicates", as: "alice", wantStatus: 200},
+		{
+			method: "POST", path: "/galleries/duplicates", as: "alice",
+			form:       url.Values{"keep": {fmt.Sprint(a.beach.ID)}, "remove": {fmt.Sprint(a.dupe.ID)}},
+			wantStatus: 302, wantLocation: "/galleries/duplicates",
+		},
+
+		// Resumable uploads.
+		{
+			method: "OPTIONS", path: private + "/uploads", as: "alice",
+			wantStatus: 204,
+		},
+		{
+			method: "POST", path: private + "/uploads", as: "alice",
+			header: http.Header{
+				"Tus-Resumable":   {"1.0.0"},
+				"Upload-Length":   {"100"},
+				"Upload-Metadata": {tusMeta},
+			},
+			wantStatus: 201, wantLocation: private + "/uploads/", locationPrefix: true,
+		},
+		{
+			method: "HEAD", path: upload, as: "alice",
+			header:     http.Header{"Tus-Resumable": {"1.0.0"}},
+			wantStatus: 200,
+		},
+		{
+			method: "PATCH", path: upload, as: "alice",
+			header: http.Header{
+				"Tus-Resumable": {"1.0.0"},
+				"Content-Type":  {"application/offset+octet-stream"},
+				"Upload-Offset": {"0"},
+			},
+			body:       a.tusImage,
+			wantStatus: 204,
+		},
+		{
+			method: "DELETE", path: fmt.Sprintf("%s/uploads/%s", private, a.abort.Token), as: "alice",
+			header:     http.Header{"Tus-Resumable": {"1.0.0"}},
+			wantStatus: 204,
+		},
+
+		// Sharing the galleries.
+		{method: "GET", path: private, as: "carol", wantStatus: 200},
+		{method: "GET", path: private + "/edit", as: "carol", wantStatus: 404},
+		{
+			method: "POST", path: private + "/members", as: "alice",
+			form:       url.Values{"email": {"erin@example.com"}, "role": {models.RoleViewer}},
+			wantStatus: 302, wantLocation: private + "/edit",
+		},
+		{
+			method: "POST", path: fmt.Sprintf("%s/members/%d/role", private, a.carol.ID), as: "alice",
+			form:       url.Values{"role": {models.RoleContributor}},
+			wantStatus: 302, wantLocation: private + "/edit",
+		},
+		{method: "GET", path: private + "/edit", as: "carol", wantStatus: 200},
+		{
+			method: "POST", path: private + "/update", as: "carol",
+			form:       url.Values{"title": {"Carol's holiday"}},
+			wantStatus: 404,
+		},
+		{
+			method: "POST", path: private + "/images/beach.png/delete", as: "carol",
+			wantStatus: 404,
+		},
+		{
+			method: "POST", path: fmt.Sprintf("%s/invitations/%d/delete", public, a.revoke.ID), as: "alice",
+			wantStatus: 302, wantLocation: public + "/edit",
+		},
+		{method: "GET", path: "/invitations/" + a.accept.Token, as: "carol", wantStatus: 200},
+		// The invitation was sent to carol, nobody else can use the link.
+		{method: "POST", path: "/invitations/" + a.accept.Token, as: "admin", wantStatus: 200},
+		{
+			method: "POST", path: "/invitations/" + a.accept.Token, as: "carol",
+			wantStatus: 302, wantLocation: public,
+		},
+		{method: "GET", path: "/invitations/" + a.revoke.Token, as: "carol", wantStatus: 404},
+		{
+			method: "POST", path: fmt.Sprintf("%s/members/%d/delete", private, a.carol.ID), as: "alice",
+			wantStatus: 302, wantLocation: private + "/edit",
+		},
+		{method: "GET", path: private, as: "carol", wantStatus: 404},
+
+		// Tags and the trash.
+		{method: "GET", path: "/tags", as: "alice", wantStatus: 200},
+		{method: "GET", path: "/tags/summer", as: "alice", wantStatus: 200},
+		{method: "GET", path: "/api/tags?q=su", as: "alice", wantStatus: 200},
+		{method: "GET", path: "/trash", as: "alice", wantStatus: 200},
+		{
+			method: "POST", path: fmt.Sprintf("/trash/images/%d/restore", a.trashedImg.ID), as: "alice",
+			wantStatus: 302, wantLocation: "/trash",
+		},
+		{
+			method: "POST", path: fmt.Sprintf("/trash/galleries/%d/restore", a.trashed.ID), as: "alice",
+			wantStatus: 302, wantLocation: "/trash",
+		},
+		{
+			method: "POST", path: fmt.Sprintf("/trash/galleries/%d/restore", a.trashed.ID), as: "alice",
+			wantStatus: 404,
+		},
+
+		// The account of alice.
+		{method: "GET", path: "/account", as: "alice", wantStatus: 200},
+		{
+			method: "POST", path: "/account", as: "alice",
+			form:       url.Values{"name": {"Alice"}, "handle": {"alice"}, "bio": {"Photographer"}},
+			files:      map[string][]namedFile{"avatar": {{"me.png", pngImage(a.t, color.Black)}}},
+			wantStatus: 302, wantLocation: "/account",
+		},
+		{method: "GET", path: "/account/security", as: "alice", wantStatus: 200},
+		{method: "GET", path: "/account/webhooks", as: "alice", wantStatus: 200},
+		{
+			method: "POST", path: "/account/webhooks", as: "alice",
+			form:       url.Values{"url": {"https://example.com/other"}, "events": {models.EventGalleryCreated}, "active": {"true"}},
+			wantStatus: 302, wantLocation: createdWebhook,
+		},
+		{method: "GET", path: webhook, as: "alice", wantStatus: 200},
+		{
+			method: "POST", path: webhook + "/update", as: "alice",
+			form:       url.Values{"url": {"https://example.com/hooks"}, "events": {models.EventGalleryDeleted}},
+			wantStatus: 302, wantLocation: webhook,
+		},
+		{
+			method: "POST", path: fmt.Sprintf("%s/deliveries/%d/redeliver", webhook, a.delivery.ID), as: "alice",
+			wantStatus: 302, wantLocation: webhook,
+		},
+		{
+			method: "POST", path: webhook + "/delete", as: "alice",
+			wantStatus: 302, wantLocation: "/account/webhooks",
+		},
+
+		// The audit log is only for admins.
+		{method: "GET", path: "/admin/audit", as: "admin", wantStatus: 200},
+		{method: "GET", path: "/admin/audit?action=gallery.create", as: "admin", wantStatus: 200},
+		{method: "GET", path: "/admin/audit", as: "alice", wantStatus: 404},
+		{method: "GET", path: "/admin/audit", wantStatus: 302, wantLocation: "/login"},
+
+		{
+			method: "POST", path: private + "/delete", as: "alice",
+			wantStatus: 302, wantLocation: "/galleries",
+		},
+		{method: "GET", path: private, as: "alice", wantStatus: 404},
+		{method: "POST", path: "/logout", as: "alice", wantStatus: 302, wantLocation: "/"},
+		{method: "GET", path: "/galleries", as: "alice", wantStatus: 302, wantLocation: "/login"},
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	a := newTestApp(t)
+	a.check(t, a.routes())
+}
+
+func TestRoutesAudit(t *testing.T) {
+	a := newTestApp(t)
+	a.check(t, a.routes())
+	entries, err := a.svc.Audit.Search(models.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := make(map[string]bool)
+	for _, entry := range entries {
+		recorded[entry.Action] = true
+	}
+	// Every change made by the routes is in the audit log.
+	for _, action := range []string{
+		models.AuditGalleryCreate, models.AuditGalleryUpdate, models.AuditGalleryDelete, models.AuditGalleryRestore,
+		models.AuditImageUpload, models.AuditImageUpdate, models.AuditImageDelete, models.AuditImageRestore,
+		models.AuditMemberUpdate, models.AuditMemberRemove,
+		models.AuditInvitationCreate, models.AuditInvitationRevoke, models.AuditInvitationAccept,
+		models.AuditWebhookCreate, models.AuditWebhookUpdate, models.AuditWebhookDelete,
+	} {
+		if !recorded[action] {
+			t.Errorf("no %s entry in the audit log", action)
+		}
+	}
+
+	// The trash, which the private gallery was moved to, is purged by a background job.
+	cfg := DefaultConfig()
+	purgeTrash(a.svc.Trash, a.svc.Audit, time.Now().Add(cfg.TrashRetention()+time.Minute))
+	purged, err := a.svc.Audit.Search(models.AuditQuery{
+		Actions:    []string{models.AuditGalleryPurge},
+		TargetType: models.AuditTargetGallery,
+		TargetID:   a.private.ID,
+	})
+	if err != nil || len(purged) != 1 {
+		t.Errorf("purge entries = %v, %v, want one", purged, err)
+	}
+}
+
+// TestRoutesUnlistedGallery shows what happens to the links of galleries
+// created before members: they are not public, so only their owner
+// may see them until they are made public.
+func TestRoutesUnlistedGallery(t *testing.T) {
+	a := newTestApp(t)
+	gallery := a.gallery(&models.Gallery{Title: "Before members"})
+	img := a.image(gallery, "old.png", color.White)
+	path := fmt.Sprintf("/galleries/%d", gallery.ID)
+	a.check(t, []routeTest{
+		{method: "GET", path: path, wantStatus: 404},
+		{method: "GET", path: "/" + img.RelativePath(), wantStatus: 404},
+		{method: "GET", path: path, as: "alice", wantStatus: 200},
+	})
+	gallery.Public = true
+	a.must(a.svc.Gallery.Update(gallery))
+	a.check(t, []routeTest{
+		{method: "GET", path: path, wantStatus: 200},
+		{method: "GET", path: "/" + img.RelativePath(), wantStatus: 200},
+	})
+}
+
+func TestRoutesUploadOverQuota(t *testing.T) {
+	a := newTestApp(t)
+	first := pngImage(t, color.White)
+	last := pngImage(t, color.Black)
+	// Only the first and the last file fit into the quota, the one in between does not.
+	db, err := a.svc.DB()
+	a.must(err)
+	quota := DefaultQuotas()[models.DefaultPlan]
+	_, err = db.Exec("UPDATE users SET storage_bytes = ? WHERE id = ?", quota-int64(len(first)+len(last)), a.alice.ID)
+	a.must(err)
+
+	private := fmt.Sprintf("/galleries/%d", a.private.ID)
+	res := a.do(t, routeTest{
+		method: "POST", path: private + "/images", as: "alice",
+		files: map[string][]namedFile{"images": {
+			{"first.png", first},
+			{"large.png", make([]byte, 4*len(last))},
+			{"last.png", last},
+		}},
+	})
+	// The edit page shows the error, instead of a redirect after the last file.
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	images, err := a.svc.Image.ByGalleryID(a.private.ID)
+	a.must(err)
+	uploaded := make(map[string]bool)
+	for _, img := range images {
+		uploaded[img.Filename] = true
+	}
+	if !uploaded["first.png"] || uploaded["large.png"] || uploaded["last.png"] {
+		t.Errorf("uploaded %v, want only first.png of the files", uploaded)
+	}
+}
+
+func TestRoutesContributorUpload(t *testing.T) {
+	a := newTestApp(t)
+	a.must(a.svc.Member.Create(&models.Member{
+		GalleryID: a.private.ID,
+		UserID:    a.bob.ID,
+		Role:      models.RoleContributor,
+	}))
+	private := fmt.Sprintf("/galleries/%d", a.private.ID)
+	res := a.do(t, routeTest{
+		method: "POST", path: private + "/uploads", as: "bob",
+		header: http.Header{
+			"Tus-Resumable":   {"1.0.0"},
+			"Upload-Length":   {fmt.Sprint(len(a.tusImage))},
+			"Upload-Metadata": {"filename " + base64.StdEncoding.EncodeToString([]byte("second.png"))},
+		},
+	})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("creating the upload: status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	// The contributor carries on with the upload they started.
+	upload := res.Header.Get("Location")
+	a.check(t, []routeTest{
+		{method: "HEAD", path: upload, as: "bob", header: http.Header{"Tus-Resumable": {"1.0.0"}}, wantStatus: 200},
+		{
+			method: "PATCH", path: upload, as: "bob",
+			header: http.Header{
+				"Tus-Resumable": {"1.0.0"},
+				"Content-Type":  {"application/offset+octet-stream"},
+				"Upload-Offset": {"0"},
+			},
+			body:       a.tusImage,
+			wantStatus: 204,
+		},
+	})
+	images, err := a.svc.Image.ByGalleryID(a.private.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range images {
+		if img.Filename == "second.png" {
+			if img.UploaderID != a.bob.ID {
+				t.Errorf("uploader = %d, want %d", img.UploaderID, a.bob.ID)
+			}
+			return
+		}
+	}
+	t.Errorf("images = %v, want second.png", images)
+}
+
+func TestLoginLogout(t *testing.T) {
+	// Logging in and out rotates the remember token, which would
+	// sign the other browsers of alice out of the other tests.
+	a := newTestApp(t)
+	a.check(t, []routeTest{
+		{method: "GET", path: "/account", as: "visitor", wantStatus: 302, wantLocation: "/login"},
+		{
+			method: "POST", path: "/login", as: "visitor",
+			form:       url.Values{"email": {"alice@example.com"}, "password": {"password123"}},
+			wantStatus: 302, wantLocation: "/",
+		},
+		{method: "GET", path: "/account", as: "visitor", wantStatus: 200},
+		{method: "POST", path: "/logout", as: "visitor", wantStatus: 302, wantLocation: "/"},
+		{method: "GET", path: "/account", as: "visitor", wantStatus: 302, wantLocation: "/login"},
+		{method: "POST", path: "/logout", as: "visitor", wantStatus: 302, wantLocation: "/login"},
+	})
+}
+
+func TestRoutesRequireUser(t *testing.T) {
+	a := newTestApp(t)
+	private := fmt.Sprintf("/galleries/%d", a.private.ID)
+	paths := []struct{ method, path string }{
+		{"POST", "/logout"},
+		{"GET", "/account"},
+		{"POST", "/account"},
+		{"GET", "/account/security"},
+		{"GET", "/account/webhooks"},
+		{"POST", "/account/webhooks"},
+		{"GET", fmt.Sprintf("/account/webhooks/%d", a.webhook.ID)},
+		{"POST", fmt.Sprintf("/account/webhooks/%d/update", a.webhook.ID)},
+		{"POST", fmt.Sprintf("/account/webhooks/%d/delete", a.webhook.ID)},
+		{"POST", fmt.Sprintf("/account/webhooks/%d/deliveries/%d/redeliver", a.webhook.ID, a.delivery.ID)},
+		{"GET", "/admin/audit"},
+		{"GET", "/galleries"},
+		{"GET", "/galleries/new"},
+		{"POST", "/galleries"},
+		{"POST", "/galleries/preview"},
+		{"GET", "/galleries/duplicates"},
+		{"POST", "/galleries/duplicates"},
+		{"GET", private + "/edit"},
+		{"POST", private + "/update"},
+		{"POST", private + "/delete"},
+		{"POST", private + "/images"},
+		{"OPTIONS", private + "/uploads"},
+		{"POST", private + "/uploads"},
+		{"HEAD", private + "/uploads/" + a.upload.Token},
+		{"PATCH", private + "/uploads/" + a.upload.Token},
+		{"DELETE", private + "/uploads/" + a.upload.Token},
+		{"POST", private + "/images/tags"},
+		{"POST", private + "/images/beach.png/delete"},
+		{"POST", private + "/images/beach.png/caption"},
+		{"POST", private + "/members"},
+		{"POST", fmt.Sprintf("%s/members/%d/role", private, a.carol.ID)},
+		{"POST", fmt.Sprintf("%s/members/%d/delete", private, a.carol.ID)},
+		{"POST", fmt.Sprintf("/galleries/%d/invitations/%d/delete", a.public.ID, a.revoke.ID)},
+		{"GET", "/invitations/" + a.accept.Token},
+		{"POST", "/invitations/" + a.accept.Token},
+		{"GET", fmt.Sprintf("/galleries/%d/proofing", a.proofing.ID)},
+		{"GET", fmt.Sprintf("/galleries/%d/proofing/selections.csv", a.proofing.ID)},
+		{"GET", "/trash"},
+		{"GET", "/tags"},
+		{"GET", "/tags/summer"},
+		{"GET", "/api/tags"},
+		{"POST", fmt.Sprintf("/trash/galleries/%d/restore", a.trashed.ID)},
+		{"POST", fmt.Sprintf("/trash/images/%d/restore", a.trashedImg.ID)},
+	}
+	tests := make([]routeTest, len(paths))
+	for i, p := range paths {
+		tests[i] = routeTest{method: p.method, path: p.path, wantStatus: 302, wantLocation: "/login"}
+	}
+	a.check(t, tests)
+
+	// Nothing was changed by the requests of the visitor.
+	if _, err := a.svc.Gallery.ByID(a.private.ID); err != nil {
+		t.Errorf("gallery of alice: %v", err)
+	}
+	if _, err := a.svc.Upload.ByToken(a.upload.Token); err != nil {
+		t.Errorf("upload of alice: %v", err)
+	}
+}
+
+func TestRoutesOwnership(t *testing.T) {
+	a := newTestApp(t)
+	private := fmt.Sprintf("/galleries/%d", a.private.ID)
+	proofing := fmt.Sprintf("/galleries/%d", a.proofing.ID)
+	webhook := fmt.Sprintf("/account/webhooks/%d", a.webhook.ID)
+	upload := private + "/uploads/" + a.upload.Token
+	tus := http.Header{"Tus-Resumable": {"1.0.0"}}
+	a.check(t, []routeTest{
+		{method: "GET", path: private, as: "bob", wantStatus: 404},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d", private, a.beach.ID), as: "bob", wantStatus: 404},
+		{method: "GET", path: fmt.Sprintf("%s/images/%d/download", private, a.beach.ID), as: "bob", wantStatus: 404},
+		{method: "GET", path: "/" + a.beach.RelativePath(), as: "bob", wantStatus: 404},
+		{method: "GET", path: private + "/edit", as: "bob", wantStatus: 404},
+		{method: "POST", path: private + "/update", as: "bob", form: url.Values{"title": {"Mine"}}, wantStatus: 404},
+		{method: "POST", path: private + "/delete", as: "bob", wantStatus: 404},
+		{
+			method: "POST", path: private + "/images", as: "bob",
+			files:      map[string][]namedFile{"images": {{"intruder.png", pngImage(t, color.Black)}}},
+			wantStatus: 404,
+		},
+		{method: "POST", path: private + "/images/tags", as: "bob", form: url.Values{"images": {fmt.Sprint(a.beach.ID)}}, wantStatus: 404},
+		{method: "POST", path: private + "/images/beach.png/delete", as: "bob", wantStatus: 404},
+		{method: "POST", path: private + "/images/beach.png/caption", as: "bob", wantStatus: 404},
+		{method: "POST", path: private + "/members", as: "bob", form: url.Values{"email": {"bob@example.com"}, "role": {models.RoleOwner}}, wantStatus: 404},
+		{method: "POST", path: fmt.Sprintf("%s/members/%d/role", private, a.carol.ID), as: "bob", wantStatus: 404},
+		{method: "POST", path: fmt.Sprintf("%s/members/%d/delete", private, a.carol.ID), as: "bob", wantStatus: 404},
+		{method: "POST", path: fmt.Sprintf("/galleries/%d/invitations/%d/delete", a.public.ID, a.revoke.ID), as: "bob", wantStatus: 404},
+		// Viewers may not manage the gallery either.
+		{method: "POST", path: private + "/update", as: "carol", form: url.Values{"title": {"Mine"}}, wantStatus: 404},
+		{method: "POST", path: private + "/delete", as: "carol", wantStatus: 404},
+		{method: "POST", path: private + "/images/beach.png/delete", as: "carol", wantStatus: 404},
+		{method: "POST", path: fmt.Sprintf("%s/members/%d/role", private, a.carol.ID), as: "carol", form: url.Values{"role": {models.RoleOwner}}, wantStatus: 404},
+		{method: "POST", path: private + "/uploads", as: "carol", header: http.Header{"Upload-Length": {"1"}}, wantStatus: 404},
+
+		{method: "POST", path: private + "/uploads", as: "bob", header: http.Header{"Upload-Length": {"1"}}, wantStatus: 404},
+		{method: "HEAD", path: upload, as: "bob", header: tus, wantStatus: 404},
+		{
+			method: "PATCH", path: upload, as: "bob",
+			header:     http.Header{"Content-Type": {"application/offset+octet-stream"}, "Upload-Offset": {"0"}},
+			body:       a.tusImage,
+			wantStatus: 404,
+		},
+		{method: "DELETE", path: upload, as: "bob", header: tus, wantStatus: 404},
+		// An upload of alice cannot be reached through another gallery either.
+		{method: "HEAD", path: fmt.Sprintf("%s/uploads/%s", proofing, a.upload.Token), as: "alice", header: tus, wantStatus: 404},
+
+		{method: "GET", path: proofing + "/proofing", as: "bob", wantStatus: 404},
+		{method: "GET", path: proofing + "/proofing/selections.csv", as: "bob", wantStatus: 404},
+		{method: "GET", path: webhook, as: "bob", wantStatus: 404},
+		{method: "POST", path: webhook + "/update", as: "bob", form: url.Values{"url": {"https://example.com/bob"}}, wantStatus: 404},
+		{method: "POST", path: webhook + "/delete", as: "bob", wantStatus: 404},
+		{method: "POST", path: fmt.Sprintf("%s/deliveries/%d/redeliver", webhook, a.delivery.ID), as: "bob", wantStatus: 404},
+		{method: "POST", path: fmt.Sprintf("/trash/galleries/%d/restore", a.trashed.ID), as: "bob", wantStatus: 404},
+		{method: "POST", path: fmt.Sprintf("/trash/images/%d/restore", a.trashedImg.ID), as: "bob", wantStatus: 404},
+		// Duplicates of others are skipped rather than refused.
+		{
+			method: "POST", path: "/galleries/duplicates", as: "bob",
+			form:       url.Values{"keep": {fmt.Sprint(a.beach.ID)}, "remove": {fmt.Sprint(a.dupe.ID)}},
+			wantStatus: 302, wantLocation: "/galleries/duplicates",
+		},
+	})
+
+	// None of the requests changed anything of alice.
+	g, err := a.svc.Gallery.ByID(a.private.ID)
+	if err != nil || g.Title != a.private.Title {
+		t.Errorf("gallery of alice = %v, %v", g, err)
+	}
+	if _, err = a.svc.Image.ByID(a.dupe.ID); err != nil {
+		t.Errorf("image of alice: %v", err)
+	}
+	if _, err = a.svc.Upload.ByToken(a.upload.Token); err != nil {
+		t.Errorf("upload of alice: %v", err)
+	}
+	if _, err = a.svc.Webhook.ByID(a.webhook.ID); err != nil {
+		t.Errorf("webhook of alice: %v", err)
+	}
+	if _, err = a.svc.Gallery.TrashedByID(a.trashed.ID); err != nil {
+		t.Errorf("trashed gallery of alice: %v", err)
+	}
+	if role, err := a.svc.Member.Role(a.private, a.carol.ID); err != nil || role != models.RoleViewer {
+		t.Errorf("role of carol = %q, %v", role, err)
+	}
+}
+
+func TestRoutesCSRF(t *testing.T) {
+	a := newTestApp(t)
+	var tests []routeTest
+	for _, rt := range a.routes() {
+		switch rt.method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			continue
+		}
+		rt.noCSRF = true
+		rt.wantStatus, rt.wantLocation, rt.locationPrefix = http.StatusForbidden, "", false
+		tests = append(tests, rt)
+	}
+	tests = append(tests, routeTest{
+		method: "POST", path: "/login", noCSRF: true,
+		form:       url.Values{"email": {"alice@example.com"}, "password": {"password123"}},
+		wantStatus: http.StatusForbidden,
+	})
+	a.check(t, tests)
+
+	// A token of another browser is not accepted either.
+	rt := routeTest{method: "POST", path: "/galleries", as: "alice", form: url.Values{"title": {"Forged"}}, noCSRF: true}
+	rt.header = http.Header{"X-Csrf-Token": {a.client("bob").csrf}}
+	if res := a.do(t, rt); res.StatusCode != http.StatusForbidden {
+		t.Errorf("%v with the token of bob: status = %d, want %d", rt, res.StatusCode, http.StatusForbidden)
+	}
+
+	if _, err := a.svc.Gallery.ByID(a.private.ID); err != nil {
+		t.Errorf("gallery of alice: %v", err)
+	}
+}
+
+// TestRoutesCovered makes sure TestRoutes sends a request to every route,
+// so a new route cannot be added without a test.
+func TestRoutesCovered(t *testing.T) {
+	a := newTestApp(t)
+	tests := a.routes()
+	err := a.router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Routes for every method, like the file servers.
+			methods = []string{http.MethodGet}
+		}
+		for _, method := range methods {
+			covered := false
+			for _, rt := range tests {
+				req := httptest.NewRequest(rt.method, rt.path, nil)
+				var match mux.RouteMatch
+				if req.Method == method && route.Match(req, &match) {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				t.Errorf("no request to %s %s", method, tmpl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// spanKey stores the span of a query in the gorm statement until it is done.
+const spanKey = "tracing:span"
+
+// GormPlugin records a span for every query as a child of the
+// span in the context of the query, set with db.WithContext.
+type GormPlugin struct{}
+
+var _ gorm.Plugin = GormPlugin{}
+
+func (GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (GormPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("tracing:before_create", before("create")),
+		cb.Create().After("gorm:create").Register("tracing:after_create", after),
+		cb.Query().Before("gorm:query").Register("tracing:before_query", before("query")),
+		cb.Query().After("gorm:query").Register("tracing:after_query", after),
+		cb.Update().Before("gorm:update").Register("tracing:before_update", before("update")),
+		cb.Update().After("gorm:update").Register("tracing:after_update", after),
+		cb.Delete().Before("gorm:delete").Register("tracing:before_delete", before("delete")),
+		cb.Delete().After("gorm:delete").Register("tracing:after_delete", after),
+		cb.Row().Before("gorm:row").Register("tracing:before_row", before("row")),
+		cb.Row().After("gorm:row").Register("tracing:after_row", after),
+		cb.Raw().Before("gorm:raw").Register("tracing:before_raw", before("raw")),
+		cb.Raw().After("gorm:raw").Register("tracing:after_raw", after),
+	)
+}
+
+// before starts the span of a query.
+func before(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		_, span := Start(db.Statement.Context, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				dbSystem(db),
+				semconv.DBOperationName(operation),
+			))
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+// dbSystem names the database the query runs on.
+func dbSystem(db *gorm.DB) attribute.KeyValue {
+	if db.Dialector.Name() == "sqlite" {
+		return semconv.DBSystemSqlite
+	}
+	return semconv.DBSystemPostgreSQL
+}
+
+// after ends the span of a query, with the SQL and its table. The SQL
+// has placeholders for the values, so no user data ends up in the span.
+func after(db *gorm.DB) {
+	v, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	if db.Statement.Table != "" {
+		span.SetAttributes(semconv.DBCollectionName(db.Statement.Table))
+	}
+	span.SetAttributes(
+		semconv.DBQueryText(db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	err := db.Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Finding nothing is expected, and not a failed query.
+		err = nil
+	}
+	End(span, err)
+}
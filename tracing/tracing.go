@@ -0,0 +1,84 @@
+// Package tracing records OpenTelemetry traces of requests, database
+// queries and image processing, and exports them to a collector over
+// OTLP or prints them for development.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName identifies the application in the traces.
+const serviceName = "myphoto"
+
+// Exporters send the recorded spans somewhere.
+const (
+	// ExporterNone records no traces at all.
+	ExporterNone = ""
+	// ExporterOTLP sends the spans to a collector over OTLP/HTTP.
+	ExporterOTLP = "otlp"
+	// ExporterStdout prints the spans, for development.
+	ExporterStdout = "stdout"
+)
+
+// Setup installs the global tracer provider exporting spans with the
+// exporter. A ratio of the traces between 0 and 1 is sampled, unless the
+// caller of a request already decided for its trace. The returned function
+// flushes the remaining spans and has to be called before exiting.
+func Setup(exporter, endpoint string, ratio float64) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		err = fmt.Errorf("tracing: unknown exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// Start starts a span of the application as a child of the span in ctx.
+// Until Setup is called, or without an exporter, spans are not recorded.
+func Start(ctx context.Context, name string, attrs ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(serviceName).Start(ctx, name, attrs...)
+}
+
+// End ends the span, marking it as failed with err if it is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -3,7 +3,7 @@ package views
 import (
 	"errors"
 	"html/template"
-	"log"
+	"myphoto/context"
 	"myphoto/models"
 	"net/http"
 	"time"
@@ -34,8 +34,13 @@ type Data struct {
 	User  *models.User
 	CSRF  template.HTML
 	Yield interface{}
+	// err is the private error behind the alert, which is
+	// logged with the request when the view is rendered.
+	err error
 }
 
+// SetAlert shows the message of public errors. Other errors are logged
+// when the view is rendered, and a generic message is shown instead.
 func (d *Data) SetAlert(err error) {
 	var publicError PublicError
 	if ok := errors.As(err, &publicError); ok {
@@ -44,7 +49,7 @@ func (d *Data) SetAlert(err error) {
 			Message: publicError.Public(),
 		}
 	} else {
-		log.Println(err)
+		d.err = err
 		d.Alert = &Alert{
 			Level:   AlertLevelError,
 			Message: AlertMessageGeneric,
@@ -59,6 +64,16 @@ func (d *Data) AlertError(msg string) {
 	}
 }
 
+// ServerErrorMessage is shown for unexpected errors, with the ID
+// of the request so users can refer to it when they report it.
+func ServerErrorMessage(r *http.Request) string {
+	msg := "Something went wrong."
+	if id := context.RequestID(r.Context()); id != "" {
+		msg += " Request ID: " + id
+	}
+	return msg
+}
+
 type PublicError interface {
 	error
 	Public() string
@@ -120,3 +135,9 @@ func RedirectAlert(w http.ResponseWriter, r *http.Request, url string, code int,
 	persistAlert(w, alert)
 	http.Redirect(w, r, url, code)
 }
+
+// PersistAlert persists an alert in a cookie, so it can be displayed
+// when the page is reloaded, e.g. after a request made by JavaScript.
+func PersistAlert(w http.ResponseWriter, alert Alert) {
+	persistAlert(w, alert)
+}
@@ -2,12 +2,16 @@ package views
 
 import (
 	"bytes"
+	"fmt"
 	"html/template"
 	"io"
-	"log"
 	"myphoto/context"
+	"myphoto/markdown"
+	"myphoto/models"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strings"
 
 	"github.com/gorilla/csrf"
 	"github.com/pkg/errors"
@@ -28,6 +32,10 @@ func NewView(layout string, files ...string) *View {
 		"csrfField": func() (template.HTML, error) {
 			return "", errors.New("csrfField is not implemented")
 		},
+		"bytes":      FormatBytes,
+		"highlight":  Highlight,
+		"pathEscape": url.PathEscape,
+		"markdown":   markdown.Render,
 	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)
@@ -61,6 +69,12 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 		}
 	}
 
+	if vd.err != nil {
+		context.Logger(r.Context()).Error("request failed", "err", vd.err)
+		if id := context.RequestID(r.Context()); id != "" && vd.Alert != nil {
+			vd.Alert.Message += " Request ID: " + id
+		}
+	}
 	if alert := getAlert(r); alert != nil {
 		vd.Alert = alert
 		clearAlert(w)
@@ -76,8 +90,8 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 		},
 	})
 	if err := tpl.ExecuteTemplate(&buf, v.Layout, vd); err != nil {
-		log.Println(err)
-		http.Error(w, "Something went wrong. If the problem persists, please email support@myphoto.com.",
+		context.Logger(r.Context()).Error("rendering view failed", "err", err)
+		http.Error(w, ServerErrorMessage(r)+" If the problem persists, please email support@myphoto.com.",
 			http.StatusInternalServerError)
 		return
 	}
@@ -87,6 +101,30 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 	}
 }
 
+// FormatBytes formats a number of bytes using binary
+// prefixes, e.g. 1536 is formatted as "1.5 KiB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Highlight escapes a search result headline and marks the
+// words between the highlight sentinels of the search.
+func Highlight(headline string) template.HTML {
+	escaped := template.HTMLEscapeString(headline)
+	escaped = strings.ReplaceAll(escaped, models.HighlightStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, models.HighlightStop, "</mark>")
+	return template.HTML(escaped)
+}
+
 func layoutFiles() []string {
 	files, err := filepath.Glob(layoutDir + "*" + templateExt)
 	if err != nil {